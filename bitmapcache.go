@@ -0,0 +1,239 @@
+package grdp
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+// bitmapCacheVersion is the format of the persistent cache files
+const bitmapCacheVersion = 1
+
+// cellPixels is the largest bitmap of cache id, 16x16 pixels for the first one
+// and four times as many for each next one
+func cellPixels(id int) int {
+	return 256 << (2 * id)
+}
+
+type cacheEntry struct {
+	index uint16
+	// key is 0 for the cells the server does not persist
+	key  uint64
+	img  *image.RGBA
+	used *list.Element
+}
+
+// cellCache is one of the bitmap caches, the server picks the cells. The recently
+// used ones come first in lru, they are the ones kept by the persistent cache.
+type cellCache struct {
+	size    int
+	entries map[uint16]*cacheEntry
+	lru     *list.List
+}
+
+func newCellCache(size int) *cellCache {
+	return &cellCache{size: size, entries: make(map[uint16]*cacheEntry), lru: list.New()}
+}
+
+func (c *cellCache) get(index uint16) *image.RGBA {
+	e, ok := c.entries[index]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e.used)
+	return e.img
+}
+
+func (c *cellCache) put(index uint16, key uint64, img *image.RGBA) {
+	if e, ok := c.entries[index]; ok {
+		e.key, e.img = key, img
+		c.lru.MoveToFront(e.used)
+		return
+	}
+	if index != pdu.BITMAPCACHE_WAITING_LIST_INDEX && len(c.entries) >= c.size {
+		c.evict()
+	}
+	e := &cacheEntry{index: index, key: key, img: img}
+	e.used = c.lru.PushFront(e)
+	c.entries[index] = e
+}
+
+// evict drops the least recently used cell
+func (c *cellCache) evict() {
+	last := c.lru.Back()
+	if last == nil {
+		return
+	}
+	e := c.lru.Remove(last).(*cacheEntry)
+	delete(c.entries, e.index)
+}
+
+// persistent returns the cells with a key, most recently used first
+func (c *cellCache) persistent() []*cacheEntry {
+	entries := make([]*cacheEntry, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*cacheEntry); e.key != 0 && e.index != pdu.BITMAPCACHE_WAITING_LIST_INDEX {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// bitmapCache holds the bitmaps of the cache orders referenced by MemBlt and Mem3Blt
+type bitmapCache struct {
+	mu    sync.Mutex
+	cells []*cellCache
+}
+
+func newBitmapCache() *bitmapCache {
+	b := &bitmapCache{}
+	for _, n := range pdu.BitmapCacheCells {
+		b.cells = append(b.cells, newCellCache(int(n)))
+	}
+	return b
+}
+
+func (b *bitmapCache) get(id int, index uint16) *image.RGBA {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id >= len(b.cells) {
+		return nil
+	}
+	return b.cells[id].get(index)
+}
+
+func (b *bitmapCache) put(id int, index uint16, key uint64, img *image.RGBA) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id >= len(b.cells) {
+		return
+	}
+	b.cells[id].put(index, key, img)
+}
+
+// keys lists the persistent keys by cache and index, up to the last cell in use
+// and 0 for the empty ones. The cells loaded from disk are numbered from 0 in
+// the order they were saved.
+func (b *bitmapCache) keys() [][]uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([][]uint64, len(b.cells))
+	for i, c := range b.cells {
+		// the cells are sparse, the waiting list is not a cell
+		n := 0
+		for idx := range c.entries {
+			if int(idx) < c.size {
+				n = max(n, int(idx)+1)
+			}
+		}
+		keys[i] = make([]uint64, n)
+		for idx, e := range c.entries {
+			if int(idx) >= c.size {
+				continue
+			}
+			keys[i][idx] = e.key
+		}
+	}
+	return keys
+}
+
+// bitmapCachePath is the file of the persistent cache of a host in dir
+func bitmapCachePath(dir, host string) string {
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(host)
+	return filepath.Join(dir, name+".bmc")
+}
+
+// loadBitmapCache reads the persistent cache of a previous session, a missing file is an empty cache
+func loadBitmapCache(path string) (*bitmapCache, error) {
+	b := newBitmapCache()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return b, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	version, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return b, err
+	}
+	if version != bitmapCacheVersion {
+		return b, errors.New("unknown bitmap cache version")
+	}
+	next := make([]uint16, len(b.cells))
+	for {
+		id, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		key1, _ := core.ReadUInt32LE(r)
+		key2, _ := core.ReadUInt32LE(r)
+		w, _ := core.ReadUint16LE(r)
+		h, _ := core.ReadUint16LE(r)
+		if int(id) >= len(b.cells) || int(w)*int(h) > cellPixels(int(id)) {
+			return newBitmapCache(), errors.New("corrupt bitmap cache")
+		}
+		pix, err := core.ReadBytes(int(w)*int(h)*4, r)
+		if err != nil {
+			return newBitmapCache(), err
+		}
+		if int(next[id]) >= b.cells[id].size {
+			continue
+		}
+		img := &image.RGBA{Pix: pix, Stride: int(w) * 4, Rect: image.Rect(0, 0, int(w), int(h))}
+		// the first saved is the most recently used
+		c := b.cells[id]
+		e := &cacheEntry{index: next[id], key: uint64(key2)<<32 | uint64(key1), img: img}
+		e.used = c.lru.PushBack(e)
+		c.entries[e.index] = e
+		next[id]++
+	}
+	return b, nil
+}
+
+// save writes the persistent cells of b to path
+func (b *bitmapCache) save(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	core.WriteUInt32LE(bitmapCacheVersion, w)
+	for id, c := range b.cells {
+		for _, e := range c.persistent() {
+			core.WriteUInt8(uint8(id), w)
+			core.WriteUInt32LE(uint32(e.key), w)
+			core.WriteUInt32LE(uint32(e.key>>32), w)
+			core.WriteUInt16LE(uint16(e.img.Rect.Dx()), w)
+			core.WriteUInt16LE(uint16(e.img.Rect.Dy()), w)
+			for y := e.img.Rect.Min.Y; y < e.img.Rect.Max.Y; y++ {
+				core.WriteBytes(e.img.Pix[e.img.PixOffset(e.img.Rect.Min.X, y):e.img.PixOffset(e.img.Rect.Max.X, y)], w)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
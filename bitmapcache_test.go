@@ -0,0 +1,109 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+func TestCellCacheLRU(t *testing.T) {
+	c := newCellCache(2)
+	c.put(0, 10, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	c.put(1, 11, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	c.get(0)
+	// the least recently used cell 1 makes room for 2
+	c.put(2, 0, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if c.get(1) != nil || c.get(0) == nil || c.get(2) == nil {
+		t.Fatal("evicted", c.entries)
+	}
+	c.put(pdu.BITMAPCACHE_WAITING_LIST_INDEX, 12, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if len(c.entries) != 3 {
+		t.Error("waiting list evicted a cell")
+	}
+	p := c.persistent()
+	if len(p) != 1 || p[0].key != 10 {
+		t.Error("persistent", p)
+	}
+}
+
+func TestBitmapCacheSaveLoad(t *testing.T) {
+	path := bitmapCachePath(t.TempDir(), "host:3389")
+	if b, err := loadBitmapCache(path); err != nil || len(b.keys()[0]) != 0 {
+		t.Fatal("missing cache", err)
+	}
+	b := newBitmapCache()
+	older := image.NewRGBA(image.Rect(0, 0, 1, 2))
+	newer := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	newer.SetRGBA(1, 0, color.RGBA{1, 2, 3, 0xff})
+	b.put(1, 40, 0x1111, older)
+	b.put(1, 7, 0x2222, newer)
+	b.put(1, 8, 0, newer)
+	if err := b.save(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadBitmapCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := l.keys()
+	if len(keys[1]) != 2 || keys[1][0] != 0x2222 || keys[1][1] != 0x1111 {
+		t.Fatal("keys", keys)
+	}
+	if img := l.get(1, 0); img == nil || img.RGBAAt(1, 0) != (color.RGBA{1, 2, 3, 0xff}) {
+		t.Error("most recent bitmap", img)
+	}
+	if img := l.get(1, 1); img == nil || img.Rect != older.Rect {
+		t.Error("older bitmap", img)
+	}
+}
+
+func TestBitmapCacheKeys(t *testing.T) {
+	b := newBitmapCache()
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	b.put(0, 5, 0x55, img)
+	b.put(0, 2, 0x22, img)
+	b.put(0, pdu.BITMAPCACHE_WAITING_LIST_INDEX, 0x77, img)
+	keys := b.keys()
+	if len(keys[0]) != 6 || keys[0][5] != 0x55 || keys[0][2] != 0x22 || keys[0][0] != 0 {
+		t.Error("keys", keys[0])
+	}
+}
+
+func TestBitmapCacheLoadCorrupt(t *testing.T) {
+	path := bitmapCachePath(t.TempDir(), "host:3389")
+	for _, entry := range [][]byte{
+		// 0xffff x 0xffff in cache 0
+		{0, 1, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+		// unknown cache
+		{9, 1, 0, 0, 0, 2, 0, 0, 0, 1, 0, 1, 0},
+	} {
+		if err := os.WriteFile(path, append([]byte{bitmapCacheVersion, 0, 0, 0}, entry...), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		b, err := loadBitmapCache(path)
+		if err == nil || len(b.keys()[0]) != 0 {
+			t.Error("corrupt cache loaded", entry)
+		}
+	}
+}
+
+func TestFramebufferCachedMemBlt(t *testing.T) {
+	f, e := testFramebuffer(32)
+	e.Emit("orders", []pdu.OrderPdu{
+		// 2x1 at 32 bpp, green then blue
+		{Type: pdu.ORDER_SECONDARY, Secondary: &pdu.Secondary{Data: &pdu.CacheBitmapV2Order{
+			CacheId: 2, BitmapBpp: 32, BitmapWidth: 2, BitmapHeight: 1, CacheIndex: 5,
+			BitmapDataStream: []byte{0, 0xff, 0, 0, 0xff, 0, 0, 0},
+		}}},
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{
+			CacheId: 2, CacheIdx: 5, X: 3, Y: 4, Cx: 1, Cy: 1, Opcode: 0xcc, Srcx: 1,
+		}}},
+	})
+	img := f.Snapshot()
+	if got := img.RGBAAt(3, 4); got != (color.RGBA{0, 0, 0xff, 0xff}) {
+		t.Error("MemBlt", got)
+	}
+}
@@ -0,0 +1,374 @@
+// Package clearcodec decodes the ClearCodec bitmaps of the graphics pipeline,
+// a residual layer under bands of cached vertical bars and subcodec areas.
+package clearcodec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+
+	"github.com/sergei-bronnikov/grdp/codec/nsc"
+)
+
+/**
+ * @see MS-RDPEGFX 2.2.4.1 ClearCodec Bitmap Stream
+ */
+
+const (
+	CLEARCODEC_FLAG_GLYPH_INDEX = 0x01
+	CLEARCODEC_FLAG_GLYPH_HIT   = 0x02
+	CLEARCODEC_FLAG_CACHE_RESET = 0x04
+)
+
+// subcodecs of the subcodec layer
+const (
+	CLEARCODEC_SUBCODEC_UNCOMPRESSED = 0x00
+	CLEARCODEC_SUBCODEC_NSCODEC      = 0x01
+	CLEARCODEC_SUBCODEC_RLEX         = 0x02
+)
+
+const (
+	GLYPH_CACHE_SIZE       = 4000
+	VBAR_CACHE_SIZE        = 32768
+	SHORT_VBAR_CACHE_SIZE  = 16384
+	MAX_GLYPH_PIXELS       = 1024
+	MAX_BAND_HEIGHT        = 52
+	MAX_RLEX_PALETTE_COLOR = 127
+)
+
+var errTruncated = errors.New("clearcodec: truncated bitmap")
+
+type glyph struct {
+	w, h int
+	// pix are RGBA rows
+	pix []byte
+}
+
+// Decoder keeps the glyph and vertical bar caches of a connection, its bitmaps
+// must be decoded in order
+type Decoder struct {
+	glyphs [GLYPH_CACHE_SIZE]*glyph
+	// vBars are full bars of BGR pixels, shortVBars the pixels between yOn and yOff
+	vBars       [VBAR_CACHE_SIZE][]byte
+	vBarCursor  int
+	shortVBars  [SHORT_VBAR_CACHE_SIZE][]byte
+	shortCursor int
+	nsc         *nsc.Decoder
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{nsc: &nsc.Decoder{}}
+}
+
+// canvas is the area of width x height at the point at of dst, clipped to dst
+type canvas struct {
+	dst  *image.RGBA
+	at   image.Point
+	w, h int
+}
+
+// set paints the BGR pixel p at x, y of the canvas
+func (c *canvas) set(x, y int, p []byte) {
+	pt := image.Pt(x, y).Add(c.at)
+	if x >= c.w || y >= c.h || !pt.In(c.dst.Rect) {
+		return
+	}
+	i := c.dst.PixOffset(pt.X, pt.Y)
+	c.dst.Pix[i], c.dst.Pix[i+1], c.dst.Pix[i+2], c.dst.Pix[i+3] = p[2], p[1], p[0], 0xff
+}
+
+// Decode paints the bitmap of width x height at the point at of dst
+func (d *Decoder) Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error) {
+	r := &reader{b: data}
+	flags := r.uint8()
+	// the sequence number only tells lost bitmaps, the channel is reliable
+	r.uint8()
+	glyphIndex := -1
+	if flags&CLEARCODEC_FLAG_GLYPH_INDEX != 0 {
+		glyphIndex = int(r.uint16())
+		if glyphIndex >= GLYPH_CACHE_SIZE {
+			return nil, fmt.Errorf("clearcodec: invalid glyph index %d", glyphIndex)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if flags&CLEARCODEC_FLAG_CACHE_RESET != 0 {
+		d.vBarCursor, d.shortCursor = 0, 0
+	}
+	rect := image.Rect(0, 0, width, height).Add(at).Intersect(dst.Rect)
+	if flags&CLEARCODEC_FLAG_GLYPH_HIT != 0 {
+		if glyphIndex < 0 || d.glyphs[glyphIndex] == nil {
+			return nil, errors.New("clearcodec: glyph hit of an empty entry")
+		}
+		g := d.glyphs[glyphIndex]
+		rect = image.Rect(0, 0, min(g.w, width), min(g.h, height)).Add(at).Intersect(dst.Rect)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			src := g.pix[((y-at.Y)*g.w+rect.Min.X-at.X)*4:]
+			copy(dst.Pix[dst.PixOffset(rect.Min.X, y):dst.PixOffset(rect.Max.X, y)], src)
+		}
+		return []image.Rectangle{rect}, nil
+	}
+
+	residual, bands, subcodecs := int(r.uint32()), int(r.uint32()), int(r.uint32())
+	if r.err != nil {
+		return nil, r.err
+	}
+	c := &canvas{dst, at, width, height}
+	var err error
+	if residual > 0 {
+		err = d.residual(r.sub(residual), c)
+	}
+	if err == nil && bands > 0 {
+		err = d.bands(r.sub(bands), c)
+	}
+	if err == nil && subcodecs > 0 {
+		err = d.subcodecs(r.sub(subcodecs), c)
+	}
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if glyphIndex >= 0 && width*height <= MAX_GLYPH_PIXELS {
+		g := &glyph{w: width, h: height, pix: make([]byte, width*height*4)}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			copy(g.pix[((y-at.Y)*width+rect.Min.X-at.X)*4:], dst.Pix[dst.PixOffset(rect.Min.X, y):dst.PixOffset(rect.Max.X, y)])
+		}
+		d.glyphs[glyphIndex] = g
+	}
+	return []image.Rectangle{rect}, nil
+}
+
+/**
+ * residual fills the canvas with runs of colors, row after row
+ * @see MS-RDPEGFX 2.2.4.1.1.1 CLEARCODEC_RESIDUAL_DATA
+ */
+func (d *Decoder) residual(r *reader, c *canvas) error {
+	n := 0
+	for len(r.b) > 0 {
+		p := r.bytes(3)
+		run := r.runLength()
+		if r.err != nil {
+			return r.err
+		}
+		if run > c.w*c.h-n {
+			return errors.New("clearcodec: residual past the end of the bitmap")
+		}
+		for ; run > 0; run-- {
+			c.set(n%c.w, n/c.w, p)
+			n++
+		}
+	}
+	if n != c.w*c.h {
+		return errors.New("clearcodec: residual does not cover the bitmap")
+	}
+	return nil
+}
+
+/**
+ * bands paints columns of vertical bars over a background color, the bars
+ * are cached for the next bands
+ * @see MS-RDPEGFX 2.2.4.1.1.2 CLEARCODEC_BANDS_DATA
+ */
+func (d *Decoder) bands(r *reader, c *canvas) error {
+	for len(r.b) > 0 {
+		xStart, xEnd, yStart, yEnd := int(r.uint16()), int(r.uint16()), int(r.uint16()), int(r.uint16())
+		bkg := r.bytes(3)
+		if r.err != nil {
+			return r.err
+		}
+		height := yEnd - yStart + 1
+		if xEnd < xStart || height < 1 || height > MAX_BAND_HEIGHT {
+			return errors.New("clearcodec: invalid band")
+		}
+		for x := xStart; x <= xEnd; x++ {
+			vBar, err := d.vBar(r, bkg, height)
+			if err != nil {
+				return err
+			}
+			for y := 0; y < min(len(vBar)/3, height); y++ {
+				c.set(x, yStart+y, vBar[y*3:])
+			}
+		}
+	}
+	return nil
+}
+
+// vBar reads a vertical bar of height pixels, from the caches or the stream
+func (d *Decoder) vBar(r *reader, bkg []byte, height int) ([]byte, error) {
+	header := r.uint16()
+	var short []byte
+	var yOn int
+	switch {
+	case header&0x8000 != 0:
+		// VBAR_CACHE_HIT
+		vBar := d.vBars[header&0x7fff]
+		if vBar == nil {
+			return nil, errors.New("clearcodec: vbar hit of an empty entry")
+		}
+		return vBar, r.err
+	case header&0x4000 != 0:
+		// SHORT_VBAR_CACHE_HIT
+		short = d.shortVBars[header&0x3fff]
+		yOn = int(r.uint8())
+		if short == nil {
+			return nil, errors.New("clearcodec: short vbar hit of an empty entry")
+		}
+	default:
+		// SHORT_VBAR_CACHE_MISS
+		yOn = int(header & 0xff)
+		yOff := int(header >> 8 & 0x3f)
+		if yOff < yOn {
+			return nil, errors.New("clearcodec: invalid short vbar")
+		}
+		short = append([]byte(nil), r.bytes((yOff-yOn)*3)...)
+		if r.err != nil {
+			return nil, r.err
+		}
+		d.shortVBars[d.shortCursor] = short
+		d.shortCursor = (d.shortCursor + 1) % SHORT_VBAR_CACHE_SIZE
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if yOn+len(short)/3 > height {
+		return nil, errors.New("clearcodec: short vbar taller than its band")
+	}
+	vBar := make([]byte, height*3)
+	for y := 0; y < height; y++ {
+		copy(vBar[y*3:y*3+3], bkg)
+	}
+	copy(vBar[yOn*3:], short)
+	d.vBars[d.vBarCursor] = vBar
+	d.vBarCursor = (d.vBarCursor + 1) % VBAR_CACHE_SIZE
+	return vBar, nil
+}
+
+/**
+ * subcodecs paints areas of the canvas with their own codec
+ * @see MS-RDPEGFX 2.2.4.1.1.3 CLEARCODEC_SUBCODECS_DATA
+ */
+func (d *Decoder) subcodecs(r *reader, c *canvas) error {
+	for len(r.b) > 0 {
+		x, y, w, h := int(r.uint16()), int(r.uint16()), int(r.uint16()), int(r.uint16())
+		n := int(r.uint32())
+		id := r.uint8()
+		data := r.bytes(n)
+		if r.err != nil {
+			return r.err
+		}
+		if x+w > c.w || y+h > c.h {
+			return errors.New("clearcodec: subcodec area outside the bitmap")
+		}
+		sub := &canvas{c.dst, c.at.Add(image.Pt(x, y)), w, h}
+		switch id {
+		case CLEARCODEC_SUBCODEC_UNCOMPRESSED:
+			if len(data) != w*h*3 {
+				return errors.New("clearcodec: invalid uncompressed subcodec")
+			}
+			for i := 0; i < w*h; i++ {
+				sub.set(i%w, i/w, data[i*3:])
+			}
+		case CLEARCODEC_SUBCODEC_NSCODEC:
+			if _, err := d.nsc.Decode(data, w, h, c.dst, sub.at); err != nil {
+				return err
+			}
+		case CLEARCODEC_SUBCODEC_RLEX:
+			if err := rlex(&reader{b: data}, sub); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("clearcodec: unknown subcodec %d", id)
+		}
+	}
+	return nil
+}
+
+/**
+ * rlex paints runs of a palette color each followed by a suite of the colors
+ * up to a stop index
+ * @see MS-RDPEGFX 2.2.4.1.1.3.1.1 CLEARCODEC_SUBCODEC_RLEX
+ */
+func rlex(r *reader, c *canvas) error {
+	count := int(r.uint8())
+	if count < 1 || count > MAX_RLEX_PALETTE_COLOR {
+		return errors.New("clearcodec: invalid rlex palette")
+	}
+	palette := r.bytes(count * 3)
+	numBits := max(bits.Len(uint(count-1)), 1)
+	n := 0
+	for len(r.b) > 0 && n < c.w*c.h {
+		b := int(r.uint8())
+		stop := b & (1<<numBits - 1)
+		depth := b >> numBits
+		run := r.runLength()
+		if r.err != nil {
+			return r.err
+		}
+		start := stop - depth
+		if start < 0 || stop >= count || n+run+depth+1 > c.w*c.h {
+			return errors.New("clearcodec: invalid rlex segment")
+		}
+		for ; run > 0; run-- {
+			c.set(n%c.w, n/c.w, palette[start*3:])
+			n++
+		}
+		for i := start; i <= stop; i++ {
+			c.set(n%c.w, n/c.w, palette[i*3:])
+			n++
+		}
+	}
+	return r.err
+}
+
+// reader reads the fields of a bitmap, the first error sticks
+type reader struct {
+	b   []byte
+	err error
+}
+
+// bytes returns n bytes, or zeroes for the integers read after an error: n
+// may come from the bitmap itself and is not allocated
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) || n < 0 {
+		r.err = errTruncated
+		return make([]byte, min(max(n, 0), 4))
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// sub splits the next n bytes in their own reader
+func (r *reader) sub(n int) *reader {
+	return &reader{b: r.bytes(n), err: r.err}
+}
+
+func (r *reader) uint8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.bytes(2))
+}
+
+func (r *reader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+// runLength reads a factor of 1 byte, 2 when the first is 0xff and 4 when those are 0xffff
+func (r *reader) runLength() int {
+	run := int(r.uint8())
+	if run == 0xff {
+		run = int(r.uint16())
+		if run == 0xffff {
+			run = int(r.uint32())
+		}
+	}
+	return run
+}
@@ -0,0 +1,180 @@
+package clearcodec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// bitmap builds a composite payload of the residual, bands and subcodec layers
+func bitmap(flags uint8, glyphIndex uint16, residual, bands, subcodecs []byte) []byte {
+	b := []byte{flags, 0}
+	if flags&CLEARCODEC_FLAG_GLYPH_INDEX != 0 {
+		b = binary.LittleEndian.AppendUint16(b, glyphIndex)
+	}
+	if flags&CLEARCODEC_FLAG_GLYPH_HIT != 0 {
+		return b
+	}
+	for _, l := range [][]byte{residual, bands, subcodecs} {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(l)))
+	}
+	b = append(b, residual...)
+	b = append(b, bands...)
+	return append(b, subcodecs...)
+}
+
+func u16(v ...uint16) []byte {
+	var b []byte
+	for _, x := range v {
+		b = binary.LittleEndian.AppendUint16(b, x)
+	}
+	return b
+}
+
+func check(t *testing.T, name string, img *image.RGBA, want [][]color.RGBA) {
+	t.Helper()
+	for y, row := range want {
+		for x, c := range row {
+			if got := img.RGBAAt(x, y); got != c {
+				t.Errorf("%s: pixel %d,%d = %v, want %v", name, x, y, got, c)
+			}
+		}
+	}
+}
+
+var (
+	blue  = color.RGBA{0x30, 0x20, 0x10, 0xff}
+	gray  = color.RGBA{3, 2, 1, 0xff}
+	red   = color.RGBA{0xff, 0, 0, 0xff}
+	green = color.RGBA{0, 0xff, 0, 0xff}
+)
+
+func TestResidualBandsAndGlyphs(t *testing.T) {
+	d := NewDecoder()
+	residual := []byte{0x10, 0x20, 0x30, 4, 1, 2, 3, 2}
+	// a band of columns 1 and 2 over red, the first bar is green from row 1,
+	// the second repeats the first from the cache
+	bands := append(u16(1, 2, 0, 1), 0, 0, 0xff)
+	bands = append(bands, u16(0x0201)...)
+	bands = append(bands, 0, 0xff, 0)
+	bands = append(bands, u16(0x8000)...)
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	rects, err := d.Decode(bitmap(CLEARCODEC_FLAG_GLYPH_INDEX, 5, residual, bands, nil), 3, 2, img, image.Point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rects) != 1 || rects[0] != img.Rect {
+		t.Error("updated", rects)
+	}
+	want := [][]color.RGBA{{blue, red, red}, {blue, green, green}}
+	check(t, "bands", img, want)
+
+	glyph := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	if _, err := d.Decode(bitmap(CLEARCODEC_FLAG_GLYPH_INDEX|CLEARCODEC_FLAG_GLYPH_HIT, 5, nil, nil, nil), 3, 2, glyph, image.Pt(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	check(t, "glyph", glyph, [][]color.RGBA{{{}}, {{}, blue, red, red}, {{}, blue, green, green}})
+
+	// the short bar of the first band moved to row 0 over the residual gray
+	bands = append(u16(0, 0, 0, 1), 0, 0, 0xff)
+	bands = append(bands, u16(0x4000)...)
+	bands = append(bands, 0)
+	img = image.NewRGBA(image.Rect(0, 0, 2, 2))
+	if _, err := d.Decode(bitmap(0, 0, []byte{1, 2, 3, 4}, bands, nil), 2, 2, img, image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	check(t, "short bar", img, [][]color.RGBA{{green, gray}, {red, gray}})
+
+	if _, err := d.Decode(bitmap(0, 0, []byte{1, 2, 3, 3}, nil, nil), 2, 2, img, image.Point{}); err == nil {
+		t.Error("short residual accepted")
+	}
+	if _, err := d.Decode(bitmap(CLEARCODEC_FLAG_GLYPH_INDEX|CLEARCODEC_FLAG_GLYPH_HIT, 6, nil, nil, nil), 2, 2, img, image.Point{}); err == nil {
+		t.Error("hit of an empty glyph accepted")
+	}
+}
+
+func TestSubcodecs(t *testing.T) {
+	// rlex of 2 colors, a run of 2 of the first then the suite of both
+	rlex := []byte{2, 0x10, 0x20, 0x30, 1, 2, 3, 1 | 1<<1, 2}
+	sub := append(u16(0, 0, 4, 1), 0, 0, 0, 0, CLEARCODEC_SUBCODEC_RLEX)
+	binary.LittleEndian.PutUint32(sub[8:], uint32(len(rlex)))
+	sub = append(sub, rlex...)
+	raw := []byte{0, 0xff, 0, 0, 0, 0xff}
+	sub = append(sub, u16(1, 1, 2, 1)...)
+	sub = binary.LittleEndian.AppendUint32(sub, uint32(len(raw)))
+	sub = append(sub, CLEARCODEC_SUBCODEC_UNCOMPRESSED)
+	sub = append(sub, raw...)
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	if _, err := NewDecoder().Decode(bitmap(0, 0, nil, nil, sub), 4, 2, img, image.Point{}); err != nil {
+		t.Fatal(err)
+	}
+	check(t, "subcodecs", img, [][]color.RGBA{{blue, blue, blue, gray}, {{}, green, red, {}}})
+}
+
+func TestTruncatedLengths(t *testing.T) {
+	// a subcodec claiming 0x88888888 bytes
+	data := []byte("00000\x88\x88\x88\x88\x88\x88\x88\x88\x88")
+	d := NewDecoder()
+	img := image.NewRGBA(image.Rect(0, 0, 25, 1))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := d.Decode(data, 25, 1, img, image.Point{}); err == nil {
+		t.Error("truncated bitmap decoded")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes", n)
+	}
+}
+
+// TestGolden decodes the payloads captured from a server in testdata, each
+// <name>_<width>x<height>.bin is compared with the pixels of the .png of the
+// same name
+func TestGolden(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.bin"))
+	if len(files) == 0 {
+		t.Skip("no captured payloads in testdata")
+	}
+files:
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".bin")
+		var width, height int
+		if _, err := fmt.Sscanf(name[strings.LastIndex(name, "_")+1:], "%dx%d", &width, &height); err != nil {
+			t.Fatal(file, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(file, err)
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		if _, err := NewDecoder().Decode(data, width, height, dst, image.Point{}); err != nil {
+			t.Error(file, err)
+			continue
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if got, w := dst.RGBAAt(x, y), color.RGBAModel.Convert(want.At(x, y)); got != w {
+					t.Errorf("%s: pixel %d,%d is %v, want %v", file, x, y, got, w)
+					continue files
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package codec negotiates the bitmap codecs of the surface bits commands, the
+// codecs register themselves from their own packages.
+package codec
+
+import (
+	"fmt"
+	"image"
+	"sync"
+)
+
+/**
+ * @see MS-RDPBCGR 2.2.7.2.10 Bitmap Codecs Capability Set
+ */
+
+// Decoder paints the bitmaps of a codec, a decoder may keep state between the
+// bitmaps of a connection
+type Decoder interface {
+	// Decode paints data of width x height at the point at of dst and returns the areas it updated
+	Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error)
+}
+
+// Codec is a decoder announced in the Bitmap Codecs capability
+type Codec struct {
+	Name string
+	GUID [16]byte
+	// ID is the codec id the client assigns, the surface bits refer to it
+	ID uint8
+	// Properties are the client properties of the codec
+	Properties func() []byte
+	NewDecoder func() Decoder
+}
+
+var (
+	mu     sync.Mutex
+	codecs []Codec
+)
+
+// Register makes a codec available to the connections, it panics when its GUID
+// or ID is already registered
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range codecs {
+		if r.GUID == c.GUID || r.ID == c.ID {
+			panic(fmt.Sprintf("codec: %s conflicts with %s", c.Name, r.Name))
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// Registered lists the codecs in the order they were registered
+func Registered() []Codec {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Codec(nil), codecs...)
+}
+
+// Lookup returns the codec registered with guid
+func Lookup(guid [16]byte) (Codec, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, c := range codecs {
+		if c.GUID == guid {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// Set maps the codec ids of a connection to their decoders, the decoders are
+// created on the first bitmap
+type Set struct {
+	codecs   map[uint8]Codec
+	decoders map[uint8]Decoder
+}
+
+// NewSet maps the ids of the registered codecs, then the ones assigned by the server
+// in its own capability
+func NewSet(server map[uint8][16]byte) *Set {
+	s := &Set{codecs: make(map[uint8]Codec), decoders: make(map[uint8]Decoder)}
+	for _, c := range Registered() {
+		s.codecs[c.ID] = c
+	}
+	for id, guid := range server {
+		if _, ok := s.codecs[id]; ok {
+			continue
+		}
+		if c, ok := Lookup(guid); ok {
+			s.codecs[id] = c
+		}
+	}
+	return s
+}
+
+// Decoder returns the decoder of id, nil for the unknown codecs
+func (s *Set) Decoder(id uint8) Decoder {
+	if d, ok := s.decoders[id]; ok {
+		return d
+	}
+	c, ok := s.codecs[id]
+	if !ok {
+		return nil
+	}
+	d := c.NewDecoder()
+	s.decoders[id] = d
+	return d
+}
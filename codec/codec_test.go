@@ -0,0 +1,36 @@
+package codec
+
+import (
+	"image"
+	"testing"
+)
+
+type testDecoder struct{}
+
+func (testDecoder) Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error) {
+	return nil, nil
+}
+
+func TestSet(t *testing.T) {
+	guid := [16]byte{1, 2, 3}
+	Register(Codec{Name: "test", GUID: guid, ID: 9, Properties: func() []byte { return nil },
+		NewDecoder: func() Decoder { return testDecoder{} }})
+	defer func() { codecs = nil }()
+
+	s := NewSet(map[uint8][16]byte{5: guid, 6: {4}})
+	if s.Decoder(9) == nil || s.Decoder(5) == nil {
+		t.Error("registered codec")
+	}
+	if s.Decoder(5) != s.Decoder(5) {
+		t.Error("decoder not kept")
+	}
+	if s.Decoder(6) != nil {
+		t.Error("unknown codec")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate GUID")
+		}
+	}()
+	Register(Codec{Name: "duplicate", GUID: guid, ID: 10})
+}
@@ -0,0 +1,192 @@
+// Package nsc decodes the NSCodec bitmaps of the surface bits commands.
+package nsc
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+
+	"github.com/sergei-bronnikov/grdp/codec"
+)
+
+/**
+ * @see MS-RDPNSC 2.2 Message Syntax
+ */
+
+// GUID is CODEC_GUID_NSCODEC of the Bitmap Codecs capability
+var GUID = [16]byte{0xb9, 0x1b, 0x8d, 0xca, 0x0f, 0x00, 0x4f, 0x15, 0x58, 0x9f, 0xae, 0x2d, 0x1a, 0x87, 0xe2, 0xd6}
+
+// CODEC_ID is the id the client assigns to NSCodec
+const CODEC_ID = 0x01
+
+// ColorLossLevel is the highest loss of the chroma planes the client accepts, from 1 to 7
+var ColorLossLevel uint8 = 3
+
+var errTruncated = errors.New("nsc: truncated bitmap")
+
+func init() {
+	codec.Register(codec.Codec{
+		Name:       "NSCodec",
+		GUID:       GUID,
+		ID:         CODEC_ID,
+		Properties: ClientProperties,
+		NewDecoder: func() codec.Decoder { return &Decoder{} },
+	})
+}
+
+// ClientProperties is the TS_NSCODEC_CAPABILITYSET of the client
+func ClientProperties() []byte {
+	// fAllowDynamicFidelity, fAllowSubsampling, colorLossLevel
+	return []byte{1, 1, ColorLossLevel}
+}
+
+// Decoder decodes TS_NSCODEC_BITMAP_STREAM, the bitmaps are independent
+type Decoder struct {
+	planes [4][]byte
+}
+
+// Decode paints the bitmap of width x height at the point at of dst
+func (d *Decoder) Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error) {
+	if len(data) < 20 {
+		return nil, errTruncated
+	}
+	lossLevel := int(data[16])
+	subsampling := data[17] != 0
+	if lossLevel < 1 || lossLevel > 7 {
+		return nil, errors.New("nsc: invalid color loss level")
+	}
+
+	if width <= 0 || height <= 0 || !image.Rect(0, 0, width, height).Add(at).In(dst.Rect) {
+		return nil, errors.New("nsc: bitmap outside of the destination")
+	}
+	// the planes are only allocated once the stream holds them
+	var lengths [4]int
+	total := 0
+	for i := range lengths {
+		lengths[i] = int(binary.LittleEndian.Uint32(data[i*4:]))
+		total += lengths[i]
+		if lengths[i] > len(data)-20 || total > len(data)-20 {
+			return nil, errTruncated
+		}
+	}
+
+	// the planes of the subsampled chroma are padded to 8 columns and 2 rows
+	paddedWidth, paddedHeight := (width+7)&^7, (height+1)&^1
+	sizes := [4]int{width * height, width * height, width * height, width * height}
+	if subsampling {
+		sizes[0] = paddedWidth * height
+		sizes[1] = (paddedWidth / 2) * (paddedHeight / 2)
+		sizes[2] = sizes[1]
+	}
+	stream := data[20:]
+	for i := range d.planes {
+		n := lengths[i]
+		if cap(d.planes[i]) < sizes[i] {
+			d.planes[i] = make([]byte, sizes[i])
+		}
+		d.planes[i] = d.planes[i][:sizes[i]]
+		if err := decodePlane(stream[:n], d.planes[i]); err != nil {
+			return nil, err
+		}
+		stream = stream[n:]
+	}
+
+	// the encoder dropped the low bits of the chroma
+	shift := uint(lossLevel - 1)
+	r := image.Rect(0, 0, width, height).Add(at).Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := y - at.Y
+		yRow, coRow, cgRow := sy*width, sy*width, sy*width
+		if subsampling {
+			yRow, coRow, cgRow = sy*paddedWidth, (sy>>1)*(paddedWidth/2), (sy>>1)*(paddedWidth/2)
+		}
+		pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx := x - at.X
+			cx := sx
+			if subsampling {
+				cx = sx >> 1
+			}
+			yv := int(d.planes[0][yRow+sx])
+			co := int(int8(d.planes[1][coRow+cx])) << shift
+			cg := int(int8(d.planes[2][cgRow+cx])) << shift
+			i := (x - r.Min.X) * 4
+			pix[i] = clamp(yv + co - cg)
+			pix[i+1] = clamp(yv + cg)
+			pix[i+2] = clamp(yv - co - cg)
+			pix[i+3] = d.planes[3][sy*width+sx]
+		}
+	}
+	return []image.Rectangle{r}, nil
+}
+
+// decodePlane fills out with a plane, raw when it has its full size, opaque when
+// empty and run-length encoded otherwise
+func decodePlane(in, out []byte) error {
+	switch {
+	case len(in) == 0:
+		for i := range out {
+			out[i] = 0xff
+		}
+		return nil
+	case len(in) >= len(out):
+		copy(out, in)
+		return nil
+	}
+	return decodeRLE(in, out)
+}
+
+/**
+ * @see MS-RDPNSC 3.1.8.1 RLE Decompression
+ */
+func decodeRLE(in, out []byte) error {
+	n := 0
+	for len(out)-n > 4 {
+		if len(in) < 1 {
+			return errTruncated
+		}
+		value := in[0]
+		in = in[1:]
+		if len(out)-n == 5 || len(in) == 0 || in[0] != value {
+			out[n] = value
+			n++
+			continue
+		}
+		// a repeated value is followed by the length of the run
+		if len(in) < 2 {
+			return errTruncated
+		}
+		run := int(in[1]) + 2
+		in = in[2:]
+		if run == 0xff+2 {
+			if len(in) < 4 {
+				return errTruncated
+			}
+			run = int(binary.LittleEndian.Uint32(in))
+			in = in[4:]
+		}
+		if run > len(out)-n {
+			return errors.New("nsc: run past the end of the plane")
+		}
+		for i := 0; i < run; i++ {
+			out[n+i] = value
+		}
+		n += run
+	}
+	// the last 4 bytes are raw
+	if len(in) < len(out)-n {
+		return errTruncated
+	}
+	copy(out[n:], in)
+	return nil
+}
+
+func clamp(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,86 @@
+package nsc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeRLE(t *testing.T) {
+	// 7 times 0x10, then a run with a 32 bits length, 3 raw values and the last 4 bytes
+	in := []byte{0x10, 0x10, 5, 0x20, 0x20, 0xff, 0x06, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7}
+	out := make([]byte, 7+6+3+4)
+	if err := decodeRLE(in, out); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{0x10}, 7), bytes.Repeat([]byte{0x20}, 6)...)
+	want = append(want, 1, 2, 3, 4, 5, 6, 7)
+	if !bytes.Equal(out, want) {
+		t.Error(out)
+	}
+	if err := decodeRLE(in[:8], out); err == nil {
+		t.Error("truncated")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// 2x2 subsampled, the luma padded to 8 columns and the alpha plane omitted
+	planes := [][]byte{
+		{100, 100, 0, 0, 0, 0, 0, 0, 50, 50, 0, 0, 0, 0, 0, 0},
+		{0x08, 0, 0, 0},
+		{0xfc, 0, 0, 0},
+		nil,
+	}
+	data := make([]byte, 20)
+	for i, p := range planes {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(len(p)))
+	}
+	data[16], data[17] = 3, 1
+	for _, p := range planes {
+		data = append(data, p...)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	rects, err := (&Decoder{}).Decode(data, 2, 2, dst, image.Pt(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rects) != 1 || rects[0] != image.Rect(1, 1, 3, 3) {
+		t.Error("updated", rects)
+	}
+	// co 8<<2 and cg -4<<2
+	if got := dst.RGBAAt(2, 1); got != (color.RGBA{148, 84, 84, 0xff}) {
+		t.Error("first row", got)
+	}
+	if got := dst.RGBAAt(1, 2); got != (color.RGBA{98, 34, 34, 0xff}) {
+		t.Error("second row", got)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	d := &Decoder{}
+	dst := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	// empty planes are opaque and would be filled whatever their size
+	empty := make([]byte, 20)
+	empty[16] = 1
+	long := append([]byte(nil), empty...)
+	long[0] = 0xff
+	for _, c := range []struct {
+		data          []byte
+		width, height int
+	}{
+		{empty, 0xffff, 0xffff},
+		{empty, 64, 65},
+		{long, 64, 64},
+	} {
+		if _, err := d.Decode(c.data, c.width, c.height, dst, image.Point{}); err == nil {
+			t.Error("decoded", c.width, c.height)
+		}
+	}
+	for i, p := range d.planes {
+		if p != nil {
+			t.Error("allocated plane", i, len(p))
+		}
+	}
+}
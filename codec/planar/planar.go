@@ -0,0 +1,210 @@
+// Package planar decodes the RDP 6.0 planar bitmaps of the graphics pipeline.
+package planar
+
+import (
+	"errors"
+	"image"
+)
+
+/**
+ * @see MS-RDPEGDI 2.2.2.5.1 RDP 6.0 Bitmap Compressed Stream
+ */
+
+// flags of the format header, the low 3 bits are the color loss level
+const (
+	PLANAR_FORMAT_HEADER_CLL_MASK = 0x07
+	PLANAR_FORMAT_HEADER_CS       = 0x08
+	PLANAR_FORMAT_HEADER_RLE      = 0x10
+	PLANAR_FORMAT_HEADER_NA       = 0x20
+)
+
+var errTruncated = errors.New("planar: truncated bitmap")
+
+// Decoder decodes the planes of alpha and either red, green, blue or luma and
+// chroma, the bitmaps are independent
+type Decoder struct {
+	planes [4][]byte
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Decode paints the bitmap of width x height at the point at of dst, its rows are top-down
+func (d *Decoder) Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error) {
+	if len(data) < 1 {
+		return nil, errTruncated
+	}
+	header := data[0]
+	data = data[1:]
+	cll := int(header & PLANAR_FORMAT_HEADER_CLL_MASK)
+	subsampling := header&PLANAR_FORMAT_HEADER_CS != 0
+	if subsampling && cll == 0 {
+		return nil, errors.New("planar: chroma subsampling without color loss")
+	}
+
+	// the chroma planes have half the columns and rows when they are subsampled
+	cw, ch := width, height
+	if subsampling {
+		cw, ch = (width+1)/2, (height+1)/2
+	}
+	sizes := [4][2]int{{width, height}, {width, height}, {cw, ch}, {cw, ch}}
+	first := 0
+	if header&PLANAR_FORMAT_HEADER_NA != 0 {
+		first = 1
+	}
+	// the planes are only allocated once data holds them
+	if width <= 0 || height <= 0 || !image.Rect(0, 0, width, height).Add(at).In(dst.Rect) {
+		return nil, errors.New("planar: bitmap outside of the destination")
+	}
+	need := 0
+	for i := first; i < 4; i++ {
+		need += planeLength(header&PLANAR_FORMAT_HEADER_RLE != 0, sizes[i][0], sizes[i][1])
+	}
+	if len(data) < need {
+		return nil, errTruncated
+	}
+	if first == 1 {
+		d.plane(0, width*height)
+		for i := range d.planes[0] {
+			d.planes[0][i] = 0xff
+		}
+	}
+	for i := first; i < 4; i++ {
+		w, h := sizes[i][0], sizes[i][1]
+		out := d.plane(i, w*h)
+		if header&PLANAR_FORMAT_HEADER_RLE == 0 {
+			if len(data) < w*h {
+				return nil, errTruncated
+			}
+			copy(out, data)
+			data = data[w*h:]
+			continue
+		}
+		n, err := decodeRLE(data, out, w, h)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+
+	shift := uint(max(cll-1, 0))
+	r := image.Rect(0, 0, width, height).Add(at).Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := y - at.Y
+		pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx := x - at.X
+			i, c := sy*width+sx, sy*cw+sx
+			if subsampling {
+				c = (sy>>1)*cw + sx>>1
+			}
+			p := pix[(x-r.Min.X)*4:]
+			if cll == 0 {
+				p[0], p[1], p[2] = d.planes[1][i], d.planes[2][i], d.planes[3][i]
+			} else {
+				yv := int(d.planes[1][i])
+				// halves of the chroma, the encoder dropped their low cll bits
+				co := int(int8(d.planes[2][c])) << shift
+				cg := int(int8(d.planes[3][c])) << shift
+				p[0], p[1], p[2] = clamp(yv+co-cg), clamp(yv+cg), clamp(yv-co-cg)
+			}
+			p[3] = d.planes[0][i]
+		}
+	}
+	return []image.Rectangle{r}, nil
+}
+
+// planeLength is the least number of bytes of a plane of w x h, a RLE
+// control byte codes at most 47 values
+func planeLength(rle bool, w, h int) int {
+	if rle {
+		return (w + 46) / 47 * h
+	}
+	return w * h
+}
+
+func (d *Decoder) plane(i, size int) []byte {
+	if cap(d.planes[i]) < size {
+		d.planes[i] = make([]byte, size)
+	}
+	d.planes[i] = d.planes[i][:size]
+	return d.planes[i]
+}
+
+/**
+ * decodeRLE fills out with a plane of w x h and returns the bytes it read, the
+ * first row is absolute and the others are deltas of the row above
+ * @see MS-RDPEGDI 2.2.2.5.1.1 RDP6_RLE_SEGMENTS
+ */
+func decodeRLE(in, out []byte, w, h int) (int, error) {
+	n := 0
+	for y := 0; y < h; y++ {
+		row := out[y*w : (y+1)*w]
+		var prev []byte
+		if y > 0 {
+			prev = out[(y-1)*w : y*w]
+		}
+		var value byte
+		x := 0
+		for x < w {
+			if n >= len(in) {
+				return 0, errTruncated
+			}
+			control := in[n]
+			n++
+			run, raw := int(control&0x0f), int(control>>4)
+			// runs of 16 to 47 values have no raw bytes
+			switch run {
+			case 1:
+				run, raw = raw+16, 0
+			case 2:
+				run, raw = raw+32, 0
+			}
+			if x+raw+run > w {
+				return 0, errors.New("planar: segment past the end of the row")
+			}
+			if n+raw > len(in) {
+				return 0, errTruncated
+			}
+			for ; raw > 0; raw-- {
+				value = in[n]
+				n++
+				if prev != nil {
+					value = delta(value)
+				}
+				row[x] = value
+				if prev != nil {
+					row[x] += prev[x]
+				}
+				x++
+			}
+			for ; run > 0; run-- {
+				row[x] = value
+				if prev != nil {
+					row[x] += prev[x]
+				}
+				x++
+			}
+		}
+	}
+	return n, nil
+}
+
+// delta decodes the magnitude and sign folded by 2*|v| - sign
+func delta(v byte) byte {
+	if v&1 != 0 {
+		return -(v>>1 + 1)
+	}
+	return v >> 1
+}
+
+func clamp(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,160 @@
+package planar
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRLE(t *testing.T) {
+	// a run of 17 zeros without raw bytes, then a raw 7
+	out := make([]byte, 18)
+	n, err := decodeRLE([]byte{0x11, 0x10, 7, 0xaa}, out, 18, 1)
+	if err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(out, append(make([]byte, 17), 7)) {
+		t.Error(out)
+	}
+	if _, err := decodeRLE([]byte{0x15, 1}, out[:4], 4, 1); err == nil {
+		t.Error("segment past the row accepted")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		data          []byte
+		want          []color.RGBA
+	}{
+		{
+			name:  "rle with alpha",
+			width: 4, height: 2,
+			data: []byte{
+				PLANAR_FORMAT_HEADER_RLE,
+				// alpha, the second row repeats the first
+				0x13, 0xff, 0x04,
+				// red 10 20 20 20 raw, runs of 1 and 2 carry no raw bytes, then each one more
+				0x40, 10, 20, 20, 20, 0x13, 2,
+				// green 5, then each 2 less
+				0x13, 5, 0x13, 3,
+				// blue 1 2 3 4 twice
+				0x40, 1, 2, 3, 4, 0x04,
+			},
+			want: []color.RGBA{
+				{10, 5, 1, 0xff}, {20, 5, 2, 0xff}, {20, 5, 3, 0xff}, {20, 5, 4, 0xff},
+				{11, 3, 1, 0xff}, {21, 3, 2, 0xff}, {21, 3, 3, 0xff}, {21, 3, 4, 0xff},
+			},
+		},
+		{
+			name:  "raw subsampled chroma",
+			width: 2, height: 2,
+			data: []byte{
+				PLANAR_FORMAT_HEADER_NA | PLANAR_FORMAT_HEADER_CS | 3,
+				100, 100, 50, 50,
+				// co 8 and cg -4 shifted by the color loss level
+				0x08, 0xfc,
+				0,
+			},
+			want: []color.RGBA{
+				{148, 84, 84, 0xff}, {148, 84, 84, 0xff},
+				{98, 34, 34, 0xff}, {98, 34, 34, 0xff},
+			},
+		},
+	}
+	for _, tt := range tests {
+		dst := image.NewRGBA(image.Rect(0, 0, tt.width+1, tt.height+1))
+		rects, err := NewDecoder().Decode(tt.data, tt.width, tt.height, dst, image.Pt(1, 1))
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if len(rects) != 1 || rects[0] != image.Rect(1, 1, tt.width+1, tt.height+1) {
+			t.Error(tt.name, "updated", rects)
+		}
+		for i, want := range tt.want {
+			x, y := i%tt.width+1, i/tt.width+1
+			if got := dst.RGBAAt(x, y); got != want {
+				t.Errorf("%s: pixel %d,%d = %v, want %v", tt.name, x, y, got, want)
+			}
+		}
+	}
+
+	if _, err := NewDecoder().Decode([]byte{PLANAR_FORMAT_HEADER_NA, 1, 2, 3}, 2, 2, image.NewRGBA(image.Rect(0, 0, 2, 2)), image.Point{}); err == nil {
+		t.Error("truncated planes accepted")
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	d := NewDecoder()
+	dst := image.NewRGBA(image.Rect(0, 0, 1024, 1024))
+	for _, c := range []struct {
+		data          []byte
+		width, height int
+	}{
+		// no alpha plane and 3 bytes for 1024x1024 pixels
+		{[]byte{PLANAR_FORMAT_HEADER_NA | PLANAR_FORMAT_HEADER_RLE, 0x13, 0xff, 0x04}, 1024, 1024},
+		{[]byte{PLANAR_FORMAT_HEADER_NA, 1, 2, 3}, 1024, 1024},
+		// larger than the destination
+		{[]byte{PLANAR_FORMAT_HEADER_NA, 1, 2, 3}, 0xffff, 0xffff},
+	} {
+		if _, err := d.Decode(c.data, c.width, c.height, dst, image.Point{}); err == nil {
+			t.Error("decoded", c.data, c.width, c.height)
+		}
+	}
+	for i, p := range d.planes {
+		if p != nil {
+			t.Error("allocated plane", i, len(p))
+		}
+	}
+}
+
+// TestGolden decodes the payloads captured from a server in testdata, each
+// <name>_<width>x<height>.bin is compared with the pixels of the .png of the
+// same name
+func TestGolden(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "*.bin"))
+	if len(files) == 0 {
+		t.Skip("no captured payloads in testdata")
+	}
+files:
+	for _, file := range files {
+		name := strings.TrimSuffix(file, ".bin")
+		var width, height int
+		if _, err := fmt.Sscanf(name[strings.LastIndex(name, "_")+1:], "%dx%d", &width, &height); err != nil {
+			t.Fatal(file, err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(name + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(file, err)
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		if _, err := NewDecoder().Decode(data, width, height, dst, image.Point{}); err != nil {
+			t.Error(file, err)
+			continue
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if got, w := dst.RGBAAt(x, y), color.RGBAModel.Convert(want.At(x, y)); got != w {
+					t.Errorf("%s: pixel %d,%d is %v, want %v", file, x, y, got, w)
+					continue files
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package rfx
+
+/**
+ * Dequantization and inverse discrete wavelet transform of a 64x64 tile. The
+ * coefficients are laid out as HL1, LH1, HH1, HL2, LH2, HH2, HL3, LH3, HH3, LL3.
+ * @see MS-RDPRFX 3.1.8.1.4 Discrete Wavelet Transform
+ */
+
+// Quant are the quantization factors of a tileset, in the order of the wire
+type Quant struct {
+	LL3, LH3, HL3, HH3, LH2, HL2, HH2, LH1, HL1, HH1 uint8
+}
+
+// parseQuant reads the 5 bytes of TS_RFX_CODEC_QUANT, the low nibble first
+func parseQuant(b []byte) Quant {
+	n := func(i int) uint8 {
+		if i&1 == 0 {
+			return b[i/2] & 0x0f
+		}
+		return b[i/2] >> 4
+	}
+	return Quant{n(0), n(1), n(2), n(3), n(4), n(5), n(6), n(7), n(8), n(9)}
+}
+
+// dequantize scales the bands of c by their factors
+func dequantize(c []int16, q Quant) {
+	bands := []struct {
+		offset, size int
+		factor       uint8
+	}{
+		{0, 1024, q.HL1}, {1024, 1024, q.LH1}, {2048, 1024, q.HH1},
+		{3072, 256, q.HL2}, {3328, 256, q.LH2}, {3584, 256, q.HH2},
+		{3840, 64, q.HL3}, {3904, 64, q.LH3}, {3968, 64, q.HH3},
+		{4032, 64, q.LL3},
+	}
+	for _, b := range bands {
+		if b.factor <= 1 {
+			continue
+		}
+		shift := uint(b.factor - 1)
+		for i := b.offset; i < b.offset+b.size; i++ {
+			c[i] <<= shift
+		}
+	}
+}
+
+// differentialDecode undoes the deltas of the LL3 band
+func differentialDecode(c []int16) {
+	for i := 1; i < len(c); i++ {
+		c[i] += c[i-1]
+	}
+}
+
+// idwt2D reconstructs the tile in place from the three levels of sub-bands
+func idwt2D(c, tmp []int16) {
+	idwtBlock(c[3840:], tmp, 8)
+	idwtBlock(c[3072:], tmp, 16)
+	idwtBlock(c[0:], tmp, 32)
+}
+
+// idwtBlock merges the HL, LH, HH and LL bands of width w into a block of 2w
+func idwtBlock(c, tmp []int16, w int) {
+	hl, lh, hh, ll := c[0:w*w], c[w*w:2*w*w], c[2*w*w:3*w*w], c[3*w*w:4*w*w]
+	l, h := tmp[0:2*w*w], tmp[2*w*w:4*w*w]
+	idwtHoriz(ll, hl, l, w)
+	idwtHoriz(lh, hh, h, w)
+	idwtVert(l, h, c, w)
+}
+
+func idwtHoriz(l, h, dst []int16, w int) {
+	for y := 0; y < w; y++ {
+		lr, hr, dr := l[y*w:(y+1)*w], h[y*w:(y+1)*w], dst[y*2*w:(y+1)*2*w]
+		for n := 0; n < w; n++ {
+			prev := hr[max(n-1, 0)]
+			dr[2*n] = int16(int32(lr[n]) - ((int32(prev) + int32(hr[n]) + 1) >> 1))
+		}
+		for n := 0; n < w-1; n++ {
+			dr[2*n+1] = int16(int32(hr[n])<<1 + ((int32(dr[2*n]) + int32(dr[2*n+2])) >> 1))
+		}
+		dr[2*w-1] = int16(int32(hr[w-1])<<1 + int32(dr[2*w-2]))
+	}
+}
+
+func idwtVert(l, h, dst []int16, w int) {
+	width := 2 * w
+	for n := 0; n < w; n++ {
+		prev := max(n-1, 0)
+		for x := 0; x < width; x++ {
+			dst[2*n*width+x] = int16(int32(l[n*width+x]) - ((int32(h[prev*width+x]) + int32(h[n*width+x]) + 1) >> 1))
+		}
+	}
+	for n := 0; n < w; n++ {
+		for x := 0; x < width; x++ {
+			even := int32(dst[2*n*width+x])
+			next := even
+			if n < w-1 {
+				next = int32(dst[(2*n+2)*width+x])
+			}
+			dst[(2*n+1)*width+x] = int16(int32(h[n*width+x])<<1 + ((even + next) >> 1))
+		}
+	}
+}
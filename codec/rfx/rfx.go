@@ -0,0 +1,281 @@
+// Package rfx decodes the RemoteFX codec of the surface bits commands.
+package rfx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/sergei-bronnikov/grdp/codec"
+	"github.com/sergei-bronnikov/grdp/core"
+)
+
+/**
+ * @see MS-RDPRFX 2.2.2 Message Syntax
+ */
+const (
+	WBT_SYNC           = 0xCCC0
+	WBT_CODEC_VERSIONS = 0xCCC1
+	WBT_CHANNELS       = 0xCCC2
+	WBT_CONTEXT        = 0xCCC3
+	WBT_FRAME_BEGIN    = 0xCCC4
+	WBT_FRAME_END      = 0xCCC5
+	WBT_REGION         = 0xCCC6
+	WBT_EXTENSION      = 0xCCC7
+	CBT_REGION         = 0xCAC1
+	CBT_TILESET        = 0xCAC2
+	CBT_TILE           = 0xCAC3
+)
+
+const (
+	CBY_CAPS           = 0xCBC0
+	CBY_CAPSET         = 0xCBC1
+	CLY_CAPSET         = 0xCFC0
+	CLW_VERSION_1_0    = 0x0100
+	CT_TILE_64x64      = 0x0040
+	CLW_COL_CONV_ICT   = 0x1
+	CLW_XFORM_DWT_53_A = 0x1
+	// CARDP_CAPS_CAPTURE_NON_CAC lets the server use other codecs for the content RemoteFX is not good at
+	CARDP_CAPS_CAPTURE_NON_CAC = 0x00000001
+)
+
+// TileSize is the width and height of the tiles
+const TileSize = 64
+
+// GUID is CODEC_GUID_REMOTEFX of the Bitmap Codecs capability
+var GUID = [16]byte{0x12, 0x2f, 0x77, 0x76, 0x72, 0xbd, 0x63, 0x44, 0xaf, 0xb3, 0xb7, 0x3c, 0x9c, 0x6f, 0x78, 0x86}
+
+// CODEC_ID is the id the client assigns to RemoteFX
+const CODEC_ID = 0x03
+
+var errTruncated = errors.New("rfx: truncated message")
+
+func init() {
+	codec.Register(codec.Codec{
+		Name:       "RemoteFX",
+		GUID:       GUID,
+		ID:         CODEC_ID,
+		Properties: ClientProperties,
+		NewDecoder: func() codec.Decoder { return NewDecoder() },
+	})
+}
+
+// ClientProperties is the TS_RFX_CLNT_CAPS_CONTAINER of the client, it accepts both entropy algorithms
+func ClientProperties() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(49, buff)
+	core.WriteUInt32LE(CARDP_CAPS_CAPTURE_NON_CAC, buff)
+	core.WriteUInt32LE(37, buff)
+	// TS_RFX_CAPS
+	core.WriteUInt16LE(CBY_CAPS, buff)
+	core.WriteUInt32LE(8, buff)
+	core.WriteUInt16LE(1, buff)
+	// TS_RFX_CAPSET
+	core.WriteUInt16LE(CBY_CAPSET, buff)
+	core.WriteUInt32LE(29, buff)
+	core.WriteUInt8(1, buff)
+	core.WriteUInt16LE(CLY_CAPSET, buff)
+	core.WriteUInt16LE(2, buff)
+	core.WriteUInt16LE(8, buff)
+	for _, entropy := range []uint8{CLW_ENTROPY_RLGR1, CLW_ENTROPY_RLGR3} {
+		// TS_RFX_ICAP in video mode
+		core.WriteUInt16LE(CLW_VERSION_1_0, buff)
+		core.WriteUInt16LE(CT_TILE_64x64, buff)
+		core.WriteUInt8(0, buff)
+		core.WriteUInt8(CLW_COL_CONV_ICT, buff)
+		core.WriteUInt8(CLW_XFORM_DWT_53_A, buff)
+		core.WriteUInt8(entropy, buff)
+	}
+	return buff.Bytes()
+}
+
+// Decoder decodes the messages of a RemoteFX stream, the first one carries the
+// context the next ones rely on
+type Decoder struct {
+	entropy int
+	rects   []image.Rectangle
+	coeffs  [3][TileSize * TileSize]int16
+	tmp     [TileSize * TileSize]int16
+	tile    *image.RGBA
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		entropy: CLW_ENTROPY_RLGR1,
+		tile:    image.NewRGBA(image.Rect(0, 0, TileSize, TileSize)),
+	}
+}
+
+// Decode paints the tiles of a message of width x height at the point at of dst and
+// returns the areas it updated
+func (d *Decoder) Decode(data []byte, width, height int, dst *image.RGBA, at image.Point) ([]image.Rectangle, error) {
+	var updated []image.Rectangle
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return updated, errTruncated
+		}
+		blockType := binary.LittleEndian.Uint16(data)
+		blockLen := int(binary.LittleEndian.Uint32(data[2:]))
+		if blockLen < 6 || blockLen > len(data) {
+			return updated, errTruncated
+		}
+		block := data[6:blockLen]
+		data = data[blockLen:]
+		// the blocks of the codec carry its id and a channel
+		if blockType >= WBT_CONTEXT && blockType <= WBT_EXTENSION {
+			if len(block) < 2 {
+				return updated, errTruncated
+			}
+			block = block[2:]
+		}
+
+		var err error
+		switch blockType {
+		case WBT_SYNC, WBT_CODEC_VERSIONS, WBT_CHANNELS, WBT_FRAME_BEGIN, WBT_FRAME_END:
+		case WBT_CONTEXT:
+			err = d.readContext(block)
+		case WBT_REGION:
+			err = d.readRegion(block, width, height)
+		case WBT_EXTENSION:
+			err = d.readTileset(block, dst, at)
+			for _, r := range d.rects {
+				updated = append(updated, r.Add(at).Intersect(dst.Rect))
+			}
+		default:
+			err = fmt.Errorf("rfx: unknown block 0x%04x", blockType)
+		}
+		if err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+func (d *Decoder) readContext(b []byte) error {
+	if len(b) < 5 {
+		return errTruncated
+	}
+	properties := binary.LittleEndian.Uint16(b[3:])
+	d.entropy = int(properties>>9) & 0x0f
+	return nil
+}
+
+// readRegion keeps the rectangles the next tileset updates, none means the whole message
+func (d *Decoder) readRegion(b []byte, width, height int) error {
+	if len(b) < 3 {
+		return errTruncated
+	}
+	n := int(binary.LittleEndian.Uint16(b[1:]))
+	b = b[3:]
+	if len(b) < n*8 {
+		return errTruncated
+	}
+	d.rects = d.rects[:0]
+	for i := 0; i < n; i++ {
+		x, y := int(binary.LittleEndian.Uint16(b)), int(binary.LittleEndian.Uint16(b[2:]))
+		w, h := int(binary.LittleEndian.Uint16(b[4:])), int(binary.LittleEndian.Uint16(b[6:]))
+		d.rects = append(d.rects, image.Rect(x, y, x+w, y+h))
+		b = b[8:]
+	}
+	if n == 0 {
+		d.rects = append(d.rects, image.Rect(0, 0, width, height))
+	}
+	return nil
+}
+
+func (d *Decoder) readTileset(b []byte, dst *image.RGBA, at image.Point) error {
+	if len(b) < 14 {
+		return errTruncated
+	}
+	if binary.LittleEndian.Uint16(b) != CBT_TILESET {
+		return errors.New("rfx: unknown extension")
+	}
+	properties := binary.LittleEndian.Uint16(b[4:])
+	entropy := int(properties>>10) & 0x0f
+	if entropy == 0 {
+		entropy = d.entropy
+	}
+	numQuant := int(b[6])
+	numTiles := int(binary.LittleEndian.Uint16(b[8:]))
+	b = b[14:]
+	if len(b) < numQuant*5 {
+		return errTruncated
+	}
+	quants := make([]Quant, numQuant)
+	for i := range quants {
+		quants[i] = parseQuant(b[i*5:])
+	}
+	b = b[numQuant*5:]
+
+	for i := 0; i < numTiles; i++ {
+		if len(b) < 19 {
+			return errTruncated
+		}
+		blockLen := int(binary.LittleEndian.Uint32(b[2:]))
+		if binary.LittleEndian.Uint16(b) != CBT_TILE || blockLen < 19 || blockLen > len(b) {
+			return errTruncated
+		}
+		tile := b[6:blockLen]
+		b = b[blockLen:]
+		qy, qcb, qcr := int(tile[0]), int(tile[1]), int(tile[2])
+		if qy >= numQuant || qcb >= numQuant || qcr >= numQuant {
+			return errors.New("rfx: unknown quantization")
+		}
+		xIdx, yIdx := int(binary.LittleEndian.Uint16(tile[3:])), int(binary.LittleEndian.Uint16(tile[5:]))
+		yLen, cbLen, crLen := int(binary.LittleEndian.Uint16(tile[7:])), int(binary.LittleEndian.Uint16(tile[9:])), int(binary.LittleEndian.Uint16(tile[11:]))
+		planes := tile[13:]
+		if len(planes) < yLen+cbLen+crLen {
+			return errTruncated
+		}
+		d.decodeComponent(entropy, planes[:yLen], quants[qy], d.coeffs[0][:])
+		d.decodeComponent(entropy, planes[yLen:yLen+cbLen], quants[qcb], d.coeffs[1][:])
+		d.decodeComponent(entropy, planes[yLen+cbLen:yLen+cbLen+crLen], quants[qcr], d.coeffs[2][:])
+		ycbcrToRGBA(d.coeffs[0][:], d.coeffs[1][:], d.coeffs[2][:], d.tile.Pix)
+		d.paintTile(dst, at, image.Pt(xIdx*TileSize, yIdx*TileSize))
+	}
+	return nil
+}
+
+func (d *Decoder) decodeComponent(entropy int, data []byte, q Quant, c []int16) {
+	rlgrDecode(entropy, data, c)
+	differentialDecode(c[4032:])
+	dequantize(c, q)
+	idwt2D(c, d.tmp[:])
+}
+
+// paintTile copies the parts of the decoded tile at p inside the rectangles of the region
+func (d *Decoder) paintTile(dst *image.RGBA, at, p image.Point) {
+	tile := image.Rect(0, 0, TileSize, TileSize).Add(p)
+	for _, r := range d.rects {
+		r = r.Intersect(tile).Add(at).Intersect(dst.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			sx, sy := r.Min.X-at.X-p.X, y-at.Y-p.Y
+			copy(dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)], d.tile.Pix[d.tile.PixOffset(sx, sy):])
+		}
+	}
+}
+
+// ycbcrToRGBA converts the coefficients, fixed point numbers with 5 fractional bits
+// and Y centered on 0
+func ycbcrToRGBA(y, cb, cr []int16, pix []byte) {
+	for i := range y {
+		yv := (int64(y[i]) + 4096) << 16
+		cbv, crv := int64(cb[i]), int64(cr[i])
+		r := int16((yv+crv*91916)>>16) >> 5
+		g := int16((yv-cbv*22527-crv*46819)>>16) >> 5
+		b := int16((yv+cbv*115992)>>16) >> 5
+		pix[i*4], pix[i*4+1], pix[i*4+2], pix[i*4+3] = clamp(r), clamp(g), clamp(b), 0xff
+	}
+}
+
+func clamp(v int16) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
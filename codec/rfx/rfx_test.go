@@ -0,0 +1,178 @@
+package rfx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n&7 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.n&7))
+		w.n++
+	}
+}
+
+func (w *bitWriter) grCode(krp *int, v uint32) {
+	kr := *krp >> lsgr
+	vk := int(v >> uint(kr))
+	for i := 0; i < vk; i++ {
+		w.bits(1, 1)
+	}
+	w.bits(0, 1)
+	w.bits(v&(1<<uint(kr)-1), kr)
+	if vk == 0 {
+		*krp = max(*krp-2, 0)
+	} else if vk > 1 {
+		*krp = min(*krp+vk, kpMax)
+	}
+}
+
+func fold(v int16) uint32 {
+	if v < 0 {
+		return uint32(-v)*2 - 1
+	}
+	return uint32(v) * 2
+}
+
+// rlgrEncode follows the encoder of the specification, data must not end with zeros
+func rlgrEncode(mode int, data []int16) []byte {
+	w := &bitWriter{}
+	kp, krp := 1<<lsgr, 1<<lsgr
+	k := kp >> lsgr
+	for i := 0; i < len(data); {
+		if k != 0 {
+			zeros := 0
+			for ; data[i] == 0; i++ {
+				zeros++
+			}
+			for zeros >= 1<<uint(k) {
+				w.bits(0, 1)
+				zeros -= 1 << uint(k)
+				kp = min(kp+upGR, kpMax)
+				k = kp >> lsgr
+			}
+			w.bits(1, 1)
+			w.bits(uint32(zeros), k)
+			v := data[i]
+			i++
+			mag := uint32(v)
+			if v < 0 {
+				w.bits(1, 1)
+				mag = uint32(-v)
+			} else {
+				w.bits(0, 1)
+			}
+			w.grCode(&krp, mag-1)
+			kp = max(kp-dnGR, 0)
+			k = kp >> lsgr
+			continue
+		}
+		if mode == CLW_ENTROPY_RLGR1 {
+			v := fold(data[i])
+			i++
+			w.grCode(&krp, v)
+			if v == 0 {
+				kp = min(kp+uqGR, kpMax)
+			} else {
+				kp = max(kp-dqGR, 0)
+			}
+			k = kp >> lsgr
+			continue
+		}
+		v1, v2 := fold(data[i]), uint32(0)
+		if i+1 < len(data) {
+			v2 = fold(data[i+1])
+		}
+		i += 2
+		w.grCode(&krp, v1+v2)
+		w.bits(v1, bits.Len32(v1+v2))
+		if v1 != 0 && v2 != 0 {
+			kp = max(kp-2*dqGR, 0)
+		} else if v1 == 0 && v2 == 0 {
+			kp = min(kp+2*uqGR, kpMax)
+		}
+		k = kp >> lsgr
+	}
+	return w.data
+}
+
+func TestRLGR(t *testing.T) {
+	in := make([]int16, 4096)
+	for i := range in {
+		switch {
+		case i%97 == 0:
+			in[i] = int16(i%13) - 6
+		case i > 3000:
+			in[i] = int16(i%7) - 3
+		}
+	}
+	in[len(in)-1] = 5
+	for _, mode := range []int{CLW_ENTROPY_RLGR1, CLW_ENTROPY_RLGR3} {
+		out := make([]int16, len(in))
+		rlgrDecode(mode, rlgrEncode(mode, in), out)
+		for i := range in {
+			if in[i] != out[i] {
+				t.Fatalf("mode %d coefficient %d: %d, want %d", mode, i, out[i], in[i])
+			}
+		}
+	}
+}
+
+func block(blockType uint16, channel bool, body []byte) []byte {
+	b := &bytes.Buffer{}
+	n := 6 + len(body)
+	if channel {
+		n += 2
+	}
+	binary.Write(b, binary.LittleEndian, blockType)
+	binary.Write(b, binary.LittleEndian, uint32(n))
+	if channel {
+		b.Write([]byte{1, 0})
+	}
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestDecodeFlatTile(t *testing.T) {
+	region := []byte{0x01, 1, 0, 70, 0, 0, 0, 20, 0, 8, 0, 0xc1, 0xca, 1, 0}
+	// an empty tile has every coefficient at 0, it is mid gray
+	tile := block(CBT_TILE, false, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	tileset := []byte{0xc2, 0xca, 0, 0, 0x01 << 1, 0x01, 1, 0x40, 1, 0}
+	tileset = binary.LittleEndian.AppendUint32(tileset, uint32(len(tile)))
+	tileset = append(tileset, 0x66, 0x66, 0x77, 0x88, 0x98)
+	tileset = append(tileset, tile...)
+
+	var msg []byte
+	msg = append(msg, block(WBT_FRAME_BEGIN, true, []byte{0, 0, 0, 0, 1, 0})...)
+	msg = append(msg, block(WBT_REGION, true, region)...)
+	msg = append(msg, block(WBT_EXTENSION, true, tileset)...)
+	msg = append(msg, block(WBT_FRAME_END, true, nil)...)
+
+	dst := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	rects, err := NewDecoder().Decode(msg, 128, 64, dst, image.Pt(30, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rects) != 1 || rects[0] != image.Rect(100, 4, 120, 12) {
+		t.Fatal("updated", rects)
+	}
+	gray := color.RGBA{128, 128, 128, 255}
+	if got := dst.RGBAAt(110, 4); got != gray {
+		t.Error("inside", got)
+	}
+	if got := dst.RGBAAt(110, 12); got.A != 0 {
+		t.Error("outside of the region", got)
+	}
+}
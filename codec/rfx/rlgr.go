@@ -0,0 +1,142 @@
+package rfx
+
+import "math/bits"
+
+/**
+ * Adaptive run-length Golomb-Rice entropy coding of the coefficients
+ * @see MS-RDPRFX 3.1.8.1.7.3 RLGR1/RLGR3 Pseudocode
+ */
+
+// entropy algorithms of the context and tileset properties
+const (
+	CLW_ENTROPY_RLGR1 = 0x01
+	CLW_ENTROPY_RLGR3 = 0x04
+)
+
+const (
+	kpMax = 80
+	lsgr  = 3
+	upGR  = 4
+	dnGR  = 6
+	uqGR  = 3
+	dqGR  = 3
+)
+
+// bitReader reads data from the most significant bit, past its end it reads zeros
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) left() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data)*8 {
+		return 0
+	}
+	b := uint32(r.data[r.pos>>3]>>(7-uint(r.pos&7))) & 1
+	r.pos++
+	return b
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// grCode reads a Golomb-Rice code of parameter kr and adapts it
+func (r *bitReader) grCode(kr, krp *int) uint32 {
+	vk := 0
+	for r.left() > 0 && r.bit() == 1 {
+		vk++
+	}
+	code := uint32(vk)<<uint(*kr) | r.bits(*kr)
+	if vk == 0 {
+		*krp = max(*krp-2, 0)
+	} else if vk != 1 {
+		*krp = min(*krp+vk, kpMax)
+	}
+	*kr = *krp >> lsgr
+	return code
+}
+
+// twoMagSign decodes the magnitude and sign folded by 2*|v| - sign
+func twoMagSign(v uint32) int16 {
+	if v&1 != 0 {
+		return -int16((v + 1) >> 1)
+	}
+	return int16(v >> 1)
+}
+
+// rlgrDecode fills out with the coefficients of data, the ones missing are 0
+func rlgrDecode(mode int, data []byte, out []int16) {
+	r := &bitReader{data: data}
+	kp, krp := 1<<lsgr, 1<<lsgr
+	k, kr := kp>>lsgr, krp>>lsgr
+	n := 0
+	for n < len(out) && r.left() > 0 {
+		if k != 0 {
+			// run-length mode, every 0 bit is a run of 1<<k zeros
+			run := 0
+			for r.left() > 0 && r.bit() == 0 {
+				run += 1 << uint(k)
+				kp = min(kp+upGR, kpMax)
+				k = kp >> lsgr
+			}
+			run += int(r.bits(k))
+			sign := r.bit()
+			mag := int16(r.grCode(&kr, &krp) + 1)
+			kp = max(kp-dnGR, 0)
+			k = kp >> lsgr
+			for ; run > 0 && n < len(out); run-- {
+				out[n] = 0
+				n++
+			}
+			if n < len(out) {
+				if sign != 0 {
+					mag = -mag
+				}
+				out[n] = mag
+				n++
+			}
+			continue
+		}
+
+		code := r.grCode(&kr, &krp)
+		if mode == CLW_ENTROPY_RLGR1 {
+			if code == 0 {
+				kp = min(kp+uqGR, kpMax)
+			} else {
+				kp = max(kp-dqGR, 0)
+			}
+			k = kp >> lsgr
+			out[n] = twoMagSign(code)
+			n++
+			continue
+		}
+
+		// RLGR3 codes the sum of two values then the first one
+		val1 := r.bits(bits.Len32(code))
+		val2 := code - val1
+		if val1 != 0 && val2 != 0 {
+			kp = max(kp-2*dqGR, 0)
+		} else if val1 == 0 && val2 == 0 {
+			kp = min(kp+2*uqGR, kpMax)
+		}
+		k = kp >> lsgr
+		out[n] = twoMagSign(val1)
+		n++
+		if n < len(out) {
+			out[n] = twoMagSign(val2)
+			n++
+		}
+	}
+	for ; n < len(out); n++ {
+		out[n] = 0
+	}
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+ * Errors reported by the layers of the rdp stack while the connection
+ * sequence is running
+ */
+var (
+	// ErrAuthFailed is reported when the server rejects the NLA credentials
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrAccessDenied is reported when the server denies the user in the
+	// early user authorization result, after NLA succeeded
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrRestrictedAdmin is reported when the server does not confirm the
+	// restricted admin mode requested by the client
+	ErrRestrictedAdmin = errors.New("restricted admin mode is not supported by the server")
+
+	// ErrProtocolDowngrade is reported when the server selects a security
+	// protocol the client did not request
+	ErrProtocolDowngrade = errors.New("server selected a security protocol that was not requested")
+
+	// ErrCertificateMismatch is reported when a known host presents another public key
+	ErrCertificateMismatch = errors.New("server certificate does not match the known host")
+
+	// ErrLicense is reported when the licensing sequence is aborted by the server
+	ErrLicense = errors.New("licensing failed")
+
+	// ErrActivation is reported when the capability exchange cannot be completed
+	ErrActivation = errors.New("activation failed")
+
+	// ErrConnectionClosed is reported when the transport closes before the session is ready
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// ErrNegotiationFailure is reported when the server answers the X.224
+// connection request with an RDP_NEG_FAILURE.
+// @see http://msdn.microsoft.com/en-us/library/cc240507.aspx
+type ErrNegotiationFailure struct {
+	Code uint32
+}
+
+func (e ErrNegotiationFailure) Error() string {
+	return fmt.Sprintf("x224 negotiation failure with code %d", e.Code)
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SPKIHash returns the SHA-256 of the certificate SubjectPublicKeyInfo as
+// sha256/<base64>, it stays the same when the certificate is renewed with the same key
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// KnownHosts is a trust on first use store of the server public keys, each
+// line of the file holds a host:port and its SPKIHash
+type KnownHosts struct {
+	path  string
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+// NewKnownHosts loads the store from path, a missing file is created on the
+// first new host and an empty path keeps the store in memory
+func NewKnownHosts(path string) (*KnownHosts, error) {
+	k := &KnownHosts{
+		path:  path,
+		hosts: make(map[string]string),
+	}
+	if path == "" {
+		return k, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		k.hosts[fields[0]] = fields[1]
+	}
+	return k, nil
+}
+
+// Verify trusts and records the key of an unknown host, it returns
+// ErrCertificateMismatch when a known host presents another key
+func (k *KnownHosts) Verify(hostPort string, cert *x509.Certificate) error {
+	return k.VerifyFunc(hostPort, cert, nil)
+}
+
+// VerifyFunc is Verify followed by trust when the key is not rejected, an
+// unknown host is only recorded once trust accepts it. The store stays locked
+// meanwhile, so concurrent connections to the same host cannot record another
+// key between the check and the record.
+func (k *KnownHosts) VerifyFunc(hostPort string, cert *x509.Certificate, trust func() error) error {
+	hash := SPKIHash(cert)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	known, ok := k.hosts[hostPort]
+	if ok && known != hash {
+		return fmt.Errorf("%w: %s presents %s, expected %s", ErrCertificateMismatch, hostPort, hash, known)
+	}
+	if trust != nil {
+		if err := trust(); err != nil {
+			return err
+		}
+	}
+	if ok {
+		return nil
+	}
+	k.hosts[hostPort] = hash
+	if k.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", hostPort, hash)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Lookup returns the key recorded for hostPort, a nil store knows no host
+func (k *KnownHosts) Lookup(hostPort string) (string, bool) {
+	if k == nil {
+		return "", false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	hash, ok := k.hosts[hostPort]
+	return hash, ok
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	a := &x509.Certificate{RawSubjectPublicKeyInfo: []byte{1}}
+	b := &x509.Certificate{RawSubjectPublicKeyInfo: []byte{2}}
+
+	k, err := NewKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Verify("host:3389", a); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = NewKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Verify("host:3389", a); err != nil {
+		t.Error("known key", err)
+	}
+	if err := k.Verify("host:3389", b); !errors.Is(err, ErrCertificateMismatch) {
+		t.Error("changed key", err)
+	}
+	if err := k.Verify("host:3390", b); err != nil {
+		t.Error("other port", err)
+	}
+}
+
+func TestKnownHostsVerifyFunc(t *testing.T) {
+	k, _ := NewKnownHosts("")
+	a := &x509.Certificate{RawSubjectPublicKeyInfo: []byte{1}}
+	b := &x509.Certificate{RawSubjectPublicKeyInfo: []byte{2}}
+	rejected := errors.New("rejected")
+
+	if err := k.VerifyFunc("host:3389", a, func() error { return rejected }); !errors.Is(err, rejected) {
+		t.Error("rejected", err)
+	}
+	if _, ok := k.Lookup("host:3389"); ok {
+		t.Error("rejected key recorded")
+	}
+	calls := 0
+	trust := func() error { calls++; return nil }
+	if err := k.VerifyFunc("host:3389", a, trust); err != nil {
+		t.Error("first use", err)
+	}
+	if err := k.VerifyFunc("host:3389", a, trust); err != nil || calls != 2 {
+		t.Error("known key", err, calls)
+	}
+	if err := k.VerifyFunc("host:3389", b, trust); !errors.Is(err, ErrCertificateMismatch) || calls != 2 {
+		t.Error("changed key", err, calls)
+	}
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/asn1"
 	"math/big"
 
@@ -13,6 +14,10 @@ import (
 type SocketLayer struct {
 	conn    net.Conn
 	tlsConn *tls.Conn
+	// client side TLS settings, the certificate is not verified when nil
+	tlsConfig *tls.Config
+	// certificate presented when acting as a server
+	localCert *x509.Certificate
 }
 
 func NewSocketLayer(conn net.Conn) *SocketLayer {
@@ -47,17 +52,45 @@ func (s *SocketLayer) Close() error {
 	return s.conn.Close()
 }
 
+// SetTLSConfig sets the settings used by StartTLS, ServerName must be set
+// unless the chain is only checked by VerifyConnection or VerifyPeerCertificate
+func (s *SocketLayer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
 func (s *SocketLayer) StartTLS() error {
-	config := &tls.Config{
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS12,
-		MaxVersion:         tls.VersionTLS12,
-		//		MaxVersion:               tls.VersionTLS13,
+	config := s.tlsConfig
+	if config == nil {
+		config = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	if config.MinVersion == 0 {
+		config = config.Clone()
+		config.MinVersion = tls.VersionTLS12
 	}
 	s.tlsConn = tls.Client(s.conn, config)
 	return s.tlsConn.Handshake()
 }
 
+// StartServerTLS answers the client TLS handshake with the certificate of config
+func (s *SocketLayer) StartServerTLS(config *tls.Config) error {
+	if config == nil || len(config.Certificates) == 0 {
+		return errors.New("TLS server certificate does not exist")
+	}
+	cert := config.Certificates[0].Leaf
+	if cert == nil {
+		var err error
+		cert, err = x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	s.localCert = cert
+	s.tlsConn = tls.Server(s.conn, config)
+	return s.tlsConn.Handshake()
+}
+
 type PublicKey struct {
 	N *big.Int `asn1:"explicit,tag:0"` // modulus
 	E int      `asn1:"explicit,tag:1"` // public exponent
@@ -67,6 +100,13 @@ func (s *SocketLayer) TlsPubKey() ([]byte, error) {
 	if s.tlsConn == nil {
 		return nil, errors.New("TLS conn does not exist")
 	}
-	pub := s.tlsConn.ConnectionState().PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+	cert := s.localCert
+	if cert == nil {
+		cert = s.tlsConn.ConnectionState().PeerCertificates[0]
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("TLS public key is not RSA")
+	}
 	return asn1.Marshal(*pub)
 }
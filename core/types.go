@@ -12,6 +12,8 @@ type Transport interface {
 	Emit(event interface{}, arguments ...interface{}) *emission.Emitter
 }
 
+// secFlag of the fast-path layers holds the security flags in its two low bits,
+// the input PDUs carry their number of events in bits 2 to 5
 type FastPathListener interface {
 	RecvFastPath(secFlag byte, s []byte)
 }
@@ -0,0 +1,17 @@
+package grdp
+
+import "github.com/sergei-bronnikov/grdp/core"
+
+// Errors returned by ConnectContext, see core for their meaning
+type ErrNegotiationFailure = core.ErrNegotiationFailure
+
+var (
+	ErrAuthFailed          = core.ErrAuthFailed
+	ErrAccessDenied        = core.ErrAccessDenied
+	ErrRestrictedAdmin     = core.ErrRestrictedAdmin
+	ErrProtocolDowngrade   = core.ErrProtocolDowngrade
+	ErrCertificateMismatch = core.ErrCertificateMismatch
+	ErrLicense             = core.ErrLicense
+	ErrActivation          = core.ErrActivation
+	ErrConnectionClosed    = core.ErrConnectionClosed
+)
@@ -0,0 +1,429 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"sync"
+
+	"github.com/sergei-bronnikov/grdp/codec"
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/emission"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+// Pointer is the mouse cursor set by the server
+type Pointer struct {
+	Visible bool
+	// Image is nil for the default pointer of the system
+	Image   *image.RGBA
+	Hotspot image.Point
+	// Position is only known when the server moved the pointer itself
+	Position image.Point
+}
+
+// Framebuffer is the desktop of a session, it applies every update sent by the server
+type Framebuffer struct {
+	mu           sync.Mutex
+	img          *image.RGBA
+	palette      [256]color.RGBA
+	pointer      Pointer
+	pointers     map[uint16]Pointer
+	bitmaps      *bitmapCache
+	glyphs       *glyphCache
+	codecs       *codec.Set
+	bitsPerPixel func() int
+	onDirty      []func(image.Rectangle)
+	onPointer    []func(Pointer)
+}
+
+type updateSource interface {
+	On(event, listener interface{}) *emission.Emitter
+}
+
+// NewFramebuffer paints the updates of g. It is attached to every connection of g,
+// created on a connected session it asks the server to repaint the whole desktop.
+func NewFramebuffer(g *RdpClient) *Framebuffer {
+	f := newFramebuffer(g.Width(), g.Height(), func() int {
+		return g.pdu.BitsPerPixel()
+	})
+	g.framebuffer = f
+	if g.pdu != nil {
+		f.attach(g)
+		if g.eventReady {
+			g.pdu.SendRefreshRect(image.Rect(0, 0, g.Width(), g.Height()))
+		}
+	}
+	return f
+}
+
+// attach subscribes f to the layers of the current connection of g
+func (f *Framebuffer) attach(g *RdpClient) {
+	f.mu.Lock()
+	f.codecs = codec.NewSet(g.pdu.ServerBitmapCodecs())
+	if g.bitmaps != nil {
+		f.bitmaps = g.bitmaps
+	}
+	f.mu.Unlock()
+	// the codecs of the server are only known once it is activated
+	g.pdu.On("ready", func() {
+		f.mu.Lock()
+		f.codecs = codec.NewSet(g.pdu.ServerBitmapCodecs())
+		f.mu.Unlock()
+	})
+	f.subscribe(g.pdu)
+	if g.gfx != nil {
+		g.gfx.On("paint", f.applyGfxPaint)
+		g.gfx.On("reset", f.applyGfxReset)
+	}
+}
+
+func newFramebuffer(width, height int, bitsPerPixel func() int) *Framebuffer {
+	return &Framebuffer{
+		img:          image.NewRGBA(image.Rect(0, 0, width, height)),
+		pointer:      Pointer{Visible: true},
+		pointers:     make(map[uint16]Pointer),
+		bitmaps:      newBitmapCache(),
+		glyphs:       newGlyphCache(),
+		codecs:       codec.NewSet(nil),
+		bitsPerPixel: bitsPerPixel,
+	}
+}
+
+func (f *Framebuffer) subscribe(s updateSource) {
+	s.On("bitmap", f.applyBitmaps)
+	s.On("orders", f.applyOrders)
+	s.On("palette", f.applyPalette)
+	s.On("surface_bits", f.applySurfaceBits)
+	s.On("pointer_update", func(p *pdu.FastPathUpdatePointerPDU) {
+		f.cachePointer(p.CacheIdx, p.X, p.Y, int(p.XorBpp), p.Width, p.Height, p.Data, p.Mask)
+	})
+	s.On("color", func(p *pdu.FastPathColorPdu) {
+		f.cachePointer(p.CacheIdx, p.X, p.Y, 24, p.Width, p.Height, p.Data, p.Mask)
+	})
+	s.On("pointer_cached", func(idx uint16) {
+		f.setPointer(func(p *Pointer) {
+			if cached, ok := f.pointers[idx]; ok {
+				p.Image, p.Hotspot = cached.Image, cached.Hotspot
+			}
+			p.Visible = true
+		})
+	})
+	s.On("pointer_hide", func() {
+		f.setPointer(func(p *Pointer) {
+			p.Visible = false
+		})
+	})
+	s.On("pointer_default", func() {
+		f.setPointer(func(p *Pointer) {
+			p.Visible, p.Image, p.Hotspot = true, nil, image.Point{}
+		})
+	})
+	s.On("pointer_position", func(x, y uint16) {
+		f.setPointer(func(p *Pointer) {
+			p.Position = image.Pt(int(x), int(y))
+		})
+	})
+}
+
+// OnDirty is called with every area of the desktop repainted by an update
+func (f *Framebuffer) OnDirty(fn func(image.Rectangle)) *Framebuffer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onDirty = append(f.onDirty, fn)
+	return f
+}
+
+// OnPointer is called when the server changes the pointer
+func (f *Framebuffer) OnPointer(fn func(Pointer)) *Framebuffer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onPointer = append(f.onPointer, fn)
+	return f
+}
+
+// Snapshot returns a copy of the desktop
+func (f *Framebuffer) Snapshot() *image.RGBA {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img := image.NewRGBA(f.img.Rect)
+	copy(img.Pix, f.img.Pix)
+	return img
+}
+
+// Pointer returns the current pointer
+func (f *Framebuffer) Pointer() Pointer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pointer
+}
+
+// update runs paint under the lock and notifies the areas it returns
+func (f *Framebuffer) update(paint func() []image.Rectangle) {
+	f.mu.Lock()
+	dirty := paint()
+	listeners := f.onDirty
+	f.mu.Unlock()
+	for _, r := range dirty {
+		if r.Empty() {
+			continue
+		}
+		for _, fn := range listeners {
+			fn(r)
+		}
+	}
+}
+
+func (f *Framebuffer) setPointer(change func(*Pointer)) {
+	f.mu.Lock()
+	change(&f.pointer)
+	p := f.pointer
+	listeners := f.onPointer
+	f.mu.Unlock()
+	for _, fn := range listeners {
+		fn(p)
+	}
+}
+
+func (f *Framebuffer) applyBitmaps(rectangles []pdu.BitmapData) {
+	f.update(func() []image.Rectangle {
+		dirty := make([]image.Rectangle, 0, len(rectangles))
+		for _, v := range rectangles {
+			if v.Width == 0 || v.Height == 0 || v.DestRight < v.DestLeft || v.DestBottom < v.DestTop {
+				continue
+			}
+			src := f.decodeBitmap(v)
+			if src == nil {
+				continue
+			}
+			r := image.Rect(int(v.DestLeft), int(v.DestTop), int(v.DestRight)+1, int(v.DestBottom)+1).Intersect(f.img.Rect)
+			draw.Draw(f.img, r, src, image.Point{}, draw.Src)
+			dirty = append(dirty, r)
+		}
+		return dirty
+	})
+}
+
+func (f *Framebuffer) applyPalette(p *pdu.PaletteUpdateDataPDU) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, e := range p.Entries {
+		f.palette[i] = color.RGBA{e.Red, e.Green, e.Blue, 0xff}
+	}
+}
+
+func (f *Framebuffer) applyOrders(orders []pdu.OrderPdu) {
+	f.update(func() []image.Rectangle {
+		dirty := make([]image.Rectangle, 0, len(orders))
+		for _, o := range orders {
+			switch {
+			case o.Type == pdu.ORDER_SECONDARY && o.Secondary != nil:
+				f.applySecondary(o.Secondary)
+			case o.Type == pdu.ORDER_PRIMARY && o.Primary != nil && o.Primary.Data != nil:
+				dirty = append(dirty, f.applyPrimary(o))
+			}
+		}
+		return dirty
+	})
+}
+
+// cachedBitmap returns the cell idx of the bitmap cache id
+func (f *Framebuffer) cachedBitmap(id uint8, idx uint16) *image.RGBA {
+	return f.bitmaps.get(int(id), idx)
+}
+
+// applySecondary stores the bitmaps of the cache orders
+func (f *Framebuffer) applySecondary(s *pdu.Secondary) {
+	switch cb := s.Data.(type) {
+	case *pdu.CacheBitmapOrder:
+		img := f.decodeBitmap(cachedBitmapData(int(cb.BitmapWidth), int(cb.BitmapHeight), int(cb.BitmapBpp), cb.Compressed, cb.BitmapDataStream))
+		if img != nil {
+			f.bitmaps.put(int(cb.CacheId), cb.CacheIndex, 0, img)
+		}
+
+	case *pdu.CacheBitmapV2Order:
+		img := f.decodeBitmap(cachedBitmapData(int(cb.BitmapWidth), int(cb.BitmapHeight), int(cb.BitmapBpp), cb.Compressed, cb.BitmapDataStream))
+		var key uint64
+		if cb.Flags&pdu.CBR2_PERSISTENT_KEY_PRESENT != 0 {
+			key = cb.Key()
+		}
+		if img != nil {
+			f.bitmaps.put(int(cb.CacheId), uint16(cb.CacheIndex), key, img)
+		}
+
+	case *pdu.CacheGlyphOrder:
+		for i := range cb.Glyphs {
+			f.glyphs.put(cb.CacheId, &cb.Glyphs[i])
+		}
+
+	case *pdu.CacheBitmapV3Order:
+		b := cb.BitmapData
+		if b.CodecID != 0 {
+			slog.Debug("cached bitmap codec not supported", "codec", b.CodecID)
+			return
+		}
+		img := f.decodeBitmap(cachedBitmapData(int(b.Width), int(b.Height), int(b.Bpp), false, b.Data))
+		if img != nil {
+			f.bitmaps.put(int(cb.CacheId), cb.CacheIndex, cb.Key(), img)
+		}
+	}
+}
+
+func cachedBitmapData(width, height, bitsPerPixel int, compressed bool, data []byte) pdu.BitmapData {
+	b := pdu.BitmapData{
+		Width:            uint16(width),
+		Height:           uint16(height),
+		BitsPerPixel:     uint16(bitsPerPixel),
+		BitmapDataStream: data,
+	}
+	if compressed {
+		b.Flags = pdu.BITMAP_COMPRESSION
+	}
+	return b
+}
+
+// orderColor converts the color of an order, encoded in the depth of the session
+func (f *Framebuffer) orderColor(c [4]uint8) color.RGBA {
+	var r, g, b uint8
+	switch f.bitsPerPixel() {
+	case 8:
+		return f.palette[c[0]]
+	case 15:
+		r, g, b = core.RGB555ToRGB(uint16(c[0]) | uint16(c[1])<<8)
+	case 16:
+		r, g, b = core.RGB565ToRGB(uint16(c[0]) | uint16(c[1])<<8)
+	default:
+		r, g, b = c[0], c[1], c[2]
+	}
+	return color.RGBA{r, g, b, 0xff}
+}
+
+func bytesPerPixel(bitsPerPixel int) int {
+	return (bitsPerPixel + 7) / 8
+}
+
+// pixel reads the color at p, 15 and 16 bpp pixels are little endian unless bigEndian
+func (f *Framebuffer) pixel(bitsPerPixel int, p []byte, bigEndian bool) color.RGBA {
+	var r, g, b uint8
+	switch bitsPerPixel {
+	case 8:
+		return f.palette[p[0]]
+	case 15, 16:
+		v := uint16(p[0]) | uint16(p[1])<<8
+		if bigEndian {
+			v = core.Uint16BE(p[0], p[1])
+		}
+		if bitsPerPixel == 15 {
+			r, g, b = core.RGB555ToRGB(v)
+		} else {
+			r, g, b = core.RGB565ToRGB(v)
+		}
+	default:
+		r, g, b = p[2], p[1], p[0]
+	}
+	return color.RGBA{r, g, b, 0xff}
+}
+
+// decodeBitmap converts the pixels of v, raw bitmaps are stored bottom-up with padded rows
+// while core.Decompress returns the rows top-down with 16 bpp pixels in big endian
+func (f *Framebuffer) decodeBitmap(v pdu.BitmapData) *image.RGBA {
+	w, h := int(v.Width), int(v.Height)
+	bitsPerPixel := int(v.BitsPerPixel)
+	size := bytesPerPixel(bitsPerPixel)
+	if size == 0 || size > 4 {
+		slog.Warn("invalid bitmap color depth", "bpp", v.BitsPerPixel)
+		return nil
+	}
+	data := v.BitmapDataStream
+	stride := w * size
+	compressed := v.IsCompress()
+	if compressed {
+		data = core.Decompress(data, w, h, size)
+	} else if padded := (stride + 3) &^ 3; len(data) >= padded*h {
+		stride = padded
+	}
+	if len(data) < stride*(h-1)+w*size {
+		slog.Warn("short bitmap data", "len", len(data), "width", w, "height", h)
+		return nil
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := y
+		if !compressed {
+			row = h - 1 - y
+		}
+		line := data[row*stride:]
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, f.pixel(bitsPerPixel, line[x*size:], compressed))
+		}
+	}
+	return img
+}
+
+func (f *Framebuffer) cachePointer(idx, x, y uint16, xorBpp int, width, height uint16, xorMask, andMask []byte) {
+	f.mu.Lock()
+	img := f.pointerImage(xorBpp, int(width), int(height), xorMask, andMask)
+	f.pointers[idx] = Pointer{Image: img, Hotspot: image.Pt(int(x), int(y))}
+	f.mu.Unlock()
+	f.setPointer(func(p *Pointer) {
+		p.Visible, p.Image, p.Hotspot = true, img, image.Pt(int(x), int(y))
+	})
+}
+
+// pointerImage combines the masks of a pointer, the color ones are stored bottom-up.
+// Pixels cleared by the AND mask are opaque, set ones keep the screen unless the
+// XOR color inverts it, which is drawn as is. 32 bpp pointers carry their own alpha.
+// @see MS-RDPBCGR 2.2.9.1.1.4.4 Color Pointer Update
+func (f *Framebuffer) pointerImage(xorBpp, w, h int, xorMask, andMask []byte) *image.RGBA {
+	var xorStride int
+	switch xorBpp {
+	case 1:
+		xorStride = (w + 15) / 16 * 2
+	case 8, 15, 16, 24, 32:
+		// every scan line is padded to a multiple of 2 bytes
+		xorStride = (w*bytesPerPixel(xorBpp) + 1) / 2 * 2
+	default:
+		slog.Warn("unsupported pointer depth", "bpp", xorBpp)
+		return nil
+	}
+	andStride := (w + 15) / 16 * 2
+	hasAnd := len(andMask) >= andStride*h
+	if len(xorMask) < xorStride*h {
+		slog.Warn("short pointer data", "len", len(xorMask), "bpp", xorBpp)
+		return nil
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := y
+		if xorBpp != 1 {
+			row = h - 1 - y
+		}
+		xorLine := xorMask[row*xorStride:]
+		for x := 0; x < w; x++ {
+			transparent := hasAnd && andMask[row*andStride+x/8]&(0x80>>(x%8)) != 0
+			var c color.RGBA
+			switch xorBpp {
+			case 1:
+				if xorLine[x/8]&(0x80>>(x%8)) != 0 {
+					c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+				} else {
+					c = color.RGBA{0, 0, 0, 0xff}
+				}
+			case 32:
+				p := xorLine[x*4:]
+				img.Set(x, y, color.NRGBA{p[2], p[1], p[0], p[3]})
+				continue
+			default:
+				c = f.pixel(xorBpp, xorLine[x*bytesPerPixel(xorBpp):], false)
+			}
+			if transparent && c.R == 0 && c.G == 0 && c.B == 0 {
+				continue
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
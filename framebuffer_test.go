@@ -0,0 +1,169 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"net"
+	"testing"
+
+	"github.com/sergei-bronnikov/grdp/emission"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/x224"
+)
+
+func testFramebuffer(bitsPerPixel int) (*Framebuffer, *emission.Emitter) {
+	e := emission.NewEmitter()
+	f := newFramebuffer(16, 16, func() int { return bitsPerPixel })
+	f.subscribe(e)
+	return f, e
+}
+
+func TestFramebufferBitmap(t *testing.T) {
+	f, e := testFramebuffer(32)
+	var dirty []image.Rectangle
+	f.OnDirty(func(r image.Rectangle) { dirty = append(dirty, r) })
+
+	// 2x2 at 32 bpp, the bottom row first
+	e.Emit("bitmap", []pdu.BitmapData{{
+		DestLeft: 4, DestTop: 5, DestRight: 5, DestBottom: 6,
+		Width: 2, Height: 2, BitsPerPixel: 32,
+		BitmapDataStream: []byte{
+			0xff, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0xff, 0, 0, 0xff, 0, 0,
+		},
+	}})
+	img := f.Snapshot()
+	want := map[image.Point]color.RGBA{
+		{4, 5}: {0xff, 0, 0, 0xff},
+		{5, 5}: {0, 0xff, 0, 0xff},
+		{4, 6}: {0, 0, 0xff, 0xff},
+		{5, 6}: {0, 0, 0, 0xff},
+	}
+	for p, c := range want {
+		if got := img.RGBAAt(p.X, p.Y); got != c {
+			t.Errorf("pixel %v: %v, want %v", p, got, c)
+		}
+	}
+	if len(dirty) != 1 || dirty[0] != image.Rect(4, 5, 6, 7) {
+		t.Error("dirty", dirty)
+	}
+}
+
+func TestFramebufferPalette(t *testing.T) {
+	f, e := testFramebuffer(8)
+	e.Emit("palette", &pdu.PaletteUpdateDataPDU{NumberColors: 2, Entries: []pdu.PaletteEntry{{}, {Red: 0x10, Green: 0x20, Blue: 0x30}}})
+	// rows of 8 bpp bitmaps are padded to 4 bytes
+	e.Emit("bitmap", []pdu.BitmapData{{
+		DestRight: 0, DestBottom: 1, Width: 1, Height: 2, BitsPerPixel: 8,
+		BitmapDataStream: []byte{1, 0, 0, 0, 0, 0, 0, 0},
+	}})
+	img := f.Snapshot()
+	if got := img.RGBAAt(0, 1); got != (color.RGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Error("palette color", got)
+	}
+	if got := img.RGBAAt(0, 0); got != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Error("palette black", got)
+	}
+}
+
+func TestFramebufferOrders(t *testing.T) {
+	f, e := testFramebuffer(16)
+	e.Emit("orders", []pdu.OrderPdu{
+		// 0xf800 is red in RGB565
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.OpaqueRect{X: 0, Y: 0, Cx: 2, Cy: 2, Colour: [4]uint8{0x00, 0xf8}}}},
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Scrblt{X: 1, Y: 1, Cx: 2, Cy: 2, Opcode: 0xcc, Srcx: 0, Srcy: 0}}},
+	})
+	img := f.Snapshot()
+	red := color.RGBA{0xf8, 0, 0, 0xff}
+	for _, p := range []image.Point{{0, 0}, {1, 1}, {2, 2}, {1, 2}} {
+		if got := img.RGBAAt(p.X, p.Y); got != red {
+			t.Errorf("pixel %v: %v", p, got)
+		}
+	}
+	if got := img.RGBAAt(3, 3); got.R != 0 {
+		t.Error("outside of the orders", got)
+	}
+}
+
+func TestFramebufferPointer(t *testing.T) {
+	f, e := testFramebuffer(32)
+	var pointers []Pointer
+	f.OnPointer(func(p Pointer) { pointers = append(pointers, p) })
+
+	// 1x2 monochrome pointer, white over a transparent pixel, rows top-down
+	e.Emit("pointer_update", &pdu.FastPathUpdatePointerPDU{
+		XorBpp: 1, CacheIdx: 3, X: 0, Y: 1, Width: 1, Height: 2,
+		Data: []byte{0x80, 0, 0, 0},
+		Mask: []byte{0, 0, 0x80, 0},
+	})
+	e.Emit("pointer_hide")
+	e.Emit("pointer_cached", uint16(3))
+	if len(pointers) != 3 {
+		t.Fatal("notifications", len(pointers))
+	}
+	if pointers[1].Visible {
+		t.Error("pointer not hidden")
+	}
+	p := f.Pointer()
+	if !p.Visible || p.Image == nil || p.Hotspot != image.Pt(0, 1) {
+		t.Fatal("cached pointer", p)
+	}
+	if got := p.Image.RGBAAt(0, 0); got != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Error("white pixel", got)
+	}
+	if got := p.Image.RGBAAt(0, 1); got.A != 0 {
+		t.Error("transparent pixel", got)
+	}
+
+	// unknown depths are ignored, 15 bpp rows are padded to 2 bytes
+	f.cachePointer(4, 0, 0, 0, 2, 2, nil, nil)
+	if p := f.Pointer(); p.Image != nil {
+		t.Error("0 bpp pointer", p.Image)
+	}
+	f.cachePointer(5, 0, 0, 15, 1, 2, []byte{0x00, 0x7c, 0x1f, 0x00}, nil)
+	p = f.Pointer()
+	if p.Image == nil {
+		t.Fatal("15 bpp pointer")
+	}
+	if got := p.Image.RGBAAt(0, 0); got.B < 0xf0 || got.R != 0 {
+		t.Error("15 bpp bottom-up row", got)
+	}
+}
+
+func TestFramebufferAttach(t *testing.T) {
+	g := NewRdpClient("127.0.0.1:3389", 16, 16)
+	conn, server := net.Pipe()
+	defer server.Close()
+	cfg := Config{BitmapCacheDir: t.TempDir()}
+	g.setup(conn, cfg, x224.PROTOCOL_RDP)
+	if g.bitmapCachePath != "" {
+		t.Error("bitmap cache without a framebuffer")
+	}
+	f := NewFramebuffer(g)
+	g.setup(conn, cfg, x224.PROTOCOL_RDP)
+	g.pdu.Emit("pointer_hide")
+	if f.Pointer().Visible {
+		t.Error("framebuffer not attached to the next connection")
+	}
+	if g.bitmapCachePath == "" {
+		t.Error("bitmap cache with a framebuffer")
+	}
+}
+
+func TestFramebufferSurfaceBits(t *testing.T) {
+	f, e := testFramebuffer(32)
+	var dirty []image.Rectangle
+	f.OnDirty(func(r image.Rectangle) { dirty = append(dirty, r) })
+
+	// 2x1 uncompressed, BGRX rows top-down
+	e.Emit("surface_bits", &pdu.SurfaceBits{
+		Cmd: pdu.CMDTYPE_SET_SURFACE_BITS, DestLeft: 15, DestTop: 3,
+		Bitmap: pdu.BitmapDataEx{Bpp: 32, CodecID: CODEC_ID_NONE, Width: 2, Height: 1, Data: []byte{0x30, 0x20, 0x10, 0, 0xff, 0xff, 0xff, 0}},
+	})
+	if got := f.Snapshot().RGBAAt(15, 3); got != (color.RGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Error("pixel", got)
+	}
+	if len(dirty) != 1 || dirty[0] != image.Rect(15, 3, 16, 4) {
+		t.Error("dirty", dirty)
+	}
+}
@@ -0,0 +1,216 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"log/slog"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+/**
+ * Rendering of the text orders
+ * @see MS-RDPEGDI 3.2.5.1 Glyph Cache and Fragment Cache
+ */
+
+// glyphCache holds the glyphs of the cache glyph and fast glyph orders, and the
+// fragments of glyph data the text orders reuse
+type glyphCache struct {
+	glyphs    [len(pdu.GlyphCaches)]map[uint16]*pdu.Glyph
+	fragments [256][]byte
+}
+
+func newGlyphCache() *glyphCache {
+	c := &glyphCache{}
+	for i := range c.glyphs {
+		c.glyphs[i] = make(map[uint16]*pdu.Glyph)
+	}
+	return c
+}
+
+func (c *glyphCache) get(id uint8, index uint16) *pdu.Glyph {
+	if int(id) >= len(c.glyphs) {
+		return nil
+	}
+	return c.glyphs[id][index]
+}
+
+func (c *glyphCache) put(id uint8, g *pdu.Glyph) {
+	if int(id) >= len(c.glyphs) || g.CacheIndex >= pdu.GlyphCaches[id].Entries {
+		return
+	}
+	c.glyphs[id][g.CacheIndex] = g
+}
+
+// textOrder are the fields shared by GlyphIndex, FastIndex and FastGlyph
+type textOrder struct {
+	cacheId   uint8
+	flAccel   uint8
+	ulCharInc uint8
+	// the glyphs take the back color, the opaque rectangle the fore color
+	back, fore color.RGBA
+	bk, op     image.Rectangle
+	x, y       int
+}
+
+// textRect is empty when right or bottom do not pass left or top, the glyph orders
+// send such rectangles when they have no background
+func textRect(left, top, right, bottom int32) image.Rectangle {
+	if right <= left || bottom <= top {
+		return image.Rectangle{}
+	}
+	return image.Rect(int(left), int(top), int(right), int(bottom))
+}
+
+// fastTextOrder decodes the rectangles of FastIndex and FastGlyph, an OpBottom of -32768
+// tells with the bits of OpTop which sides of the opaque rectangle are the ones of bk
+func (f *Framebuffer) fastTextOrder(cacheId, ulCharInc, flAccel uint8, back, fore [4]uint8, bk, op [4]int32, x, y int32) textOrder {
+	if op[3] == -32768 {
+		flags := op[1]
+		for i, bit := range [4]int32{0x08, 0x04, 0x02, 0x01} {
+			if flags&bit != 0 {
+				op[i] = bk[i]
+			}
+		}
+	}
+	if op[0] == 0 {
+		op[0] = bk[0]
+	}
+	if op[2] == 0 {
+		op[2] = bk[2]
+	}
+	if x == -32768 {
+		x = bk[0]
+	}
+	if y == -32768 {
+		y = bk[1]
+	}
+	return textOrder{
+		cacheId:   cacheId,
+		flAccel:   flAccel,
+		ulCharInc: ulCharInc,
+		back:      f.orderColor(back),
+		fore:      f.orderColor(fore),
+		bk:        textRect(bk[0], bk[1], bk[2], bk[3]),
+		op:        textRect(op[0], op[1], op[2], op[3]),
+		x:         int(x),
+		y:         int(y),
+	}
+}
+
+// applyText paints the opaque rectangle of t then its glyphs
+func (f *Framebuffer) applyText(t textOrder, data []byte, clip image.Rectangle) image.Rectangle {
+	dirty := image.Rectangle{}
+	if !t.op.Empty() {
+		dirty = f.blit(t.op, clip, 0xf0, solid(t.fore), nil)
+	}
+	if !t.bk.Empty() {
+		clip = clip.Intersect(t.bk)
+	}
+	x, y := t.x, t.y
+	for i := 0; i < len(data); {
+		switch op := data[i]; op {
+		case pdu.GLYPH_FRAGMENT_USE:
+			if i+1 >= len(data) {
+				return dirty
+			}
+			fragment := f.glyphs.fragments[data[i+1]]
+			i += 2
+			// the delta to the fragment replaces the one of its first glyph,
+			// which was relative to the glyph preceding it in another text
+			// @see MS-RDPEGDI 2.2.2.2.1.1.2.13 GlyphIndex
+			moved := t.hasDelta() && i < len(data)
+			if moved {
+				var delta int
+				delta, i = t.delta(data, i)
+				t.advance(&x, &y, delta)
+			}
+			for j, first := 0, true; j < len(fragment); first = false {
+				j = f.applyGlyph(t, fragment, j, &x, &y, clip, &dirty, first && moved)
+			}
+
+		case pdu.GLYPH_FRAGMENT_ADD:
+			if i+2 >= len(data) {
+				return dirty
+			}
+			// the fragment is the data preceding the command
+			size := int(data[i+2])
+			if size <= i {
+				f.glyphs.fragments[data[i+1]] = append([]byte(nil), data[i-size:i]...)
+			}
+			i += 3
+
+		default:
+			i = f.applyGlyph(t, data, i, &x, &y, clip, &dirty, false)
+		}
+	}
+	return dirty
+}
+
+// applyGlyph draws the glyph at data[i] and returns the index of the next one,
+// its delta is read but not applied with skipDelta
+func (f *Framebuffer) applyGlyph(t textOrder, data []byte, i int, x, y *int, clip image.Rectangle, dirty *image.Rectangle, skipDelta bool) int {
+	index := data[i]
+	i++
+	if t.hasDelta() && i < len(data) {
+		var delta int
+		delta, i = t.delta(data, i)
+		if !skipDelta {
+			t.advance(x, y, delta)
+		}
+	}
+	g := f.glyphs.get(t.cacheId, uint16(index))
+	if g == nil {
+		slog.Debug("missing glyph", "cacheId", t.cacheId, "index", index)
+		return i
+	}
+	*dirty = dirty.Union(f.drawGlyph(g, *x, *y, t.back, clip))
+	switch {
+	case t.flAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE != 0:
+		t.advance(x, y, int(g.Cx))
+	case t.ulCharInc != 0:
+		t.advance(x, y, int(t.ulCharInc))
+	}
+	return i
+}
+
+// hasDelta tells if the glyphs are followed by their distance to the previous one
+func (t textOrder) hasDelta() bool {
+	return t.ulCharInc == 0 && t.flAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE == 0
+}
+
+// delta reads the distance to the previous glyph, 0x80 introduces a 16-bit one
+func (t textOrder) delta(data []byte, i int) (int, int) {
+	d := int(data[i])
+	i++
+	if d&0x80 != 0 && i+1 < len(data) {
+		d = int(int16(uint16(data[i]) | uint16(data[i+1])<<8))
+		i += 2
+	}
+	return d, i
+}
+
+func (t textOrder) advance(x, y *int, delta int) {
+	if t.flAccel&pdu.SO_VERTICAL != 0 {
+		*y += delta
+	} else {
+		*x += delta
+	}
+}
+
+// drawGlyph paints the set bits of g with c, x and y is the origin of the text
+func (f *Framebuffer) drawGlyph(g *pdu.Glyph, x, y int, c color.RGBA, clip image.Rectangle) image.Rectangle {
+	r := image.Rect(0, 0, int(g.Cx), int(g.Cy)).Add(image.Pt(x+int(g.X), y+int(g.Y)))
+	stride := (int(g.Cx) + 7) / 8
+	painted := r.Intersect(clip).Intersect(f.img.Rect)
+	for py := painted.Min.Y; py < painted.Max.Y; py++ {
+		row := (py - r.Min.Y) * stride
+		for px := painted.Min.X; px < painted.Max.X; px++ {
+			gx := px - r.Min.X
+			if row+gx/8 < len(g.Aj) && g.Aj[row+gx/8]&(0x80>>uint(gx&7)) != 0 {
+				f.img.SetRGBA(px, py, c)
+			}
+		}
+	}
+	return painted
+}
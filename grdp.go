@@ -1,15 +1,25 @@
 package grdp
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"log/slog"
+	"math"
 	"net"
+	"time"
 
 	"github.com/sergei-bronnikov/grdp/plugin"
+	"github.com/sergei-bronnikov/grdp/plugin/drdynvc"
+	"github.com/sergei-bronnikov/grdp/plugin/rdpei"
+	"github.com/sergei-bronnikov/grdp/plugin/rdpgfx"
 
 	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/bulk"
 	"github.com/sergei-bronnikov/grdp/protocol/nla"
 	"github.com/sergei-bronnikov/grdp/protocol/pdu"
 	"github.com/sergei-bronnikov/grdp/protocol/sec"
@@ -36,6 +46,17 @@ type RdpClient struct {
 	pdu        *pdu.Client
 	channels   *plugin.Channels
 	eventReady bool
+	bitmaps    *bitmapCache
+	// bitmapCachePath is the persistent cache file, empty when it is disabled
+	bitmapCachePath string
+	// gfx is the graphics pipeline, nil unless the config enables it
+	gfx *rdpgfx.GfxClient
+	// rdpei is the touch and pen input, nil unless the config enables it
+	rdpei *rdpei.InputClient
+	// lockKeys are the TS_SYNC_* toggle flags synchronized on each activation
+	lockKeys uint32
+	// framebuffer paints the updates, nil unless NewFramebuffer was called
+	framebuffer *Framebuffer
 }
 
 type Bitmap struct {
@@ -110,6 +131,59 @@ func bpp(BitsPerPixel uint16) (pixel int) {
 	return
 }
 
+// Config holds the credentials and options used to establish a session
+type Config struct {
+	Domain   string
+	User     string
+	Password string
+	// TLSConfig verifies the server certificate, with RootCAs for a private CA.
+	// When it is nil the certificate is verified against the system roots,
+	// unless KnownHosts or VerifyCertificate are set. InsecureSkipVerify
+	// without any of them accepts any server. ServerName defaults to the dialed host.
+	TLSConfig *tls.Config
+	// KnownHosts pins the public key of each host:port on first use
+	KnownHosts *core.KnownHosts
+	// VerifyCertificate is shown the server chain, an error rejects the connection
+	VerifyCertificate func(hostPort string, chain []*x509.Certificate) error
+	// Protocols lists the acceptable security protocols in order of preference,
+	// x224.PROTOCOL_HYBRID_EX, PROTOCOL_HYBRID, PROTOCOL_SSL or PROTOCOL_RDP.
+	// ConnectContext redials with the next protocol allowed by the server when
+	// the negotiation fails. Only PROTOCOL_RDP is requested when empty.
+	Protocols []uint32
+	// Kerberos authenticates NLA with a service ticket of TERMSRV/<host>,
+	// falling back to NTLM when no ticket can be obtained. KDC is the
+	// host:port of the KDC, found in DNS SRV records of the domain when empty.
+	Kerberos bool
+	KDC      string
+	// NTHash authenticates NTLM with the 16 byte MD4 hash of the unicode password
+	// instead of Password. The server must allow restricted admin logons,
+	// empty credentials are delegated to it.
+	NTHash []byte
+	// RestrictedAdmin never delegates the password to the server, the session
+	// runs as the NLA identity without network credentials. Implied by NTHash.
+	// It requires NLA, the connection fails when the server does not confirm it.
+	// Remote Credential Guard is not supported.
+	RestrictedAdmin bool
+	// SmartCard logs on with a certificate over Kerberos PKINIT instead of
+	// Password, its PIN is delegated to the server
+	SmartCard *nla.SmartCard
+	// BitmapCacheDir keeps the bitmaps cached by the server between sessions,
+	// one file per host. Their keys are announced when reconnecting so the
+	// server draws them from the cache instead of sending them again. It is
+	// only used with a Framebuffer.
+	BitmapCacheDir string
+	// GraphicsPipeline updates the desktop over the graphics pipeline of RDP 8
+	// instead of the bitmap updates and drawing orders, the server may still
+	// fall back to them. Only the desktop of a Framebuffer shows its updates.
+	GraphicsPipeline bool
+	// VideoDecoder decodes the H.264 of the graphics pipeline, the server only
+	// encodes the desktop as video when it is set
+	VideoDecoder rdpgfx.VideoDecoder
+	// TouchContacts is the number of simultaneous touch contacts announced to
+	// the server over the input extension, touch and pen input are off when 0
+	TouchContacts int
+}
+
 func (g *RdpClient) Login(domain string, user string, password string) error {
 	slog.Info("Login", "Host", g.hostPort, "domain", domain, "user", user)
 	conn, err := net.Dial("tcp", g.hostPort)
@@ -117,7 +191,145 @@ func (g *RdpClient) Login(domain string, user string, password string) error {
 		return fmt.Errorf("[dial err] %v", err)
 	}
 
-	g.tpkt = tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2(domain, user, password))
+	g.setup(conn, Config{Domain: domain, User: user, Password: password}, x224.PROTOCOL_RDP)
+
+	err = g.x224.Connect()
+	if err != nil {
+		return fmt.Errorf("[x224 connect err] %v", err)
+	}
+
+	g.OnReady(func() {
+		g.eventReady = true
+	})
+
+	return nil
+}
+
+// ConnectContext dials the server and blocks until the session is ready
+// or the connection sequence fails. The context deadline is applied to
+// the whole handshake and cancelling the context aborts it.
+func (g *RdpClient) ConnectContext(ctx context.Context, cfg Config) error {
+	slog.Info("ConnectContext", "Host", g.hostPort, "domain", cfg.Domain, "user", cfg.User)
+	protocols := cfg.Protocols
+	if len(protocols) == 0 {
+		protocols = []uint32{x224.PROTOCOL_RDP}
+	}
+	if err := cfg.validate(protocols); err != nil {
+		return err
+	}
+	i := 0
+	for {
+		err := g.connect(ctx, cfg, protocols[i])
+		var nf core.ErrNegotiationFailure
+		if !errors.As(err, &nf) {
+			return err
+		}
+		next := nextProtocol(protocols, i, nf.Code)
+		if next < 0 {
+			return err
+		}
+		slog.Info("ConnectContext redial", "code", nf.Code, "protocol", protocols[next])
+		i = next
+	}
+}
+
+func (cfg *Config) restrictedAdmin() bool {
+	return cfg.RestrictedAdmin || cfg.NTHash != nil
+}
+
+// validate rejects the options that cannot work before dialing
+func (cfg *Config) validate(protocols []uint32) error {
+	if cfg.NTHash != nil && len(cfg.NTHash) != 16 {
+		return fmt.Errorf("NTHash must be the 16 bytes of an MD4 hash, got %d", len(cfg.NTHash))
+	}
+	if !cfg.restrictedAdmin() {
+		return nil
+	}
+	for _, p := range protocols {
+		if p != x224.PROTOCOL_HYBRID && p != x224.PROTOCOL_HYBRID_EX {
+			return fmt.Errorf("restricted admin mode requires NLA, protocol %d is allowed", p)
+		}
+	}
+	return nil
+}
+
+// nextProtocol returns the index of the next protocol after i allowed by the
+// negotiation failure code, -1 when none is left
+// @see http://msdn.microsoft.com/en-us/library/cc240507.aspx
+func nextProtocol(protocols []uint32, i int, code uint32) int {
+	allowed := func(p uint32) bool {
+		switch code {
+		case x224.SSL_REQUIRED_BY_SERVER:
+			return p == x224.PROTOCOL_SSL
+		case x224.SSL_NOT_ALLOWED_BY_SERVER, x224.SSL_CERT_NOT_ON_SERVER:
+			return p == x224.PROTOCOL_RDP
+		case x224.HYBRID_REQUIRED_BY_SERVER:
+			return p == x224.PROTOCOL_HYBRID || p == x224.PROTOCOL_HYBRID_EX
+		}
+		return false
+	}
+	for j := i + 1; j < len(protocols); j++ {
+		if allowed(protocols[j]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// connect runs one connection attempt requesting protocol
+func (g *RdpClient) connect(ctx context.Context, cfg Config, protocol uint32) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", g.hostPort)
+	if err != nil {
+		return fmt.Errorf("[dial err] %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	g.setup(conn, cfg, protocol)
+
+	result := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	g.pdu.Once("ready", func() {
+		g.eventReady = true
+		done(nil)
+	})
+	g.pdu.Once("error", func(e error) {
+		done(e)
+	})
+	g.pdu.Once("close", func() {
+		done(core.ErrConnectionClosed)
+	})
+
+	err = g.x224.Connect()
+	if err != nil {
+		g.Close()
+		return fmt.Errorf("[x224 connect err] %w", err)
+	}
+
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		g.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+func (g *RdpClient) setup(conn net.Conn, cfg Config, protocol uint32) {
+	socket := core.NewSocketLayer(conn)
+	socket.SetTLSConfig(g.tlsConfig(cfg))
+	g.tpkt = tpkt.New(socket, g.authenticator(cfg))
 	g.x224 = x224.New(g.tpkt)
 	g.mcs = t125.NewMCSClient(g.x224, KbdLayout, KeyboardType, KeyboardSubType)
 	g.sec = sec.NewClient(g.mcs)
@@ -135,30 +347,151 @@ func (g *RdpClient) Login(domain string, user string, password string) error {
 	//g.sec.SetAlternateShell("")
 
 	//dvc
-	//g.channels.Register(drdynvc.NewDvcClient())
+	g.gfx = nil
+	g.rdpei = nil
+	dvc := drdynvc.NewDvcClient()
+	if cfg.GraphicsPipeline {
+		g.gfx = rdpgfx.NewClient()
+		g.gfx.SetVideoDecoder(cfg.VideoDecoder)
+		dvc.Register(g.gfx)
+		g.mcs.SetClientGraphicsPipeline()
+	}
+	if cfg.TouchContacts > 0 {
+		g.rdpei = rdpei.NewClient(uint16(min(cfg.TouchContacts, rdpei.MAX_TOUCH_CONTACTS)))
+		dvc.Register(g.rdpei)
+	}
+	if g.gfx != nil || g.rdpei != nil {
+		g.channels.Register(dvc)
+		g.mcs.SetClientDynvcProtocol()
+	}
+
+	g.pdu.On("ready", g.sendLockKeys)
 
-	g.sec.SetUser(user)
-	g.sec.SetPwd(password)
-	g.sec.SetDomain(domain)
+	g.bitmaps = newBitmapCache()
+	g.bitmapCachePath = ""
+	// only a framebuffer fills the cache
+	if cfg.BitmapCacheDir != "" && g.framebuffer != nil {
+		g.bitmapCachePath = bitmapCachePath(cfg.BitmapCacheDir, g.hostPort)
+		bitmaps, err := loadBitmapCache(g.bitmapCachePath)
+		if err != nil {
+			slog.Warn("load bitmap cache", "path", g.bitmapCachePath, "err", err)
+		}
+		g.bitmaps = bitmaps
+		g.pdu.SetPersistentKeys(bitmaps.keys())
+	}
+
+	if g.framebuffer != nil {
+		g.framebuffer.attach(g)
+		g.pdu.SetDrawingOrders(true)
+		// the surface bits are only decoded by a framebuffer
+		g.pdu.SetBitmapCodecs(bitmapCodecs())
+	}
+
+	// RDP61 would let the server pick NCRUSH, which bulk does not decompress
+	g.sec.SetCompression(bulk.PACKET_COMPR_TYPE_64K)
+	g.sec.SetUser(cfg.User)
+	g.sec.SetPwd(cfg.Password)
+	g.sec.SetDomain(cfg.Domain)
+	if cfg.SmartCard != nil {
+		g.sec.SetSmartCardPin(cfg.SmartCard.PIN)
+	}
+	if cfg.restrictedAdmin() {
+		g.x224.SetRequestFlags(x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+		g.tpkt.SetDelegation(tpkt.DELEGATE_RESTRICTED_ADMIN)
+		g.sec.SetPwd("")
+	}
 
 	g.tpkt.SetFastPathListener(g.sec)
 	g.sec.SetFastPathListener(g.pdu)
 	g.sec.SetChannelSender(g.mcs)
 	g.channels.SetChannelSender(g.sec)
-	//g.pdu.SetFastPathSender(g.tpkt)
+	g.sec.SetFastPathSender(g.tpkt)
+	g.pdu.SetFastPathSender(g.sec)
 
-	g.x224.SetRequestedProtocol(x224.PROTOCOL_RDP)
+	if protocol == x224.PROTOCOL_HYBRID_EX {
+		// HYBRID_EX is only valid along with HYBRID
+		protocol |= x224.PROTOCOL_HYBRID
+	}
+	g.x224.SetRequestedProtocol(protocol)
+}
 
-	err = g.x224.Connect()
+// authenticator returns the security package of NLA
+func (g *RdpClient) authenticator(cfg Config) nla.Authenticator {
+	if cfg.NTHash != nil {
+		return nla.NewNTLMv2Hash(cfg.Domain, cfg.User, cfg.NTHash)
+	}
+	host, _, err := net.SplitHostPort(g.hostPort)
 	if err != nil {
-		return fmt.Errorf("[x224 connect err] %v", err)
+		host = g.hostPort
+	}
+	if cfg.SmartCard != nil {
+		return nla.NewKerberosSmartCard(cfg.Domain, cfg.User, cfg.SmartCard, cfg.KDC, host)
 	}
+	ntlm := nla.NewNTLMv2(cfg.Domain, cfg.User, cfg.Password)
+	if !cfg.Kerberos {
+		return ntlm
+	}
+	return nla.NewNegotiate(nla.NewKerberos(cfg.Domain, cfg.User, cfg.Password, cfg.KDC, host), ntlm)
+}
 
-	g.OnReady(func() {
-		g.eventReady = true
-	})
+// tlsConfig merges the certificate checks of cfg, KnownHosts and
+// VerifyCertificate run after the chain verification of TLSConfig.
+// Without any of them the chain is verified against the system roots.
+func (g *RdpClient) tlsConfig(cfg Config) *tls.Config {
+	var config *tls.Config
+	if cfg.TLSConfig != nil {
+		config = cfg.TLSConfig.Clone()
+	} else {
+		// the pin or the callback replace the chain verification
+		config = &tls.Config{InsecureSkipVerify: cfg.KnownHosts != nil || cfg.VerifyCertificate != nil}
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(g.hostPort); err == nil {
+			config.ServerName = host
+		}
+	}
+	if cfg.KnownHosts == nil && cfg.VerifyCertificate == nil {
+		if config.InsecureSkipVerify && config.VerifyPeerCertificate == nil && config.VerifyConnection == nil {
+			slog.Warn("the server certificate is not verified", "Host", g.hostPort)
+		}
+		return config
+	}
+	next := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		chain := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, cert)
+		}
+		if len(chain) == 0 {
+			return errors.New("no server certificate")
+		}
+		verify := func() error {
+			if cfg.VerifyCertificate != nil {
+				return cfg.VerifyCertificate(g.hostPort, chain)
+			}
+			return nil
+		}
+		if cfg.KnownHosts == nil {
+			return verify()
+		}
+		// a new host is only recorded once every other check passed
+		return cfg.KnownHosts.VerifyFunc(g.hostPort, chain[0], verify)
+	}
+	return config
+}
 
-	return nil
+// SelectedProtocol returns the security protocol chosen by the server
+func (g *RdpClient) SelectedProtocol() uint32 {
+	return g.x224.SelectedProtocol()
 }
 
 func (g *RdpClient) Width() int {
@@ -241,7 +574,7 @@ func (g *RdpClient) KeyUp(sc int) {
 	p := &pdu.ScancodeKeyEvent{}
 	p.KeyCode = uint16(sc)
 	p.KeyboardFlags |= pdu.KBDFLAGS_RELEASE
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, []pdu.InputEventsInterface{p})
+	g.pdu.SendInput(p)
 }
 
 func (g *RdpClient) KeyDown(sc int) {
@@ -249,7 +582,7 @@ func (g *RdpClient) KeyDown(sc int) {
 
 	p := &pdu.ScancodeKeyEvent{}
 	p.KeyCode = uint16(sc)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, []pdu.InputEventsInterface{p})
+	g.pdu.SendInput(p)
 }
 
 func (g *RdpClient) MouseMove(x, y int) {
@@ -258,61 +591,89 @@ func (g *RdpClient) MouseMove(x, y int) {
 	p.PointerFlags |= pdu.PTRFLAGS_MOVE
 	p.XPos = uint16(x)
 	p.YPos = uint16(y)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
+	g.pdu.SendInput(p)
 }
 
-func (g *RdpClient) MouseWheel(scroll int) {
-	slog.Debug("MouseWheel")
-	p := &pdu.PointerEvent{}
-	p.PointerFlags |= pdu.PTRFLAGS_WHEEL
-	if scroll < 0 {
-		p.PointerFlags |= pdu.PTRFLAGS_WHEEL_NEGATIVE
-	}
-	var ts uint8 = uint8(scroll)
-	p.PointerFlags |= pdu.WheelRotationMask & uint16(ts)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
+// MouseMoveRelative moves the pointer by dx, dy, it is dropped when the
+// server does not announce relative mouse input
+func (g *RdpClient) MouseMoveRelative(dx, dy int) {
+	slog.Debug("MouseMoveRelative", "dx", dx, "dy", dy)
+	g.pdu.SendInput(relativeEvents(dx, dy)...)
 }
 
-func (g *RdpClient) MouseUp(button int, x, y int) {
-	slog.Debug("MouseUp", "x", x, "y", y, "button", button)
-	p := &pdu.PointerEvent{}
-
-	switch button {
-	case 0:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON1
-	case 2:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON2
-	case 1:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON3
-	default:
-		p.PointerFlags |= pdu.PTRFLAGS_MOVE
+// relativeEvents splits a move into the 16-bit deltas of the events
+func relativeEvents(dx, dy int) []pdu.InputEvent {
+	var events []pdu.InputEvent
+	for dx != 0 || dy != 0 {
+		x := min(max(dx, math.MinInt16), math.MaxInt16)
+		y := min(max(dy, math.MinInt16), math.MaxInt16)
+		events = append(events, &pdu.RelativePointerEvent{PointerFlags: pdu.PTRFLAGS_MOVE, XDelta: int16(x), YDelta: int16(y)})
+		dx, dy = dx-x, dy-y
 	}
+	return events
+}
 
-	p.XPos = uint16(x)
-	p.YPos = uint16(y)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
+// MouseWheel scrolls vertically, a notch is 120 and positive scrolls up. Finer
+// deltas scroll smoothly where the application supports it.
+func (g *RdpClient) MouseWheel(scroll int) {
+	slog.Debug("MouseWheel", "scroll", scroll)
+	g.pdu.SendInput(wheelEvents(pdu.PTRFLAGS_WHEEL, scroll)...)
 }
 
-func (g *RdpClient) MouseDown(button int, x, y int) {
-	slog.Debug("MouseDown", "x", x, "y", y, "button", button)
-	p := &pdu.PointerEvent{}
+// MouseHWheel scrolls horizontally, a notch is 120 and positive scrolls right
+func (g *RdpClient) MouseHWheel(scroll int) {
+	slog.Debug("MouseHWheel", "scroll", scroll)
+	g.pdu.SendInput(wheelEvents(pdu.PTRFLAGS_HWHEEL, scroll)...)
+}
 
-	p.PointerFlags |= pdu.PTRFLAGS_DOWN
+// wheelEvents splits a delta into the rotations of the pointer flags
+func wheelEvents(flags uint16, scroll int) []pdu.InputEvent {
+	var events []pdu.InputEvent
+	for scroll != 0 {
+		delta := min(max(scroll, -256), 255)
+		events = append(events, &pdu.PointerEvent{PointerFlags: flags | pdu.WheelRotation(delta)})
+		scroll -= delta
+	}
+	return events
+}
 
+// buttonEvent is the pointer event of button 0 to 4, the left, middle, right,
+// back and forward ones. The last two are extended mouse events.
+func buttonEvent(button int, down bool, x, y int) pdu.InputEvent {
+	var flags uint16
 	switch button {
+	case 3, 4:
+		flags = pdu.PTRXFLAGS_BUTTON1
+		if button == 4 {
+			flags = pdu.PTRXFLAGS_BUTTON2
+		}
+		if down {
+			flags |= pdu.PTRXFLAGS_DOWN
+		}
+		return &pdu.PointerExEvent{PointerFlags: flags, XPos: uint16(x), YPos: uint16(y)}
 	case 0:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON1
+		flags = pdu.PTRFLAGS_BUTTON1
 	case 2:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON2
+		flags = pdu.PTRFLAGS_BUTTON2
 	case 1:
-		p.PointerFlags |= pdu.PTRFLAGS_BUTTON3
+		flags = pdu.PTRFLAGS_BUTTON3
 	default:
-		p.PointerFlags |= pdu.PTRFLAGS_MOVE
+		flags = pdu.PTRFLAGS_MOVE
 	}
+	if down {
+		flags |= pdu.PTRFLAGS_DOWN
+	}
+	return &pdu.PointerEvent{PointerFlags: flags, XPos: uint16(x), YPos: uint16(y)}
+}
 
-	p.XPos = uint16(x)
-	p.YPos = uint16(y)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
+func (g *RdpClient) MouseUp(button int, x, y int) {
+	slog.Debug("MouseUp", "x", x, "y", y, "button", button)
+	g.pdu.SendInput(buttonEvent(button, false, x, y))
+}
+
+func (g *RdpClient) MouseDown(button int, x, y int) {
+	slog.Debug("MouseDown", "x", x, "y", y, "button", button)
+	g.pdu.SendInput(buttonEvent(button, true, x, y))
 }
 
 func (g *RdpClient) Close() {
@@ -320,4 +681,9 @@ func (g *RdpClient) Close() {
 	if g != nil && g.tpkt != nil {
 		g.tpkt.Close()
 	}
+	if g != nil && g.bitmapCachePath != "" {
+		if err := g.bitmaps.save(g.bitmapCachePath); err != nil {
+			slog.Warn("save bitmap cache", "path", g.bitmapCachePath, "err", err)
+		}
+	}
 }
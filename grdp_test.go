@@ -0,0 +1,472 @@
+package grdp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/nla"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/x224"
+	"github.com/sergei-bronnikov/grdp/server"
+)
+
+func serve(t *testing.T, handle func(conn net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	}()
+	return l.Addr().String()
+}
+
+func readTPKT(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	body := make([]byte, int(header[2])<<8|int(header[3])-4)
+	_, err := io.ReadFull(conn, body)
+	return body, err
+}
+
+func TestConnectContextNegotiationFailure(t *testing.T) {
+	// HYBRID_REQUIRED_BY_SERVER
+	confirm, _ := hex.DecodeString("030000130ed000000000000300080005000000")
+	addr := serve(t, func(conn net.Conn) {
+		if _, err := readTPKT(conn); err != nil {
+			return
+		}
+		conn.Write(confirm)
+		io.Copy(io.Discard, conn)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := NewRdpClient(addr, 800, 600).ConnectContext(ctx, Config{User: "user"})
+	var nf ErrNegotiationFailure
+	if !errors.As(err, &nf) {
+		t.Fatalf("expected ErrNegotiationFailure, got %v", err)
+	}
+	if nf.Code != 5 {
+		t.Error("code", nf.Code, "not equal to", 5)
+	}
+}
+
+func TestConnectContextDeadline(t *testing.T) {
+	addr := serve(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := NewRdpClient(addr, 800, 600).ConnectContext(ctx, Config{User: "user"})
+	if err == nil {
+		t.Fatal("expected an error when the server never answers")
+	}
+}
+
+// tlsServer runs a TLS only server, NLA is refused with SSL_REQUIRED_BY_SERVER
+func tlsServer(t *testing.T) (string, *x509.Certificate) {
+	return listenServer(t, &server.Config{})
+}
+
+func listenServer(t *testing.T, config *server.Config) (string, *x509.Certificate) {
+	return startServer(t, config, func(conn *server.Conn) {
+		conn.Handshake(context.Background())
+	})
+}
+
+// startServer hands each accepted connection to handle in its own goroutine
+func startServer(t *testing.T, config *server.Config, handle func(conn *server.Conn)) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	s, err := server.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return s.Addr().String(), cert
+}
+
+// insecure accepts the self-signed certificates of the test servers
+var insecure = &tls.Config{InsecureSkipVerify: true}
+
+func connectSSL(addr string, cfg Config) (*RdpClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewRdpClient(addr, 800, 600)
+	cfg.User = "user"
+	cfg.Protocols = []uint32{x224.PROTOCOL_SSL}
+	err := c.ConnectContext(ctx, cfg)
+	if err == nil {
+		c.Close()
+	}
+	return c, err
+}
+
+func TestConnectContextFallback(t *testing.T) {
+	addr, _ := tlsServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewRdpClient(addr, 800, 600)
+	err := c.ConnectContext(ctx, Config{
+		User:      "user",
+		TLSConfig: insecure,
+		Protocols: []uint32{x224.PROTOCOL_HYBRID_EX, x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.SelectedProtocol() != x224.PROTOCOL_SSL {
+		t.Error("selected protocol", c.SelectedProtocol())
+	}
+}
+
+func TestConnectContextKerberosFallback(t *testing.T) {
+	addr, _ := listenServer(t, &server.Config{
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", user == "alice"
+		},
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	kdc := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewRdpClient(addr, 800, 600)
+	err := c.ConnectContext(ctx, Config{
+		Domain:    "TEST",
+		TLSConfig: insecure,
+		User:      "alice",
+		Password:  "secret",
+		Protocols: []uint32{x224.PROTOCOL_HYBRID},
+		Kerberos:  true,
+		KDC:       kdc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestConnectContextNTHash(t *testing.T) {
+	addr, _ := listenServer(t, &server.Config{
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", user == "alice"
+		},
+	})
+	for _, c := range []struct {
+		hash string
+		err  error
+	}{
+		{"secret", nil},
+		{"wrong", ErrAuthFailed},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		client := NewRdpClient(addr, 800, 600)
+		err := client.ConnectContext(ctx, Config{
+			User:      "alice",
+			TLSConfig: insecure,
+			NTHash:    nla.NTHash(c.hash),
+			Protocols: []uint32{x224.PROTOCOL_HYBRID},
+		})
+		cancel()
+		if !errors.Is(err, c.err) {
+			t.Error(c.hash, err)
+		}
+		if err == nil {
+			client.Close()
+		}
+	}
+}
+
+func TestConnectContextRestrictedAdmin(t *testing.T) {
+	addr, _ := listenServer(t, &server.Config{
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", user == "alice"
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewRdpClient(addr, 800, 600)
+	err := c.ConnectContext(ctx, Config{
+		User:            "alice",
+		TLSConfig:       insecure,
+		Password:        "secret",
+		Protocols:       []uint32{x224.PROTOCOL_HYBRID},
+		RestrictedAdmin: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.x224.ResponseFlags()&x224.RESTRICTED_ADMIN_MODE_SUPPORTED == 0 {
+		t.Error("response flags", c.x224.ResponseFlags())
+	}
+
+	// the password would be sent in the client info without NLA
+	err = NewRdpClient(addr, 800, 600).ConnectContext(ctx, Config{
+		User:            "alice",
+		Password:        "secret",
+		Protocols:       []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL},
+		RestrictedAdmin: true,
+	})
+	if err == nil {
+		t.Error("restricted admin mode without NLA")
+	}
+
+	// a server selecting NLA without RESTRICTED_ADMIN_MODE_SUPPORTED
+	confirm, _ := hex.DecodeString("030000130ed000000000000200080002000000")
+	addr = serve(t, func(conn net.Conn) {
+		if _, err := readTPKT(conn); err != nil {
+			return
+		}
+		conn.Write(confirm)
+		io.Copy(io.Discard, conn)
+	})
+	err = NewRdpClient(addr, 800, 600).ConnectContext(ctx, Config{
+		User:      "alice",
+		NTHash:    nla.NTHash("secret"),
+		Protocols: []uint32{x224.PROTOCOL_HYBRID},
+	})
+	if !errors.Is(err, ErrRestrictedAdmin) {
+		t.Error("restricted admin mode not confirmed", err)
+	}
+
+	// a hash of the wrong length is rejected before dialing
+	err = NewRdpClient("127.0.0.1:1", 800, 600).ConnectContext(ctx, Config{
+		User:      "alice",
+		NTHash:    []byte("secret"),
+		Protocols: []uint32{x224.PROTOCOL_HYBRID},
+	})
+	if err == nil || !strings.Contains(err.Error(), "NTHash") {
+		t.Error("NTHash length", err)
+	}
+}
+
+func TestConnectContextDowngrade(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, c := range []struct {
+		confirm  string
+		protocol uint32
+	}{
+		// standard RDP security selected instead of TLS
+		{"030000130ed000000000000200080000000000", x224.PROTOCOL_SSL},
+		// TLS selected instead of NLA
+		{"030000130ed000000000000200080001000000", x224.PROTOCOL_HYBRID},
+		// no negotiation response
+		{"0300000b06d00000000000", x224.PROTOCOL_HYBRID},
+	} {
+		confirm, _ := hex.DecodeString(c.confirm)
+		addr := serve(t, func(conn net.Conn) {
+			if _, err := readTPKT(conn); err != nil {
+				return
+			}
+			conn.Write(confirm)
+			io.Copy(io.Discard, conn)
+		})
+		err := NewRdpClient(addr, 800, 600).ConnectContext(ctx, Config{
+			User: "alice", Password: "secret", Protocols: []uint32{c.protocol},
+		})
+		if !errors.Is(err, ErrProtocolDowngrade) {
+			t.Error("downgrade", c.confirm, err)
+		}
+	}
+}
+
+func TestConnectContextCertificate(t *testing.T) {
+	addr, cert := tlsServer(t)
+
+	// the self-signed certificate is not in the system roots
+	if _, err := connectSSL(addr, Config{}); err == nil {
+		t.Error("expected the default to verify the chain")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	if _, err := connectSSL(addr, Config{TLSConfig: &tls.Config{RootCAs: pool}}); err != nil {
+		t.Error("trusted CA", err)
+	}
+	if _, err := connectSSL(addr, Config{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}}); err == nil {
+		t.Error("expected an unknown authority error")
+	}
+
+	rejected := errors.New("rejected")
+	_, err := connectSSL(addr, Config{VerifyCertificate: func(hostPort string, chain []*x509.Certificate) error {
+		if hostPort != addr || !chain[0].Equal(cert) {
+			t.Error("unexpected certificate for", hostPort)
+		}
+		return rejected
+	}})
+	if !errors.Is(err, rejected) {
+		t.Error("callback", err)
+	}
+
+	// a certificate rejected by the callback is not pinned
+	known, _ := core.NewKnownHosts("")
+	_, err = connectSSL(addr, Config{KnownHosts: known, VerifyCertificate: func(string, []*x509.Certificate) error {
+		return rejected
+	}})
+	if _, ok := known.Lookup(addr); !errors.Is(err, rejected) || ok {
+		t.Error("rejected certificate recorded", err)
+	}
+	if _, err := connectSSL(addr, Config{KnownHosts: known}); err != nil {
+		t.Error("first use", err)
+	}
+	if hash, _ := known.Lookup(addr); hash != core.SPKIHash(cert) {
+		t.Error("recorded", hash)
+	}
+	// the callback still runs for a known host
+	_, err = connectSSL(addr, Config{KnownHosts: known, VerifyCertificate: func(string, []*x509.Certificate) error {
+		return rejected
+	}})
+	if !errors.Is(err, rejected) {
+		t.Error("known host callback", err)
+	}
+	other, _ := tlsServer(t)
+	known, _ = core.NewKnownHosts("")
+	known.Verify(other, cert)
+	if _, err := connectSSL(other, Config{KnownHosts: known}); !errors.Is(err, ErrCertificateMismatch) {
+		t.Error("pinned", err)
+	}
+}
+
+func TestNextProtocol(t *testing.T) {
+	protocols := []uint32{x224.PROTOCOL_HYBRID_EX, x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP}
+	if i := nextProtocol(protocols, 0, x224.SSL_REQUIRED_BY_SERVER); i != 2 {
+		t.Error("SSL_REQUIRED_BY_SERVER", i)
+	}
+	if i := nextProtocol(protocols, 2, x224.SSL_NOT_ALLOWED_BY_SERVER); i != 3 {
+		t.Error("SSL_NOT_ALLOWED_BY_SERVER", i)
+	}
+	if i := nextProtocol(protocols, 2, x224.HYBRID_REQUIRED_BY_SERVER); i != -1 {
+		t.Error("HYBRID_REQUIRED_BY_SERVER", i)
+	}
+}
+
+func TestMouseEvents(t *testing.T) {
+	events := wheelEvents(pdu.PTRFLAGS_HWHEEL, -600)
+	total := 0
+	for _, e := range events {
+		p := e.(*pdu.PointerEvent)
+		if p.PointerFlags&^pdu.WheelRotationMask != pdu.PTRFLAGS_HWHEEL {
+			t.Errorf("flags 0x%x", p.PointerFlags)
+		}
+		total += p.WheelDelta()
+	}
+	if len(events) != 3 || total != -600 {
+		t.Error("wheel events", len(events), total)
+	}
+
+	x, ok := buttonEvent(4, true, 10, 20).(*pdu.PointerExEvent)
+	if !ok || x.PointerFlags != pdu.PTRXFLAGS_DOWN|pdu.PTRXFLAGS_BUTTON2 || x.XPos != 10 || x.YPos != 20 {
+		t.Errorf("xbutton2 %+v", x)
+	}
+	p, ok := buttonEvent(2, false, 1, 2).(*pdu.PointerEvent)
+	if !ok || p.PointerFlags != pdu.PTRFLAGS_BUTTON2 {
+		t.Errorf("right button %+v", p)
+	}
+
+	events = relativeEvents(40000, -3)
+	if len(events) != 2 {
+		t.Fatal("relative events", len(events))
+	}
+	first, second := events[0].(*pdu.RelativePointerEvent), events[1].(*pdu.RelativePointerEvent)
+	if first.PointerFlags != pdu.PTRFLAGS_MOVE || first.XDelta != 32767 || first.YDelta != -3 ||
+		second.XDelta != 40000-32767 || second.YDelta != 0 {
+		t.Errorf("relative events %+v %+v", first, second)
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	toggles := make(chan uint32, 1)
+	conns := make(chan *server.Conn, 1)
+	addr, _ := startServer(t, &server.Config{}, func(conn *server.Conn) {
+		conn.OnSynchronize(func(flags uint32) { toggles <- flags })
+		if conn.Handshake(context.Background()) == nil {
+			conns <- conn
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewRdpClient(addr, 800, 600)
+	c.SyncLockKeys(true, true, false, false)
+	if err := c.ConnectContext(ctx, Config{User: "user", TLSConfig: insecure, Protocols: []uint32{x224.PROTOCOL_SSL}}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case flags := <-toggles:
+		if flags != pdu.TS_SYNC_CAPS_LOCK|pdu.TS_SYNC_NUM_LOCK {
+			t.Errorf("toggle flags 0x%x", flags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no synchronize event after activation")
+	}
+
+	leds := make(chan [4]bool, 1)
+	c.OnKeyboardIndicators(func(caps, num, scroll, kana bool) {
+		leds <- [4]bool{caps, num, scroll, kana}
+	})
+	conn := <-conns
+	conn.SetKeyboardIndicators(pdu.TS_SYNC_SCROLL_LOCK)
+	select {
+	case l := <-leds:
+		if l != [4]bool{false, false, true, false} {
+			t.Error("indicators", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("indicators timeout")
+	}
+}
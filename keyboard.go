@@ -0,0 +1,197 @@
+package grdp
+
+import (
+	"fmt"
+	"log/slog"
+	"unicode/utf16"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/t125/gcc"
+)
+
+// scancodes of the keys typed along with the characters
+const (
+	SCANCODE_BACKSPACE = 0x0e
+	SCANCODE_TAB       = 0x0f
+	SCANCODE_ENTER     = 0x1c
+	SCANCODE_LSHIFT    = 0x2a
+	SCANCODE_ALT       = 0x38
+	SCANCODE_SPACE     = 0x39
+)
+
+// layoutScancodes are the keys of the character rows, from the one of the digits
+// down to the bottom one. The ISO key next to the left shift comes first in it.
+var layoutScancodes = []uint16{
+	0x29, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x2b,
+	0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28,
+	0x56, 0x2c, 0x2d, 0x2e, 0x2f, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35,
+}
+
+// keyLayers are the characters of layoutScancodes without modifier, with shift
+// and with AltGr, a space is a key without character or a dead key
+type keyLayers [3]string
+
+var keyboardLayouts = map[gcc.KeyboardLayout]keyLayers{
+	gcc.US: {
+		"`1234567890-=" + "qwertyuiop[]\\" + "asdfghjkl;'" + " zxcvbnm,./",
+		"~!@#$%^&*()_+" + "QWERTYUIOP{}|" + "ASDFGHJKL:\"" + " ZXCVBNM<>?",
+		"",
+	},
+	gcc.GERMAN: {
+		" 1234567890ß " + "qwertzuiopü+#" + "asdfghjklöä" + "<yxcvbnm,.-",
+		"°!\"§$%&/()=? " + "QWERTZUIOPÜ*'" + "ASDFGHJKLÖÄ" + ">YXCVBNM;:_",
+		"  ²³   {[]}\\ " + "@ €        ~ " + "           " + "|      µ   ",
+	},
+}
+
+// keystroke types a character of a layout
+type keystroke struct {
+	code         uint16
+	shift, altGr bool
+}
+
+// layoutKeystrokes maps the characters of a layout to their keys
+func layoutKeystrokes(layout gcc.KeyboardLayout) (map[rune]keystroke, bool) {
+	layers, ok := keyboardLayouts[layout]
+	if !ok {
+		return nil, false
+	}
+	keys := map[rune]keystroke{' ': {code: SCANCODE_SPACE}}
+	for i, layer := range layers {
+		for j, c := range []rune(layer) {
+			if _, ok := keys[c]; ok || c == ' ' {
+				continue
+			}
+			keys[c] = keystroke{code: layoutScancodes[j], shift: i == 1, altGr: i == 2}
+		}
+	}
+	return keys, true
+}
+
+func keyEvents(code uint16, flags uint16) []pdu.InputEvent {
+	return []pdu.InputEvent{
+		&pdu.ScancodeKeyEvent{KeyCode: code, KeyboardFlags: flags},
+		&pdu.ScancodeKeyEvent{KeyCode: code, KeyboardFlags: flags | pdu.KBDFLAGS_RELEASE},
+	}
+}
+
+// textEvents are the key events typing text, unicode ones or else the scancodes
+// of the keyboard layout. Tabs, new lines and backspaces are typed as their keys.
+func textEvents(text string, unicode bool, layout gcc.KeyboardLayout) ([]pdu.InputEvent, error) {
+	var keys map[rune]keystroke
+	if !unicode {
+		var ok bool
+		if keys, ok = layoutKeystrokes(layout); !ok {
+			return nil, fmt.Errorf("no scancodes for the keyboard layout 0x%08x", uint32(layout))
+		}
+	}
+	runes := []rune(text)
+	events := make([]pdu.InputEvent, 0, 2*len(runes))
+	for i, c := range runes {
+		switch c {
+		case '\r':
+			if i+1 < len(runes) && runes[i+1] == '\n' {
+				continue
+			}
+			events = append(events, keyEvents(SCANCODE_ENTER, 0)...)
+			continue
+		case '\n':
+			events = append(events, keyEvents(SCANCODE_ENTER, 0)...)
+			continue
+		case '\t':
+			events = append(events, keyEvents(SCANCODE_TAB, 0)...)
+			continue
+		case '\b':
+			events = append(events, keyEvents(SCANCODE_BACKSPACE, 0)...)
+			continue
+		}
+
+		if unicode {
+			// characters past the BMP are sent as their surrogate pair
+			for _, u := range utf16.Encode([]rune{c}) {
+				events = append(events,
+					&pdu.UnicodeKeyEvent{Unicode: u},
+					&pdu.UnicodeKeyEvent{Unicode: u, KeyboardFlags: pdu.KBDFLAGS_RELEASE})
+			}
+			continue
+		}
+
+		k, ok := keys[c]
+		if !ok {
+			return nil, fmt.Errorf("no key for %q in the keyboard layout 0x%08x", c, uint32(layout))
+		}
+		switch {
+		case k.shift:
+			events = append(events, &pdu.ScancodeKeyEvent{KeyCode: SCANCODE_LSHIFT})
+		case k.altGr:
+			events = append(events, &pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ALT, KeyboardFlags: pdu.KBDFLAGS_EXTENDED})
+		}
+		events = append(events, keyEvents(k.code, 0)...)
+		switch {
+		case k.shift:
+			events = append(events, &pdu.ScancodeKeyEvent{KeyCode: SCANCODE_LSHIFT, KeyboardFlags: pdu.KBDFLAGS_RELEASE})
+		case k.altGr:
+			events = append(events, &pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ALT, KeyboardFlags: pdu.KBDFLAGS_EXTENDED | pdu.KBDFLAGS_RELEASE})
+		}
+	}
+	return events, nil
+}
+
+// TypeText types text with unicode key events, or with the scancodes of
+// KbdLayout when the server does not take unicode input. A character missing
+// from the layout fails before anything is sent.
+func (g *RdpClient) TypeText(text string) error {
+	slog.Debug("TypeText", "len", len(text))
+	unicode := g.pdu.ServerInputFlags()&pdu.INPUT_FLAG_UNICODE != 0
+	events, err := textEvents(text, unicode, gcc.KeyboardLayout(KbdLayout))
+	if err != nil {
+		return err
+	}
+	g.pdu.SendInput(events...)
+	return nil
+}
+
+// SyncLockKeys sets the toggle keys of the session to the local ones, they are
+// synchronized again after each activation
+func (g *RdpClient) SyncLockKeys(caps, num, scroll, kana bool) {
+	g.lockKeys = 0
+	if caps {
+		g.lockKeys |= pdu.TS_SYNC_CAPS_LOCK
+	}
+	if num {
+		g.lockKeys |= pdu.TS_SYNC_NUM_LOCK
+	}
+	if scroll {
+		g.lockKeys |= pdu.TS_SYNC_SCROLL_LOCK
+	}
+	if kana {
+		g.lockKeys |= pdu.TS_SYNC_KANA_LOCK
+	}
+	if g.eventReady {
+		g.sendLockKeys()
+	}
+}
+
+func (g *RdpClient) sendLockKeys() {
+	slog.Debug("sendLockKeys", "flags", g.lockKeys)
+	g.pdu.SendInput(&pdu.SynchronizeEvent{ToggleFlags: g.lockKeys})
+}
+
+// OnKeyboardIndicators is called when the server turns the lock key LEDs on or off
+func (g *RdpClient) OnKeyboardIndicators(f func(caps, num, scroll, kana bool)) *RdpClient {
+	g.pdu.On("keyboard_indicators", func(flags uint16) {
+		f(flags&pdu.TS_SYNC_CAPS_LOCK != 0, flags&pdu.TS_SYNC_NUM_LOCK != 0,
+			flags&pdu.TS_SYNC_SCROLL_LOCK != 0, flags&pdu.TS_SYNC_KANA_LOCK != 0)
+	})
+	return g
+}
+
+// OnImeStatus is called when the IME of the session opens or closes, convMode
+// holds the IME_CMODE_* conversion mode
+func (g *RdpClient) OnImeStatus(f func(open bool, convMode uint32)) *RdpClient {
+	g.pdu.On("ime_status", func(state, convMode uint32) {
+		f(state != 0, convMode)
+	})
+	return g
+}
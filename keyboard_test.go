@@ -0,0 +1,65 @@
+package grdp
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/t125/gcc"
+)
+
+func TestKeyboardLayouts(t *testing.T) {
+	for layout, layers := range keyboardLayouts {
+		for i, layer := range layers {
+			if n := utf8.RuneCountInString(layer); layer != "" && n != len(layoutScancodes) {
+				t.Errorf("layout 0x%x layer %d has %d keys", uint32(layout), i, n)
+			}
+		}
+	}
+}
+
+func TestTextEvents(t *testing.T) {
+	events, err := textEvents("a😀\r\n", true, gcc.US)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pdu.InputEvent{
+		&pdu.UnicodeKeyEvent{Unicode: 'a'},
+		&pdu.UnicodeKeyEvent{Unicode: 'a', KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.UnicodeKeyEvent{Unicode: 0xd83d},
+		&pdu.UnicodeKeyEvent{Unicode: 0xd83d, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.UnicodeKeyEvent{Unicode: 0xde00},
+		&pdu.UnicodeKeyEvent{Unicode: 0xde00, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ENTER},
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ENTER, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unicode events %+v", events)
+	}
+
+	events, err = textEvents("Z@", false, gcc.GERMAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []pdu.InputEvent{
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_LSHIFT},
+		&pdu.ScancodeKeyEvent{KeyCode: 0x15},
+		&pdu.ScancodeKeyEvent{KeyCode: 0x15, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_LSHIFT, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ALT, KeyboardFlags: pdu.KBDFLAGS_EXTENDED},
+		&pdu.ScancodeKeyEvent{KeyCode: 0x10},
+		&pdu.ScancodeKeyEvent{KeyCode: 0x10, KeyboardFlags: pdu.KBDFLAGS_RELEASE},
+		&pdu.ScancodeKeyEvent{KeyCode: SCANCODE_ALT, KeyboardFlags: pdu.KBDFLAGS_EXTENDED | pdu.KBDFLAGS_RELEASE},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("scancode events %+v", events)
+	}
+
+	if _, err = textEvents("é", false, gcc.US); err == nil {
+		t.Error("character missing from the layout typed")
+	}
+	if _, err = textEvents("a", false, gcc.JAPANESE); err == nil {
+		t.Error("layout without table typed")
+	}
+}
@@ -0,0 +1,298 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"log/slog"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+/**
+ * Rendering of the primary drawing orders
+ * @see MS-RDPEGDI 2.2.2.2.1.1 Primary Drawing Orders
+ */
+
+// hatchPatterns are the 8x8 rows of the hatched brushes, the lines are the cleared bits
+var hatchPatterns = [6][8]uint8{
+	pdu.HS_HORIZONTAL: {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff},
+	pdu.HS_VERTICAL:   {0xf7, 0xf7, 0xf7, 0xf7, 0xf7, 0xf7, 0xf7, 0xf7},
+	pdu.HS_FDIAGONAL:  {0xfe, 0xfd, 0xfb, 0xf7, 0xef, 0xdf, 0xbf, 0x7f},
+	pdu.HS_BDIAGONAL:  {0x7f, 0xbf, 0xdf, 0xef, 0xf7, 0xfb, 0xfd, 0xfe},
+	pdu.HS_CROSS:      {0xf7, 0xf7, 0xf7, 0xf7, 0xf7, 0xf7, 0x00, 0xf7},
+	pdu.HS_DIAGCROSS:  {0x7e, 0xbd, 0xdb, 0xe7, 0xe7, 0xdb, 0xbd, 0x7e},
+}
+
+// pixels of the raster operations are packed as 0xBBGGRR
+func pack(c color.RGBA) uint32 {
+	return uint32(c.R) | uint32(c.G)<<8 | uint32(c.B)<<16
+}
+
+func unpack(v uint32) color.RGBA {
+	return color.RGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), 0xff}
+}
+
+// rop3 combines the pattern, source and destination with a ternary raster operation,
+// bit P<<2|S<<1|D of rop is the result for these input bits
+func rop3(rop uint8, p, s, d uint32) uint32 {
+	switch rop {
+	case 0x00: // BLACKNESS
+		return 0
+	case 0xcc: // SRCCOPY
+		return s
+	case 0xf0: // PATCOPY
+		return p
+	case 0xff: // WHITENESS
+		return 0xffffff
+	}
+	var res uint32
+	for i := uint(0); i < 8; i++ {
+		if rop&(1<<i) == 0 {
+			continue
+		}
+		t := ^uint32(0)
+		if i&4 != 0 {
+			t &= p
+		} else {
+			t &= ^p
+		}
+		if i&2 != 0 {
+			t &= s
+		} else {
+			t &= ^s
+		}
+		if i&1 != 0 {
+			t &= d
+		} else {
+			t &= ^d
+		}
+		res |= t
+	}
+	return res & 0xffffff
+}
+
+// rop2ToRop3 converts the binary raster operations of the pens, R2_BLACK is 1
+func rop2ToRop3(rop2 uint8) uint8 {
+	n := (rop2 - 1) & 0xf
+	var rop uint8
+	for i := uint(0); i < 8; i++ {
+		p, d := i>>2&1, i&1
+		if n>>(p*2+d)&1 != 0 {
+			rop |= 1 << i
+		}
+	}
+	return rop
+}
+
+// ropUses tells whether the result of rop depends on the pattern and on the source
+func ropUses(rop uint8) (pattern, source bool) {
+	return (rop>>4)&0x0f != rop&0x0f, (rop>>2)&0x33 != rop&0x33
+}
+
+type pixelSource func(x, y int) uint32
+
+func solid(c color.RGBA) pixelSource {
+	v := pack(c)
+	return func(x, y int) uint32 {
+		return v
+	}
+}
+
+// brush returns the pattern of b, the set bits of monochrome patterns take the background
+func (f *Framebuffer) brush(b pdu.Brush, fg, bg color.RGBA) pixelSource {
+	var rows [8]uint8
+	switch {
+	case b.Style&pdu.CACHED_BRUSH != 0:
+		slog.Debug("cached brush is drawn solid", "index", b.Hatch)
+		return solid(fg)
+	case b.Style == pdu.BS_HATCHED && int(b.Hatch) < len(hatchPatterns):
+		rows = hatchPatterns[b.Hatch]
+	case b.Style == pdu.BS_PATTERN && len(b.Data) == 8:
+		copy(rows[:], b.Data)
+	default:
+		return solid(fg)
+	}
+	front, back := pack(fg), pack(bg)
+	return func(x, y int) uint32 {
+		if rows[(y-int(b.Y))&7]&(0x80>>uint((x-int(b.X))&7)) != 0 {
+			return back
+		}
+		return front
+	}
+}
+
+// screen copies r of the desktop, sources may overlap the destination
+func (f *Framebuffer) screen(r image.Rectangle) pixelSource {
+	r = r.Intersect(f.img.Rect)
+	tmp := image.NewRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(tmp.Pix[tmp.PixOffset(r.Min.X, y):tmp.PixOffset(r.Max.X, y)], f.img.Pix[f.img.PixOffset(r.Min.X, y):f.img.PixOffset(r.Max.X, y)])
+	}
+	return bitmapSource(tmp, 0, 0)
+}
+
+// bitmapSource reads img translated by dx, dy, pixels outside of it are black
+func bitmapSource(img *image.RGBA, dx, dy int) pixelSource {
+	return func(x, y int) uint32 {
+		p := image.Pt(x+dx, y+dy)
+		if !p.In(img.Rect) {
+			return 0
+		}
+		return pack(img.RGBAAt(p.X, p.Y))
+	}
+}
+
+// blit runs rop over r, clipped by clip
+func (f *Framebuffer) blit(r, clip image.Rectangle, rop uint8, pattern, source pixelSource) image.Rectangle {
+	r = r.Intersect(clip)
+	usesPattern, usesSource := ropUses(rop)
+	var p, s uint32
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if usesPattern && pattern != nil {
+				p = pattern(x, y)
+			}
+			if usesSource && source != nil {
+				s = source(x, y)
+			}
+			d := pack(f.img.RGBAAt(x, y))
+			f.img.SetRGBA(x, y, unpack(rop3(rop, p, s, d)))
+		}
+	}
+	return r
+}
+
+// clip is the area an order may paint
+func (f *Framebuffer) clip(o pdu.OrderPdu) image.Rectangle {
+	if !o.HasBounds() {
+		return f.img.Rect
+	}
+	b := o.Primary.Bounds
+	return image.Rect(int(b.Left), int(b.Top), int(b.Right)+1, int(b.Bottom)+1).Intersect(f.img.Rect)
+}
+
+func orderRect(x, y, cx, cy int32) image.Rectangle {
+	return image.Rect(int(x), int(y), int(x+cx), int(y+cy))
+}
+
+// applyPrimary paints a primary order and returns the area it changed
+func (f *Framebuffer) applyPrimary(o pdu.OrderPdu) image.Rectangle {
+	clip := f.clip(o)
+	switch d := o.Primary.Data.(type) {
+	case *pdu.Dstblt:
+		return f.blit(orderRect(d.X, d.Y, d.Cx, d.Cy), clip, d.Opcode, nil, nil)
+
+	case *pdu.Patblt:
+		pattern := f.brush(d.Brush, f.orderColor(d.Fgcolour), f.orderColor(d.Bgcolour))
+		return f.blit(orderRect(d.X, d.Y, d.Cx, d.Cy), clip, d.Opcode, pattern, nil)
+
+	case *pdu.Scrblt:
+		r := orderRect(d.X, d.Y, d.Cx, d.Cy)
+		dx, dy := int(d.Srcx-d.X), int(d.Srcy-d.Y)
+		src := f.screen(r.Add(image.Pt(dx, dy)))
+		return f.blit(r, clip, d.Opcode, nil, func(x, y int) uint32 {
+			return src(x+dx, y+dy)
+		})
+
+	case *pdu.OpaqueRect:
+		return f.blit(orderRect(d.X, d.Y, d.Cx, d.Cy), clip, 0xf0, solid(f.orderColor(d.Colour)), nil)
+
+	case *pdu.LineTo:
+		return f.line(d, clip)
+
+	case *pdu.Memblt:
+		bm := f.cachedBitmap(d.CacheId, d.CacheIdx)
+		if bm == nil {
+			slog.Debug("MemBlt of a missing bitmap", "cacheId", d.CacheId, "cacheIdx", d.CacheIdx)
+			return image.Rectangle{}
+		}
+		return f.blit(orderRect(d.X, d.Y, d.Cx, d.Cy), clip, d.Opcode, nil,
+			bitmapSource(bm, int(d.Srcx-d.X), int(d.Srcy-d.Y)))
+
+	case *pdu.Mem3blt:
+		bm := f.cachedBitmap(d.CacheId, d.CacheIdx)
+		if bm == nil {
+			slog.Debug("Mem3Blt of a missing bitmap", "cacheId", d.CacheId, "cacheIdx", d.CacheIdx)
+			return image.Rectangle{}
+		}
+		pattern := f.brush(d.Brush, f.orderColor(d.Fgcolour), f.orderColor(d.Bgcolour))
+		return f.blit(orderRect(d.X, d.Y, d.Cx, d.Cy), clip, d.Opcode, pattern,
+			bitmapSource(bm, int(d.Srcx-d.X), int(d.Srcy-d.Y)))
+
+	case *pdu.GlyphIndex:
+		// its rectangles are inclusive
+		t := textOrder{
+			cacheId:   d.CacheId,
+			flAccel:   d.FlAccel,
+			ulCharInc: d.UlCharInc,
+			back:      f.orderColor(d.BackColor),
+			fore:      f.orderColor(d.ForeColor),
+			bk:        textRect(d.BkLeft, d.BkTop, d.BkRight+1, d.BkBottom+1),
+			op:        textRect(d.OpLeft, d.OpTop, d.OpRight+1, d.OpBottom+1),
+			x:         int(d.X),
+			y:         int(d.Y),
+		}
+		if d.FOpRedundant != 0 {
+			t.op = t.bk
+		}
+		return f.applyText(t, d.Data, clip)
+
+	case *pdu.FastIndex:
+		t := f.fastTextOrder(d.CacheId, d.UlCharInc, d.FlAccel, d.BackColor, d.ForeColor,
+			[4]int32{d.BkLeft, d.BkTop, d.BkRight, d.BkBottom}, [4]int32{d.OpLeft, d.OpTop, d.OpRight, d.OpBottom}, d.X, d.Y)
+		return f.applyText(t, d.Data, clip)
+
+	case *pdu.FastGlyph:
+		t := f.fastTextOrder(d.CacheId, d.UlCharInc, d.FlAccel, d.BackColor, d.ForeColor,
+			[4]int32{d.BkLeft, d.BkTop, d.BkRight, d.BkBottom}, [4]int32{d.OpLeft, d.OpTop, d.OpRight, d.OpBottom}, d.X, d.Y)
+		if d.Glyph != nil {
+			f.glyphs.put(d.CacheId, d.Glyph)
+		}
+		// a single glyph at the origin
+		return f.applyText(t, []byte{d.CacheIndex}, clip)
+	}
+	slog.Debug("primary order not painted", "type", o.Primary.Data.Type())
+	return image.Rectangle{}
+}
+
+// line draws a one pixel wide pen, the end point is excluded like in GDI
+func (f *Framebuffer) line(d *pdu.LineTo, clip image.Rectangle) image.Rectangle {
+	if d.Pen.Style == pdu.PS_NULL {
+		return image.Rectangle{}
+	}
+	rop := rop2ToRop3(d.Opcode)
+	pen := pack(f.orderColor(d.Pen.Colour))
+	x0, y0, x1, y1 := int(d.Startx), int(d.Starty), int(d.Endx), int(d.Endy)
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x1 < x0 {
+		sx = -1
+	}
+	if y1 < y0 {
+		sy = -1
+	}
+	dirty := image.Rectangle{}
+	for e := dx + dy; x0 != x1 || y0 != y1; {
+		if p := image.Pt(x0, y0); p.In(clip) {
+			f.img.SetRGBA(x0, y0, unpack(rop3(rop, pen, 0, pack(f.img.RGBAAt(x0, y0)))))
+			dirty = dirty.Union(image.Rect(x0, y0, x0+1, y0+1))
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+	return dirty
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
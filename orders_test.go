@@ -0,0 +1,112 @@
+package grdp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+func TestRop3(t *testing.T) {
+	const p, s, d = 0xf0f0f0, 0xcccccc, 0xaaaaaa
+	for rop := 0; rop < 256; rop++ {
+		// with these inputs the result repeats the truth table
+		if got := rop3(uint8(rop), p, s, d); got != uint32(rop)*0x010101 {
+			t.Errorf("rop 0x%02x: 0x%06x", rop, got)
+		}
+	}
+	// R2_COPYPEN, R2_NOT, R2_XORPEN
+	for rop2, want := range map[uint8]uint8{13: 0xf0, 6: 0x55, 7: 0x5a} {
+		if got := rop2ToRop3(rop2); got != want {
+			t.Errorf("rop2 %d: 0x%02x", rop2, got)
+		}
+	}
+}
+
+func primary(flags uint8, bounds pdu.Bounds, order pdu.PrimaryOrder) pdu.OrderPdu {
+	return pdu.OrderPdu{
+		ControlFlags: pdu.TS_STANDARD | flags,
+		Type:         pdu.ORDER_PRIMARY,
+		Primary:      &pdu.Primary{Bounds: bounds, Data: order},
+	}
+}
+
+func TestFramebufferPrimaryOrders(t *testing.T) {
+	f, e := testFramebuffer(24)
+	white := [4]uint8{0xff, 0xff, 0xff}
+	e.Emit("orders", []pdu.OrderPdu{
+		// WHITENESS clipped to the left half
+		primary(pdu.TS_BOUNDS, pdu.Bounds{Left: 0, Top: 0, Right: 7, Bottom: 15}, &pdu.Dstblt{X: 0, Y: 0, Cx: 16, Cy: 16, Opcode: 0xff}),
+		// DSTINVERT of the first row
+		primary(0, pdu.Bounds{}, &pdu.Dstblt{X: 0, Y: 0, Cx: 16, Cy: 1, Opcode: 0x55}),
+		// PATCOPY of a vertical hatch, the line is in the fg color
+		primary(0, pdu.Bounds{}, &pdu.Patblt{X: 8, Y: 8, Cx: 8, Cy: 8, Opcode: 0xf0,
+			Fgcolour: [4]uint8{0xff}, Bgcolour: white, Brush: pdu.Brush{Style: pdu.BS_HATCHED, Hatch: pdu.HS_VERTICAL}}),
+		// PATCOPY of a diagonal pattern, its set bits are in the bg color
+		primary(0, pdu.Bounds{}, &pdu.Patblt{X: 0, Y: 8, Cx: 8, Cy: 8, Opcode: 0xf0,
+			Fgcolour: [4]uint8{0xff}, Bgcolour: white, Brush: pdu.Brush{Style: pdu.BS_PATTERN,
+				Data: []byte{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}}}),
+		// R2_COPYPEN line from 8,2 to 12,2
+		primary(0, pdu.Bounds{}, &pdu.LineTo{Startx: 8, Starty: 2, Endx: 12, Endy: 2, Opcode: 13,
+			Pen: pdu.Pen{Colour: [4]uint8{0, 0xff}}}),
+	})
+	img := f.Snapshot()
+	black, whiteC := color.RGBA{0, 0, 0, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}
+	red, green := color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0xff, 0, 0xff}
+	want := map[image.Point]color.RGBA{
+		{0, 0}: black, {10, 0}: whiteC, // inverted
+		{3, 5}: whiteC, {9, 5}: {}, // clipped
+		{12, 9}: red, {13, 9}: whiteC, // hatch
+		{0, 8}: whiteC, {1, 8}: red, {7, 15}: whiteC, {6, 15}: red, // pattern
+		{8, 2}: green, {11, 2}: green, {12, 2}: {}, // end point excluded
+	}
+	for p, c := range want {
+		if got := img.RGBAAt(p.X, p.Y); got != c {
+			t.Errorf("pixel %v: %v, want %v", p, got, c)
+		}
+	}
+}
+
+func TestFramebufferText(t *testing.T) {
+	f, e := testFramebuffer(32)
+	red, blue := [4]uint8{0xff, 0, 0}, [4]uint8{0, 0, 0xff}
+	e.Emit("orders", []pdu.OrderPdu{
+		{Type: pdu.ORDER_SECONDARY, Secondary: &pdu.Secondary{Data: &pdu.CacheGlyphOrder{Glyphs: []pdu.Glyph{
+			{CacheIndex: 1, Y: -1, Cx: 2, Cy: 1, Aj: []byte{0xc0, 0, 0, 0}},
+			{CacheIndex: 2, Cx: 1, Cy: 1, Aj: []byte{0x80, 0, 0, 0}},
+		}}}},
+		// glyph 1 at the origin and glyph 2 three pixels right, kept as fragment 0
+		primary(0, pdu.Bounds{}, &pdu.GlyphIndex{
+			BackColor: red, ForeColor: blue,
+			BkRight: 7, BkBottom: 3, OpRight: 7, OpBottom: 3,
+			X: 1, Y: 2, Data: []byte{1, 0, 2, 3, pdu.GLYPH_FRAGMENT_ADD, 0, 4},
+		}),
+		// the fragment again two pixels right of the origin, without background
+		primary(0, pdu.Bounds{}, &pdu.FastIndex{
+			BackColor: red, ForeColor: blue,
+			BkTop: 8, BkRight: 8, BkBottom: 12,
+			Y: 10, Data: []byte{pdu.GLYPH_FRAGMENT_USE, 0, 2},
+		}),
+		// with a fixed advance of 4 the glyphs and fragments have no delta
+		primary(0, pdu.Bounds{}, &pdu.FastIndex{
+			BackColor: red, ForeColor: blue, UlCharInc: 4,
+			BkTop: 13, BkRight: 16, BkBottom: 16,
+			Y: 14, Data: []byte{2, pdu.GLYPH_FRAGMENT_ADD, 1, 1, pdu.GLYPH_FRAGMENT_USE, 1, 2},
+		}),
+	})
+	img := f.Snapshot()
+	want := map[image.Point]color.RGBA{
+		{1, 1}: {0xff, 0, 0, 0xff}, {2, 1}: {0xff, 0, 0, 0xff}, {4, 2}: {0xff, 0, 0, 0xff},
+		{0, 0}: {0, 0, 0xff, 0xff}, {3, 2}: {0, 0, 0xff, 0xff}, {7, 3}: {0, 0, 0xff, 0xff},
+		{2, 9}: {0xff, 0, 0, 0xff}, {3, 9}: {0xff, 0, 0, 0xff}, {5, 10}: {0xff, 0, 0, 0xff},
+		{4, 10}: {0, 0, 0, 0}, {8, 3}: {0, 0, 0, 0},
+		{0, 14}: {0xff, 0, 0, 0xff}, {4, 14}: {0xff, 0, 0, 0xff}, {8, 14}: {0xff, 0, 0, 0xff},
+		{12, 14}: {0, 0, 0, 0},
+	}
+	for p, c := range want {
+		if got := img.RGBAAt(p.X, p.Y); got != c {
+			t.Errorf("pixel %v: %v, want %v", p, got, c)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/sergei-bronnikov/grdp/core"
 	"github.com/sergei-bronnikov/grdp/emission"
+	"github.com/sergei-bronnikov/grdp/protocol/bulk"
 )
 
 const (
@@ -175,6 +176,7 @@ const (
 
 const (
 	RDPGFX_DVC_CHANNEL_NAME = "Microsoft::Windows::RDS::Graphics" // Graphics Extension
+	RDPEI_DVC_CHANNEL_NAME  = "Microsoft::Windows::RDS::Input"    // Input Extension
 )
 
 var StaticVirtualChannels = map[string]int{
@@ -194,6 +196,14 @@ const (
 	CHANNEL_FLAG_SHOW_PROTOCOL = 0x10
 )
 
+// compression of the chunks, the high bytes of the flags are the bulk compression flags
+const (
+	CHANNEL_PACKET_COMPRESSED = 0x00200000
+	CHANNEL_PACKET_AT_FRONT   = 0x00400000
+	CHANNEL_PACKET_FLUSHED    = 0x00800000
+	ChannelCompressionMask    = 0x00EF0000
+)
+
 type ChannelTransport interface {
 	GetType() (string, uint32)
 	Sender(core.ChannelSender)
@@ -210,6 +220,8 @@ type Channels struct {
 	transport     core.Transport
 	buff          *bytes.Buffer
 	channelSender core.ChannelSender
+	// bulk decompresses the chunks, the channels share a history apart from the updates
+	bulk *bulk.Decompressor
 }
 
 func NewChannels(t core.Transport) *Channels {
@@ -218,6 +230,7 @@ func NewChannels(t core.Transport) *Channels {
 		channels:  make(map[string]ChannelClient, 20),
 		transport: t,
 		buff:      &bytes.Buffer{},
+		bulk:      bulk.NewDecompressor(),
 	}
 	t.On("channel", c.process)
 	return c
@@ -284,18 +297,25 @@ func (c *Channels) process(channel string, s []byte) {
 	ln, _ := core.ReadUInt32LE(r)
 	flags, _ := core.ReadUInt32LE(r)
 	slog.Debug(fmt.Sprintf("channel:%s length: %d, flags: %d", channel, ln, flags))
+	b, _ := core.ReadBytes(r.Len(), r)
+	if compression := uint8((flags & ChannelCompressionMask) >> 16); bulk.Compressed(compression) {
+		var err error
+		if b, err = c.bulk.Decompress(b, compression); err != nil {
+			slog.Error("channel decompress", "channel", channel, "err", err)
+			return
+		}
+	}
 	if flags&CHANNEL_FLAG_FIRST == 0 || flags&CHANNEL_FLAG_LAST == 0 {
 		if flags&CHANNEL_FLAG_FIRST != 0 {
 			c.buff.Reset()
 		}
-		b, _ := core.ReadBytes(r.Len(), r)
 		c.buff.Write(b)
 		if flags&CHANNEL_FLAG_LAST == 0 {
 			return
 		}
 		s = c.buff.Bytes()
 	} else {
-		s, _ = core.ReadBytes(r.Len(), r)
+		s = b
 	}
 
 	cli.t.Process(s)
@@ -2,7 +2,6 @@ package drdynvc
 
 import (
 	"bytes"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,6 +10,11 @@ import (
 	"github.com/sergei-bronnikov/grdp/plugin"
 )
 
+/**
+ * Dynamic virtual channels multiplexed over the drdynvc static channel
+ * @see MS-RDPEDYC 2.2 Message Syntax
+ */
+
 const (
 	ChannelName   = plugin.DRDYNVC_SVC_CHANNEL_NAME
 	ChannelOption = plugin.CHANNEL_OPTION_INITIALIZED |
@@ -19,6 +23,9 @@ const (
 
 const (
 	MAX_DVC_CHANNELS = 20
+	// MAX_DVC_MESSAGE_SIZE bounds the length announced by DATA_FIRST, the
+	// fragments of a longer message are dropped instead of reassembled
+	MAX_DVC_MESSAGE_SIZE = 64 << 20
 )
 
 const (
@@ -33,25 +40,51 @@ const (
 	DYNVC_SOFT_SYNC_RESPONSE    = 0x09
 )
 
+// DVC_VERSION is the highest version of the client, version 3 adds compression
+const DVC_VERSION = 2
+
+// creation status of the channels nobody listens to
+const E_FAIL = 0x80004005
+
+// ChannelListener is told when the server opens and closes a dynamic channel
+type ChannelListener interface {
+	Opened()
+	Closed()
+}
+
 type ChannelClient struct {
-	name          string
-	id            uint32
-	channelSender core.ChannelSender
+	name string
+	id   uint32
+	t    plugin.ChannelTransport
+	// data reassembles a message split in DATA_FIRST and DATA
+	data   *bytes.Buffer
+	length int
+	// drop skips the fragments of a message above MAX_DVC_MESSAGE_SIZE
+	drop bool
 }
 
 type DvcClient struct {
-	w        core.ChannelSender
-	channels map[string]ChannelClient
+	w         core.ChannelSender
+	listeners map[string]plugin.ChannelTransport
+	channels  map[uint32]*ChannelClient
 }
 
 func NewDvcClient() *DvcClient {
 	return &DvcClient{
-		channels: make(map[string]ChannelClient, 100),
+		listeners: make(map[string]plugin.ChannelTransport),
+		channels:  make(map[uint32]*ChannelClient, MAX_DVC_CHANNELS),
 	}
 }
 
-func (c *DvcClient) LoadAddin(f core.ChannelSender) {
-
+// Register accepts the dynamic channel of t when the server creates it
+func (c *DvcClient) Register(t plugin.ChannelTransport) {
+	name, _ := t.GetType()
+	if _, ok := c.listeners[name]; ok {
+		slog.Warn("Already register", "channel", name)
+		return
+	}
+	t.Sender(c)
+	c.listeners[name] = t
 }
 
 type DvcHeader struct {
@@ -71,19 +104,34 @@ func readHeader(r io.Reader) *DvcHeader {
 func (h *DvcHeader) serialize(channelId uint32) []byte {
 	b := &bytes.Buffer{}
 	core.WriteUInt8((h.cmd<<4)|(h.sp<<2)|h.cbChId, b)
-	if h.cbChId == 0 {
-		core.WriteUInt8(uint8(channelId), b)
-	} else if h.cbChId == 1 {
-		core.WriteUInt16LE(uint16(channelId), b)
-	} else {
-		core.WriteUInt32LE(channelId, b)
+	writeDvcValue(channelId, h.cbChId, b)
+	return b.Bytes()
+}
+
+// valueSize is the size code of v in the headers, 0 for 1 byte, 1 for 2 and 2 for 4
+func valueSize(v uint32) uint8 {
+	switch {
+	case v <= 0xff:
+		return 0
+	case v <= 0xffff:
+		return 1
 	}
+	return 2
+}
 
-	return b.Bytes()
+func writeDvcValue(v uint32, size uint8, w io.Writer) {
+	switch size {
+	case 0:
+		core.WriteUInt8(uint8(v), w)
+	case 1:
+		core.WriteUInt16LE(uint16(v), w)
+	default:
+		core.WriteUInt32LE(v, w)
+	}
 }
 
 func (c *DvcClient) Send(s []byte) (int, error) {
-	slog.Debug("len:", len(s), "data:", hex.EncodeToString(s))
+	slog.Debug("dvc send", "len", len(s))
 	name, _ := c.GetType()
 	return c.w.SendToChannel(name, s)
 }
@@ -94,43 +142,166 @@ func (c *DvcClient) GetType() (string, uint32) {
 	return ChannelName, ChannelOption
 }
 
+// SendToChannel writes s to the open dynamic channel, in chunks of the static channel
+func (c *DvcClient) SendToChannel(channel string, s []byte) (int, error) {
+	var ch *ChannelClient
+	for _, v := range c.channels {
+		if v.name == channel {
+			ch = v
+		}
+	}
+	if ch == nil {
+		return 0, fmt.Errorf("dynamic channel %s is not open", channel)
+	}
+	hdr := &DvcHeader{cmd: DYNVC_DATA, cbChId: valueSize(ch.id)}
+	max := plugin.CHANNEL_CHUNK_LENGTH - 1 - (1 << hdr.cbChId)
+	if len(s) <= max {
+		return c.Send(append(hdr.serialize(ch.id), s...))
+	}
+
+	first := &DvcHeader{cmd: DYNVC_DATA_FIRST, sp: valueSize(uint32(len(s))), cbChId: hdr.cbChId}
+	b := &bytes.Buffer{}
+	b.Write(first.serialize(ch.id))
+	writeDvcValue(uint32(len(s)), first.sp, b)
+	n := plugin.CHANNEL_CHUNK_LENGTH - b.Len()
+	b.Write(s[:n])
+	if _, err := c.Send(b.Bytes()); err != nil {
+		return 0, err
+	}
+	for n < len(s) {
+		end := min(n+max, len(s))
+		if _, err := c.Send(append(hdr.serialize(ch.id), s[n:end]...)); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
 func (c *DvcClient) Process(s []byte) {
-	slog.Debug("recv:", hex.EncodeToString(s))
+	if len(s) == 0 {
+		return
+	}
 	r := bytes.NewReader(s)
 	hdr := readHeader(r)
-	slog.Info(fmt.Sprintf("dvc: Cmd=0x%x, Sp=%d CbChId=%d all=%d", hdr.cmd, hdr.sp, hdr.cbChId, r.Len()))
+	slog.Debug(fmt.Sprintf("dvc: Cmd=0x%x, Sp=%d CbChId=%d all=%d", hdr.cmd, hdr.sp, hdr.cbChId, r.Len()))
 
 	b, _ := core.ReadBytes(r.Len(), r)
+	need := 1 << hdr.cbChId
+	if hdr.cmd == DYNVC_CAPABILITIES {
+		// pad and version
+		need = 3
+	}
+	if len(b) < need {
+		slog.Warn("dvc pdu too short", "cmd", hdr.cmd)
+		return
+	}
 
 	switch hdr.cmd {
 	case DYNVC_CAPABILITIES:
-		slog.Info("DYNVC_CAPABILITIES")
 		c.processCapsPdu(hdr, b)
 	case DYNVC_CREATE_REQ:
-		slog.Info("DYNVC_CREATE_REQ")
 		c.processCreateReq(hdr, b)
 	case DYNVC_DATA_FIRST:
-		slog.Info("DYNVC_DATA_FIRST")
+		c.processData(hdr, b, true)
 	case DYNVC_DATA:
-		slog.Info("DYNVC_DATA")
+		c.processData(hdr, b, false)
 	case DYNVC_CLOSE:
-		slog.Info("DYNVC_CLOSE")
+		c.processClose(hdr, b)
 	default:
 		slog.Error(fmt.Sprintf("type 0x%x not supported", hdr.cmd))
 	}
 }
+
 func (c *DvcClient) processCreateReq(hdr *DvcHeader, s []byte) {
 	r := bytes.NewReader(s)
 	channelId := readDvcId(r, hdr.cbChId)
 	name, _ := core.ReadBytes(r.Len(), r)
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
 	channelName := string(name)
 	slog.Info(fmt.Sprintf("Server requests channelId=%d, name=%s", channelId, channelName))
 
+	t, ok := c.listeners[channelName]
+	var status uint32 = E_FAIL
+	if ok && len(c.channels) < MAX_DVC_CHANNELS {
+		status = 0
+	}
+
 	//response
 	b := &bytes.Buffer{}
 	b.Write(hdr.serialize(channelId))
-	core.WriteUInt32LE(0, b)
+	core.WriteUInt32LE(status, b)
 	c.Send(b.Bytes())
+
+	if status != 0 {
+		return
+	}
+	c.channels[channelId] = &ChannelClient{name: channelName, id: channelId, t: t, data: &bytes.Buffer{}}
+	if l, ok := t.(ChannelListener); ok {
+		l.Opened()
+	}
+}
+
+// processData delivers the messages of the channels, first starts a fragmented one
+func (c *DvcClient) processData(hdr *DvcHeader, s []byte, first bool) {
+	r := bytes.NewReader(s)
+	channelId := readDvcId(r, hdr.cbChId)
+	ch, ok := c.channels[channelId]
+	if !ok {
+		slog.Warn("dvc data of an unknown channel", "id", channelId)
+		return
+	}
+	if first {
+		if r.Len() < 1<<hdr.sp {
+			return
+		}
+		ch.length = int(readDvcId(r, hdr.sp))
+		ch.data.Reset()
+		ch.drop = ch.length > MAX_DVC_MESSAGE_SIZE
+		if ch.drop {
+			slog.Warn("dvc message too long", "channel", ch.name, "length", ch.length)
+		}
+	}
+	b, _ := core.ReadBytes(r.Len(), r)
+	if ch.length == 0 {
+		ch.t.Process(b)
+		return
+	}
+	if ch.drop {
+		ch.length -= len(b)
+		if ch.length <= 0 {
+			ch.length = 0
+			ch.drop = false
+		}
+		return
+	}
+	ch.data.Write(b)
+	if ch.data.Len() < ch.length {
+		return
+	}
+	if ch.data.Len() > ch.length {
+		slog.Warn("dvc message longer than announced", "channel", ch.name, "length", ch.length, "received", ch.data.Len())
+	}
+	data := append([]byte(nil), ch.data.Bytes()...)
+	ch.length = 0
+	ch.data.Reset()
+	ch.t.Process(data)
+}
+
+func (c *DvcClient) processClose(hdr *DvcHeader, s []byte) {
+	r := bytes.NewReader(s)
+	channelId := readDvcId(r, hdr.cbChId)
+	ch, ok := c.channels[channelId]
+	if !ok {
+		return
+	}
+	delete(c.channels, channelId)
+	c.Send(hdr.serialize(channelId))
+	if l, ok := ch.t.(ChannelListener); ok {
+		l.Closed()
+	}
 }
 
 func readDvcId(r io.Reader, cbLen uint8) (id uint32) {
@@ -146,18 +317,15 @@ func readDvcId(r io.Reader, cbLen uint8) (id uint32) {
 	}
 	return
 }
+
 func (c *DvcClient) processCapsPdu(hdr *DvcHeader, s []byte) {
 	r := bytes.NewReader(s)
 	core.ReadUInt8(r)
 	ver, _ := core.ReadUint16LE(r)
 	slog.Info(fmt.Sprintf("Server supports dvc=%d", ver))
 
-	hdr.cmd = DYNVC_CAPABILITIES
-	hdr.cbChId = 0
-	hdr.sp = 0
-
 	b := &bytes.Buffer{}
 	core.WriteUInt16LE(0x0050, b)
-	core.WriteUInt16LE(ver, b)
+	core.WriteUInt16LE(min(ver, DVC_VERSION), b)
 	c.Send(b.Bytes())
 }
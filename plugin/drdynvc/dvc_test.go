@@ -0,0 +1,94 @@
+package drdynvc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/plugin"
+)
+
+type recorder struct {
+	sent [][]byte
+}
+
+func (r *recorder) SendToChannel(channel string, s []byte) (int, error) {
+	r.sent = append(r.sent, append([]byte(nil), s...))
+	return len(s), nil
+}
+
+type testChannel struct {
+	w        core.ChannelSender
+	received [][]byte
+	opened   bool
+}
+
+func (t *testChannel) GetType() (string, uint32)   { return "test", 0 }
+func (t *testChannel) Sender(w core.ChannelSender) { t.w = w }
+func (t *testChannel) Process(s []byte)            { t.received = append(t.received, s) }
+func (t *testChannel) Opened()                     { t.opened = true }
+func (t *testChannel) Closed()                     { t.opened = false }
+
+func TestDvcClient(t *testing.T) {
+	rec := &recorder{}
+	c := NewDvcClient()
+	c.Sender(rec)
+	ch := &testChannel{}
+	c.Register(ch)
+
+	c.Process([]byte{0x50, 0, 3, 0})
+	c.Process(append([]byte{0x10, 7}, "test\x00"...))
+	c.Process(append([]byte{0x10, 8}, "other\x00"...))
+	if !ch.opened {
+		t.Fatal("channel not opened")
+	}
+	want := [][]byte{{0x50, 0, 2, 0}, {0x10, 7, 0, 0, 0, 0}, {0x10, 8, 0x05, 0x40, 0, 0x80}}
+	for i, w := range want {
+		if !bytes.Equal(rec.sent[i], w) {
+			t.Errorf("response %d: %x, want %x", i, rec.sent[i], w)
+		}
+	}
+
+	// a message of 5 bytes in two parts, then a single one
+	c.Process([]byte{0x20, 7, 5, 1, 2})
+	c.Process([]byte{0x30, 7, 3, 4, 5})
+	c.Process([]byte{0x30, 7, 9})
+	if len(ch.received) != 2 || !bytes.Equal(ch.received[0], []byte{1, 2, 3, 4, 5}) || !bytes.Equal(ch.received[1], []byte{9}) {
+		t.Error("received", ch.received)
+	}
+
+	// the fragments of a message of 256 MiB are dropped
+	c.Process([]byte{0x28, 7, 0, 0, 0, 0x10, 1, 2})
+	c.Process([]byte{0x30, 7, 3, 4, 5})
+	if n := c.channels[7].data.Len(); n != 0 {
+		t.Error("buffered", n)
+	}
+	c.Process([]byte{0x20, 7, 2, 6, 7})
+	if len(ch.received) != 3 || !bytes.Equal(ch.received[2], []byte{6, 7}) {
+		t.Error("received", ch.received)
+	}
+
+	rec.sent = nil
+	big := bytes.Repeat([]byte{0xaa}, 2*plugin.CHANNEL_CHUNK_LENGTH)
+	if _, err := ch.w.SendToChannel("test", big); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.sent) != 3 || rec.sent[0][0] != 0x24 || rec.sent[1][0] != 0x30 {
+		t.Fatal("fragments", len(rec.sent))
+	}
+	total := 0
+	for _, s := range rec.sent {
+		if len(s) > plugin.CHANNEL_CHUNK_LENGTH {
+			t.Error("fragment too long", len(s))
+		}
+		total += len(s) - 2
+	}
+	if total != len(big)+2 {
+		t.Error("sent", total)
+	}
+
+	c.Process([]byte{0x40, 7})
+	if ch.opened {
+		t.Error("channel not closed")
+	}
+}
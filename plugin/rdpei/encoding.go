@@ -0,0 +1,53 @@
+package rdpei
+
+import "bytes"
+
+/**
+ * Variable length integers of the touch and pen events, the high bits of the
+ * first byte hold the number of bytes minus one, then the sign of signed ones
+ * @see MS-RDPEI 2.2.2 Variable Length Integers
+ */
+
+// writeVar writes v in as few bytes as it fits, it is clamped to the largest
+// magnitude of the encoding. cBits is 1 for the two-byte integers, 2 for the
+// four-byte ones and 3 for the eight-byte one.
+func writeVar(b *bytes.Buffer, v int64, cBits uint, signed bool) {
+	var sign byte
+	if v < 0 {
+		sign = 0x80 >> cBits
+		v = -v
+	}
+	bits := 8 - cBits
+	if signed {
+		bits--
+	}
+	n := uint(1)
+	for n < 1<<cBits && v >= 1<<(bits+8*(n-1)) {
+		n++
+	}
+	v = min(v, 1<<(bits+8*(n-1))-1)
+	b.WriteByte(byte(n-1)<<(8-cBits) | sign | byte(v>>(8*(n-1))))
+	for i := int(n) - 2; i >= 0; i-- {
+		b.WriteByte(byte(v >> (8 * i)))
+	}
+}
+
+func writeTwoByteUnsigned(b *bytes.Buffer, v uint32) {
+	writeVar(b, int64(v), 1, false)
+}
+
+func writeTwoByteSigned(b *bytes.Buffer, v int32) {
+	writeVar(b, int64(v), 1, true)
+}
+
+func writeFourByteUnsigned(b *bytes.Buffer, v uint32) {
+	writeVar(b, int64(v), 2, false)
+}
+
+func writeFourByteSigned(b *bytes.Buffer, v int32) {
+	writeVar(b, int64(v), 2, true)
+}
+
+func writeEightByteUnsigned(b *bytes.Buffer, v uint64) {
+	writeVar(b, int64(min(v, 1<<62)), 3, false)
+}
@@ -0,0 +1,380 @@
+// Package rdpei is the input extension, the touch and pen input of the client
+// go over a dynamic channel
+package rdpei
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/emission"
+	"github.com/sergei-bronnikov/grdp/plugin"
+)
+
+const (
+	ChannelName = plugin.RDPEI_DVC_CHANNEL_NAME
+)
+
+/**
+ * @see MS-RDPEI 2.2.3 Message Syntax
+ */
+const (
+	EVENTID_SC_READY                 = 0x0001
+	EVENTID_CS_READY                 = 0x0002
+	EVENTID_TOUCH                    = 0x0003
+	EVENTID_SUSPEND_INPUT            = 0x0004
+	EVENTID_RESUME_INPUT             = 0x0005
+	EVENTID_DISMISS_HOVERING_CONTACT = 0x0006
+	EVENTID_PEN                      = 0x0008
+)
+
+const (
+	RDPINPUT_PROTOCOL_V10  = 0x00010000
+	RDPINPUT_PROTOCOL_V101 = 0x00010001
+	RDPINPUT_PROTOCOL_V200 = 0x00020000
+	RDPINPUT_PROTOCOL_V300 = 0x00030000
+)
+
+// supportedFeatures of the server ready PDU
+const (
+	SC_READY_MULTIPEN_INJECTION_SUPPORTED = 0x00000001
+)
+
+// flags of the client ready PDU
+const (
+	READY_FLAGS_SHOW_TOUCH_VISUALS          = 0x00000001
+	READY_FLAGS_DISABLE_TIMESTAMP_INJECTION = 0x00000002
+	READY_FLAGS_ENABLE_MULTIPEN_INJECTION   = 0x00000004
+)
+
+/**
+ * @see MS-RDPEI 2.2.3.3.1.1 RDPINPUT_CONTACT_DATA
+ */
+const (
+	CONTACT_DATA_CONTACTRECT_PRESENT = 0x0001
+	CONTACT_DATA_ORIENTATION_PRESENT = 0x0002
+	CONTACT_DATA_PRESSURE_PRESENT    = 0x0004
+)
+
+const (
+	CONTACT_FLAG_DOWN      = 0x0001
+	CONTACT_FLAG_UPDATE    = 0x0002
+	CONTACT_FLAG_UP        = 0x0004
+	CONTACT_FLAG_INRANGE   = 0x0008
+	CONTACT_FLAG_INCONTACT = 0x0010
+	CONTACT_FLAG_CANCELED  = 0x0020
+)
+
+/**
+ * @see MS-RDPEI 2.2.3.7.1.1 RDPINPUT_PEN_CONTACT
+ */
+const (
+	PEN_CONTACT_PENFLAGS_PRESENT = 0x0001
+	PEN_CONTACT_PRESSURE_PRESENT = 0x0002
+	PEN_CONTACT_ROTATION_PRESENT = 0x0004
+	PEN_CONTACT_TILTX_PRESENT    = 0x0008
+	PEN_CONTACT_TILTY_PRESENT    = 0x0010
+)
+
+const (
+	PEN_FLAG_BARREL_PRESSED = 0x0001
+	PEN_FLAG_ERASER_PRESSED = 0x0002
+	PEN_FLAG_INVERTED       = 0x0004
+)
+
+// MAX_TOUCH_CONTACTS is the most contacts the client can announce
+const MAX_TOUCH_CONTACTS = 256
+
+var (
+	// ErrNotReady is returned until the server opened the channel and announced its version
+	ErrNotReady = errors.New("rdpei: the server is not ready for touch input")
+	// ErrSuspended is returned while the server suspends the input
+	ErrSuspended = errors.New("rdpei: input suspended by the server")
+)
+
+// TouchContact is an RDPINPUT_CONTACT_DATA, the optional fields are only sent
+// when their CONTACT_DATA_*_PRESENT flag is set in FieldsPresent
+type TouchContact struct {
+	ContactId     uint8
+	FieldsPresent uint16
+	X, Y          int32
+	// ContactFlags hold the CONTACT_FLAG_* state of the contact
+	ContactFlags uint32
+	// the rectangle of the contact area, relative to X and Y
+	RectLeft, RectTop, RectRight, RectBottom int16
+	// Orientation is in degrees, from 0 to 359
+	Orientation uint32
+	// Pressure is from 0 to 1024
+	Pressure uint32
+}
+
+// PenContact is an RDPINPUT_PEN_CONTACT, the optional fields are only sent
+// when their PEN_CONTACT_*_PRESENT flag is set in FieldsPresent
+type PenContact struct {
+	DeviceId      uint8
+	FieldsPresent uint16
+	X, Y          int32
+	// ContactFlags hold the CONTACT_FLAG_* state of the pen
+	ContactFlags uint32
+	// PenFlags hold the PEN_FLAG_* buttons
+	PenFlags uint32
+	// Pressure is from 0 to 1024
+	Pressure uint32
+	// Rotation is in degrees, from 0 to 359
+	Rotation uint16
+	// TiltX and TiltY are in degrees, from -90 to 90
+	TiltX, TiltY int16
+}
+
+type InputClient struct {
+	emission.Emitter
+	w           core.ChannelSender
+	maxContacts uint16
+
+	mu sync.Mutex
+	// version is the negotiated protocol version, 0 until the server is ready
+	version   uint32
+	multipen  bool
+	suspended bool
+	// the time of the last frames, the next ones carry their offset from them
+	lastTouch time.Time
+	lastPen   time.Time
+}
+
+// NewClient announces maxContacts simultaneous touch contacts to the server
+func NewClient(maxContacts uint16) *InputClient {
+	return &InputClient{
+		Emitter:     *emission.NewEmitter(),
+		maxContacts: min(maxContacts, MAX_TOUCH_CONTACTS),
+	}
+}
+
+func (c *InputClient) Send(s []byte) (int, error) {
+	name, _ := c.GetType()
+	return c.w.SendToChannel(name, s)
+}
+func (c *InputClient) Sender(f core.ChannelSender) {
+	c.w = f
+}
+func (c *InputClient) GetType() (string, uint32) {
+	return ChannelName, 0
+}
+
+// Version is the protocol version negotiated with the server, 0 until it is ready
+func (c *InputClient) Version() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// Opened waits for the server ready PDU
+func (c *InputClient) Opened() {
+	c.mu.Lock()
+	c.version, c.multipen, c.suspended = 0, false, false
+	c.lastTouch, c.lastPen = time.Time{}, time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *InputClient) Closed() {
+	slog.Info("rdpei channel closed")
+	c.mu.Lock()
+	c.version = 0
+	c.mu.Unlock()
+}
+
+func (c *InputClient) sendPDU(eventId uint16, body []byte) error {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(eventId, b)
+	core.WriteUInt32LE(uint32(6+len(body)), b)
+	b.Write(body)
+	_, err := c.Send(b.Bytes())
+	return err
+}
+
+// Process reads the RDPINPUT_HEADER of the messages of the server
+func (c *InputClient) Process(s []byte) {
+	for len(s) >= 6 {
+		eventId := binary.LittleEndian.Uint16(s)
+		length := int(binary.LittleEndian.Uint32(s[2:]))
+		if length < 6 || length > len(s) {
+			slog.Error("rdpei", "err", fmt.Sprintf("invalid pdu length %d", length))
+			return
+		}
+		c.processPDU(eventId, s[6:length])
+		s = s[length:]
+	}
+}
+
+func (c *InputClient) processPDU(eventId uint16, body []byte) {
+	switch eventId {
+	case EVENTID_SC_READY:
+		if len(body) < 4 {
+			slog.Error("rdpei", "err", "truncated server ready pdu")
+			return
+		}
+		c.recvServerReady(binary.LittleEndian.Uint32(body), body[4:])
+	case EVENTID_SUSPEND_INPUT:
+		c.mu.Lock()
+		c.suspended = true
+		c.mu.Unlock()
+		c.Emit("suspend")
+	case EVENTID_RESUME_INPUT:
+		c.mu.Lock()
+		c.suspended = false
+		c.mu.Unlock()
+		c.Emit("resume")
+	default:
+		slog.Debug("rdpei ignore pdu", "eventId", eventId)
+	}
+}
+
+// recvServerReady answers with the highest version both sides support
+func (c *InputClient) recvServerReady(serverVersion uint32, rest []byte) {
+	var features uint32
+	if len(rest) >= 4 {
+		features = binary.LittleEndian.Uint32(rest)
+	}
+	version := min(serverVersion, RDPINPUT_PROTOCOL_V300)
+	var flags uint32 = READY_FLAGS_SHOW_TOUCH_VISUALS
+	multipen := version >= RDPINPUT_PROTOCOL_V300 && features&SC_READY_MULTIPEN_INJECTION_SUPPORTED != 0
+	if multipen {
+		flags |= READY_FLAGS_ENABLE_MULTIPEN_INJECTION
+	}
+	slog.Info("rdpei server ready", "version", fmt.Sprintf("0x%08x", serverVersion), "features", features)
+
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(flags, b)
+	core.WriteUInt32LE(version, b)
+	core.WriteUInt16LE(c.maxContacts, b)
+	if err := c.sendPDU(EVENTID_CS_READY, b.Bytes()); err != nil {
+		slog.Error("rdpei", "err", err)
+		return
+	}
+	c.mu.Lock()
+	c.version, c.multipen, c.suspended = version, multipen, false
+	c.mu.Unlock()
+	c.Emit("ready", version)
+}
+
+// ready fails when the input cannot be sent, the lock is held on success
+func (c *InputClient) ready() error {
+	c.mu.Lock()
+	switch {
+	case c.version == 0:
+		c.mu.Unlock()
+		return ErrNotReady
+	case c.suspended:
+		c.mu.Unlock()
+		return ErrSuspended
+	}
+	return nil
+}
+
+// frameOffset is the time since the previous frame in microseconds, 0 for the first one
+func frameOffset(last *time.Time) uint64 {
+	now := time.Now()
+	var offset uint64
+	if !last.IsZero() {
+		offset = uint64(now.Sub(*last).Microseconds())
+	}
+	*last = now
+	return offset
+}
+
+// TouchFrame sends the state of the touch contacts at one instant in an
+// RDPINPUT_TOUCH_EVENT_PDU of a single frame
+func (c *InputClient) TouchFrame(contacts []TouchContact) error {
+	if len(contacts) > int(c.maxContacts) {
+		return fmt.Errorf("rdpei: %d contacts, %d announced", len(contacts), c.maxContacts)
+	}
+	if err := c.ready(); err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+
+	b := &bytes.Buffer{}
+	// the frame is encoded as soon as it is taken
+	writeFourByteUnsigned(b, 0)
+	writeTwoByteUnsigned(b, 1)
+	writeTwoByteUnsigned(b, uint32(len(contacts)))
+	writeEightByteUnsigned(b, frameOffset(&c.lastTouch))
+	for _, t := range contacts {
+		b.WriteByte(t.ContactId)
+		writeTwoByteUnsigned(b, uint32(t.FieldsPresent))
+		writeFourByteSigned(b, t.X)
+		writeFourByteSigned(b, t.Y)
+		writeFourByteUnsigned(b, t.ContactFlags)
+		if t.FieldsPresent&CONTACT_DATA_CONTACTRECT_PRESENT != 0 {
+			writeTwoByteSigned(b, int32(t.RectLeft))
+			writeTwoByteSigned(b, int32(t.RectTop))
+			writeTwoByteSigned(b, int32(t.RectRight))
+			writeTwoByteSigned(b, int32(t.RectBottom))
+		}
+		if t.FieldsPresent&CONTACT_DATA_ORIENTATION_PRESENT != 0 {
+			writeFourByteUnsigned(b, t.Orientation)
+		}
+		if t.FieldsPresent&CONTACT_DATA_PRESSURE_PRESENT != 0 {
+			writeFourByteUnsigned(b, t.Pressure)
+		}
+	}
+	return c.sendPDU(EVENTID_TOUCH, b.Bytes())
+}
+
+// PenFrame sends the state of the pens at one instant in an
+// RDPINPUT_PEN_EVENT_PDU of a single frame. Pens need version 2.0 and
+// several of them the multipen injection of version 3.0.
+func (c *InputClient) PenFrame(contacts []PenContact) error {
+	if err := c.ready(); err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	if c.version < RDPINPUT_PROTOCOL_V200 {
+		return fmt.Errorf("rdpei: no pen input in version 0x%08x", c.version)
+	}
+	if len(contacts) > 1 && !c.multipen {
+		return errors.New("rdpei: the server does not inject several pens")
+	}
+
+	b := &bytes.Buffer{}
+	writeFourByteUnsigned(b, 0)
+	writeTwoByteUnsigned(b, 1)
+	writeTwoByteUnsigned(b, uint32(len(contacts)))
+	writeEightByteUnsigned(b, frameOffset(&c.lastPen))
+	for _, p := range contacts {
+		b.WriteByte(p.DeviceId)
+		writeTwoByteUnsigned(b, uint32(p.FieldsPresent))
+		writeFourByteSigned(b, p.X)
+		writeFourByteSigned(b, p.Y)
+		writeFourByteUnsigned(b, p.ContactFlags)
+		if p.FieldsPresent&PEN_CONTACT_PENFLAGS_PRESENT != 0 {
+			writeFourByteUnsigned(b, p.PenFlags)
+		}
+		if p.FieldsPresent&PEN_CONTACT_PRESSURE_PRESENT != 0 {
+			writeFourByteUnsigned(b, p.Pressure)
+		}
+		if p.FieldsPresent&PEN_CONTACT_ROTATION_PRESENT != 0 {
+			writeTwoByteUnsigned(b, uint32(p.Rotation))
+		}
+		if p.FieldsPresent&PEN_CONTACT_TILTX_PRESENT != 0 {
+			writeTwoByteSigned(b, int32(p.TiltX))
+		}
+		if p.FieldsPresent&PEN_CONTACT_TILTY_PRESENT != 0 {
+			writeTwoByteSigned(b, int32(p.TiltY))
+		}
+	}
+	return c.sendPDU(EVENTID_PEN, b.Bytes())
+}
+
+// DismissHovering removes a contact in range of the screen but not touching it
+func (c *InputClient) DismissHovering(contactId uint8) error {
+	if err := c.ready(); err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	return c.sendPDU(EVENTID_DISMISS_HOVERING_CONTACT, []byte{contactId})
+}
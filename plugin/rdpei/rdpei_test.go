@@ -0,0 +1,158 @@
+package rdpei
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// readVar is the decoder of writeVar
+func readVar(r *bytes.Reader, cBits uint, signed bool) int64 {
+	first, _ := r.ReadByte()
+	n := int(first >> (8 - cBits))
+	bits := 8 - cBits
+	var neg bool
+	if signed {
+		bits--
+		neg = first&(1<<bits) != 0
+	}
+	v := int64(first & (1<<bits - 1))
+	for i := 0; i < n; i++ {
+		b, _ := r.ReadByte()
+		v = v<<8 | int64(b)
+	}
+	if neg {
+		v = -v
+	}
+	return v
+}
+
+func TestVariableLengthIntegers(t *testing.T) {
+	for _, c := range []struct {
+		v      int64
+		cBits  uint
+		signed bool
+		b      []byte
+	}{
+		{0x7f, 1, false, []byte{0x7f}},
+		{0x80, 1, false, []byte{0x80, 0x80}},
+		{-0x3f, 1, true, []byte{0x7f}},
+		{-0x40, 1, true, []byte{0xc0, 0x40}},
+		{0x3fff, 1, true, []byte{0xbf, 0xff}},
+		{0x4000, 1, true, []byte{0xbf, 0xff}},
+		{0x12345, 2, false, []byte{0x81, 0x23, 0x45}},
+		{-0x1fffffff, 2, true, []byte{0xff, 0xff, 0xff, 0xff}},
+		{0x20, 3, false, []byte{0x20, 0x20}},
+	} {
+		b := &bytes.Buffer{}
+		writeVar(b, c.v, c.cBits, c.signed)
+		if !bytes.Equal(b.Bytes(), c.b) {
+			t.Errorf("%d in % x, want % x", c.v, b.Bytes(), c.b)
+		}
+		want := min(max(c.v, -0x3fff), 0x3fff)
+		if c.cBits > 1 {
+			want = c.v
+		}
+		if v := readVar(bytes.NewReader(b.Bytes()), c.cBits, c.signed); v != want {
+			t.Errorf("% x read as %d", b.Bytes(), v)
+		}
+	}
+}
+
+type recorder struct {
+	sent [][]byte
+}
+
+func (r *recorder) SendToChannel(channel string, s []byte) (int, error) {
+	r.sent = append(r.sent, append([]byte(nil), s...))
+	return len(s), nil
+}
+
+func pdu(eventId uint16, body ...byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, eventId)
+	b = binary.LittleEndian.AppendUint32(b, uint32(6+len(body)))
+	return append(b, body...)
+}
+
+func TestInputClient(t *testing.T) {
+	w := &recorder{}
+	c := NewClient(10)
+	c.Sender(w)
+	c.Opened()
+	if err := c.TouchFrame([]TouchContact{{}}); !errors.Is(err, ErrNotReady) {
+		t.Fatal("touch before ready", err)
+	}
+
+	var version uint32
+	c.On("ready", func(v uint32) { version = v })
+	sc := binary.LittleEndian.AppendUint32(nil, 0x00040000)
+	sc = binary.LittleEndian.AppendUint32(sc, SC_READY_MULTIPEN_INJECTION_SUPPORTED)
+	c.Process(pdu(EVENTID_SC_READY, sc...))
+	if version != RDPINPUT_PROTOCOL_V300 || len(w.sent) != 1 {
+		t.Fatalf("version 0x%x, sent %d", version, len(w.sent))
+	}
+	cs := w.sent[0]
+	if binary.LittleEndian.Uint16(cs) != EVENTID_CS_READY || len(cs) != 16 ||
+		binary.LittleEndian.Uint32(cs[6:]) != READY_FLAGS_SHOW_TOUCH_VISUALS|READY_FLAGS_ENABLE_MULTIPEN_INJECTION ||
+		binary.LittleEndian.Uint32(cs[10:]) != RDPINPUT_PROTOCOL_V300 || binary.LittleEndian.Uint16(cs[14:]) != 10 {
+		t.Fatalf("client ready % x", cs)
+	}
+
+	err := c.TouchFrame([]TouchContact{{
+		ContactId:     1,
+		FieldsPresent: CONTACT_DATA_PRESSURE_PRESENT,
+		X:             100, Y: -2,
+		ContactFlags: CONTACT_FLAG_DOWN | CONTACT_FLAG_INRANGE | CONTACT_FLAG_INCONTACT,
+		Pressure:     512,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pdu(EVENTID_TOUCH,
+		0,    // encodeTime
+		1,    // frameCount
+		1,    // contactCount
+		0,    // frameOffset of the first frame
+		1, 4, // contactId, fieldsPresent
+		0x40, 0x64, // x
+		0x22,       // y
+		0x19,       // contactFlags
+		0x42, 0x00, // pressure
+	)
+	if !bytes.Equal(w.sent[1], want) {
+		t.Fatalf("touch % x", w.sent[1])
+	}
+
+	if err = c.PenFrame([]PenContact{{DeviceId: 1}, {DeviceId: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint16(w.sent[2]) != EVENTID_PEN {
+		t.Fatalf("pen % x", w.sent[2])
+	}
+	if err = c.DismissHovering(1); err != nil || !bytes.Equal(w.sent[3], pdu(EVENTID_DISMISS_HOVERING_CONTACT, 1)) {
+		t.Fatalf("dismiss hovering % x, %v", w.sent[3], err)
+	}
+
+	c.Process(pdu(EVENTID_SUSPEND_INPUT))
+	if err = c.TouchFrame(nil); !errors.Is(err, ErrSuspended) {
+		t.Fatal("touch while suspended", err)
+	}
+	c.Process(pdu(EVENTID_RESUME_INPUT))
+	if err = c.TouchFrame(make([]TouchContact, 11)); err == nil {
+		t.Fatal("more contacts than announced")
+	}
+	if err = c.TouchFrame(nil); err != nil {
+		t.Fatal("touch after resume", err)
+	}
+
+	// a server of version 1.0 takes no pen
+	c.Opened()
+	c.Process(pdu(EVENTID_SC_READY, 0, 0, 1, 0))
+	if c.Version() != RDPINPUT_PROTOCOL_V10 {
+		t.Fatalf("version 0x%x", c.Version())
+	}
+	if err = c.PenFrame([]PenContact{{}}); err == nil {
+		t.Fatal("pen in version 1.0")
+	}
+}
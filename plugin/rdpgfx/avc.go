@@ -0,0 +1,135 @@
+package rdpgfx
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+/**
+ * H.264 surface commands, the bitstreams are handed to a VideoDecoder
+ * @see MS-RDPEGFX 2.2.4.4 RFX_AVC420_BITMAP_STREAM
+ * @see MS-RDPEGFX 2.2.4.6 RFX_AVC444_BITMAP_STREAM
+ */
+
+// LC of RFX_AVC444_BITMAP_STREAM, the streams present in the command
+const (
+	AVC444_LUMA_AND_CHROMA = 0x0
+	AVC444_LUMA            = 0x1
+	AVC444_CHROMA          = 0x2
+)
+
+// QuantQuality is the RFX_AVC420_QUANT_QUALITY of a region
+type QuantQuality struct {
+	QP          uint8
+	Progressive bool
+	Quality     uint8
+}
+
+// AVCStream is an RFX_AVC420_BITMAP_STREAM, the region rectangles are in
+// surface coordinates
+type AVCStream struct {
+	Regions []image.Rectangle
+	Quality []QuantQuality
+	// Data are the NAL units of the H.264 Annex B bitstream
+	Data []byte
+}
+
+// VideoFrame is a surface command of an H.264 codec, AVC420 only has Luma while
+// AVC444 may update the luma and the chroma views of the surface separately
+type VideoFrame struct {
+	SurfaceId uint16
+	CodecId   uint16
+	// Dest is the destination rectangle of the command on the surface
+	Dest   image.Rectangle
+	Luma   *AVCStream
+	Chroma *AVCStream
+}
+
+// VideoDecoder decodes the H.264 streams of the surfaces, a decoder keeps its
+// state per surface
+type VideoDecoder interface {
+	// Decode paints the regions of f on the surface dst and returns the areas it changed
+	Decode(f *VideoFrame, dst *image.RGBA) ([]image.Rectangle, error)
+}
+
+// SetVideoDecoder advertises H.264 with d, it must be set before the channel opens
+func (c *GfxClient) SetVideoDecoder(d VideoDecoder) {
+	c.video = d
+}
+
+func (c *GfxClient) decodeVideo(surfaceId, codecId uint16, s *surface, rect image.Rectangle, data []byte) error {
+	if c.video == nil {
+		return errors.New("rdpgfx: h264 without a video decoder")
+	}
+	f := &VideoFrame{SurfaceId: surfaceId, CodecId: codecId, Dest: rect}
+	var err error
+	if codecId == RDPGFX_CODECID_AVC420 {
+		f.Luma, err = readAVC420(data)
+	} else {
+		f.Luma, f.Chroma, err = readAVC444(data)
+	}
+	if err != nil {
+		return err
+	}
+	dirty, err := c.video.Decode(f, s.img)
+	for _, r := range dirty {
+		s.invalidate(r)
+	}
+	return err
+}
+
+// readAVC420 parses the RFX_AVC420_METABLOCK in front of the bitstream
+func readAVC420(data []byte) (*AVCStream, error) {
+	r := &reader{b: data}
+	n := int(r.uint32())
+	// a region is a rect of 8 bytes and its quality of 2
+	if n > len(r.b)/10 {
+		return nil, fmt.Errorf("rdpgfx: %d avc420 regions", n)
+	}
+	s := &AVCStream{Regions: make([]image.Rectangle, n), Quality: make([]QuantQuality, n)}
+	for i := range s.Regions {
+		s.Regions[i] = r.rect()
+	}
+	for i := range s.Quality {
+		qp, quality := r.uint8(), r.uint8()
+		s.Quality[i] = QuantQuality{QP: qp & 0x3f, Progressive: qp&0x80 != 0, Quality: quality}
+	}
+	s.Data = r.b
+	return s, r.err
+}
+
+// readAVC444 splits the luma and chroma streams, either may be absent
+func readAVC444(data []byte) (luma, chroma *AVCStream, err error) {
+	r := &reader{b: data}
+	info := r.uint32()
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	size, lc := int(info&0x3fffffff), info>>30
+	var first, second []byte
+	switch lc {
+	case AVC444_LUMA_AND_CHROMA:
+		first = r.bytes(size)
+		second = r.b
+	case AVC444_LUMA, AVC444_CHROMA:
+		first = r.b
+	default:
+		return nil, nil, errors.New("rdpgfx: invalid avc444 lc")
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	s, err := readAVC420(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch lc {
+	case AVC444_LUMA:
+		return s, nil, nil
+	case AVC444_CHROMA:
+		return nil, s, nil
+	}
+	chroma, err = readAVC420(second)
+	return s, chroma, err
+}
@@ -1,10 +1,21 @@
+// Package rdpgfx is the graphics pipeline, the surfaces of the desktop are
+// updated over a dynamic channel
 package rdpgfx
 
 import (
-	"encoding/hex"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
 	"log/slog"
 
+	"github.com/sergei-bronnikov/grdp/codec"
+	"github.com/sergei-bronnikov/grdp/codec/clearcodec"
+	"github.com/sergei-bronnikov/grdp/codec/planar"
+	"github.com/sergei-bronnikov/grdp/codec/rfx"
 	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/emission"
 	"github.com/sergei-bronnikov/grdp/plugin"
 )
 
@@ -12,17 +23,590 @@ const (
 	ChannelName = plugin.RDPGFX_DVC_CHANNEL_NAME
 )
 
-type gfxClient struct {
+/**
+ * @see MS-RDPEGFX 2.2.1.5 RDPGFX_HEADER
+ */
+const (
+	RDPGFX_CMDID_WIRETOSURFACE_1          = 0x0001
+	RDPGFX_CMDID_WIRETOSURFACE_2          = 0x0002
+	RDPGFX_CMDID_DELETEENCODINGCONTEXT    = 0x0003
+	RDPGFX_CMDID_SOLIDFILL                = 0x0004
+	RDPGFX_CMDID_SURFACETOSURFACE         = 0x0005
+	RDPGFX_CMDID_SURFACETOCACHE           = 0x0006
+	RDPGFX_CMDID_CACHETOSURFACE           = 0x0007
+	RDPGFX_CMDID_EVICTCACHEENTRY          = 0x0008
+	RDPGFX_CMDID_CREATESURFACE            = 0x0009
+	RDPGFX_CMDID_DELETESURFACE            = 0x000A
+	RDPGFX_CMDID_STARTFRAME               = 0x000B
+	RDPGFX_CMDID_ENDFRAME                 = 0x000C
+	RDPGFX_CMDID_FRAMEACKNOWLEDGE         = 0x000D
+	RDPGFX_CMDID_RESETGRAPHICS            = 0x000E
+	RDPGFX_CMDID_MAPSURFACETOOUTPUT       = 0x000F
+	RDPGFX_CMDID_CACHEIMPORTOFFER         = 0x0010
+	RDPGFX_CMDID_CACHEIMPORTREPLY         = 0x0011
+	RDPGFX_CMDID_CAPSADVERTISE            = 0x0012
+	RDPGFX_CMDID_CAPSCONFIRM              = 0x0013
+	RDPGFX_CMDID_MAPSURFACETOWINDOW       = 0x0015
+	RDPGFX_CMDID_QOEFRAMEACKNOWLEDGE      = 0x0016
+	RDPGFX_CMDID_MAPSURFACETOSCALEDOUTPUT = 0x0017
+	RDPGFX_CMDID_MAPSURFACETOSCALEDWINDOW = 0x0018
+)
+
+/**
+ * @see MS-RDPEGFX 2.2.3 Capability Sets
+ */
+const (
+	RDPGFX_CAPVERSION_8   = 0x00080004
+	RDPGFX_CAPVERSION_81  = 0x00080105
+	RDPGFX_CAPVERSION_10  = 0x000A0002
+	RDPGFX_CAPVERSION_101 = 0x000A0100
+	RDPGFX_CAPVERSION_102 = 0x000A0200
+	RDPGFX_CAPVERSION_103 = 0x000A0301
+	RDPGFX_CAPVERSION_104 = 0x000A0400
+	RDPGFX_CAPVERSION_105 = 0x000A0502
+	RDPGFX_CAPVERSION_106 = 0x000A0600
+	RDPGFX_CAPVERSION_107 = 0x000A0701
+)
+
+const (
+	RDPGFX_CAPS_FLAG_THINCLIENT        = 0x00000001
+	RDPGFX_CAPS_FLAG_SMALL_CACHE       = 0x00000002
+	RDPGFX_CAPS_FLAG_AVC420_ENABLED    = 0x00000010
+	RDPGFX_CAPS_FLAG_AVC_DISABLED      = 0x00000020
+	RDPGFX_CAPS_FLAG_AVC_THINCLIENT    = 0x00000040
+	RDPGFX_CAPS_FLAG_SCALEDMAP_DISABLE = 0x00000080
+)
+
+/**
+ * @see MS-RDPEGFX 2.2.1.1 RDPGFX_CODECID
+ */
+const (
+	RDPGFX_CODECID_UNCOMPRESSED  = 0x0000
+	RDPGFX_CODECID_CAVIDEO       = 0x0003
+	RDPGFX_CODECID_CLEARCODEC    = 0x0008
+	RDPGFX_CODECID_CAPROGRESSIVE = 0x0009
+	RDPGFX_CODECID_PLANAR        = 0x000A
+	RDPGFX_CODECID_AVC420        = 0x000B
+	RDPGFX_CODECID_ALPHA         = 0x000C
+	RDPGFX_CODECID_AVC444        = 0x000E
+	RDPGFX_CODECID_AVC444v2      = 0x000F
+)
+
+const (
+	GFX_PIXEL_FORMAT_XRGB_8888 = 0x20
+	GFX_PIXEL_FORMAT_ARGB_8888 = 0x21
+)
+
+// MAX_CACHE_SLOTS is the size of the bitmap cache of the server, without the small cache flag
+const MAX_CACHE_SLOTS = 25600
+
+// MAX_CACHE_SIZE is the memory of the bitmap cache, 100 MB of 32 bpp pixels
+const MAX_CACHE_SIZE = 100 * 1024 * 1024
+
+// CapsSet is RDPGFX_CAPSET, Data holds the flags of most versions
+type CapsSet struct {
+	Version uint32
+	Data    []byte
+}
+
+func flagsCaps(version, flags uint32) CapsSet {
+	return CapsSet{version, binary.LittleEndian.AppendUint32(nil, flags)}
+}
+
+// CapsSets are advertised to the server, which confirms one of them. H.264 is
+// only enabled with a video decoder.
+func (c *GfxClient) CapsSets() []CapsSet {
+	var avc420, avcDisabled uint32 = 0, RDPGFX_CAPS_FLAG_AVC_DISABLED
+	if c.video != nil {
+		avc420, avcDisabled = RDPGFX_CAPS_FLAG_AVC420_ENABLED, 0
+	}
+	return []CapsSet{
+		// the surfaces are not mapped to scaled outputs
+		flagsCaps(RDPGFX_CAPVERSION_107, avcDisabled|RDPGFX_CAPS_FLAG_SCALEDMAP_DISABLE),
+		flagsCaps(RDPGFX_CAPVERSION_106, avcDisabled),
+		flagsCaps(RDPGFX_CAPVERSION_105, avcDisabled),
+		flagsCaps(RDPGFX_CAPVERSION_104, avcDisabled),
+		flagsCaps(RDPGFX_CAPVERSION_103, avcDisabled),
+		flagsCaps(RDPGFX_CAPVERSION_102, avcDisabled),
+		// 10.1 has no flags
+		{RDPGFX_CAPVERSION_101, make([]byte, 16)},
+		flagsCaps(RDPGFX_CAPVERSION_10, avcDisabled),
+		flagsCaps(RDPGFX_CAPVERSION_81, avc420),
+		flagsCaps(RDPGFX_CAPVERSION_8, 0),
+	}
 }
 
-func (c *gfxClient) Send(s []byte) (int, error) {
-	slog.Debug("len:", len(s), "data:", hex.EncodeToString(s))
+// Decoders create the decoders of the codecs of the surface commands, by codec id
+var Decoders = map[uint16]func() codec.Decoder{
+	RDPGFX_CODECID_CAVIDEO:    func() codec.Decoder { return rfx.NewDecoder() },
+	RDPGFX_CODECID_PLANAR:     func() codec.Decoder { return planar.NewDecoder() },
+	RDPGFX_CODECID_CLEARCODEC: func() codec.Decoder { return clearcodec.NewDecoder() },
+}
+
+type surface struct {
+	img    *image.RGBA
+	format uint8
+	mapped bool
+	origin image.Point
+	// dirty are the areas changed since the last paint of the output
+	dirty []image.Rectangle
+}
+
+// GfxClient applies the graphics commands to its surfaces and emits the areas of
+// the surfaces mapped to the output, "paint" with the surface, the area and the
+// origin of the surface, and "reset" with the size of the output
+type GfxClient struct {
+	emission.Emitter
+	w        core.ChannelSender
+	zgfx     *zgfx
+	caps     CapsSet
+	surfaces map[uint16]*surface
+	cache    map[uint16]*image.RGBA
+	decoders map[uint16]codec.Decoder
+	video    VideoDecoder
+	inFrame  bool
+	decoded  uint32
+	// cacheSize is the number of bytes held by cache
+	cacheSize int
+}
+
+func NewClient() *GfxClient {
+	c := &GfxClient{Emitter: *emission.NewEmitter()}
+	c.reset()
+	return c
+}
+
+func (c *GfxClient) reset() {
+	c.zgfx = newZgfx()
+	c.surfaces = make(map[uint16]*surface)
+	c.cache = make(map[uint16]*image.RGBA)
+	c.cacheSize = 0
+	c.decoders = make(map[uint16]codec.Decoder)
+	c.inFrame = false
+	c.decoded = 0
+}
+
+func (c *GfxClient) Send(s []byte) (int, error) {
 	name, _ := c.GetType()
 	return c.w.SendToChannel(name, s)
 }
-func (c *gfxClient) Sender(f core.ChannelSender) {
+func (c *GfxClient) Sender(f core.ChannelSender) {
 	c.w = f
 }
-func (c *gfxClient) GetType() (string, uint32) {
+func (c *GfxClient) GetType() (string, uint32) {
 	return ChannelName, 0
 }
+
+// Caps is the capability set confirmed by the server
+func (c *GfxClient) Caps() CapsSet {
+	return c.caps
+}
+
+// Opened advertises the capabilities once the server created the channel
+func (c *GfxClient) Opened() {
+	c.reset()
+	b := &bytes.Buffer{}
+	sets := c.CapsSets()
+	core.WriteUInt16LE(uint16(len(sets)), b)
+	for _, caps := range sets {
+		core.WriteUInt32LE(caps.Version, b)
+		core.WriteUInt32LE(uint32(len(caps.Data)), b)
+		b.Write(caps.Data)
+	}
+	c.sendPDU(RDPGFX_CMDID_CAPSADVERTISE, b.Bytes())
+}
+
+func (c *GfxClient) Closed() {
+	slog.Info("rdpgfx channel closed")
+}
+
+func (c *GfxClient) sendPDU(cmdId uint16, body []byte) {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(cmdId, b)
+	core.WriteUInt16LE(0, b)
+	core.WriteUInt32LE(uint32(8+len(body)), b)
+	b.Write(body)
+	if _, err := c.Send(b.Bytes()); err != nil {
+		slog.Warn("rdpgfx send", "cmdId", cmdId, "err", err)
+	}
+}
+
+// Process decompresses the segmented data of the server and runs its commands
+func (c *GfxClient) Process(s []byte) {
+	data, err := c.zgfx.Decompress(s)
+	if err != nil {
+		slog.Error("rdpgfx", "err", err)
+		return
+	}
+	for len(data) >= 8 {
+		cmdId := binary.LittleEndian.Uint16(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 8 || length > len(data) {
+			slog.Error("rdpgfx: invalid pdu length", "cmdId", cmdId, "length", length)
+			return
+		}
+		if err := c.processPDU(cmdId, data[8:length]); err != nil {
+			slog.Warn("rdpgfx", "cmdId", cmdId, "err", err)
+		}
+		data = data[length:]
+	}
+}
+
+var errTruncated = errors.New("rdpgfx: truncated pdu")
+
+func (c *GfxClient) processPDU(cmdId uint16, b []byte) error {
+	r := &reader{b: b}
+	var err error
+	switch cmdId {
+	case RDPGFX_CMDID_CAPSCONFIRM:
+		c.caps.Version = r.uint32()
+		c.caps.Data = r.bytes(int(r.uint32()))
+		slog.Info("rdpgfx caps confirmed", "version", fmt.Sprintf("0x%08x", c.caps.Version))
+	case RDPGFX_CMDID_RESETGRAPHICS:
+		width, height := r.uint32(), r.uint32()
+		if r.err == nil && !validOutput(width, height) {
+			err = fmt.Errorf("rdpgfx: reset graphics to %dx%d", width, height)
+		} else if r.err == nil {
+			// the surfaces and the cache of the previous output are gone
+			c.surfaces = make(map[uint16]*surface)
+			c.cache = make(map[uint16]*image.RGBA)
+			c.cacheSize = 0
+			c.Emit("reset", int(width), int(height))
+		}
+	case RDPGFX_CMDID_CREATESURFACE:
+		err = c.createSurface(r)
+	case RDPGFX_CMDID_DELETESURFACE:
+		delete(c.surfaces, r.uint16())
+	case RDPGFX_CMDID_MAPSURFACETOOUTPUT:
+		err = c.mapSurfaceToOutput(r)
+	case RDPGFX_CMDID_STARTFRAME:
+		r.uint32()
+		r.uint32()
+		c.inFrame = true
+	case RDPGFX_CMDID_ENDFRAME:
+		frameId := r.uint32()
+		c.inFrame = false
+		c.paint()
+		c.decoded++
+		c.frameAcknowledge(frameId)
+	case RDPGFX_CMDID_SOLIDFILL:
+		err = c.solidFill(r)
+	case RDPGFX_CMDID_SURFACETOSURFACE:
+		err = c.surfaceToSurface(r)
+	case RDPGFX_CMDID_SURFACETOCACHE:
+		err = c.surfaceToCache(r)
+	case RDPGFX_CMDID_CACHETOSURFACE:
+		err = c.cacheToSurface(r)
+	case RDPGFX_CMDID_EVICTCACHEENTRY:
+		c.evictCacheEntry(r.uint16())
+	case RDPGFX_CMDID_WIRETOSURFACE_1:
+		err = c.wireToSurface1(r)
+	case RDPGFX_CMDID_WIRETOSURFACE_2:
+		surfaceId, codecId := r.uint16(), r.uint16()
+		slog.Debug("rdpgfx codec not supported", "surfaceId", surfaceId, "codecId", codecId)
+	case RDPGFX_CMDID_DELETEENCODINGCONTEXT, RDPGFX_CMDID_CACHEIMPORTREPLY:
+	default:
+		slog.Debug(fmt.Sprintf("rdpgfx cmdId 0x%x not supported", cmdId))
+	}
+	if err != nil {
+		return err
+	}
+	if !c.inFrame {
+		c.paint()
+	}
+	return r.err
+}
+
+func (c *GfxClient) frameAcknowledge(frameId uint32) {
+	b := &bytes.Buffer{}
+	// queueDepth is not known
+	core.WriteUInt32LE(0, b)
+	core.WriteUInt32LE(frameId, b)
+	core.WriteUInt32LE(c.decoded, b)
+	c.sendPDU(RDPGFX_CMDID_FRAMEACKNOWLEDGE, b.Bytes())
+}
+
+// paint emits the areas changed on the mapped surfaces
+func (c *GfxClient) paint() {
+	for _, s := range c.surfaces {
+		dirty := s.dirty
+		s.dirty = nil
+		if !s.mapped {
+			continue
+		}
+		for _, r := range dirty {
+			c.Emit("paint", s.img, r, s.origin)
+		}
+	}
+}
+
+func (c *GfxClient) surface(id uint16) (*surface, error) {
+	s, ok := c.surfaces[id]
+	if !ok {
+		return nil, fmt.Errorf("rdpgfx: unknown surface %d", id)
+	}
+	return s, nil
+}
+
+// invalidate records r of s for the next paint
+func (s *surface) invalidate(r image.Rectangle) {
+	r = r.Intersect(s.img.Rect)
+	if !r.Empty() {
+		s.dirty = append(s.dirty, r)
+	}
+}
+
+// maxSurfacePixels bounds the surfaces the server creates, the largest
+// monitors are 8192 pixels wide
+const maxSurfacePixels = 8192 * 8192
+
+// maxOutputSize is the largest side of the output of a reset graphics pdu
+// @see MS-RDPEGFX 2.2.2.14 RDPGFX_RESET_GRAPHICS_PDU
+const maxOutputSize = 32766
+
+func validOutput(width, height uint32) bool {
+	return width > 0 && height > 0 && width <= maxOutputSize && height <= maxOutputSize &&
+		int(width)*int(height) <= maxSurfacePixels
+}
+
+func (c *GfxClient) createSurface(r *reader) error {
+	id, width, height, format := r.uint16(), r.uint16(), r.uint16(), r.uint8()
+	if r.err != nil {
+		return r.err
+	}
+	if int(width)*int(height) > maxSurfacePixels {
+		return fmt.Errorf("rdpgfx: surface of %dx%d", width, height)
+	}
+	c.surfaces[id] = &surface{img: image.NewRGBA(image.Rect(0, 0, int(width), int(height))), format: format}
+	return nil
+}
+
+func (c *GfxClient) mapSurfaceToOutput(r *reader) error {
+	id := r.uint16()
+	r.uint16()
+	x, y := r.uint32(), r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+	s, err := c.surface(id)
+	if err != nil {
+		return err
+	}
+	s.mapped, s.origin = true, image.Pt(int(x), int(y))
+	s.invalidate(s.img.Rect)
+	return nil
+}
+
+func (c *GfxClient) solidFill(r *reader) error {
+	s, err := c.surface(r.uint16())
+	if err != nil {
+		return err
+	}
+	// B, G, R, XA
+	px := r.bytes(4)
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		rect := r.rect().Intersect(s.img.Rect)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			row := s.img.Pix[s.img.PixOffset(rect.Min.X, y):s.img.PixOffset(rect.Max.X, y)]
+			for x := 0; x < len(row); x += 4 {
+				row[x], row[x+1], row[x+2], row[x+3] = px[2], px[1], px[0], s.alpha(px[3])
+			}
+		}
+		s.invalidate(rect)
+	}
+	return nil
+}
+
+// alpha is a of the surfaces with alpha, the others are opaque
+func (s *surface) alpha(a uint8) uint8 {
+	if s.format == GFX_PIXEL_FORMAT_ARGB_8888 {
+		return a
+	}
+	return 0xff
+}
+
+func (c *GfxClient) surfaceToSurface(r *reader) error {
+	src, err := c.surface(r.uint16())
+	if err != nil {
+		return err
+	}
+	dst, err := c.surface(r.uint16())
+	if err != nil {
+		return err
+	}
+	rect := r.rect().Intersect(src.img.Rect)
+	// the source may overlap the destinations
+	tmp := copyImage(src.img, rect)
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		at := r.point()
+		dst.invalidate(drawImage(dst.img, tmp, at))
+	}
+	return nil
+}
+
+func (c *GfxClient) surfaceToCache(r *reader) error {
+	s, err := c.surface(r.uint16())
+	if err != nil {
+		return err
+	}
+	// the key is only used by the persistent cache
+	r.bytes(8)
+	slot := r.uint16()
+	rect := r.rect()
+	if r.err != nil {
+		return r.err
+	}
+	if slot == 0 || slot > MAX_CACHE_SLOTS {
+		return fmt.Errorf("rdpgfx: invalid cache slot %d", slot)
+	}
+	rect = rect.Intersect(s.img.Rect)
+	c.evictCacheEntry(slot)
+	if size := rect.Dx() * rect.Dy() * 4; c.cacheSize+size > MAX_CACHE_SIZE {
+		return fmt.Errorf("rdpgfx: cache of %d bytes is full for %v", c.cacheSize, rect)
+	}
+	img := copyImage(s.img, rect)
+	c.cache[slot] = img
+	c.cacheSize += len(img.Pix)
+	return nil
+}
+
+func (c *GfxClient) evictCacheEntry(slot uint16) {
+	if img, ok := c.cache[slot]; ok {
+		c.cacheSize -= len(img.Pix)
+		delete(c.cache, slot)
+	}
+}
+
+func (c *GfxClient) cacheToSurface(r *reader) error {
+	slot := r.uint16()
+	s, err := c.surface(r.uint16())
+	if err != nil {
+		return err
+	}
+	img, ok := c.cache[slot]
+	if !ok {
+		return fmt.Errorf("rdpgfx: empty cache slot %d", slot)
+	}
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		s.invalidate(drawImage(s.img, img, r.point()))
+	}
+	return nil
+}
+
+func (c *GfxClient) wireToSurface1(r *reader) error {
+	surfaceId := r.uint16()
+	s, err := c.surface(surfaceId)
+	if err != nil {
+		return err
+	}
+	codecId := r.uint16()
+	r.uint8()
+	rect := r.rect()
+	data := r.bytes(int(r.uint32()))
+	if r.err != nil {
+		return r.err
+	}
+	// the decoders allocate the whole rectangle
+	if rect.Empty() || !rect.In(s.img.Rect) {
+		return fmt.Errorf("rdpgfx: rectangle %v outside of surface %d", rect, surfaceId)
+	}
+	switch codecId {
+	case RDPGFX_CODECID_UNCOMPRESSED:
+		s.invalidate(s.uncompressed(data, rect))
+		return nil
+	case RDPGFX_CODECID_AVC420, RDPGFX_CODECID_AVC444, RDPGFX_CODECID_AVC444v2:
+		return c.decodeVideo(surfaceId, codecId, s, rect, data)
+	}
+	d, ok := c.decoders[codecId]
+	if !ok {
+		newDecoder, ok := Decoders[codecId]
+		if !ok {
+			return fmt.Errorf("rdpgfx: codec 0x%x not supported", codecId)
+		}
+		d = newDecoder()
+		c.decoders[codecId] = d
+	}
+	dirty, err := d.Decode(data, rect.Dx(), rect.Dy(), s.img, rect.Min)
+	for _, r := range dirty {
+		s.invalidate(r)
+	}
+	return err
+}
+
+// uncompressed copies the 32 bpp rows of data, top-down
+func (s *surface) uncompressed(data []byte, rect image.Rectangle) image.Rectangle {
+	w := rect.Dx()
+	if len(data) < w*rect.Dy()*4 {
+		return image.Rectangle{}
+	}
+	clip := rect.Intersect(s.img.Rect)
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		src := data[((y-rect.Min.Y)*w+clip.Min.X-rect.Min.X)*4:]
+		row := s.img.Pix[s.img.PixOffset(clip.Min.X, y):s.img.PixOffset(clip.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2], row[i+3] = src[i+2], src[i+1], src[i], s.alpha(src[i+3])
+		}
+	}
+	return clip
+}
+
+func copyImage(src *image.RGBA, r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(img.Pix[img.PixOffset(0, y-r.Min.Y):], src.Pix[src.PixOffset(r.Min.X, y):src.PixOffset(r.Max.X, y)])
+	}
+	return img
+}
+
+// drawImage copies src at the point at of dst and returns the area it changed
+func drawImage(dst, src *image.RGBA, at image.Point) image.Rectangle {
+	r := src.Rect.Add(at).Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)], src.Pix[src.PixOffset(r.Min.X-at.X, y-at.Y):])
+	}
+	return r
+}
+
+// reader reads the fields of a pdu, the first error sticks
+type reader struct {
+	b   []byte
+	err error
+}
+
+// bytes returns n bytes, or zeroes for the integers read after an error: n
+// may come from the pdu itself and is not allocated
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) || n < 0 {
+		r.err = errTruncated
+		return make([]byte, min(max(n, 0), 4))
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.bytes(2))
+}
+
+func (r *reader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+// rect reads RDPGFX_RECT16, right and bottom are exclusive
+func (r *reader) rect() image.Rectangle {
+	left, top, right, bottom := r.uint16(), r.uint16(), r.uint16(), r.uint16()
+	return image.Rect(int(left), int(top), int(right), int(bottom))
+}
+
+func (r *reader) point() image.Point {
+	x, y := r.uint16(), r.uint16()
+	return image.Pt(int(x), int(y))
+}
@@ -0,0 +1,296 @@
+package rdpgfx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"runtime"
+	"testing"
+)
+
+// bitWriter packs the codes of a compressed segment from the most significant bit
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) write(v uint32, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) segment() []byte {
+	s := append([]byte{ZGFX_PACKET_COMPR_TYPE_RDP8 | ZGFX_PACKET_COMPRESSED}, w.b...)
+	return append(s, byte(len(w.b)*8-w.n))
+}
+
+func TestZgfx(t *testing.T) {
+	z := newZgfx()
+	out, err := z.Decompress([]byte{ZGFX_SEGMENTED_SINGLE, ZGFX_PACKET_COMPR_TYPE_RDP8, 'x', 'y'})
+	if err != nil || string(out) != "xy" {
+		t.Fatalf("uncompressed = %q, %v", out, err)
+	}
+
+	w := &bitWriter{}
+	for _, c := range "abc" {
+		w.write(0, 1)
+		w.write(uint32(c), 8)
+	}
+	// a match of 4 bytes at distance 5 reaches back to the previous segment
+	w.write(17, 5)
+	w.write(5, 5)
+	w.write(0b10, 2)
+	w.write(0, 2)
+	// 2 unencoded bytes from the next byte
+	w.write(17, 5)
+	w.write(0, 5)
+	w.write(2, 15)
+	w.n = len(w.b) * 8
+	w.b = append(w.b, 'd', 'e')
+	w.n += 16
+	seg := w.segment()
+
+	multipart := []byte{ZGFX_SEGMENTED_MULTIPART, 2, 0, 11, 0, 0, 0}
+	multipart = binary.LittleEndian.AppendUint32(multipart, uint32(len(seg)))
+	multipart = append(multipart, seg...)
+	multipart = binary.LittleEndian.AppendUint32(multipart, 3)
+	multipart = append(multipart, ZGFX_PACKET_COMPR_TYPE_RDP8, 'f', 'g')
+	out, err = z.Decompress(multipart)
+	if err != nil || string(out) != "abcxyabdefg" {
+		t.Fatalf("compressed = %q, %v", out, err)
+	}
+
+	if _, err := z.Decompress([]byte{ZGFX_SEGMENTED_SINGLE, ZGFX_PACKET_COMPR_TYPE_RDP8 | ZGFX_PACKET_COMPRESSED, 0x88, 0}); err == nil {
+		t.Fatal("truncated match accepted")
+	}
+}
+
+type recorder struct {
+	sent [][]byte
+}
+
+func (r *recorder) SendToChannel(channel string, s []byte) (int, error) {
+	r.sent = append(r.sent, append([]byte(nil), s...))
+	return len(s), nil
+}
+
+func pdu(cmdId uint16, fields ...interface{}) []byte {
+	body := &bytes.Buffer{}
+	for _, f := range fields {
+		binary.Write(body, binary.LittleEndian, f)
+	}
+	b := binary.LittleEndian.AppendUint16(nil, cmdId)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(8+body.Len()))
+	return append(b, body.Bytes()...)
+}
+
+func single(pdus ...[]byte) []byte {
+	return append([]byte{ZGFX_SEGMENTED_SINGLE, ZGFX_PACKET_COMPR_TYPE_RDP8}, bytes.Join(pdus, nil)...)
+}
+
+func TestGfxClient(t *testing.T) {
+	w := &recorder{}
+	c := NewClient()
+	c.Sender(w)
+	type paint struct {
+		r  image.Rectangle
+		at image.Point
+		px []uint8
+	}
+	var painted []paint
+	c.On("paint", func(img *image.RGBA, r image.Rectangle, at image.Point) {
+		painted = append(painted, paint{r, at, append([]uint8(nil), img.Pix[img.PixOffset(r.Min.X, r.Min.Y):][:4]...)})
+	})
+
+	c.Opened()
+	if len(w.sent) != 1 || binary.LittleEndian.Uint16(w.sent[0]) != RDPGFX_CMDID_CAPSADVERTISE {
+		t.Fatalf("caps advertise = %x", w.sent)
+	}
+	if n := binary.LittleEndian.Uint16(w.sent[0][8:]); int(n) != len(c.CapsSets()) {
+		t.Fatalf("caps sets = %d", n)
+	}
+
+	c.Process(single(
+		pdu(RDPGFX_CMDID_CAPSCONFIRM, uint32(RDPGFX_CAPVERSION_81), uint32(4), uint32(0)),
+		pdu(RDPGFX_CMDID_CREATESURFACE, uint16(1), uint16(16), uint16(8), uint8(GFX_PIXEL_FORMAT_XRGB_8888)),
+		pdu(RDPGFX_CMDID_MAPSURFACETOOUTPUT, uint16(1), uint16(0), uint32(100), uint32(50)),
+	))
+	if c.Caps().Version != RDPGFX_CAPVERSION_81 {
+		t.Fatalf("caps version = %x", c.Caps().Version)
+	}
+	if len(painted) != 1 || painted[0].r != image.Rect(0, 0, 16, 8) || painted[0].at != image.Pt(100, 50) {
+		t.Fatalf("map painted %v", painted)
+	}
+	painted = nil
+
+	c.Process(single(
+		pdu(RDPGFX_CMDID_STARTFRAME, uint32(0), uint32(7)),
+		// blue, green, red, alpha
+		pdu(RDPGFX_CMDID_SOLIDFILL, uint16(1), [4]uint8{0x30, 0x20, 0x10, 0}, uint16(1), [4]uint16{0, 0, 4, 4}),
+		pdu(RDPGFX_CMDID_SURFACETOSURFACE, uint16(1), uint16(1), [4]uint16{0, 0, 2, 2}, uint16(1), [2]uint16{8, 4}),
+		pdu(RDPGFX_CMDID_SURFACETOCACHE, uint16(1), uint64(0), uint16(3), [4]uint16{0, 0, 2, 2}),
+		pdu(RDPGFX_CMDID_CACHETOSURFACE, uint16(3), uint16(1), uint16(1), [2]uint16{15, 7}),
+	))
+	if len(painted) != 0 {
+		t.Fatalf("painted during the frame %v", painted)
+	}
+	c.Process(single(pdu(RDPGFX_CMDID_ENDFRAME, uint32(7))))
+
+	want := []image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(8, 4, 10, 6), image.Rect(15, 7, 16, 8)}
+	if len(painted) != len(want) {
+		t.Fatalf("painted %v", painted)
+	}
+	for i, p := range painted {
+		if p.r != want[i] || p.at != image.Pt(100, 50) || !bytes.Equal(p.px, []uint8{0x10, 0x20, 0x30, 0xff}) {
+			t.Errorf("paint %d = %v", i, p)
+		}
+	}
+
+	ack := w.sent[len(w.sent)-1]
+	if binary.LittleEndian.Uint16(ack) != RDPGFX_CMDID_FRAMEACKNOWLEDGE ||
+		binary.LittleEndian.Uint32(ack[12:]) != 7 || binary.LittleEndian.Uint32(ack[16:]) != 1 {
+		t.Fatalf("frame acknowledge = %x", ack)
+	}
+
+	c.Process(single(pdu(RDPGFX_CMDID_DELETESURFACE, uint16(1))))
+	painted = nil
+	c.Process(single(pdu(RDPGFX_CMDID_SOLIDFILL, uint16(1), [4]uint8{}, uint16(1), [4]uint16{0, 0, 4, 4})))
+	if len(painted) != 0 {
+		t.Fatalf("deleted surface painted %v", painted)
+	}
+}
+
+type fakeVideo struct {
+	frames []*VideoFrame
+}
+
+func (v *fakeVideo) Decode(f *VideoFrame, dst *image.RGBA) ([]image.Rectangle, error) {
+	v.frames = append(v.frames, f)
+	return f.Luma.Regions, nil
+}
+
+// avc420 is a metablock of one region followed by the bitstream
+func avc420(region [4]uint16, qp, quality uint8, nal string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 1)
+	for _, v := range region {
+		b = binary.LittleEndian.AppendUint16(b, v)
+	}
+	return append(append(b, qp, quality), nal...)
+}
+
+func TestGfxClientVideo(t *testing.T) {
+	c := NewClient()
+	for _, caps := range c.CapsSets() {
+		if caps.Version == RDPGFX_CAPVERSION_10 && binary.LittleEndian.Uint32(caps.Data)&RDPGFX_CAPS_FLAG_AVC_DISABLED == 0 {
+			t.Error("h264 advertised without a decoder")
+		}
+	}
+	v := &fakeVideo{}
+	c.SetVideoDecoder(v)
+	c.Sender(&recorder{})
+	for _, caps := range c.CapsSets() {
+		if caps.Version == RDPGFX_CAPVERSION_81 && binary.LittleEndian.Uint32(caps.Data)&RDPGFX_CAPS_FLAG_AVC420_ENABLED == 0 {
+			t.Error("avc420 not advertised")
+		}
+	}
+
+	luma := avc420([4]uint16{0, 0, 16, 8}, 0x80|22, 100, "\x00\x00\x00\x01luma")
+	avc444 := binary.LittleEndian.AppendUint32(nil, uint32(len(luma)))
+	avc444 = append(append(avc444, luma...), avc420([4]uint16{8, 0, 16, 8}, 30, 50, "chroma")...)
+	wire := func(codecId uint16, data []byte) []byte {
+		return pdu(RDPGFX_CMDID_WIRETOSURFACE_1, uint16(1), codecId, uint8(GFX_PIXEL_FORMAT_XRGB_8888),
+			[4]uint16{0, 0, 16, 8}, uint32(len(data)), data)
+	}
+	chromaOnly := binary.LittleEndian.AppendUint32(nil, AVC444_CHROMA<<30)
+	chromaOnly = append(chromaOnly, avc420([4]uint16{0, 0, 4, 4}, 0, 0, "c")...)
+	c.Process(single(
+		pdu(RDPGFX_CMDID_CREATESURFACE, uint16(1), uint16(16), uint16(8), uint8(GFX_PIXEL_FORMAT_XRGB_8888)),
+		wire(RDPGFX_CODECID_AVC420, luma),
+		wire(RDPGFX_CODECID_AVC444, avc444),
+	))
+	if len(v.frames) != 2 {
+		t.Fatalf("%d frames", len(v.frames))
+	}
+	f := v.frames[0]
+	if f.SurfaceId != 1 || f.Dest != image.Rect(0, 0, 16, 8) || f.Chroma != nil ||
+		len(f.Luma.Regions) != 1 || f.Luma.Quality[0] != (QuantQuality{22, true, 100}) ||
+		string(f.Luma.Data) != "\x00\x00\x00\x01luma" {
+		t.Errorf("avc420 frame %+v %+v", f, f.Luma)
+	}
+	f = v.frames[1]
+	if f.CodecId != RDPGFX_CODECID_AVC444 || string(f.Luma.Data) != "\x00\x00\x00\x01luma" ||
+		f.Chroma == nil || f.Chroma.Regions[0] != image.Rect(8, 0, 16, 8) || string(f.Chroma.Data) != "chroma" {
+		t.Errorf("avc444 frame %+v", f)
+	}
+
+	if _, chroma, err := readAVC444(chromaOnly); err != nil || chroma == nil || string(chroma.Data) != "c" {
+		t.Errorf("chroma only = %v, %v", chroma, err)
+	}
+	if _, err := readAVC420([]byte{0xff, 0, 0, 0, 1, 2}); err == nil {
+		t.Error("regions past the metablock accepted")
+	}
+}
+
+// TestGfxClientLimits feeds lengths from the wire that must not be allocated
+func TestGfxClientLimits(t *testing.T) {
+	c := NewClient()
+	c.Sender(&recorder{})
+	c.Opened()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	c.Process(single(
+		pdu(RDPGFX_CMDID_CAPSCONFIRM, uint32(RDPGFX_CAPVERSION_81), uint32(0xfffffff0)),
+		pdu(RDPGFX_CMDID_CREATESURFACE, uint16(1), uint16(0xffff), uint16(0xffff), uint8(GFX_PIXEL_FORMAT_XRGB_8888)),
+		pdu(RDPGFX_CMDID_CREATESURFACE, uint16(2), uint16(4), uint16(4), uint8(GFX_PIXEL_FORMAT_XRGB_8888)),
+		pdu(RDPGFX_CMDID_WIRETOSURFACE_1, uint16(2), uint16(RDPGFX_CODECID_UNCOMPRESSED), uint8(GFX_PIXEL_FORMAT_XRGB_8888),
+			[4]uint16{0, 0, 4, 4}, uint32(0xfffffff0)),
+	))
+	resets := 0
+	c.On("reset", func(width, height int) { resets++ })
+	c.Process(single(pdu(RDPGFX_CMDID_RESETGRAPHICS, uint32(0xffffff), uint32(0xffffff), uint32(0))))
+	if resets != 0 {
+		t.Error("reset to 16777215x16777215")
+	}
+	// a planar bitmap of 65535x65535 pixels on the 4x4 surface
+	if err := c.processPDU(RDPGFX_CMDID_WIRETOSURFACE_1, []byte{2, 0, byte(RDPGFX_CODECID_PLANAR), 0, GFX_PIXEL_FORMAT_XRGB_8888,
+		0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 0}); err == nil {
+		t.Error("rectangle outside of the surface")
+	}
+	// a multipart of 4 GB in one empty segment
+	multipart := []byte{ZGFX_SEGMENTED_MULTIPART, 1, 0, 0xf0, 0xff, 0xff, 0xff, 1, 0, 0, 0, ZGFX_PACKET_COMPR_TYPE_RDP8}
+	if _, err := newZgfx().Decompress(multipart); err == nil {
+		t.Error("multipart larger than its segments")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20 {
+		t.Fatalf("allocated %d bytes", n)
+	}
+	if _, ok := c.surfaces[1]; ok {
+		t.Error("surface of 65535x65535")
+	}
+
+	// the cache holds 100 MB whatever the number of slots
+	toCache := func(slot uint16) error {
+		return c.processPDU(RDPGFX_CMDID_SURFACETOCACHE, pdu(0, uint16(2), uint64(0), slot, [4]uint16{0, 0, 4, 4})[8:])
+	}
+	if err := toCache(1); err != nil || c.cacheSize != 64 {
+		t.Fatal(err, c.cacheSize)
+	}
+	c.cacheSize += MAX_CACHE_SIZE - 100
+	if err := toCache(2); err == nil || c.cache[2] != nil {
+		t.Error("cache above its size")
+	}
+	if err := toCache(1); err != nil {
+		t.Error("slot replaced", err)
+	}
+	c.processPDU(RDPGFX_CMDID_EVICTCACHEENTRY, []byte{1, 0})
+	if c.cacheSize != MAX_CACHE_SIZE-100 {
+		t.Error("evicted", c.cacheSize)
+	}
+}
@@ -0,0 +1,302 @@
+package rdpgfx
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/**
+ * RDP8 bulk decompression of the segmented data sent by the server
+ * @see MS-RDPEGFX 2.2.5 RDP_SEGMENTED_DATA
+ * @see MS-RDPEGFX 3.1.9.1 RDP 8.0 Bulk Compression
+ */
+
+const (
+	ZGFX_SEGMENTED_SINGLE    = 0xE0
+	ZGFX_SEGMENTED_MULTIPART = 0xE1
+)
+
+const (
+	ZGFX_PACKET_COMPR_TYPE_RDP8 = 0x04
+	ZGFX_PACKET_COMPRESSED      = 0x20
+)
+
+// zgfxHistorySize is the size of the history buffer shared by the segments
+const zgfxHistorySize = 2500000
+
+// zgfxSegmentMaxSize is the most a segment decompresses to
+const zgfxSegmentMaxSize = 65535
+
+var errZgfx = errors.New("zgfx: invalid compressed data")
+
+type zgfxToken struct {
+	prefixLength int
+	prefixCode   uint32
+	valueBits    int
+	match        bool
+	valueBase    uint32
+}
+
+// zgfxTokens are the literals and the match distances, by prefix
+var zgfxTokens = []zgfxToken{
+	{1, 0, 8, false, 0},
+	{5, 17, 5, true, 0},
+	{5, 18, 7, true, 32},
+	{5, 19, 9, true, 160},
+	{5, 20, 10, true, 672},
+	{5, 21, 12, true, 1696},
+	{5, 24, 0, false, 0x00},
+	{5, 25, 0, false, 0x01},
+	{6, 44, 14, true, 5792},
+	{6, 45, 15, true, 22176},
+	{6, 52, 0, false, 0x02},
+	{6, 53, 0, false, 0x03},
+	{6, 54, 0, false, 0xFF},
+	{7, 92, 18, true, 54944},
+	{7, 93, 20, true, 317088},
+	{7, 110, 0, false, 0x04},
+	{7, 111, 0, false, 0x05},
+	{7, 112, 0, false, 0x06},
+	{7, 113, 0, false, 0x07},
+	{7, 114, 0, false, 0x08},
+	{7, 115, 0, false, 0x09},
+	{7, 116, 0, false, 0x0A},
+	{7, 117, 0, false, 0x0B},
+	{7, 118, 0, false, 0x3A},
+	{7, 119, 0, false, 0x3B},
+	{7, 120, 0, false, 0x3C},
+	{7, 121, 0, false, 0x3D},
+	{7, 122, 0, false, 0x3E},
+	{7, 123, 0, false, 0x3F},
+	{7, 124, 0, false, 0x40},
+	{7, 125, 0, false, 0x80},
+	{8, 188, 20, true, 1365664},
+	{8, 189, 21, true, 2414240},
+	{8, 252, 0, false, 0x0C},
+	{8, 253, 0, false, 0x38},
+	{8, 254, 0, false, 0x39},
+	{8, 255, 0, false, 0x66},
+	{9, 380, 22, true, 4511392},
+	{9, 381, 23, true, 8705696},
+	{9, 382, 24, true, 17094304},
+}
+
+// zgfx decompresses the segments of a channel, the history spans its whole life
+type zgfx struct {
+	history []byte
+	head    int
+	// full is set once the history wrapped
+	full bool
+
+	in []byte
+	// pos is the next bit of in, end is past the last one
+	pos, end int
+}
+
+func newZgfx() *zgfx {
+	return &zgfx{history: make([]byte, zgfxHistorySize)}
+}
+
+// Decompress reads an RDP_SEGMENTED_DATA
+func (z *zgfx) Decompress(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errZgfx
+	}
+	switch data[0] {
+	case ZGFX_SEGMENTED_SINGLE:
+		return z.segment(data[1:], nil)
+	case ZGFX_SEGMENTED_MULTIPART:
+		if len(data) < 7 {
+			return nil, errZgfx
+		}
+		count := int(binary.LittleEndian.Uint16(data[1:]))
+		size := int(binary.LittleEndian.Uint32(data[3:]))
+		data = data[7:]
+		// a segment is at least 5 bytes and decompresses to at most 65535
+		if count > len(data)/5 || size > count*zgfxSegmentMaxSize {
+			return nil, errZgfx
+		}
+		out := make([]byte, 0, min(size, zgfxHistorySize))
+		var err error
+		for i := 0; i < count; i++ {
+			if len(data) < 4 {
+				return nil, errZgfx
+			}
+			n := int(binary.LittleEndian.Uint32(data))
+			if n > len(data)-4 {
+				return nil, errZgfx
+			}
+			if out, err = z.segment(data[4:4+n], out); err != nil {
+				return nil, err
+			}
+			data = data[4+n:]
+		}
+		if len(out) != size {
+			return nil, errZgfx
+		}
+		return out, nil
+	}
+	return nil, errZgfx
+}
+
+// segment appends the bytes of an RDP8_BULK_ENCODED_DATA to out
+func (z *zgfx) segment(s []byte, out []byte) ([]byte, error) {
+	if len(s) < 1 {
+		return nil, errZgfx
+	}
+	flags := s[0]
+	s = s[1:]
+	if flags&ZGFX_PACKET_COMPRESSED == 0 {
+		z.write(s)
+		return append(out, s...), nil
+	}
+	if len(s) < 1 {
+		return nil, errZgfx
+	}
+	base := len(out)
+	// the last byte is the count of padding bits
+	z.in = s[:len(s)-1]
+	z.pos, z.end = 0, len(z.in)*8-int(s[len(s)-1])
+	for z.pos < z.end {
+		t, ok := z.token()
+		if !ok {
+			return nil, errZgfx
+		}
+		v, ok := z.read(t.valueBits)
+		if !ok {
+			return nil, errZgfx
+		}
+		v += t.valueBase
+		switch {
+		case !t.match:
+			z.write([]byte{byte(v)})
+			out = append(out, byte(v))
+
+		case v == 0:
+			// unencoded bytes, from the next byte boundary
+			n, ok := z.read(15)
+			if !ok {
+				return nil, errZgfx
+			}
+			start := (z.pos + 7) / 8
+			if start+int(n) > len(z.in) {
+				return nil, errZgfx
+			}
+			raw := z.in[start : start+int(n)]
+			z.pos = (start + int(n)) * 8
+			z.write(raw)
+			out = append(out, raw...)
+
+		default:
+			count, ok := z.matchCount()
+			if !ok || int(v) > z.size() || len(out)-base+count > zgfxSegmentMaxSize {
+				return nil, errZgfx
+			}
+			out = z.copyMatch(int(v), count, out)
+		}
+	}
+	return out, nil
+}
+
+// token reads the prefix of the next literal or match
+func (z *zgfx) token() (zgfxToken, bool) {
+	var prefix uint32
+	have := 0
+	for _, t := range zgfxTokens {
+		for have < t.prefixLength {
+			b, ok := z.read(1)
+			if !ok {
+				return t, false
+			}
+			prefix = prefix<<1 | b
+			have++
+		}
+		if prefix == t.prefixCode {
+			return t, true
+		}
+	}
+	return zgfxToken{}, false
+}
+
+// matchCount reads the length of a match, 3 or a power of two plus its extra bits
+func (z *zgfx) matchCount() (int, bool) {
+	b, ok := z.read(1)
+	if !ok {
+		return 0, false
+	}
+	if b == 0 {
+		return 3, true
+	}
+	count, extra := 4, 2
+	for {
+		b, ok = z.read(1)
+		if !ok {
+			return 0, false
+		}
+		if b == 0 {
+			break
+		}
+		count *= 2
+		extra++
+		if count > zgfxSegmentMaxSize {
+			return 0, false
+		}
+	}
+	v, ok := z.read(extra)
+	return count + int(v), ok
+}
+
+// read returns the next n bits, the most significant first
+func (z *zgfx) read(n int) (uint32, bool) {
+	if z.pos+n > z.end {
+		return 0, false
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(z.in[z.pos>>3]>>(7-uint(z.pos&7)))&1
+		z.pos++
+	}
+	return v, true
+}
+
+func (z *zgfx) size() int {
+	if z.full {
+		return len(z.history)
+	}
+	return z.head
+}
+
+func (z *zgfx) write(b []byte) {
+	for len(b) > 0 {
+		n := copy(z.history[z.head:], b)
+		b = b[n:]
+		z.head += n
+		if z.head == len(z.history) {
+			z.head = 0
+			z.full = true
+		}
+	}
+}
+
+// copyMatch repeats count bytes from distance back in the history, they may overlap
+func (z *zgfx) copyMatch(distance, count int, out []byte) []byte {
+	src := z.head - distance
+	if src < 0 {
+		src += len(z.history)
+	}
+	for i := 0; i < count; i++ {
+		c := z.history[src]
+		src++
+		if src == len(z.history) {
+			src = 0
+		}
+		z.history[z.head] = c
+		z.head++
+		if z.head == len(z.history) {
+			z.head = 0
+			z.full = true
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+// Package bulk decompresses the data the server compressed with the
+// compression type announced in the client info.
+//
+// NCRUSH of RDP 6.0 is not implemented. As a server may pick any type up to
+// the announced one, clients announce at most PACKET_COMPR_TYPE_64K until it
+// is, and the XCRUSH decoder of RDP 6.1 is not used by them yet.
+package bulk
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+ * @see MS-RDPBCGR 3.1.8 Bulk Data Compression
+ */
+
+// compression types of the client info, the packets carry theirs in the low bits of their flags
+const (
+	PACKET_COMPR_TYPE_8K    = 0x0
+	PACKET_COMPR_TYPE_64K   = 0x1
+	PACKET_COMPR_TYPE_RDP6  = 0x2
+	PACKET_COMPR_TYPE_RDP61 = 0x3
+)
+
+const (
+	CompressionTypeMask = 0x0F
+	PACKET_COMPRESSED   = 0x20
+	PACKET_AT_FRONT     = 0x40
+	PACKET_FLUSHED      = 0x80
+)
+
+var errTruncated = errors.New("bulk: truncated data")
+
+// Decompressor keeps the history of a stream of packets, the fast-path and
+// slow-path updates share one and the virtual channels have their own
+type Decompressor struct {
+	rdp4  *mppc
+	rdp5  *mppc
+	rdp61 *xcrush
+}
+
+func NewDecompressor() *Decompressor {
+	return &Decompressor{}
+}
+
+// Compressed tells whether the packet of flags must go through Decompress
+func Compressed(flags uint8) bool {
+	return flags&(PACKET_COMPRESSED|PACKET_AT_FRONT|PACKET_FLUSHED) != 0
+}
+
+// Decompress returns the data of a packet, flags are its compression type and flags
+func (d *Decompressor) Decompress(data []byte, flags uint8) ([]byte, error) {
+	var out []byte
+	var err error
+	switch flags & CompressionTypeMask {
+	case PACKET_COMPR_TYPE_8K:
+		if d.rdp4 == nil {
+			d.rdp4 = newMppc(false)
+		}
+		out, err = d.rdp4.decompress(data, flags)
+	case PACKET_COMPR_TYPE_64K:
+		if d.rdp5 == nil {
+			d.rdp5 = newMppc(true)
+		}
+		out, err = d.rdp5.decompress(data, flags)
+	case PACKET_COMPR_TYPE_RDP61:
+		if d.rdp61 == nil {
+			d.rdp61 = newXcrush()
+		}
+		out, err = d.rdp61.decompress(data, flags)
+	default:
+		// NCRUSH is not implemented, see the package documentation
+		return nil, fmt.Errorf("bulk: compression type %d not supported", flags&CompressionTypeMask)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the output lives in the history, the next packet overwrites it
+	return append([]byte(nil), out...), nil
+}
@@ -0,0 +1,119 @@
+package bulk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// bitWriter packs codes from the most significant bit, the last byte is padded with zeros
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) write(v uint32, bits int) *bitWriter {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << uint(7-w.n%8)
+		w.n++
+	}
+	return w
+}
+
+func (w *bitWriter) literals(s string) *bitWriter {
+	for _, c := range []byte(s) {
+		if c < 0x80 {
+			w.write(uint32(c), 8)
+		} else {
+			w.write(0b10, 2).write(uint32(c&0x7f), 7)
+		}
+	}
+	return w
+}
+
+func TestMppc(t *testing.T) {
+	d := NewDecompressor()
+	// a match at distance 3 of 3 bytes, then one of 4 overlapping itself
+	rdp5 := (&bitWriter{}).literals("ab\xe9").
+		write(0b11111, 5).write(3, 6).write(0, 1).
+		write(0b11111, 5).write(1, 6).write(0b10, 2).write(0, 2)
+	out, err := d.Decompress(rdp5.b, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED|PACKET_FLUSHED)
+	if err != nil || string(out) != "ab\xe9ab\xe9\xe9\xe9\xe9\xe9" {
+		t.Fatalf("rdp5 = %q, %v", out, err)
+	}
+	// the next packet refers to the history of the first one, 320 + 0 bytes back is past its start
+	next := (&bitWriter{}).write(0b110, 3).write(0, 16).write(0, 1)
+	if _, err := d.Decompress(next.b, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED); err == nil {
+		t.Error("match before the history accepted")
+	}
+	next = (&bitWriter{}).write(0b11110, 5).write(0, 8).write(0, 1)
+	if _, err := d.Decompress(next.b, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED); err == nil {
+		t.Error("match before the history accepted")
+	}
+	next = (&bitWriter{}).literals("!").write(0b11111, 5).write(11, 6).write(0, 1)
+	if out, err = d.Decompress(next.b, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED); err != nil || string(out) != "!ab\xe9" {
+		t.Fatalf("rdp5 history = %q, %v", out, err)
+	}
+
+	rdp4 := (&bitWriter{}).literals("xyz").write(0b1111, 4).write(3, 6).write(0, 1)
+	if out, err = d.Decompress(rdp4.b, PACKET_COMPR_TYPE_8K|PACKET_COMPRESSED); err != nil || string(out) != "xyzxyz" {
+		t.Fatalf("rdp4 = %q, %v", out, err)
+	}
+	if out, err = d.Decompress([]byte("raw"), PACKET_COMPR_TYPE_8K); err != nil || string(out) != "raw" {
+		t.Fatalf("uncompressed = %q, %v", out, err)
+	}
+	if _, err = d.Decompress(rdp4.b, PACKET_COMPR_TYPE_RDP6|PACKET_COMPRESSED); err == nil {
+		t.Error("ncrush accepted")
+	}
+}
+
+func TestXcrush(t *testing.T) {
+	d := NewDecompressor()
+	flags := uint8(PACKET_COMPR_TYPE_RDP61 | PACKET_COMPRESSED)
+	out, err := d.Decompress(append([]byte{L1_NO_COMPRESSION | L1_PACKET_AT_FRONT, 0}, "hello world"...), flags|PACKET_FLUSHED)
+	if err != nil || string(out) != "hello world" {
+		t.Fatalf("level 1 raw = %q, %v", out, err)
+	}
+
+	// "say " then "hello" from the history, a literal space then "world"
+	l1 := binary.LittleEndian.AppendUint16([]byte{L1_COMPRESSED, 0}, 2)
+	for _, m := range [][3]int{{5, 4, 0}, {5, 10, 6}} {
+		l1 = binary.LittleEndian.AppendUint16(l1, uint16(m[0]))
+		l1 = binary.LittleEndian.AppendUint16(l1, uint16(m[1]))
+		l1 = binary.LittleEndian.AppendUint32(l1, uint32(m[2]))
+	}
+	l1 = append(l1, "say  !"...)
+	if out, err = d.Decompress(l1, flags); err != nil || string(out) != "say hello world!" {
+		t.Fatalf("level 1 matches = %q, %v", out, err)
+	}
+
+	// the level 1 output compressed again by mppc
+	inner := (&bitWriter{}).literals("ab").write(0b11111, 5).write(2, 6).write(0b10, 2).write(0, 2)
+	l2 := append([]byte{L1_NO_COMPRESSION | L1_INNER_COMPRESSION, PACKET_COMPR_TYPE_64K | PACKET_COMPRESSED}, inner.b...)
+	if out, err = d.Decompress(l2, flags); err != nil || string(out) != "ababab" {
+		t.Fatalf("level 2 = %q, %v", out, err)
+	}
+
+	// "hello" ends the history moved to the front by the next packet
+	long := append(bytes.Repeat([]byte{'x'}, 40000), "hello"...)
+	if _, err = d.Decompress(append([]byte{L1_NO_COMPRESSION, 0}, long...), flags); err != nil {
+		t.Fatal(err)
+	}
+	front := binary.LittleEndian.AppendUint16([]byte{L1_COMPRESSED | L1_PACKET_AT_FRONT, 0}, 1)
+	front = binary.LittleEndian.AppendUint16(front, 5)
+	front = binary.LittleEndian.AppendUint16(front, 0)
+	front = binary.LittleEndian.AppendUint32(front, XCRUSH_HISTORY_KEEP-5)
+	front = append(front, '!')
+	if out, err = d.Decompress(front, flags); err != nil || string(out) != "hello!" {
+		t.Fatalf("packet at front = %q, %v", out, err)
+	}
+
+	bad := binary.LittleEndian.AppendUint16([]byte{L1_COMPRESSED, 0}, 1)
+	bad = append(bad, 1, 0, 5, 0, 0, 0, 0, 0, 'x')
+	if _, err = d.Decompress(bad, flags); err == nil {
+		t.Error("match past the literals accepted")
+	}
+}
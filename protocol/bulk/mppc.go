@@ -0,0 +1,158 @@
+package bulk
+
+import "errors"
+
+/**
+ * MPPC of RDP 4.0 with a history of 8 KB and of RDP 5.0 with 64 KB
+ * @see MS-RDPBCGR 3.1.8.4 Compression Types
+ * @see RFC 2118 Microsoft Point-To-Point Compression (MPPC) Protocol
+ */
+
+const (
+	RDP4_HISTORY_SIZE = 8192
+	RDP5_HISTORY_SIZE = 65536
+)
+
+type mppc struct {
+	history []byte
+	pos     int
+	// big is RDP 5.0, its copy offsets and lengths are larger
+	big bool
+}
+
+func newMppc(big bool) *mppc {
+	size := RDP4_HISTORY_SIZE
+	if big {
+		size = RDP5_HISTORY_SIZE
+	}
+	return &mppc{history: make([]byte, size), big: big}
+}
+
+// decompress appends the packet to the history and returns it
+func (m *mppc) decompress(in []byte, flags uint8) ([]byte, error) {
+	if flags&PACKET_AT_FRONT != 0 {
+		m.pos = 0
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		clear(m.history)
+		m.pos = 0
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return in, nil
+	}
+
+	start := m.pos
+	r := &bitReader{b: in}
+	// the last byte is padded with less than a literal
+	for r.left() >= 8 {
+		if r.bit() == 0 {
+			if err := m.put(byte(r.bits(7))); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if r.bit() == 0 {
+			if err := m.put(0x80 | byte(r.bits(7))); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		offset := m.copyOffset(r)
+		length, err := m.lengthOfMatch(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		src := m.pos - offset
+		if src < 0 || m.pos+length > len(m.history) {
+			return nil, errors.New("mppc: match outside the history")
+		}
+		// the match may overlap its copy
+		for i := 0; i < length; i++ {
+			m.history[m.pos+i] = m.history[src+i]
+		}
+		m.pos += length
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m.history[start:m.pos], nil
+}
+
+func (m *mppc) put(b byte) error {
+	if m.pos >= len(m.history) {
+		return errors.New("mppc: history overflow")
+	}
+	m.history[m.pos] = b
+	m.pos++
+	return nil
+}
+
+// copyOffset reads the distance of a match after its leading 11
+func (m *mppc) copyOffset(r *bitReader) int {
+	if m.big {
+		switch {
+		case r.bit() == 0:
+			return int(r.bits(16)) + 2368
+		case r.bit() == 0:
+			return int(r.bits(11)) + 320
+		case r.bit() == 0:
+			return int(r.bits(8)) + 64
+		}
+		return int(r.bits(6))
+	}
+	switch {
+	case r.bit() == 0:
+		return int(r.bits(13)) + 320
+	case r.bit() == 0:
+		return int(r.bits(8)) + 64
+	}
+	return int(r.bits(6))
+}
+
+// lengthOfMatch reads 3 for a 0, else as many bits as the leading ones plus one
+// above the power of two they announce
+func (m *mppc) lengthOfMatch(r *bitReader) (int, error) {
+	ones := 0
+	for r.bit() == 1 {
+		ones++
+		if ones > 14 || (!m.big && ones > 11) || r.err != nil {
+			return 0, errors.New("mppc: invalid length of match")
+		}
+	}
+	if ones == 0 {
+		return 3, nil
+	}
+	return 1<<(ones+1) + int(r.bits(ones+1)), nil
+}
+
+// bitReader reads data from the most significant bit, past its end it fails
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) left() int {
+	return len(r.b)*8 - r.pos
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.b)*8 {
+		r.err = errTruncated
+		return 0
+	}
+	v := uint32(r.b[r.pos>>3]>>(7-uint(r.pos&7))) & 1
+	r.pos++
+	return v
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
@@ -0,0 +1,125 @@
+package bulk
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/**
+ * XCRUSH of RDP 6.1, matches of chunks of a large history whose output is in
+ * turn compressed by MPPC 64 KB
+ * @see MS-RDPEGDI 3.1.8.2 RDP 6.1 Bulk Compression
+ */
+
+// flags of the first level
+const (
+	L1_COMPRESSED        = 0x01
+	L1_NO_COMPRESSION    = 0x02
+	L1_PACKET_AT_FRONT   = 0x04
+	L1_INNER_COMPRESSION = 0x10
+)
+
+const XCRUSH_HISTORY_SIZE = 2000000
+
+// XCRUSH_HISTORY_KEEP are the last bytes of the history moved to its front
+// before a packet at front
+const XCRUSH_HISTORY_KEEP = 32768
+
+type xcrush struct {
+	history []byte
+	pos     int
+	inner   *mppc
+}
+
+func newXcrush() *xcrush {
+	return &xcrush{history: make([]byte, XCRUSH_HISTORY_SIZE), inner: newMppc(true)}
+}
+
+// decompress reads the RDP61_COMPRESSED_DATA of a packet
+func (x *xcrush) decompress(in []byte, flags uint8) ([]byte, error) {
+	if flags&PACKET_FLUSHED != 0 {
+		clear(x.history)
+		x.pos = 0
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return in, nil
+	}
+	if len(in) < 2 {
+		return nil, errTruncated
+	}
+	l1, l2 := in[0], in[1]
+	in = in[2:]
+	if Compressed(l2) {
+		var err error
+		if in, err = x.inner.decompress(in, l2); err != nil {
+			return nil, err
+		}
+	}
+
+	// the packet follows the end of the history moved to its front, the
+	// matches still reference it
+	if l1&L1_PACKET_AT_FRONT != 0 {
+		keep := min(x.pos, XCRUSH_HISTORY_KEEP)
+		copy(x.history, x.history[x.pos-keep:x.pos])
+		x.pos = keep
+	}
+	start := x.pos
+	switch {
+	case l1&L1_NO_COMPRESSION != 0:
+		if err := x.put(in); err != nil {
+			return nil, err
+		}
+	case l1&L1_COMPRESSED != 0:
+		if err := x.matches(in); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("xcrush: invalid level 1 flags")
+	}
+	return x.history[start:x.pos], nil
+}
+
+// matches rebuilds the output from the RDP61_MATCH_DETAILS and the literals between them
+func (x *xcrush) matches(in []byte) error {
+	if len(in) < 2 {
+		return errTruncated
+	}
+	count := int(binary.LittleEndian.Uint16(in))
+	if len(in) < 2+count*8 {
+		return errTruncated
+	}
+	details, literals := in[2:2+count*8], in[2+count*8:]
+	start, out := x.pos, 0
+	for i := 0; i < count; i++ {
+		d := details[i*8:]
+		length := int(binary.LittleEndian.Uint16(d))
+		outputOffset := int(binary.LittleEndian.Uint16(d[2:]))
+		historyOffset := int(binary.LittleEndian.Uint32(d[4:]))
+		n := outputOffset - out
+		if n < 0 || n > len(literals) {
+			return errors.New("xcrush: invalid match output offset")
+		}
+		if err := x.put(literals[:n]); err != nil {
+			return err
+		}
+		literals = literals[n:]
+		if historyOffset+length > len(x.history) || x.pos+length > len(x.history) {
+			return errors.New("xcrush: match outside the history")
+		}
+		// the match may overlap its copy
+		for j := 0; j < length; j++ {
+			x.history[x.pos+j] = x.history[historyOffset+j]
+		}
+		x.pos += length
+		out = x.pos - start
+	}
+	return x.put(literals)
+}
+
+func (x *xcrush) put(b []byte) error {
+	if x.pos+len(b) > len(x.history) {
+		return errors.New("xcrush: history overflow")
+	}
+	x.pos += copy(x.history[x.pos:], b)
+	return nil
+}
@@ -0,0 +1,98 @@
+package nla
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// Authenticator is the security package run inside the CredSSP TSRequest exchange
+// @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+type Authenticator interface {
+	// InitSecContext consumes the token of the server, nil on the first call,
+	// and returns the token to send. established is true once the context
+	// can wrap messages, output may then be nil.
+	InitSecContext(input []byte) (output []byte, established bool, err error)
+	// Wrap encrypts and signs a message for the server
+	Wrap(data []byte) []byte
+	// Unwrap decrypts a message of the server and checks its signature
+	Unwrap(data []byte) ([]byte, error)
+	// Credentials returns the DER encoded TSCredentials delegated to the server
+	Credentials() []byte
+}
+
+// Token is an opaque security token sent in the negoTokens of a TSRequest
+type Token []byte
+
+func (t Token) Serialize() []byte {
+	return t
+}
+
+func (n *NTLMv2) InitSecContext(input []byte) ([]byte, bool, error) {
+	if input == nil {
+		return n.GetNegotiateMessage().Serialize(), false, nil
+	}
+	msg, security := n.GetAuthenticateMessage(input)
+	if msg == nil {
+		return nil, false, errors.New("invalid challenge message")
+	}
+	n.security = security
+	return msg.Serialize(), true, nil
+}
+
+func (n *NTLMv2) Wrap(data []byte) []byte {
+	return n.security.GssEncrypt(data)
+}
+
+func (n *NTLMv2) Unwrap(data []byte) ([]byte, error) {
+	plain := n.security.GssDecrypt(data)
+	if plain == nil {
+		return nil, errors.New("invalid NTLM message signature")
+	}
+	return plain, nil
+}
+
+func (n *NTLMv2) Credentials() []byte {
+	return EncodeDERTCredentials(n.GetEncodedCredentials())
+}
+
+// Negotiate uses Kerberos and falls back to NTLM when no service ticket can be obtained
+type Negotiate struct {
+	kerberos *Kerberos
+	ntlm     *NTLMv2
+	selected Authenticator
+}
+
+func NewNegotiate(kerberos *Kerberos, ntlm *NTLMv2) *Negotiate {
+	return &Negotiate{kerberos: kerberos, ntlm: ntlm}
+}
+
+func (n *Negotiate) InitSecContext(input []byte) ([]byte, bool, error) {
+	if n.selected == nil {
+		output, established, err := n.kerberos.InitSecContext(nil)
+		if err == nil {
+			n.selected = n.kerberos
+			return output, established, nil
+		}
+		slog.Warn("Kerberos failed, fallback to NTLM", "err", err)
+		n.selected = n.ntlm
+		return n.ntlm.InitSecContext(nil)
+	}
+	return n.selected.InitSecContext(input)
+}
+
+// Selected returns the package in use after the first token
+func (n *Negotiate) Selected() Authenticator {
+	return n.selected
+}
+
+func (n *Negotiate) Wrap(data []byte) []byte {
+	return n.selected.Wrap(data)
+}
+
+func (n *Negotiate) Unwrap(data []byte) ([]byte, error) {
+	return n.selected.Unwrap(data)
+}
+
+func (n *Negotiate) Credentials() []byte {
+	return n.selected.Credentials()
+}
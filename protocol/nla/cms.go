@@ -0,0 +1,222 @@
+package nla
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+/**
+ * CMS SignedData of the PKINIT messages
+ * @see https://www.rfc-editor.org/rfc/rfc5652#section-5
+ */
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"optional,explicit,tag:0"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// signerInfo requires the signed attributes, they are mandatory for a content other than id-data
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+func newAttribute(oid asn1.ObjectIdentifier, value interface{}) []byte {
+	v, _ := asn1.Marshal(value)
+	b, _ := asn1.Marshal(attribute{oid, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: v}})
+	return b
+}
+
+func signatureAlgorithm(pub crypto.PublicKey) (pkix.AlgorithmIdentifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signer key %T", pub)
+}
+
+// signCMS wraps content in a SignedData of signer, cert is sent along
+func signCMS(contentType asn1.ObjectIdentifier, content []byte, cert *x509.Certificate, signer crypto.Signer) ([]byte, error) {
+	sigAlg, err := signatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	// DER orders the SET OF by encoding, the content type is the shorter one
+	attrs := append(newAttribute(oidContentType, contentType), newAttribute(oidMessageDigest, digest[:])...)
+	set, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	h := sha256.Sum256(set)
+	signature, err := signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sha256ID := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	b, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256ID},
+		EncapContentInfo: encapsulatedContentInfo{contentType, content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerialNumber{asn1.RawValue{FullBytes: cert.RawIssuer}, cert.SerialNumber},
+			DigestAlgorithm:    sha256ID,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{oidSignedData, explicit(0, asn1.RawValue{FullBytes: b})})
+}
+
+// verifyCMS checks the signature of a SignedData and returns its content and signer,
+// the signer chain is verified up to roots or the system roots when nil
+func verifyCMS(b []byte, roots *x509.CertPool) (asn1.ObjectIdentifier, []byte, *x509.Certificate, error) {
+	ci := &contentInfo{}
+	if _, err := asn1.Unmarshal(b, ci); err != nil {
+		return nil, nil, nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, nil, errors.New("not a CMS SignedData")
+	}
+	sd := &signedData{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, sd); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, nil, nil, errors.New("one CMS signer expected")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	si := sd.SignerInfos[0]
+	var cert *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.SID.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) {
+			cert = c
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	if cert == nil {
+		return nil, nil, nil, errors.New("no certificate of the CMS signer")
+	}
+
+	var h hash.Hash
+	var algo x509.SignatureAlgorithm
+	switch {
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA256):
+		h = sha256.New()
+		algo = x509.SHA256WithRSA
+		if si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+			algo = x509.ECDSAWithSHA256
+		}
+	case si.DigestAlgorithm.Algorithm.Equal(oidSHA1):
+		h = sha1.New()
+		algo = x509.SHA1WithRSA
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported CMS digest %v", si.DigestAlgorithm.Algorithm)
+	}
+	content := sd.EncapContentInfo.EContent
+	h.Write(content)
+	var digest []byte
+	asn1.Unmarshal(signedAttribute(si.SignedAttrs.Bytes, oidMessageDigest), &digest)
+	if !bytes.Equal(digest, h.Sum(nil)) {
+		return nil, nil, nil, errors.New("CMS message digest does not match")
+	}
+	// the signed content type must be the one of the content
+	// @see https://www.rfc-editor.org/rfc/rfc5652#section-11.1
+	var contentType asn1.ObjectIdentifier
+	asn1.Unmarshal(signedAttribute(si.SignedAttrs.Bytes, oidContentType), &contentType)
+	if !contentType.Equal(sd.EncapContentInfo.EContentType) {
+		return nil, nil, nil, fmt.Errorf("CMS content type %v is signed as %v", sd.EncapContentInfo.EContentType, contentType)
+	}
+	// the signature covers the attributes encoded as a SET OF
+	set, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err := cert.CheckSignature(algo, set, si.Signature); err != nil {
+		return nil, nil, nil, err
+	}
+	// the system roots verify the chain when roots is nil
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sd.EncapContentInfo.EContentType, content, cert, nil
+}
+
+// signedAttribute returns the encoded value of the attribute oid, nil when it is missing
+func signedAttribute(attrs []byte, oid asn1.ObjectIdentifier) []byte {
+	for len(attrs) > 0 {
+		var a attribute
+		rest, err := asn1.Unmarshal(attrs, &a)
+		if err != nil {
+			return nil
+		}
+		attrs = rest
+		if a.Type.Equal(oid) {
+			return a.Values.Bytes
+		}
+	}
+	return nil
+}
@@ -1,10 +1,29 @@
 package nla
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/asn1"
 	"log/slog"
 )
 
+/**
+ * CredSSP protocol versions
+ * From version 5 the public key is bound to a client nonce (CVE-2018-0886)
+ * @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+ */
+const (
+	CREDSSP_VERSION_2 = 2
+	CREDSSP_VERSION_5 = 5
+	CREDSSP_VERSION_6 = 6
+	CREDSSP_VERSION   = CREDSSP_VERSION_6
+)
+
+const (
+	ClientServerHashMagic = "CredSSP Client-To-Server Binding Hash\x00"
+	ServerClientHashMagic = "CredSSP Server-To-Client Binding Hash\x00"
+)
+
 type NegoToken struct {
 	Data []byte `asn1:"explicit,tag:0"`
 }
@@ -14,7 +33,9 @@ type TSRequest struct {
 	NegoTokens []NegoToken `asn1:"optional,explicit,tag:1"`
 	AuthInfo   []byte      `asn1:"optional,explicit,tag:2"`
 	PubKeyAuth []byte      `asn1:"optional,explicit,tag:3"`
-	//ErrorCode  int         `asn1:"optional,explicit,tag:4"`
+	ErrorCode  int64       `asn1:"optional,explicit,tag:4"`
+	// ClientNonce is sent from version 5
+	ClientNonce []byte `asn1:"optional,explicit,tag:5"`
 }
 
 type TSCredentials struct {
@@ -22,30 +43,46 @@ type TSCredentials struct {
 	Credentials []byte `asn1:"explicit,tag:1"`
 }
 
+/**
+ * credType of TSCredentials
+ * @see MS-CSSP 2.2.1.2 TSCredentials
+ */
+const (
+	TSCRED_PASSWORD  = 1
+	TSCRED_SMARTCARD = 2
+)
+
 type TSPasswordCreds struct {
 	DomainName []byte `asn1:"explicit,tag:0"`
 	UserName   []byte `asn1:"explicit,tag:1"`
 	Password   []byte `asn1:"explicit,tag:2"`
 }
 
+// TSCspDataDetail names the card, the strings are unicode
 type TSCspDataDetail struct {
 	KeySpec       int    `asn1:"explicit,tag:0"`
-	CardName      string `asn1:"explicit,tag:1"`
-	ReaderName    string `asn1:"explicit,tag:2"`
-	ContainerName string `asn1:"explicit,tag:3"`
-	CspName       string `asn1:"explicit,tag:4"`
+	CardName      []byte `asn1:"optional,explicit,tag:1"`
+	ReaderName    []byte `asn1:"optional,explicit,tag:2"`
+	ContainerName []byte `asn1:"optional,explicit,tag:3"`
+	CspName       []byte `asn1:"optional,explicit,tag:4"`
 }
 
 type TSSmartCardCreds struct {
-	Pin        string            `asn1:"explicit,tag:0"`
-	CspData    []TSCspDataDetail `asn1:"explicit,tag:1"`
-	UserHint   string            `asn1:"explicit,tag:2"`
-	DomainHint string            `asn1:"explicit,tag:3"`
+	Pin        []byte          `asn1:"explicit,tag:0"`
+	CspData    TSCspDataDetail `asn1:"explicit,tag:1"`
+	UserHint   []byte          `asn1:"optional,explicit,tag:2"`
+	DomainHint []byte          `asn1:"optional,explicit,tag:3"`
 }
 
 func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) []byte {
+	return EncodeDERTRequestVersion(CREDSSP_VERSION_2, msgs, authInfo, pubKeyAuth, nil)
+}
+
+// EncodeDERTRequestVersion encodes a TSRequest announcing version,
+// clientNonce is only sent from version 5
+func EncodeDERTRequestVersion(version int, msgs []Message, authInfo, pubKeyAuth, clientNonce []byte) []byte {
 	req := TSRequest{
-		Version: 2,
+		Version: version,
 	}
 
 	if len(msgs) > 0 {
@@ -65,6 +102,10 @@ func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) []byt
 		req.PubKeyAuth = pubKeyAuth
 	}
 
+	if version >= CREDSSP_VERSION_5 && len(clientNonce) > 0 {
+		req.ClientNonce = clientNonce
+	}
+
 	result, err := asn1.Marshal(req)
 	if err != nil {
 		slog.Error("EncodeDERTRequest", "err", err)
@@ -77,13 +118,49 @@ func DecodeDERTRequest(s []byte) (*TSRequest, error) {
 	_, err := asn1.Unmarshal(s, treq)
 	return treq, err
 }
+
+// NewClientNonce returns the 32 random bytes bound to the public key from version 5
+func NewClientNonce() ([]byte, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// ClientPubKeyAuth returns the value the client encrypts in pubKeyAuth,
+// the raw public key before version 5 and its SHA-256 binding hash after
+func ClientPubKeyAuth(version int, nonce, pubkey []byte) []byte {
+	if version < CREDSSP_VERSION_5 {
+		return pubkey
+	}
+	return pubKeyHash(ClientServerHashMagic, nonce, pubkey)
+}
+
+// ServerPubKeyAuth returns the value the server answers in pubKeyAuth,
+// the public key with its first byte incremented before version 5
+func ServerPubKeyAuth(version int, nonce, pubkey []byte) []byte {
+	if version < CREDSSP_VERSION_5 {
+		inc := append([]byte{}, pubkey...)
+		inc[0]++
+		return inc
+	}
+	return pubKeyHash(ServerClientHashMagic, nonce, pubkey)
+}
+
+func pubKeyHash(magic string, nonce, pubkey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(magic))
+	h.Write(nonce)
+	h.Write(pubkey)
+	return h.Sum(nil)
+}
+
 func EncodeDERTCredentials(domain, username, password []byte) []byte {
 	tpas := TSPasswordCreds{domain, username, password}
 	result, err := asn1.Marshal(tpas)
 	if err != nil {
 		slog.Error("EncodeDERTCredentials", "err", err)
 	}
-	tcre := TSCredentials{1, result}
+	tcre := TSCredentials{TSCRED_PASSWORD, result}
 	result, err = asn1.Marshal(tcre)
 	if err != nil {
 		slog.Error("EncodeDERTCredentials", "err", err)
@@ -91,6 +168,18 @@ func EncodeDERTCredentials(domain, username, password []byte) []byte {
 	return result
 }
 
+func EncodeDERTSmartCardCredentials(pin []byte, cspData TSCspDataDetail, userHint, domainHint []byte) []byte {
+	result, err := asn1.Marshal(TSSmartCardCreds{pin, cspData, userHint, domainHint})
+	if err != nil {
+		slog.Error("EncodeDERTSmartCardCredentials", "err", err)
+	}
+	result, err = asn1.Marshal(TSCredentials{TSCRED_SMARTCARD, result})
+	if err != nil {
+		slog.Error("EncodeDERTSmartCardCredentials", "err", err)
+	}
+	return result
+}
+
 func DecodeDERTCredentials(s []byte) (*TSCredentials, error) {
 	tcre := &TSCredentials{}
 	_, err := asn1.Unmarshal(s, tcre)
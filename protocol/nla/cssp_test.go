@@ -14,3 +14,37 @@ func TestEncodeDERTRequest(t *testing.T) {
 		t.Error("not equal")
 	}
 }
+
+func TestEncodeDERTRequestVersion(t *testing.T) {
+	nonce := make([]byte, 32)
+	result := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION_6, nil, nil, []byte{1}, nonce)
+	req, err := nla.DecodeDERTRequest(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != 6 || len(req.ClientNonce) != 32 {
+		t.Error("version", req.Version, "nonce", len(req.ClientNonce))
+	}
+
+	result = nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION_2, nil, nil, []byte{1}, nonce)
+	req, _ = nla.DecodeDERTRequest(result)
+	if req.ClientNonce != nil {
+		t.Error("nonce must not be sent before version 5")
+	}
+}
+
+func TestPubKeyAuth(t *testing.T) {
+	pubkey := []byte{0x30, 0x01, 0x02}
+	if hex.EncodeToString(nla.ServerPubKeyAuth(nla.CREDSSP_VERSION_2, nil, pubkey)) != "310102" {
+		t.Error("first byte must be incremented before version 5")
+	}
+	if string(nla.ClientPubKeyAuth(nla.CREDSSP_VERSION_2, nil, pubkey)) != string(pubkey) {
+		t.Error("raw public key expected before version 5")
+	}
+	nonce := make([]byte, 32)
+	client := nla.ClientPubKeyAuth(nla.CREDSSP_VERSION_6, nonce, pubkey)
+	server := nla.ServerPubKeyAuth(nla.CREDSSP_VERSION_6, nonce, pubkey)
+	if len(client) != 32 || len(server) != 32 || string(client) == string(server) {
+		t.Error("distinct SHA-256 hashes expected")
+	}
+}
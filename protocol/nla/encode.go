@@ -30,7 +30,17 @@ func HMAC_MD5(key, data []byte) []byte {
 
 // Version 2 of NTLM hash function
 func NTOWFv2(password, user, domain string) []byte {
-	return HMAC_MD5(MD4(core.UnicodeEncode(password)), core.UnicodeEncode(strings.ToUpper(user)+domain))
+	return NTOWFv2Hash(NTHash(password), user, domain)
+}
+
+// NTHash is the MD4 of the unicode password, also known as NTOWFv1
+func NTHash(password string) []byte {
+	return MD4(core.UnicodeEncode(password))
+}
+
+// NTOWFv2Hash is NTOWFv2 of a pre-computed NT hash
+func NTOWFv2Hash(ntHash []byte, user, domain string) []byte {
+	return HMAC_MD5(ntHash, core.UnicodeEncode(strings.ToUpper(user)+domain))
 }
 
 // Same as NTOWFv2
@@ -21,6 +21,20 @@ func TestNTOWFv2(t *testing.T) {
 	}
 }
 
+func TestNTHash(t *testing.T) {
+	res := hex.EncodeToString(nla.NTHash("password"))
+	expected := "8846f7eaee8fb117ad06bdd830b7586c"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+
+	res = hex.EncodeToString(nla.NTOWFv2Hash(nla.NTHash("user"), "pwd", "dom"))
+	expected = "652feb8208b3a8a6264c9c5d5b820979"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+}
+
 func TestRC4K(t *testing.T) {
 	key, _ := hex.DecodeString("55638e834ce774c100637f197bc0683f")
 	src, _ := hex.DecodeString("177d16086dd3f06fa8d594e3bad005b7")
@@ -0,0 +1,820 @@
+package nla
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+)
+
+/**
+ * Kerberos message types and application tags
+ * @see https://www.rfc-editor.org/rfc/rfc4120#section-5.10
+ */
+const (
+	KRB_TAG_TICKET        = 1
+	KRB_TAG_AUTHENTICATOR = 2
+	KRB_TAG_ENC_TICKET    = 3
+	KRB_AS_REQ            = 10
+	KRB_AS_REP            = 11
+	KRB_TGS_REQ           = 12
+	KRB_TGS_REP           = 13
+	KRB_AP_REQ            = 14
+	KRB_AP_REP            = 15
+	KRB_TAG_ENC_AS_REP    = 25
+	KRB_TAG_ENC_TGS_REP   = 26
+	KRB_TAG_ENC_AP_REP    = 27
+	KRB_ERROR             = 30
+)
+
+const (
+	KRB_NT_PRINCIPAL = 1
+	KRB_NT_SRV_INST  = 2
+)
+
+/**
+ * Pre-authentication data types
+ */
+const (
+	PA_TGS_REQ       = 1
+	PA_ENC_TIMESTAMP = 2
+	PA_ETYPE_INFO2   = 19
+)
+
+const (
+	KDC_ERR_PREAUTH_REQUIRED = 25
+)
+
+/**
+ * Flags of the GSS checksum of the AP-REQ authenticator
+ * @see https://www.rfc-editor.org/rfc/rfc4121#section-4.1.1
+ */
+const (
+	GSS_C_MUTUAL_FLAG   = 0x02
+	GSS_C_REPLAY_FLAG   = 0x04
+	GSS_C_SEQUENCE_FLAG = 0x08
+	GSS_C_CONF_FLAG     = 0x10
+	GSS_C_INTEG_FLAG    = 0x20
+	GSS_CHECKSUM_TYPE   = 0x8003
+)
+
+/**
+ * Flags of the GSS per-message tokens
+ * @see https://www.rfc-editor.org/rfc/rfc4121#section-4.2.2
+ */
+const (
+	GSS_FLAG_SENT_BY_ACCEPTOR = 0x01
+	GSS_FLAG_SEALED           = 0x02
+	GSS_FLAG_ACCEPTOR_SUBKEY  = 0x04
+	gssTokenHeaderLength      = 16
+	gssRightRotationCount     = aesBlockSize + aesHMACSize
+)
+
+var (
+	oidKRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	oidMSKRB5 = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+
+	gssTokenAPReq = []byte{0x01, 0x00}
+	gssTokenAPRep = []byte{0x02, 0x00}
+	gssTokenError = []byte{0x03, 0x00}
+)
+
+// KerberosError is a KRB-ERROR answered by the KDC or the server
+type KerberosError struct {
+	Code int32
+	Text string
+}
+
+func (e KerberosError) Error() string {
+	if e.Text != "" {
+		return fmt.Sprintf("kerberos error %d: %s", e.Code, e.Text)
+	}
+	return fmt.Sprintf("kerberos error %d", e.Code)
+}
+
+type PrincipalName struct {
+	NameType   int32           `asn1:"explicit,tag:0"`
+	NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+}
+
+func newPrincipalName(nameType int32, names ...string) PrincipalName {
+	p := PrincipalName{NameType: nameType}
+	for _, n := range names {
+		p.NameString = append(p.NameString, generalString(n))
+	}
+	return p
+}
+
+func (p PrincipalName) String() string {
+	names := make([]string, 0, len(p.NameString))
+	for _, n := range p.NameString {
+		names = append(names, string(n.Bytes))
+	}
+	return strings.Join(names, "/")
+}
+
+// generalString encodes a KerberosString, encoding/asn1 only decodes them
+func generalString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagGeneralString, Bytes: []byte(s)}
+}
+
+// explicit adds the context tag of a RawValue field, encoding/asn1 ignores the
+// explicit option of those on marshal and keeps the tag on unmarshal
+func explicit(tag int, v asn1.RawValue) asn1.RawValue {
+	b, _ := asn1.Marshal(v)
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: b}
+}
+
+type EncryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	Kvno   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type Checksum struct {
+	CksumType int32  `asn1:"explicit,tag:0"`
+	Checksum  []byte `asn1:"explicit,tag:1"`
+}
+
+type PAData struct {
+	Type  int32  `asn1:"explicit,tag:1"`
+	Value []byte `asn1:"explicit,tag:2"`
+}
+
+type ETypeInfo2Entry struct {
+	EType     int32  `asn1:"explicit,tag:0"`
+	Salt      string `asn1:"optional,explicit,tag:1"`
+	S2KParams []byte `asn1:"optional,explicit,tag:2"`
+}
+
+type PAEncTSEnc struct {
+	PATimestamp time.Time `asn1:"generalized,explicit,tag:0"`
+	PAUSec      int       `asn1:"optional,explicit,tag:1"`
+}
+
+type KDCReqBody struct {
+	KDCOptions asn1.BitString `asn1:"explicit,tag:0"`
+	CName      PrincipalName  `asn1:"optional,explicit,tag:1"`
+	Realm      asn1.RawValue  `asn1:"explicit,tag:2"`
+	SName      PrincipalName  `asn1:"optional,explicit,tag:3"`
+	Till       time.Time      `asn1:"generalized,explicit,tag:5"`
+	Nonce      int            `asn1:"explicit,tag:7"`
+	EType      []int          `asn1:"explicit,tag:8"`
+}
+
+// KDCReq keeps the raw body, the TGS-REQ checksum covers its exact encoding
+type KDCReq struct {
+	PVNO    int           `asn1:"explicit,tag:1"`
+	MsgType int           `asn1:"explicit,tag:2"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:3"`
+	ReqBody asn1.RawValue `asn1:"explicit,tag:4"`
+}
+
+type KDCRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:2"`
+	CRealm  string        `asn1:"explicit,tag:3"`
+	CName   PrincipalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart EncryptedData `asn1:"explicit,tag:6"`
+}
+
+type EncKDCRepPart struct {
+	Key           EncryptionKey  `asn1:"explicit,tag:0"`
+	LastReq       asn1.RawValue  `asn1:"explicit,tag:1"`
+	Nonce         int            `asn1:"explicit,tag:2"`
+	KeyExpiration time.Time      `asn1:"generalized,optional,explicit,tag:3"`
+	Flags         asn1.BitString `asn1:"explicit,tag:4"`
+	AuthTime      time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime     time.Time      `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime       time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill     time.Time      `asn1:"generalized,optional,explicit,tag:8"`
+	SRealm        string         `asn1:"explicit,tag:9"`
+	SName         PrincipalName  `asn1:"explicit,tag:10"`
+	CAddr         asn1.RawValue  `asn1:"optional,explicit,tag:11"`
+	EncPAData     asn1.RawValue  `asn1:"optional,explicit,tag:12"`
+}
+
+type Ticket struct {
+	TktVno  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   PrincipalName `asn1:"explicit,tag:2"`
+	EncPart EncryptedData `asn1:"explicit,tag:3"`
+}
+
+type KRBError struct {
+	PVNO      int           `asn1:"explicit,tag:0"`
+	MsgType   int           `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"generalized,optional,explicit,tag:2"`
+	CUSec     int           `asn1:"optional,explicit,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int           `asn1:"explicit,tag:5"`
+	ErrorCode int32         `asn1:"explicit,tag:6"`
+	CRealm    string        `asn1:"optional,explicit,tag:7"`
+	CName     PrincipalName `asn1:"optional,explicit,tag:8"`
+	Realm     string        `asn1:"explicit,tag:9"`
+	SName     PrincipalName `asn1:"explicit,tag:10"`
+	EText     string        `asn1:"optional,explicit,tag:11"`
+	EData     []byte        `asn1:"optional,explicit,tag:12"`
+}
+
+type KRBAuthenticator struct {
+	AVNO      int           `asn1:"explicit,tag:0"`
+	CRealm    asn1.RawValue `asn1:"explicit,tag:1"`
+	CName     PrincipalName `asn1:"explicit,tag:2"`
+	Cksum     Checksum      `asn1:"optional,explicit,tag:3"`
+	CUSec     int           `asn1:"explicit,tag:4"`
+	CTime     time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey    EncryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:7"`
+}
+
+type APReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator EncryptedData  `asn1:"explicit,tag:4"`
+}
+
+type APRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart EncryptedData `asn1:"explicit,tag:2"`
+}
+
+type EncAPRepPart struct {
+	CTime     time.Time     `asn1:"generalized,explicit,tag:0"`
+	CUSec     int           `asn1:"explicit,tag:1"`
+	SubKey    EncryptionKey `asn1:"optional,explicit,tag:2"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:3"`
+}
+
+// marshalApplication encodes v with the APPLICATION tag of a Kerberos message
+func marshalApplication(tag int, v interface{}) ([]byte, error) {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: b})
+}
+
+func unmarshalApplication(b []byte, v interface{}, tags ...int) error {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw.Class == asn1.ClassApplication && raw.Tag == KRB_ERROR {
+		return decodeKRBError(raw.Bytes)
+	}
+	for _, tag := range tags {
+		if raw.Class == asn1.ClassApplication && raw.Tag == tag {
+			_, err := asn1.Unmarshal(raw.Bytes, v)
+			return err
+		}
+	}
+	return fmt.Errorf("unexpected kerberos message tag %d", raw.Tag)
+}
+
+func decodeKRBError(b []byte) error {
+	e := &KRBError{}
+	if _, err := asn1.Unmarshal(b, e); err != nil {
+		return err
+	}
+	return &krbError{KerberosError{e.ErrorCode, e.EText}, e.EData}
+}
+
+// krbError keeps the e-data of a KRB-ERROR for the pre-authentication retry
+type krbError struct {
+	KerberosError
+	data []byte
+}
+
+func (e *krbError) Unwrap() error {
+	return e.KerberosError
+}
+
+// kerberosTime drops the sub-second part that KerberosTime cannot carry
+func kerberosTime() (time.Time, int) {
+	now := time.Now().UTC()
+	return now.Truncate(time.Second), now.Nanosecond() / 1000
+}
+
+func randomUint31() int {
+	n, _ := rand.Int(rand.Reader, big.NewInt(1<<31-1))
+	return int(n.Int64()) + 1
+}
+
+func kdcOptions(bits uint32) asn1.BitString {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, bits)
+	return asn1.BitString{Bytes: b, BitLength: 32}
+}
+
+/**
+ * Kerberos is the initiator side of the Kerberos V5 GSS-API mechanism, the
+ * tickets for TERMSRV/<host> are requested from the KDC and the AP-REQ is
+ * sent in a SPNEGO token.
+ * @see https://www.rfc-editor.org/rfc/rfc4120
+ * @see https://www.rfc-editor.org/rfc/rfc4121
+ */
+type Kerberos struct {
+	domain   string
+	realm    string
+	user     string
+	password string
+	kdc      string
+	host     string
+	timeout  time.Duration
+	// smartCard replaces the password with PKINIT
+	smartCard *SmartCard
+
+	sessionKey     *EncryptionKey
+	subkey         *EncryptionKey
+	acceptorSubkey *EncryptionKey
+	ctime          time.Time
+	cusec          int
+	sendSeq        uint64
+	mechTypes      []byte
+	established    bool
+}
+
+// NewKerberos authenticates user of domain with the KDC at kdc host:port,
+// the _kerberos._tcp SRV record of the realm is used when kdc is empty.
+// host is the name of the rdp server in its service principal TERMSRV/host.
+func NewKerberos(domain, user, password, kdc, host string) *Kerberos {
+	return &Kerberos{
+		domain:   domain,
+		realm:    strings.ToUpper(domain),
+		user:     user,
+		password: password,
+		kdc:      kdc,
+		host:     host,
+		timeout:  10 * time.Second,
+	}
+}
+
+// NewKerberosSmartCard authenticates user with the certificate of card, see NewKerberos
+func NewKerberosSmartCard(domain, user string, card *SmartCard, kdc, host string) *Kerberos {
+	k := NewKerberos(domain, user, "", kdc, host)
+	k.smartCard = card
+	return k
+}
+
+// maxKDCReplySize bounds the replies of the KDC, the limit of MIT Kerberos
+const maxKDCReplySize = 64 * 1024
+
+// exchange sends one message to the KDC over TCP, each one is prefixed by its length
+func (k *Kerberos) exchange(req []byte) ([]byte, error) {
+	kdc := k.kdc
+	if kdc == "" {
+		_, addrs, err := net.LookupSRV("kerberos", "tcp", k.realm)
+		if err != nil || len(addrs) == 0 {
+			return nil, fmt.Errorf("no KDC found for realm %s: %v", k.realm, err)
+		}
+		kdc = net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."), fmt.Sprint(addrs[0].Port))
+	}
+	conn, err := net.DialTimeout("tcp", kdc, k.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(k.timeout))
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32BE(uint32(len(req)), buff)
+	buff.Write(req)
+	if _, err := conn.Write(buff.Bytes()); err != nil {
+		return nil, err
+	}
+	size, err := core.ReadUInt32BE(conn)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxKDCReplySize {
+		return nil, fmt.Errorf("KDC reply of %d bytes", size)
+	}
+	resp := make([]byte, size)
+	_, err = io.ReadFull(conn, resp)
+	return resp, err
+}
+
+func (k *Kerberos) newReqBody(cname, sname PrincipalName, nonce int) ([]byte, error) {
+	body := KDCReqBody{
+		// forwardable, renewable, canonicalize
+		KDCOptions: kdcOptions(0x40810000),
+		CName:      cname,
+		Realm:      explicit(2, generalString(k.realm)),
+		SName:      sname,
+		Till:       time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second),
+		Nonce:      nonce,
+		EType:      []int{ETYPE_AES256_CTS_HMAC_SHA1_96, ETYPE_AES128_CTS_HMAC_SHA1_96},
+	}
+	return asn1.Marshal(body)
+}
+
+func (k *Kerberos) sendKDCReq(msgType int, padata []PAData, body []byte) ([]byte, error) {
+	req, err := marshalApplication(msgType, KDCReq{
+		PVNO:    5,
+		MsgType: msgType,
+		PAData:  padata,
+		ReqBody: explicit(4, asn1.RawValue{FullBytes: body}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k.exchange(req)
+}
+
+// asExchange requests a TGT, the first request without pre-authentication
+// returns the salt of the user key
+func (k *Kerberos) asExchange() ([]byte, *EncryptionKey, error) {
+	if k.smartCard != nil {
+		return k.pkinitExchange()
+	}
+	cname := newPrincipalName(KRB_NT_PRINCIPAL, k.user)
+	krbtgt := newPrincipalName(KRB_NT_SRV_INST, "krbtgt", k.realm)
+	nonce := randomUint31()
+	body, err := k.newReqBody(cname, krbtgt, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	etype := int32(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	salt := k.realm + k.user
+	var params []byte
+	var padata []PAData
+	var resp []byte
+	rep := &KDCRep{}
+	for attempt := 0; ; attempt++ {
+		resp, err = k.sendKDCReq(KRB_AS_REQ, padata, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = unmarshalApplication(resp, rep, KRB_AS_REP)
+		var kerr *krbError
+		if attempt > 0 || !errors.As(err, &kerr) || kerr.Code != KDC_ERR_PREAUTH_REQUIRED {
+			break
+		}
+		if entry := etypeInfo2(kerr.data); entry != nil {
+			etype, params = entry.EType, entry.S2KParams
+			if entry.Salt != "" {
+				salt = entry.Salt
+			}
+		}
+		key, err := StringToKey(etype, k.password, salt, params)
+		if err != nil {
+			return nil, nil, err
+		}
+		ts, usec := kerberosTime()
+		encTS, _ := asn1.Marshal(PAEncTSEnc{ts, usec})
+		value, _ := asn1.Marshal(EncryptedData{EType: etype, Cipher: key.Encrypt(KU_PA_ENC_TIMESTAMP, encTS)})
+		padata = []PAData{{PA_ENC_TIMESTAMP, value}}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entry := etypeInfo2(marshalPAData(rep.PAData)); entry != nil && entry.Salt != "" {
+		salt, params = entry.Salt, entry.S2KParams
+	}
+	key, err := StringToKey(rep.EncPart.EType, k.password, salt, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionKey, err := decryptKDCRep(key, KU_AS_REP_ENC_PART, rep, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep.Ticket.Bytes, sessionKey, nil
+}
+
+func marshalPAData(padata []PAData) []byte {
+	b, _ := asn1.Marshal(padata)
+	return b
+}
+
+// etypeInfo2 returns the first supported entry of the PA-ETYPE-INFO2 in a METHOD-DATA
+func etypeInfo2(methodData []byte) *ETypeInfo2Entry {
+	var padata []PAData
+	if _, err := asn1.Unmarshal(methodData, &padata); err != nil {
+		return nil
+	}
+	for _, pa := range padata {
+		if pa.Type != PA_ETYPE_INFO2 {
+			continue
+		}
+		var entries []ETypeInfo2Entry
+		if _, err := asn1.Unmarshal(pa.Value, &entries); err != nil {
+			return nil
+		}
+		for i := range entries {
+			if _, err := keySize(entries[i].EType); err == nil {
+				return &entries[i]
+			}
+		}
+	}
+	return nil
+}
+
+func decryptKDCRep(key *EncryptionKey, usage uint32, rep *KDCRep, nonce int) (*EncryptionKey, error) {
+	plain, err := key.Decrypt(usage, rep.EncPart.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	part := &EncKDCRepPart{}
+	// some KDCs answer EncASRepPart in a TGS-REP
+	if err := unmarshalApplication(plain, part, KRB_TAG_ENC_AS_REP, KRB_TAG_ENC_TGS_REP); err != nil {
+		return nil, err
+	}
+	if part.Nonce != nonce {
+		return nil, errors.New("kerberos reply nonce does not match")
+	}
+	return &part.Key, nil
+}
+
+// newAPReq builds an AP-REQ for ticket, the authenticator is sealed with key
+func (k *Kerberos) newAPReq(ticket []byte, key *EncryptionKey, usage uint32, options uint32, a *KRBAuthenticator) ([]byte, error) {
+	a.AVNO = 5
+	a.CRealm = explicit(1, generalString(k.realm))
+	a.CName = newPrincipalName(KRB_NT_PRINCIPAL, k.user)
+	a.CTime, a.CUSec = kerberosTime()
+	plain, err := marshalApplication(KRB_TAG_AUTHENTICATOR, *a)
+	if err != nil {
+		return nil, err
+	}
+	return marshalApplication(KRB_AP_REQ, APReq{
+		PVNO:          5,
+		MsgType:       KRB_AP_REQ,
+		APOptions:     kdcOptions(options),
+		Ticket:        explicit(3, asn1.RawValue{FullBytes: ticket}),
+		Authenticator: EncryptedData{EType: key.KeyType, Cipher: key.Encrypt(usage, plain)},
+	})
+}
+
+// tgsExchange requests the ticket of TERMSRV/<host> with the TGT
+func (k *Kerberos) tgsExchange(tgt []byte, tgtKey *EncryptionKey) ([]byte, *EncryptionKey, error) {
+	sname := newPrincipalName(KRB_NT_SRV_INST, "TERMSRV", k.host)
+	nonce := randomUint31()
+	body, err := k.newReqBody(PrincipalName{}, sname, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	apReq, err := k.newAPReq(tgt, tgtKey, KU_TGS_REQ_AUTHENTICATOR, 0, &KRBAuthenticator{
+		Cksum: Checksum{checksumType(tgtKey.KeyType), tgtKey.Checksum(KU_TGS_REQ_AUTH_CKSUM, body)},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := k.sendKDCReq(KRB_TGS_REQ, []PAData{{PA_TGS_REQ, apReq}}, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep := &KDCRep{}
+	if err := unmarshalApplication(resp, rep, KRB_TGS_REP); err != nil {
+		return nil, nil, err
+	}
+	key, err := decryptKDCRep(tgtKey, KU_TGS_REP_ENC_PART, rep, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep.Ticket.Bytes, key, nil
+}
+
+// gssChecksum binds the GSS flags to the authenticator, there are no channel bindings
+func gssChecksum() Checksum {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b, 16)
+	binary.LittleEndian.PutUint32(b[20:], GSS_C_MUTUAL_FLAG|GSS_C_REPLAY_FLAG|GSS_C_SEQUENCE_FLAG|GSS_C_CONF_FLAG|GSS_C_INTEG_FLAG)
+	return Checksum{GSS_CHECKSUM_TYPE, b}
+}
+
+// InitSecContext gets the service ticket and returns the SPNEGO AP-REQ on the
+// first call, then checks the AP-REP of the server
+func (k *Kerberos) InitSecContext(input []byte) ([]byte, bool, error) {
+	if input == nil {
+		token, err := k.initialToken()
+		return token, false, err
+	}
+	resp, err := decodeNegTokenResp(input)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.NegState == SPNEGO_REJECT {
+		return nil, false, errors.New("kerberos rejected by the server")
+	}
+	if !k.established {
+		if len(resp.ResponseToken) == 0 {
+			return nil, false, errors.New("no AP-REP in the server token")
+		}
+		if err := k.recvAPRep(resp.ResponseToken); err != nil {
+			return nil, false, err
+		}
+		k.established = true
+	}
+	if len(resp.MechListMIC) == 0 {
+		return nil, true, nil
+	}
+	if err := VerifyGSSMIC(k.key(), KU_GSS_ACCEPTOR_SIGN, k.mechTypes, resp.MechListMIC); err != nil {
+		return nil, false, err
+	}
+	mic := GSSMIC(k.key(), KU_GSS_INITIATOR_SIGN, k.flags(), k.nextSeq(), k.mechTypes)
+	output, err := NegTokenResp{NegState: SPNEGO_ACCEPT_COMPLETED, MechListMIC: mic}.Serialize()
+	return output, true, err
+}
+
+func (k *Kerberos) initialToken() ([]byte, error) {
+	tgt, tgtKey, err := k.asExchange()
+	if err != nil {
+		return nil, err
+	}
+	ticket, sessionKey, err := k.tgsExchange(tgt, tgtKey)
+	if err != nil {
+		return nil, err
+	}
+	k.sessionKey = sessionKey
+	k.subkey, err = newRandomKey(sessionKey.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	k.sendSeq = uint64(randomUint31())
+	a := &KRBAuthenticator{
+		Cksum:     gssChecksum(),
+		SubKey:    *k.subkey,
+		SeqNumber: int64(k.sendSeq),
+	}
+	// mutual-required
+	apReq, err := k.newAPReq(ticket, sessionKey, KU_AP_REQ_AUTHENTICATOR, 0x20000000, a)
+	if err != nil {
+		return nil, err
+	}
+	k.ctime, k.cusec = a.CTime, a.CUSec
+	slog.Debug("kerberos service ticket", "service", "TERMSRV/"+k.host, "realm", k.realm)
+
+	mechTypes := []asn1.ObjectIdentifier{oidMSKRB5, oidKRB5}
+	k.mechTypes, _ = asn1.Marshal(mechTypes)
+	return NegTokenInit{
+		MechTypes: mechTypes,
+		MechToken: GSSToken(oidKRB5, gssTokenAPReq, apReq),
+	}.Serialize()
+}
+
+func (k *Kerberos) recvAPRep(token []byte) error {
+	_, tokID, inner, err := ParseGSSToken(token)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(tokID, gssTokenError) {
+		return decodeKRBErrorMessage(inner)
+	}
+	if !bytes.Equal(tokID, gssTokenAPRep) {
+		return fmt.Errorf("unexpected GSS token id %x", tokID)
+	}
+	rep := &APRep{}
+	if err := unmarshalApplication(inner, rep, KRB_AP_REP); err != nil {
+		return err
+	}
+	plain, err := k.sessionKey.Decrypt(KU_AP_REP_ENC_PART, rep.EncPart.Cipher)
+	if err != nil {
+		return err
+	}
+	part := &EncAPRepPart{}
+	if err := unmarshalApplication(plain, part, KRB_TAG_ENC_AP_REP); err != nil {
+		return err
+	}
+	if !part.CTime.Equal(k.ctime) || part.CUSec != k.cusec {
+		return errors.New("kerberos AP-REP does not match the authenticator")
+	}
+	if len(part.SubKey.KeyValue) > 0 {
+		k.acceptorSubkey = &part.SubKey
+	}
+	return nil
+}
+
+func decodeKRBErrorMessage(b []byte) error {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	err := decodeKRBError(raw.Bytes)
+	var kerr *krbError
+	if errors.As(err, &kerr) {
+		return kerr.KerberosError
+	}
+	return err
+}
+
+// key returns the key protecting the per-message tokens
+// @see https://www.rfc-editor.org/rfc/rfc4121#section-2
+func (k *Kerberos) key() *EncryptionKey {
+	if k.acceptorSubkey != nil {
+		return k.acceptorSubkey
+	}
+	return k.subkey
+}
+
+func (k *Kerberos) flags() byte {
+	if k.acceptorSubkey != nil {
+		return GSS_FLAG_ACCEPTOR_SUBKEY
+	}
+	return 0
+}
+
+func (k *Kerberos) nextSeq() uint64 {
+	seq := k.sendSeq
+	k.sendSeq++
+	return seq
+}
+
+func (k *Kerberos) Wrap(data []byte) []byte {
+	return GSSWrap(k.key(), KU_GSS_INITIATOR_SEAL, k.flags(), k.nextSeq(), data)
+}
+
+func (k *Kerberos) Unwrap(token []byte) ([]byte, error) {
+	return GSSUnwrap(k.key(), KU_GSS_ACCEPTOR_SEAL, token)
+}
+
+func (k *Kerberos) Credentials() []byte {
+	if k.smartCard != nil {
+		return k.smartCard.credentials(k.domain, k.user)
+	}
+	return EncodeDERTCredentials(core.UnicodeEncode(k.domain), core.UnicodeEncode(k.user), core.UnicodeEncode(k.password))
+}
+
+// GSSWrap seals data in a Wrap token, the encrypted header and checksum are
+// rotated to the front like Windows does
+// @see https://www.rfc-editor.org/rfc/rfc4121#section-4.2.4
+func GSSWrap(key *EncryptionKey, usage uint32, flags byte, seq uint64, data []byte) []byte {
+	header := make([]byte, gssTokenHeaderLength)
+	header[0], header[1] = 0x05, 0x04
+	header[2] = flags | GSS_FLAG_SEALED
+	header[3] = 0xFF
+	binary.BigEndian.PutUint64(header[8:], seq)
+	plain := append(append([]byte{}, data...), header...)
+	sealed := key.Encrypt(usage, plain)
+
+	binary.BigEndian.PutUint16(header[6:], gssRightRotationCount)
+	n := len(sealed) - gssRightRotationCount
+	return append(append(header, sealed[n:]...), sealed[:n]...)
+}
+
+func GSSUnwrap(key *EncryptionKey, usage uint32, token []byte) ([]byte, error) {
+	if len(token) < gssTokenHeaderLength || token[0] != 0x05 || token[1] != 0x04 || token[3] != 0xFF {
+		return nil, errors.New("invalid GSS wrap token")
+	}
+	if token[2]&GSS_FLAG_SEALED == 0 {
+		return nil, errors.New("GSS wrap token is not sealed")
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	body := token[gssTokenHeaderLength:]
+	if len(body) == 0 {
+		return nil, errors.New("invalid GSS wrap token")
+	}
+	rrc %= len(body)
+	body = append(append([]byte{}, body[rrc:]...), body[:rrc]...)
+	plain, err := key.Decrypt(usage, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < gssTokenHeaderLength+ec {
+		return nil, errors.New("invalid GSS wrap token")
+	}
+	header := append([]byte{}, token[:gssTokenHeaderLength]...)
+	header[6], header[7] = 0, 0
+	if !bytes.Equal(plain[len(plain)-gssTokenHeaderLength:], header) {
+		return nil, errors.New("GSS wrap token header was modified")
+	}
+	return plain[:len(plain)-gssTokenHeaderLength-ec], nil
+}
+
+// GSSMIC returns a MIC token of data
+// @see https://www.rfc-editor.org/rfc/rfc4121#section-4.2.6.1
+func GSSMIC(key *EncryptionKey, usage uint32, flags byte, seq uint64, data []byte) []byte {
+	header := []byte{0x04, 0x04, flags, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[8:], seq)
+	return append(header, key.Checksum(usage, append(append([]byte{}, data...), header...))...)
+}
+
+func VerifyGSSMIC(key *EncryptionKey, usage uint32, data, token []byte) error {
+	if len(token) != gssTokenHeaderLength+aesHMACSize || token[0] != 0x04 || token[1] != 0x04 {
+		return errors.New("invalid GSS MIC token")
+	}
+	header := token[:gssTokenHeaderLength]
+	if !hmac.Equal(key.Checksum(usage, append(append([]byte{}, data...), header...)), token[gssTokenHeaderLength:]) {
+		return errors.New("GSS MIC verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package nla
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKerberosCrypto(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		n   int
+		out string
+	}{
+		{"012345", 8, "be072631276b1955"},
+		{"password", 7, "78a07b6caf85fa"},
+		{"kerberos", 16, "6b65726265726f737b9b5b2b93132b93"},
+	} {
+		if r := hex.EncodeToString(nfold([]byte(c.in), c.n)); r != c.out {
+			t.Error("nfold", c.in, r)
+		}
+	}
+
+	// RFC 3962 appendix B
+	k, _ := StringToKey(ETYPE_AES256_CTS_HMAC_SHA1_96, "password", "ATHENA.MIT.EDUraeburn", []byte{0, 0, 0, 1})
+	if r := hex.EncodeToString(k.KeyValue); r != "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161" {
+		t.Error("string to key", r)
+	}
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	in, _ := hex.DecodeString("4920776f756c64206c696b65207468652047656e6572616c20476175277320")
+	out := encryptCTS(key, in)
+	if hex.EncodeToString(out) != "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5" {
+		t.Error("cts", hex.EncodeToString(out))
+	}
+	if back, _ := decryptCTS(key, out); !bytes.Equal(back, in) {
+		t.Error("decrypt cts", hex.EncodeToString(back))
+	}
+
+	for _, size := range []int{0, 5, 16, 33} {
+		plain := bytes.Repeat([]byte{0x42}, size)
+		sealed := k.Encrypt(KU_GSS_INITIATOR_SEAL, plain)
+		if back, err := k.Decrypt(KU_GSS_INITIATOR_SEAL, sealed); err != nil || !bytes.Equal(back, plain) {
+			t.Error("roundtrip", size, err)
+		}
+		if _, err := k.Decrypt(KU_GSS_ACCEPTOR_SEAL, sealed); err == nil {
+			t.Error("key usage must be checked")
+		}
+	}
+}
+
+const testRealm = "TEST.LOCAL"
+
+type testEncTicketPart struct {
+	Key    EncryptionKey `asn1:"explicit,tag:1"`
+	CRealm string        `asn1:"explicit,tag:2"`
+	CName  PrincipalName `asn1:"explicit,tag:3"`
+}
+
+// testKDC is a local stand-in for the AS and TGS exchanges of a realm with one service
+type testKDC struct {
+	t        *testing.T
+	password string
+	krbtgt   *EncryptionKey
+	service  *EncryptionKey
+	addr     string
+	// PKINIT
+	kdcCert     *x509.Certificate
+	kdcKey      crypto.Signer
+	clientRoots *x509.CertPool
+}
+
+func startKDC(t *testing.T, password string) *testKDC {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	kdc := &testKDC{t: t, password: password, addr: l.Addr().String()}
+	kdc.krbtgt, _ = newRandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	kdc.service, _ = newRandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var size uint32
+			if binary.Read(conn, binary.BigEndian, &size) == nil {
+				req := make([]byte, size)
+				if _, err := io.ReadFull(conn, req); err == nil {
+					resp := kdc.handle(req)
+					binary.Write(conn, binary.BigEndian, uint32(len(resp)))
+					conn.Write(resp)
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return kdc
+}
+
+func (k *testKDC) error(code int32, data []byte) []byte {
+	b, _ := marshalApplication(KRB_ERROR, KRBError{PVNO: 5, MsgType: KRB_ERROR, STime: time.Now().UTC().Truncate(time.Second),
+		ErrorCode: code, Realm: testRealm, SName: newPrincipalName(KRB_NT_SRV_INST, "krbtgt", testRealm), EData: data})
+	return b
+}
+
+func (k *testKDC) ticket(key, session *EncryptionKey, cname, sname PrincipalName) []byte {
+	part, _ := marshalApplication(KRB_TAG_ENC_TICKET, testEncTicketPart{*session, testRealm, cname})
+	b, _ := marshalApplication(KRB_TAG_TICKET, Ticket{5, testRealm, sname,
+		EncryptedData{EType: key.KeyType, Cipher: key.Encrypt(KU_TICKET, part)}})
+	return b
+}
+
+func openTicket(key *EncryptionKey, b []byte) (*testEncTicketPart, error) {
+	ticket := &Ticket{}
+	if err := unmarshalApplication(b, ticket, KRB_TAG_TICKET); err != nil {
+		return nil, err
+	}
+	plain, err := key.Decrypt(KU_TICKET, ticket.EncPart.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	part := &testEncTicketPart{}
+	return part, unmarshalApplication(plain, part, KRB_TAG_ENC_TICKET)
+}
+
+func (k *testKDC) reply(msgType, tag int, key *EncryptionKey, usage uint32, body *KDCReqBody, cname PrincipalName, ticketKey *EncryptionKey, padata ...PAData) []byte {
+	session, _ := newRandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	now := time.Now().UTC().Truncate(time.Second)
+	part, _ := marshalApplication(tag, EncKDCRepPart{
+		Key: *session, LastReq: explicit(1, asn1.RawValue{FullBytes: []byte{0x30, 0}}), Nonce: body.Nonce,
+		Flags: kdcOptions(0), AuthTime: now, EndTime: now.Add(time.Hour), SRealm: testRealm, SName: body.SName,
+	})
+	b, _ := marshalApplication(msgType, KDCRep{PVNO: 5, MsgType: msgType, PAData: padata, CRealm: testRealm, CName: cname,
+		Ticket:  explicit(5, asn1.RawValue{FullBytes: k.ticket(ticketKey, session, cname, body.SName)}),
+		EncPart: EncryptedData{EType: key.KeyType, Cipher: key.Encrypt(usage, part)}})
+	return b
+}
+
+func (k *testKDC) handle(b []byte) []byte {
+	var raw asn1.RawValue
+	asn1.Unmarshal(b, &raw)
+	req := &KDCReq{}
+	if _, err := asn1.Unmarshal(raw.Bytes, req); err != nil {
+		k.t.Error("KDC-REQ", err)
+		return nil
+	}
+	body := &KDCReqBody{}
+	if _, err := asn1.Unmarshal(req.ReqBody.Bytes, body); err != nil {
+		k.t.Error("KDC-REQ-BODY", err)
+		return nil
+	}
+
+	if raw.Tag == KRB_AS_REQ && len(req.PAData) > 0 && req.PAData[0].Type == PA_PK_AS_REQ {
+		return k.pkinit(req, body)
+	}
+	if raw.Tag == KRB_AS_REQ {
+		salt := testRealm + body.CName.String()
+		key, _ := StringToKey(ETYPE_AES256_CTS_HMAC_SHA1_96, k.password, salt, nil)
+		if len(req.PAData) == 0 || req.PAData[0].Type != PA_ENC_TIMESTAMP {
+			info, _ := asn1.Marshal([]ETypeInfo2Entry{{EType: ETYPE_AES256_CTS_HMAC_SHA1_96, Salt: salt}})
+			methodData, _ := asn1.Marshal([]PAData{{PA_ETYPE_INFO2, info}})
+			return k.error(KDC_ERR_PREAUTH_REQUIRED, methodData)
+		}
+		enc := &EncryptedData{}
+		asn1.Unmarshal(req.PAData[0].Value, enc)
+		if _, err := key.Decrypt(KU_PA_ENC_TIMESTAMP, enc.Cipher); err != nil {
+			// KDC_ERR_PREAUTH_FAILED
+			return k.error(24, nil)
+		}
+		return k.reply(KRB_AS_REP, KRB_TAG_ENC_AS_REP, key, KU_AS_REP_ENC_PART, body, body.CName, k.krbtgt)
+	}
+
+	apReq := &APReq{}
+	if err := unmarshalApplication(req.PAData[0].Value, apReq, KRB_AP_REQ); err != nil {
+		k.t.Error("PA-TGS-REQ", err)
+		return nil
+	}
+	tgt, err := openTicket(k.krbtgt, apReq.Ticket.Bytes)
+	if err != nil {
+		k.t.Error("TGT", err)
+		return nil
+	}
+	plain, err := tgt.Key.Decrypt(KU_TGS_REQ_AUTHENTICATOR, apReq.Authenticator.Cipher)
+	if err != nil {
+		k.t.Error("TGS authenticator", err)
+		return nil
+	}
+	a := &KRBAuthenticator{}
+	unmarshalApplication(plain, a, KRB_TAG_AUTHENTICATOR)
+	if !bytes.Equal(a.Cksum.Checksum, tgt.Key.Checksum(KU_TGS_REQ_AUTH_CKSUM, req.ReqBody.Bytes)) {
+		k.t.Error("TGS-REQ body checksum")
+	}
+	if body.SName.String() != "TERMSRV/rdp.test.local" {
+		k.t.Error("service principal", body.SName.String())
+	}
+	return k.reply(KRB_TGS_REP, KRB_TAG_ENC_TGS_REP, &tgt.Key, KU_TGS_REP_ENC_PART, body, tgt.CName, k.service)
+}
+
+// testAcceptor is the server side of the GSS context
+type testAcceptor struct {
+	service   *EncryptionKey
+	subkey    *EncryptionKey
+	sendSeq   uint64
+	mechTypes []byte
+}
+
+func (a *testAcceptor) accept(t *testing.T, token []byte) []byte {
+	init, err := DecodeNegTokenInit(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.mechTypes, _ = asn1.Marshal(init.MechTypes)
+	_, tokID, inner, err := ParseGSSToken(init.MechToken)
+	if err != nil || !bytes.Equal(tokID, gssTokenAPReq) {
+		t.Fatal("AP-REQ token", err)
+	}
+	apReq := &APReq{}
+	if err := unmarshalApplication(inner, apReq, KRB_AP_REQ); err != nil {
+		t.Fatal(err)
+	}
+	ticket, err := openTicket(a.service, apReq.Ticket.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ticket.Key.Decrypt(KU_AP_REQ_AUTHENTICATOR, apReq.Authenticator.Cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &KRBAuthenticator{}
+	unmarshalApplication(plain, auth, KRB_TAG_AUTHENTICATOR)
+	if auth.Cksum.CksumType != GSS_CHECKSUM_TYPE || ticket.CName.String() != "alice" {
+		t.Error("authenticator", auth.Cksum.CksumType, ticket.CName.String())
+	}
+
+	a.subkey, _ = newRandomKey(ETYPE_AES256_CTS_HMAC_SHA1_96)
+	a.sendSeq = 1000
+	encPart, _ := marshalApplication(KRB_TAG_ENC_AP_REP, EncAPRepPart{auth.CTime, auth.CUSec, *a.subkey, int64(a.sendSeq)})
+	apRep, _ := marshalApplication(KRB_AP_REP, APRep{5, KRB_AP_REP,
+		EncryptedData{EType: ticket.Key.KeyType, Cipher: ticket.Key.Encrypt(KU_AP_REP_ENC_PART, encPart)}})
+	mic := GSSMIC(a.subkey, KU_GSS_ACCEPTOR_SIGN, GSS_FLAG_SENT_BY_ACCEPTOR|GSS_FLAG_ACCEPTOR_SUBKEY, a.sendSeq, a.mechTypes)
+	a.sendSeq++
+	resp, _ := NegTokenResp{
+		NegState:      SPNEGO_ACCEPT_COMPLETED,
+		SupportedMech: oidMSKRB5,
+		ResponseToken: GSSToken(oidKRB5, gssTokenAPRep, apRep),
+		MechListMIC:   mic,
+	}.Serialize()
+	return resp
+}
+
+func TestKerberos(t *testing.T) {
+	kdc := startKDC(t, "secret")
+	k := NewKerberos("test.local", "alice", "secret", kdc.addr, "rdp.test.local")
+
+	token, established, err := k.InitSecContext(nil)
+	if err != nil || established {
+		t.Fatal(err, established)
+	}
+	a := &testAcceptor{service: kdc.service}
+	token, established, err = k.InitSecContext(a.accept(t, token))
+	if err != nil || !established {
+		t.Fatal(err, established)
+	}
+	resp, err := decodeNegTokenResp(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyGSSMIC(a.subkey, KU_GSS_INITIATOR_SIGN, a.mechTypes, resp.MechListMIC); err != nil {
+		t.Error("client mechListMIC", err)
+	}
+
+	message := []byte("public key")
+	plain, err := GSSUnwrap(a.subkey, KU_GSS_INITIATOR_SEAL, k.Wrap(message))
+	if err != nil || !bytes.Equal(plain, message) {
+		t.Error("wrap", err)
+	}
+	wrapped := GSSWrap(a.subkey, KU_GSS_ACCEPTOR_SEAL, GSS_FLAG_SENT_BY_ACCEPTOR|GSS_FLAG_ACCEPTOR_SUBKEY, a.sendSeq, message)
+	plain, err = k.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(plain, message) {
+		t.Error("unwrap", err)
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := k.Unwrap(wrapped); err == nil {
+		t.Error("tampered token must be rejected")
+	}
+}
+
+func TestKerberosWrongPassword(t *testing.T) {
+	kdc := startKDC(t, "secret")
+	k := NewKerberos("test.local", "alice", "wrong", kdc.addr, "rdp.test.local")
+	_, _, err := k.InitSecContext(nil)
+	var kerr KerberosError
+	if !errors.As(err, &kerr) || kerr.Code != 24 {
+		t.Error("expected KDC_ERR_PREAUTH_FAILED, got", err)
+	}
+}
+
+func TestKerberosReplySize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		binary.Write(conn, binary.BigEndian, uint32(0xfffffff0))
+		io.Copy(io.Discard, conn)
+	}()
+	k := NewKerberos("test.local", "alice", "secret", l.Addr().String(), "rdp.test.local")
+	if _, err := k.exchange([]byte{0}); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("4 GB KDC reply", err)
+	}
+}
+
+func TestNegotiateFallback(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	ntlm := NewNTLMv2("", "alice", "secret")
+	n := NewNegotiate(NewKerberos("test.local", "alice", "secret", addr, "rdp.test.local"), ntlm)
+	token, established, err := n.InitSecContext(nil)
+	if err != nil || established {
+		t.Fatal(err, established)
+	}
+	if !bytes.HasPrefix(token, []byte("NTLMSSP\x00")) || n.Selected() != ntlm {
+		t.Error("expected the NTLM negotiate message")
+	}
+}
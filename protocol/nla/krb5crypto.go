@@ -0,0 +1,302 @@
+package nla
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/**
+ * Kerberos encryption types
+ * @see https://www.rfc-editor.org/rfc/rfc3962
+ */
+const (
+	ETYPE_AES128_CTS_HMAC_SHA1_96 = 17
+	ETYPE_AES256_CTS_HMAC_SHA1_96 = 18
+)
+
+/**
+ * Checksum types of the AES encryption types
+ */
+const (
+	CKSUMTYPE_HMAC_SHA1_96_AES128 = 15
+	CKSUMTYPE_HMAC_SHA1_96_AES256 = 16
+)
+
+/**
+ * Key usage numbers
+ * @see https://www.rfc-editor.org/rfc/rfc4120#section-7.5.1
+ * @see https://www.rfc-editor.org/rfc/rfc4121#section-2
+ */
+const (
+	KU_PA_ENC_TIMESTAMP        = 1
+	KU_TICKET                  = 2
+	KU_AS_REP_ENC_PART         = 3
+	KU_TGS_REQ_AUTH_CKSUM      = 6
+	KU_TGS_REQ_AUTHENTICATOR   = 7
+	KU_TGS_REP_ENC_PART        = 8
+	KU_AP_REQ_AUTHENTICATOR    = 11
+	KU_AP_REP_ENC_PART         = 12
+	KU_GSS_ACCEPTOR_SEAL       = 22
+	KU_GSS_ACCEPTOR_SIGN       = 23
+	KU_GSS_INITIATOR_SEAL      = 24
+	KU_GSS_INITIATOR_SIGN      = 25
+	aesBlockSize               = aes.BlockSize
+	aesHMACSize                = 12
+	aesStringToKeyIterations   = 4096
+	aesStringToKeyParamsLength = 4
+)
+
+// EncryptionKey is a Kerberos key of an AES encryption type
+type EncryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+func keySize(etype int32) (int, error) {
+	switch etype {
+	case ETYPE_AES128_CTS_HMAC_SHA1_96:
+		return 16, nil
+	case ETYPE_AES256_CTS_HMAC_SHA1_96:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("unsupported kerberos encryption type %d", etype)
+}
+
+func checksumType(etype int32) int32 {
+	if etype == ETYPE_AES128_CTS_HMAC_SHA1_96 {
+		return CKSUMTYPE_HMAC_SHA1_96_AES128
+	}
+	return CKSUMTYPE_HMAC_SHA1_96_AES256
+}
+
+// StringToKey derives the long term key of a principal, params holds the
+// iteration count sent by the KDC and may be nil
+// @see https://www.rfc-editor.org/rfc/rfc3962#section-4
+func StringToKey(etype int32, password, salt string, params []byte) (*EncryptionKey, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return nil, err
+	}
+	iterations := aesStringToKeyIterations
+	if len(params) == aesStringToKeyParamsLength {
+		iterations = int(binary.BigEndian.Uint32(params))
+	}
+	tkey := pbkdf2SHA1([]byte(password), []byte(salt), iterations, size)
+	return &EncryptionKey{etype, deriveKey(tkey, []byte("kerberos"))}, nil
+}
+
+func pbkdf2SHA1(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha1.New, password)
+	out := make([]byte, 0, size+sha1.Size)
+	for block := uint32(1); len(out) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+// nfold stretches or folds in to n bytes
+// @see https://www.rfc-editor.org/rfc/rfc3961#section-5.1
+func nfold(in []byte, n int) []byte {
+	inBits := len(in) * 8
+	outBits := n * 8
+	lcm := inBits * outBits / gcd(inBits, outBits)
+	buf := make([]byte, lcm/8)
+	for i := 0; i < lcm/inBits; i++ {
+		rotated := rotateRight(in, 13*i)
+		copy(buf[i*len(in):], rotated)
+	}
+	out := make([]byte, n)
+	for i := 0; i < len(buf); i += n {
+		carry := 0
+		for j := n - 1; j >= 0; j-- {
+			sum := int(out[j]) + int(buf[i+j]) + carry
+			out[j] = byte(sum)
+			carry = sum >> 8
+		}
+		for j := n - 1; carry != 0 && j >= 0; j-- {
+			sum := int(out[j]) + carry
+			out[j] = byte(sum)
+			carry = sum >> 8
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// rotateRight rotates the bits of b to the right by n
+func rotateRight(b []byte, n int) []byte {
+	bits := len(b) * 8
+	out := make([]byte, len(b))
+	for i := 0; i < bits; i++ {
+		src := ((i-n)%bits + bits) % bits
+		if b[src/8]&(0x80>>(src%8)) != 0 {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// deriveKey is DK of the simplified profile, random-to-key is the identity for AES
+// @see https://www.rfc-editor.org/rfc/rfc3961#section-5.1
+func deriveKey(key, constant []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	in := nfold(constant, aesBlockSize)
+	out := make([]byte, 0, len(key)+aesBlockSize)
+	for len(out) < len(key) {
+		next := make([]byte, aesBlockSize)
+		block.Encrypt(next, in)
+		out = append(out, next...)
+		in = next
+	}
+	return out[:len(key)]
+}
+
+func usageKey(key []byte, usage uint32, kind byte) []byte {
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = kind
+	return deriveKey(key, constant)
+}
+
+// encryptCTS is AES CBC with ciphertext stealing and a zero iv
+// @see https://www.rfc-editor.org/rfc/rfc3962#section-5
+func encryptCTS(key, plain []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, aesBlockSize)
+	if len(plain) <= aesBlockSize {
+		padded := make([]byte, aesBlockSize)
+		copy(padded, plain)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return padded
+	}
+	padded := make([]byte, (len(plain)+aesBlockSize-1)/aesBlockSize*aesBlockSize)
+	copy(padded, plain)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	// swap the last two blocks and drop the padding
+	n := len(padded)
+	last := append([]byte{}, padded[n-aesBlockSize:]...)
+	prev := padded[n-2*aesBlockSize : n-aesBlockSize]
+	out := append([]byte{}, padded[:n-2*aesBlockSize]...)
+	out = append(out, last...)
+	return append(out, prev[:len(plain)-(n-aesBlockSize)]...)
+}
+
+func decryptCTS(key, data []byte) ([]byte, error) {
+	if len(data) < aesBlockSize {
+		return nil, errors.New("kerberos ciphertext too short")
+	}
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, aesBlockSize)
+	if len(data) == aesBlockSize {
+		out := make([]byte, aesBlockSize)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		return out, nil
+	}
+	tail := len(data) % aesBlockSize
+	if tail == 0 {
+		tail = aesBlockSize
+	}
+	n := len(data) - tail - aesBlockSize
+	head := data[:n]
+	cn1 := data[n : n+aesBlockSize]
+	cn := data[n+aesBlockSize:]
+
+	out := make([]byte, 0, len(data))
+	if n > 0 {
+		plain := make([]byte, n)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, head)
+		out = append(out, plain...)
+		iv = head[n-aesBlockSize:]
+	}
+	// decrypting the stolen block gives the last plaintext xor the tail of cn-1
+	d := make([]byte, aesBlockSize)
+	block.Decrypt(d, cn1)
+	full := append(append([]byte{}, cn...), d[tail:]...)
+	last := make([]byte, tail)
+	for i := range last {
+		last[i] = d[i] ^ cn[i]
+	}
+	prev := make([]byte, aesBlockSize)
+	block.Decrypt(prev, full)
+	for i := range prev {
+		prev[i] ^= iv[i]
+	}
+	out = append(out, prev...)
+	return append(out, last...), nil
+}
+
+// Encrypt seals plain with a random confounder and an HMAC-SHA1-96 of usage
+// @see https://www.rfc-editor.org/rfc/rfc3961#section-5.3
+func (k *EncryptionKey) Encrypt(usage uint32, plain []byte) []byte {
+	confounder := make([]byte, aesBlockSize)
+	rand.Read(confounder)
+	data := append(confounder, plain...)
+	ke := usageKey(k.KeyValue, usage, 0xAA)
+	ki := usageKey(k.KeyValue, usage, 0x55)
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(data)
+	return append(encryptCTS(ke, data), mac.Sum(nil)[:aesHMACSize]...)
+}
+
+func (k *EncryptionKey) Decrypt(usage uint32, data []byte) ([]byte, error) {
+	if len(data) < aesBlockSize+aesHMACSize {
+		return nil, errors.New("kerberos ciphertext too short")
+	}
+	ke := usageKey(k.KeyValue, usage, 0xAA)
+	ki := usageKey(k.KeyValue, usage, 0x55)
+	plain, err := decryptCTS(ke, data[:len(data)-aesHMACSize])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, ki)
+	mac.Write(plain)
+	if !hmac.Equal(mac.Sum(nil)[:aesHMACSize], data[len(data)-aesHMACSize:]) {
+		return nil, errors.New("kerberos integrity check failed")
+	}
+	return plain[aesBlockSize:], nil
+}
+
+// Checksum is the keyed HMAC-SHA1-96 checksum of usage
+func (k *EncryptionKey) Checksum(usage uint32, data []byte) []byte {
+	mac := hmac.New(sha1.New, usageKey(k.KeyValue, usage, 0x99))
+	mac.Write(data)
+	return mac.Sum(nil)[:aesHMACSize]
+}
+
+// newRandomKey returns a fresh key of the same type, used as authenticator subkey
+func newRandomKey(etype int32) (*EncryptionKey, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &EncryptionKey{etype, key}, nil
+}
@@ -2,10 +2,12 @@ package nla
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rc4"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
@@ -287,6 +289,7 @@ type NTLMv2 struct {
 	challengeMessage    *ChallengeMessage
 	authenticateMessage *AuthenticateMessage
 	enableUnicode       bool
+	security            *NTLMv2Security
 }
 
 func NewNTLMv2(domain, user, password string) *NTLMv2 {
@@ -299,6 +302,18 @@ func NewNTLMv2(domain, user, password string) *NTLMv2 {
 	}
 }
 
+// NewNTLMv2Hash authenticates with the NT hash of the password. There is no
+// password to delegate, it goes along with the restricted admin mode of tpkt.
+func NewNTLMv2Hash(domain, user string, ntHash []byte) *NTLMv2 {
+	respKey := NTOWFv2Hash(ntHash, user, domain)
+	return &NTLMv2{
+		domain:    domain,
+		user:      user,
+		respKeyNT: respKey,
+		respKeyLM: respKey,
+	}
+}
+
 // generate first handshake messgae
 func (n *NTLMv2) GetNegotiateMessage() *NegotiateMessage {
 	negoMsg := NewNegotiateMessage()
@@ -510,9 +525,167 @@ func (n *NTLMv2Security) GssDecrypt(s []byte) []byte {
 	b := &bytes.Buffer{}
 	core.WriteUInt32LE(seqNum, b)
 	core.WriteBytes(p, b)
-	verify := HMAC_MD5(n.VerifyKey, b.Bytes())
+	verify := HMAC_MD5(n.VerifyKey, b.Bytes())[:8]
 	if string(verify) != string(check) {
 		return nil
 	}
 	return p
 }
+
+// PasswordLookup returns the password of a user known by the server
+type PasswordLookup func(domain, user string) (password string, ok bool)
+
+// NTLMv2Server is the acceptor side of the NTLMv2 handshake
+type NTLMv2Server struct {
+	computerName     string
+	domainName       string
+	lookup           PasswordLookup
+	negotiateMessage []byte
+	challengeMessage *ChallengeMessage
+	domain           string
+	user             string
+}
+
+func NewNTLMv2Server(domainName, computerName string, lookup PasswordLookup) *NTLMv2Server {
+	return &NTLMv2Server{
+		computerName: computerName,
+		domainName:   domainName,
+		lookup:       lookup,
+	}
+}
+
+// GetChallengeMessage answers the client negotiate message
+func (n *NTLMv2Server) GetChallengeMessage(negotiate []byte) (*ChallengeMessage, error) {
+	if len(negotiate) < 16 || string(negotiate[:8]) != "NTLMSSP\x00" {
+		return nil, errors.New("invalid negotiate message")
+	}
+	n.negotiateMessage = negotiate
+	clientFlags := binary.LittleEndian.Uint32(negotiate[12:16])
+
+	msg := NewChallengeMessage()
+	msg.NegotiateFlags = clientFlags&(NTLMSSP_NEGOTIATE_KEY_EXCH|
+		NTLMSSP_NEGOTIATE_128|
+		NTLMSSP_NEGOTIATE_56|
+		NTLMSSP_NEGOTIATE_VERSION|
+		NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY|
+		NTLMSSP_NEGOTIATE_ALWAYS_SIGN|
+		NTLMSSP_NEGOTIATE_SEAL|
+		NTLMSSP_NEGOTIATE_SIGN|
+		NTLMSSP_NEGOTIATE_UNICODE) |
+		NTLMSSP_NEGOTIATE_NTLM |
+		NTLMSSP_NEGOTIATE_TARGET_INFO |
+		NTLMSSP_TARGET_TYPE_SERVER |
+		NTLMSSP_REQUEST_TARGET
+	copy(msg.ServerChallenge[:], core.Random(8))
+
+	ft := uint64(time.Now().UnixNano()) / 100
+	ft += 116444736000000000 // add time between unix & windows offset
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, ft)
+
+	targetName := core.UnicodeEncode(n.computerName)
+	targetInfo := &bytes.Buffer{}
+	for _, av := range []AVPair{
+		{Id: MsvAvNbDomainName, Value: core.UnicodeEncode(n.domainName)},
+		{Id: MsvAvNbComputerName, Value: core.UnicodeEncode(n.computerName)},
+		{Id: MsvAvDnsDomainName, Value: core.UnicodeEncode(n.domainName)},
+		{Id: MsvAvDnsComputerName, Value: core.UnicodeEncode(n.computerName)},
+		{Id: MsvAvTimestamp, Value: timestamp},
+		{Id: MsvAvEOL},
+	} {
+		struc.Pack(targetInfo, &av)
+	}
+
+	offset := uint32(48)
+	if msg.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		msg.Version = NewNVersion()
+		offset += 8
+	}
+	msg.TargetNameLen = uint16(len(targetName))
+	msg.TargetNameMaxLen = msg.TargetNameLen
+	msg.TargetNameBufferOffset = offset
+	msg.TargetInfoLen = uint16(targetInfo.Len())
+	msg.TargetInfoMaxLen = msg.TargetInfoLen
+	msg.TargetInfoBufferOffset = offset + uint32(len(targetName))
+	msg.Payload = concat(targetName, targetInfo.Bytes())
+	msg.totalLen = int(offset) + len(msg.Payload)
+	n.challengeMessage = msg
+	return msg, nil
+}
+
+func authenticateField(s []byte, length uint16, offset uint32) ([]byte, error) {
+	end := uint64(offset) + uint64(length)
+	if end > uint64(len(s)) {
+		return nil, errors.New("authenticate message field out of range")
+	}
+	return s[offset:end], nil
+}
+
+// Authenticate verifies the NTLMv2 response of the client authenticate message
+// and returns the security context of the server side
+func (n *NTLMv2Server) Authenticate(s []byte) (*NTLMv2Security, error) {
+	if n.challengeMessage == nil {
+		return nil, errors.New("no challenge sent")
+	}
+	msg := &AuthenticateMessage{}
+	if err := struc.Unpack(bytes.NewReader(s), msg); err != nil {
+		return nil, err
+	}
+	if string(msg.Signature[:]) != "NTLMSSP\x00" || msg.MessageType != 0x00000003 {
+		return nil, errors.New("invalid authenticate message")
+	}
+	ntResponse, err := authenticateField(s, msg.NtChallengeResponseLen, msg.NtChallengeResponseBufferOffset)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := authenticateField(s, msg.DomainNameLen, msg.DomainNameBufferOffset)
+	if err != nil {
+		return nil, err
+	}
+	user, err := authenticateField(s, msg.UserNameLen, msg.UserNameBufferOffset)
+	if err != nil {
+		return nil, err
+	}
+	encryptedRandomSessionKey, err := authenticateField(s, msg.EncryptedRandomSessionLen, msg.EncryptedRandomSessionBufferOffset)
+	if err != nil {
+		return nil, err
+	}
+	if msg.NegotiateFlags&NTLMSSP_NEGOTIATE_UNICODE != 0 {
+		n.domain, n.user = core.UnicodeDecode(domain), core.UnicodeDecode(user)
+	} else {
+		n.domain, n.user = string(domain), string(user)
+	}
+	if len(ntResponse) <= 16 {
+		return nil, errors.New("NTLMv2 response expected")
+	}
+
+	password, ok := n.lookup(n.domain, n.user)
+	if !ok {
+		return nil, fmt.Errorf("unknown user %s\\%s", n.domain, n.user)
+	}
+	respKeyNT := NTOWFv2(password, n.user, n.domain)
+	ntProof := HMAC_MD5(respKeyNT, concat(n.challengeMessage.ServerChallenge[:], ntResponse[16:]))
+	if !hmac.Equal(ntProof, ntResponse[:16]) {
+		return nil, fmt.Errorf("invalid NTLMv2 response for %s\\%s", n.domain, n.user)
+	}
+
+	exportedSessionKey := HMAC_MD5(respKeyNT, ntProof)
+	if msg.NegotiateFlags&NTLMSSP_NEGOTIATE_KEY_EXCH != 0 {
+		exportedSessionKey = RC4K(exportedSessionKey, encryptedRandomSessionKey)
+	}
+
+	ClientSigningKey := MD5(concat(exportedSessionKey, clientSigning))
+	ServerSigningKey := MD5(concat(exportedSessionKey, serverSigning))
+	ClientSealingKey := MD5(concat(exportedSessionKey, clientSealing))
+	ServerSealingKey := MD5(concat(exportedSessionKey, serverSealing))
+
+	encryptRC4, _ := rc4.NewCipher(ServerSealingKey)
+	decryptRC4, _ := rc4.NewCipher(ClientSealingKey)
+
+	return &NTLMv2Security{encryptRC4, decryptRC4, ServerSigningKey, ClientSigningKey, 0}, nil
+}
+
+// Identity returns the domain and user authenticated by the last handshake
+func (n *NTLMv2Server) Identity() (domain, user string) {
+	return n.domain, n.user
+}
@@ -0,0 +1,331 @@
+package nla
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+)
+
+/**
+ * Public key pre-authentication of the smart card logon
+ * @see https://www.rfc-editor.org/rfc/rfc4556
+ */
+const (
+	PA_PK_AS_REQ = 16
+	PA_PK_AS_REP = 17
+	// AT_KEYEXCHANGE key of the card
+	KEYSPEC_KEYEXCHANGE = 1
+)
+
+var (
+	oidPKINITAuthData  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 1}
+	oidPKINITDHKeyData = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 2}
+	oidDHPublicNumber  = asn1.ObjectIdentifier{1, 2, 840, 10046, 2, 1}
+	// id-pkinit-san of the otherName holding the KDC principal
+	oidPKINITSAN = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 2}
+	// id-pkinit-KPKdc of the KDC certificates
+	oidPKINITKPKdc    = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 5}
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+)
+
+// dhGroup14 is the 2048-bit MODP group of the key agreement
+// @see https://www.rfc-editor.org/rfc/rfc3526#section-3
+var dhGroup14, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+		"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+
+// SmartCard logs on with a certificate, the private key stays behind Signer.
+// PIN and the card details are delegated to the server in TSSmartCardCreds.
+type SmartCard struct {
+	Certificate *x509.Certificate
+	Signer      crypto.Signer
+	PIN         string
+	// optional names of the card, announced in TSCspDataDetail
+	CardName      string
+	ReaderName    string
+	ContainerName string
+	CspName       string
+	// KDCRoots verifies the certificate of the KDC, the system roots when nil.
+	// It must be a KDC certificate of the realm, with the id-pkinit-KPKdc usage.
+	KDCRoots *x509.CertPool
+}
+
+func optionalUnicode(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return core.UnicodeEncode(s)
+}
+
+// credentials returns the TSCredentials of the card with the user as hint
+func (c *SmartCard) credentials(domain, user string) []byte {
+	return EncodeDERTSmartCardCredentials(core.UnicodeEncode(c.PIN), TSCspDataDetail{
+		KeySpec:       KEYSPEC_KEYEXCHANGE,
+		CardName:      optionalUnicode(c.CardName),
+		ReaderName:    optionalUnicode(c.ReaderName),
+		ContainerName: optionalUnicode(c.ContainerName),
+		CspName:       optionalUnicode(c.CspName),
+	}, optionalUnicode(user), optionalUnicode(domain))
+}
+
+type dhDomainParameters struct {
+	P *big.Int
+	G *big.Int
+	Q *big.Int
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type PKAuthenticator struct {
+	CUSec      int       `asn1:"explicit,tag:0"`
+	CTime      time.Time `asn1:"generalized,explicit,tag:1"`
+	Nonce      int       `asn1:"explicit,tag:2"`
+	PAChecksum []byte    `asn1:"optional,explicit,tag:3"`
+}
+
+type AuthPack struct {
+	PKAuthenticator   PKAuthenticator      `asn1:"explicit,tag:0"`
+	ClientPublicValue subjectPublicKeyInfo `asn1:"optional,explicit,tag:1"`
+}
+
+type PAPKASReq struct {
+	SignedAuthPack []byte `asn1:"tag:0"`
+}
+
+type DHRepInfo struct {
+	DHSignedData  []byte `asn1:"tag:0"`
+	ServerDHNonce []byte `asn1:"optional,explicit,tag:1"`
+}
+
+type KDCDHKeyInfo struct {
+	SubjectPublicKey asn1.BitString `asn1:"explicit,tag:0"`
+	Nonce            int            `asn1:"explicit,tag:1"`
+	DHKeyExpiration  time.Time      `asn1:"optional,generalized,explicit,tag:2"`
+}
+
+// dhPublicKey is the DER INTEGER carried in the BIT STRING of the public values
+func dhPublicKey(y *big.Int) asn1.BitString {
+	b, _ := asn1.Marshal(y)
+	return asn1.BitString{Bytes: b, BitLength: len(b) * 8}
+}
+
+func parseDHPublicKey(s asn1.BitString) (*big.Int, error) {
+	y := new(big.Int)
+	if _, err := asn1.Unmarshal(s.Bytes, &y); err != nil {
+		return nil, err
+	}
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(dhGroup14) >= 0 {
+		return nil, errors.New("invalid DH public key")
+	}
+	return y, nil
+}
+
+// dhSecret returns the shared secret left padded to the size of the modulus
+func dhSecret(y, x *big.Int) []byte {
+	return new(big.Int).Exp(y, x, dhGroup14).FillBytes(make([]byte, len(dhGroup14.Bytes())))
+}
+
+// octetString2Key derives the AS reply key from the DH secret
+// @see https://www.rfc-editor.org/rfc/rfc4556#section-3.2.3.1
+func octetString2Key(etype int32, secret []byte) (*EncryptionKey, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for counter := byte(0); len(out) < size; counter++ {
+		h := sha1.New()
+		h.Write([]byte{counter})
+		h.Write(secret)
+		out = h.Sum(out)
+	}
+	return &EncryptionKey{etype, out[:size]}, nil
+}
+
+// pkinitExchange requests a TGT signed with the card, the reply key comes from
+// an ephemeral Diffie-Hellman exchange with the KDC
+func (k *Kerberos) pkinitExchange() ([]byte, *EncryptionKey, error) {
+	card := k.smartCard
+	cname := newPrincipalName(KRB_NT_PRINCIPAL, k.user)
+	krbtgt := newPrincipalName(KRB_NT_SRV_INST, "krbtgt", k.realm)
+	nonce := randomUint31()
+	body, err := k.newReqBody(cname, krbtgt, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x, err := rand.Int(rand.Reader, new(big.Int).Rsh(dhGroup14, 1))
+	if err != nil {
+		return nil, nil, err
+	}
+	params, _ := asn1.Marshal(dhDomainParameters{dhGroup14, big.NewInt(2), new(big.Int).Rsh(dhGroup14, 1)})
+	checksum := sha1.Sum(body)
+	ctime, cusec := kerberosTime()
+	authPack, err := asn1.Marshal(AuthPack{
+		PKAuthenticator: PKAuthenticator{cusec, ctime, nonce, checksum[:]},
+		ClientPublicValue: subjectPublicKeyInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidDHPublicNumber, Parameters: asn1.RawValue{FullBytes: params}},
+			PublicKey: dhPublicKey(new(big.Int).Exp(big.NewInt(2), x, dhGroup14)),
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := signCMS(oidPKINITAuthData, authPack, card.Certificate, card.Signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, _ := asn1.Marshal(PAPKASReq{signed})
+
+	resp, err := k.sendKDCReq(KRB_AS_REQ, []PAData{{PA_PK_AS_REQ, value}}, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep := &KDCRep{}
+	if err := unmarshalApplication(resp, rep, KRB_AS_REP); err != nil {
+		return nil, nil, err
+	}
+	var info *KDCDHKeyInfo
+	for _, pa := range rep.PAData {
+		if pa.Type == PA_PK_AS_REP {
+			if info, err = parsePKASRep(pa.Value, card.KDCRoots, k.realm); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if info == nil {
+		return nil, nil, errors.New("no PA-PK-AS-REP in the AS reply")
+	}
+	if info.Nonce != nonce {
+		return nil, nil, errors.New("PKINIT nonce does not match")
+	}
+	y, err := parseDHPublicKey(info.SubjectPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := octetString2Key(rep.EncPart.EType, dhSecret(y, x))
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionKey, err := decryptKDCRep(key, KU_AS_REP_ENC_PART, rep, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep.Ticket.Bytes, sessionKey, nil
+}
+
+// parsePKASRep checks the signature of the KDC over its DH public value
+func parsePKASRep(b []byte, roots *x509.CertPool, realm string) (*KDCDHKeyInfo, error) {
+	var choice asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &choice); err != nil {
+		return nil, err
+	}
+	if choice.Class != asn1.ClassContextSpecific || choice.Tag != 0 {
+		return nil, errors.New("only the Diffie-Hellman PKINIT reply is supported")
+	}
+	rep := &DHRepInfo{}
+	if _, err := asn1.Unmarshal(choice.Bytes, rep); err != nil {
+		return nil, err
+	}
+	contentType, content, cert, err := verifyCMS(rep.DHSignedData, roots)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyKDCCertificate(cert, realm); err != nil {
+		return nil, err
+	}
+	if !contentType.Equal(oidPKINITDHKeyData) {
+		return nil, errors.New("unexpected PKINIT content type")
+	}
+	info := &KDCDHKeyInfo{}
+	_, err = asn1.Unmarshal(content, info)
+	return info, err
+}
+
+// verifyKDCCertificate checks the certificate is one of a KDC of realm: it has
+// the id-pkinit-KPKdc usage and names the realm in its subject alternative
+// names, either as the krbtgt principal or as the DNS name Windows puts there
+// @see https://www.rfc-editor.org/rfc/rfc4556#section-3.2.4
+func verifyKDCCertificate(cert *x509.Certificate, realm string) error {
+	kdc := false
+	for _, oid := range cert.UnknownExtKeyUsage {
+		kdc = kdc || oid.Equal(oidPKINITKPKdc)
+	}
+	if !kdc {
+		return errors.New("the KDC certificate has no KDC key usage")
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, realm) {
+			return nil
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSubjectAltName) && sanNamesKDC(ext.Value, realm) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the KDC certificate is not one of the realm %s", realm)
+}
+
+type krb5PrincipalName struct {
+	Realm         asn1.RawValue `asn1:"explicit,tag:0"`
+	PrincipalName PrincipalName `asn1:"explicit,tag:1"`
+}
+
+type pkinitSAN struct {
+	TypeID asn1.ObjectIdentifier
+	Value  krb5PrincipalName `asn1:"explicit,tag:0"`
+}
+
+// sanNamesKDC tells whether the GeneralNames hold the id-pkinit-san of krbtgt/realm@realm
+func sanNamesKDC(b []byte, realm string) bool {
+	var names asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &names); err != nil {
+		return false
+	}
+	for rest := names.Bytes; len(rest) > 0; {
+		var name asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+			return false
+		}
+		// otherName is an implicit [0] SEQUENCE
+		if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+			continue
+		}
+		seq, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: name.Bytes})
+		var san pkinitSAN
+		if _, err := asn1.Unmarshal(seq, &san); err != nil || !san.TypeID.Equal(oidPKINITSAN) {
+			continue
+		}
+		// the explicit tag is kept, the realm is the GeneralString inside it
+		var r asn1.RawValue
+		if _, err := asn1.Unmarshal(san.Value.Realm.Bytes, &r); err != nil {
+			continue
+		}
+		if strings.EqualFold(string(r.Bytes), realm) &&
+			strings.EqualFold(san.Value.PrincipalName.String(), "krbtgt/"+realm) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package nla
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+)
+
+func testCertificate(t *testing.T, key crypto.Signer, name string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// kdcCertificate is a self-signed KDC certificate naming krbtgt/realm in its
+// id-pkinit-san, without the KDC key usage when usage is false
+func kdcCertificate(t *testing.T, key crypto.Signer, realm string, usage bool) *x509.Certificate {
+	san, _ := asn1.Marshal(pkinitSAN{oidPKINITSAN, krb5PrincipalName{
+		Realm:         explicit(0, generalString(realm)),
+		PrincipalName: newPrincipalName(KRB_NT_SRV_INST, "krbtgt", realm),
+	}})
+	var otherName asn1.RawValue
+	asn1.Unmarshal(san, &otherName)
+	otherName = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: otherName.Bytes}
+	names, _ := asn1.Marshal([]asn1.RawValue{otherName})
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: "kdc"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Value: names}},
+	}
+	if usage {
+		template.UnknownExtKeyUsage = []asn1.ObjectIdentifier{oidPKINITKPKdc}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func certPool(cert *x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+// pkinit answers a Diffie-Hellman PA-PK-AS-REQ signed by a trusted client
+func (k *testKDC) pkinit(req *KDCReq, body *KDCReqBody) []byte {
+	pa := &PAPKASReq{}
+	asn1.Unmarshal(req.PAData[0].Value, pa)
+	contentType, content, cert, err := verifyCMS(pa.SignedAuthPack, k.clientRoots)
+	if err != nil || !contentType.Equal(oidPKINITAuthData) {
+		// KDC_ERR_CLIENT_NOT_TRUSTED
+		return k.error(62, nil)
+	}
+	authPack := &AuthPack{}
+	if _, err := asn1.Unmarshal(content, authPack); err != nil {
+		k.t.Error("AuthPack", err)
+		return nil
+	}
+	checksum := sha1.Sum(req.ReqBody.Bytes)
+	if string(authPack.PKAuthenticator.PAChecksum) != string(checksum[:]) || authPack.PKAuthenticator.Nonce != body.Nonce {
+		k.t.Error("PKAuthenticator")
+	}
+	if cert.Subject.CommonName != body.CName.String() {
+		k.t.Error("certificate of", cert.Subject.CommonName)
+	}
+	y, err := parseDHPublicKey(authPack.ClientPublicValue.PublicKey)
+	if err != nil {
+		k.t.Error(err)
+		return nil
+	}
+
+	x, _ := rand.Int(rand.Reader, dhGroup14)
+	key, _ := octetString2Key(ETYPE_AES256_CTS_HMAC_SHA1_96, dhSecret(y, x))
+	info, _ := asn1.Marshal(KDCDHKeyInfo{
+		SubjectPublicKey: dhPublicKey(new(big.Int).Exp(big.NewInt(2), x, dhGroup14)),
+		Nonce:            authPack.PKAuthenticator.Nonce,
+	})
+	signed, err := signCMS(oidPKINITDHKeyData, info, k.kdcCert, k.kdcKey)
+	if err != nil {
+		k.t.Error(err)
+		return nil
+	}
+	rep, _ := asn1.Marshal(DHRepInfo{DHSignedData: signed})
+	value, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: rep})
+	return k.reply(KRB_AS_REP, KRB_TAG_ENC_AS_REP, key, KU_AS_REP_ENC_PART, body, body.CName, k.krbtgt, PAData{PA_PK_AS_REP, value})
+}
+
+func TestPKINIT(t *testing.T) {
+	kdc := startKDC(t, "")
+	cardKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	card := &SmartCard{
+		Certificate: testCertificate(t, cardKey, "alice"),
+		Signer:      cardKey,
+		PIN:         "1234",
+		ReaderName:  "Reader 0",
+	}
+	kdcKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	kdc.kdcKey = kdcKey
+	kdc.kdcCert = kdcCertificate(t, kdcKey, testRealm, true)
+	kdc.clientRoots = certPool(card.Certificate)
+	card.KDCRoots = certPool(kdc.kdcCert)
+
+	k := NewKerberosSmartCard("test.local", "alice", card, kdc.addr, "rdp.test.local")
+	token, _, err := k.InitSecContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAcceptor{service: kdc.service}
+	if _, established, err := k.InitSecContext(a.accept(t, token)); err != nil || !established {
+		t.Fatal(err, established)
+	}
+
+	tcre, err := DecodeDERTCredentials(k.Credentials())
+	if err != nil || tcre.CredType != TSCRED_SMARTCARD {
+		t.Fatal(err, tcre.CredType)
+	}
+	creds := &TSSmartCardCreds{}
+	if _, err := asn1.Unmarshal(tcre.Credentials, creds); err != nil {
+		t.Fatal(err)
+	}
+	if core.UnicodeDecode(creds.Pin) != "1234" || core.UnicodeDecode(creds.UserHint) != "alice" ||
+		core.UnicodeDecode(creds.CspData.ReaderName) != "Reader 0" || creds.CspData.CardName != nil {
+		t.Error("smart card credentials", creds)
+	}
+
+	// the KDC certificate is not trusted, by the roots or the system ones
+	for _, roots := range []*x509.CertPool{certPool(card.Certificate), nil} {
+		card.KDCRoots = roots
+		if _, _, err := NewKerberosSmartCard("test.local", "alice", card, kdc.addr, "rdp.test.local").InitSecContext(nil); err == nil {
+			t.Error("untrusted KDC must be rejected")
+		}
+	}
+	// a trusted certificate that is not the one of a KDC of the realm
+	for _, cert := range []*x509.Certificate{
+		kdcCertificate(t, kdcKey, testRealm, false),
+		kdcCertificate(t, kdcKey, "OTHER.LOCAL", true),
+		testCertificate(t, kdcKey, "krbtgt"),
+	} {
+		kdc.kdcCert = cert
+		card.KDCRoots = certPool(cert)
+		if _, _, err := NewKerberosSmartCard("test.local", "alice", card, kdc.addr, "rdp.test.local").InitSecContext(nil); err == nil {
+			t.Error("certificate of", cert.Subject.CommonName, "accepted for the KDC")
+		}
+	}
+	// the card is not trusted by the KDC
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other := &SmartCard{Certificate: testCertificate(t, otherKey, "alice"), Signer: otherKey}
+	_, _, err = NewKerberosSmartCard("test.local", "alice", other, kdc.addr, "rdp.test.local").InitSecContext(nil)
+	if kerr, ok := err.(*krbError); !ok || kerr.Code != 62 {
+		t.Error("expected KDC_ERR_CLIENT_NOT_TRUSTED, got", err)
+	}
+}
+
+func TestVerifyCMS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := testCertificate(t, key, "alice")
+	signed, err := signCMS(oidPKINITAuthData, []byte{0x30, 0}, cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentType, content, _, err := verifyCMS(signed, certPool(cert))
+	if err != nil || !contentType.Equal(oidPKINITAuthData) || len(content) != 2 {
+		t.Fatal(contentType, content, err)
+	}
+
+	// the content type is changed without the signed attribute
+	ci := &contentInfo{}
+	asn1.Unmarshal(signed, ci)
+	sd := &signedData{}
+	asn1.Unmarshal(ci.Content.Bytes, sd)
+	sd.EncapContentInfo.EContentType = oidPKINITDHKeyData
+	b, _ := asn1.Marshal(*sd)
+	signed, _ = asn1.Marshal(contentInfo{oidSignedData, explicit(0, asn1.RawValue{FullBytes: b})})
+	if _, _, _, err := verifyCMS(signed, certPool(cert)); err == nil {
+		t.Error("content type not signed")
+	}
+}
+
+// TestKDCCertificateDNSName accepts the realm as the DNS name of the Windows KDC certificates
+func TestKDCCertificateDNSName(t *testing.T) {
+	cert := &x509.Certificate{
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidPKINITKPKdc},
+		DNSNames:           []string{"dc1.test.local", "test.local"},
+	}
+	if err := verifyKDCCertificate(cert, testRealm); err != nil {
+		t.Error(err)
+	}
+	cert.DNSNames = cert.DNSNames[:1]
+	if err := verifyKDCCertificate(cert, testRealm); err == nil {
+		t.Error("the realm is not named")
+	}
+}
+
+func TestDHGroup14(t *testing.T) {
+	q := new(big.Int).Rsh(dhGroup14, 1)
+	if dhGroup14.BitLen() != 2048 || !dhGroup14.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+		t.Error("group 14 must be a safe prime")
+	}
+}
@@ -0,0 +1,131 @@
+package nla
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+/**
+ * SPNEGO negotiation states
+ * @see https://www.rfc-editor.org/rfc/rfc4178#section-4.2.2
+ */
+const (
+	SPNEGO_ACCEPT_COMPLETED  asn1.Enumerated = 0
+	SPNEGO_ACCEPT_INCOMPLETE asn1.Enumerated = 1
+	SPNEGO_REJECT            asn1.Enumerated = 2
+	SPNEGO_REQUEST_MIC       asn1.Enumerated = 3
+)
+
+var oidSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+
+type NegTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+// Serialize returns the initial context token of the SPNEGO mechanism
+func (t NegTokenInit) Serialize() ([]byte, error) {
+	b, err := asn1.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	choice, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b})
+	if err != nil {
+		return nil, err
+	}
+	return GSSToken(oidSPNEGO, nil, choice), nil
+}
+
+func DecodeNegTokenInit(b []byte) (*NegTokenInit, error) {
+	oid, _, inner, err := ParseGSSToken(b)
+	if err != nil {
+		return nil, err
+	}
+	if !oid.Equal(oidSPNEGO) {
+		return nil, errors.New("not a SPNEGO token")
+	}
+	var choice asn1.RawValue
+	if _, err := asn1.Unmarshal(inner, &choice); err != nil {
+		return nil, err
+	}
+	if choice.Class != asn1.ClassContextSpecific || choice.Tag != 0 {
+		return nil, errors.New("not a SPNEGO NegTokenInit")
+	}
+	t := &NegTokenInit{}
+	_, err = asn1.Unmarshal(choice.Bytes, t)
+	return t, err
+}
+
+type NegTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+	MechListMIC   []byte                `asn1:"optional,explicit,tag:3"`
+}
+
+func (t NegTokenResp) Serialize() ([]byte, error) {
+	b, err := asn1.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: b})
+}
+
+// negTokenRespOptional decodes the negState that servers may leave out
+type negTokenRespOptional struct {
+	NegState      asn1.Enumerated       `asn1:"optional,explicit,tag:0,default:1"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+	MechListMIC   []byte                `asn1:"optional,explicit,tag:3"`
+}
+
+func decodeNegTokenResp(b []byte) (*NegTokenResp, error) {
+	var choice asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &choice); err != nil {
+		return nil, err
+	}
+	if choice.Class != asn1.ClassContextSpecific || choice.Tag != 1 {
+		return nil, errors.New("not a SPNEGO NegTokenResp")
+	}
+	t := &negTokenRespOptional{}
+	if _, err := asn1.Unmarshal(choice.Bytes, t); err != nil {
+		return nil, err
+	}
+	return &NegTokenResp{t.NegState, t.SupportedMech, t.ResponseToken, t.MechListMIC}, nil
+}
+
+// GSSToken frames an initial context token of mechanism oid
+// @see https://www.rfc-editor.org/rfc/rfc2743#section-3.1
+func GSSToken(oid asn1.ObjectIdentifier, tokID []byte, inner []byte) []byte {
+	b, _ := asn1.Marshal(oid)
+	b = append(b, tokID...)
+	b = append(b, inner...)
+	token, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: b})
+	return token
+}
+
+// ParseGSSToken returns the mechanism, the 2 bytes token id of Kerberos and the inner token
+func ParseGSSToken(b []byte) (oid asn1.ObjectIdentifier, tokID []byte, inner []byte, err error) {
+	var raw asn1.RawValue
+	if _, err = asn1.Unmarshal(b, &raw); err != nil {
+		return
+	}
+	if raw.Class != asn1.ClassApplication || raw.Tag != 0 {
+		err = errors.New("not a GSS-API token")
+		return
+	}
+	rest, err := asn1.Unmarshal(raw.Bytes, &oid)
+	if err != nil {
+		return
+	}
+	if oid.Equal(oidKRB5) || oid.Equal(oidMSKRB5) {
+		if len(rest) < 2 {
+			err = errors.New("GSS token too short")
+			return
+		}
+		return oid, rest[:2], rest[2:], nil
+	}
+	return oid, nil, rest, nil
+}
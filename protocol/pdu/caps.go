@@ -202,8 +202,9 @@ const (
 	INPUT_FLAG_UNICODE                = 0x0010
 	INPUT_FLAG_FASTPATH_INPUT2        = 0x0020
 	INPUT_FLAG_UNUSED1                = 0x0040
-	INPUT_FLAG_UNUSED2                = 0x0080
+	INPUT_FLAG_MOUSE_RELATIVE         = 0x0080
 	INPUT_FLAG_MOUSE_HWHEEL           = 0x0100
+	INPUT_FLAG_QOE_TIMESTAMPS         = 0x0200
 )
 
 /**
@@ -229,6 +230,19 @@ const (
 	GLYPH_SUPPORT_ENCODE               = 0x0003
 )
 
+// GlyphSupportLevel is announced by the clients, the revision of the Cache Glyph
+// orders follows it
+var GlyphSupportLevel GlyphSupport = GLYPH_SUPPORT_ENCODE
+
+// GlyphCaches are the glyph caches of the client, the cell size is the one of the glyph bitmaps
+var GlyphCaches = [10]CacheDefinition{
+	{254, 4}, {254, 4}, {254, 8}, {254, 8}, {254, 16},
+	{254, 32}, {254, 64}, {254, 128}, {254, 256}, {64, 2048},
+}
+
+// GLYPH_FRAGMENT_CACHE has 256 fragments of up to 256 bytes
+const GLYPH_FRAGMENT_CACHE = 0x01000100
+
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240550.aspx
  */
@@ -277,6 +291,7 @@ const (
 	INPUT_EVENT_UNICODE  = 0x0005
 	INPUT_EVENT_MOUSE    = 0x8001
 	INPUT_EVENT_MOUSEX   = 0x8002
+	INPUT_EVENT_MOUSEREL = 0x8004
 )
 
 const (
@@ -292,9 +307,24 @@ const (
 )
 
 const (
-	KBDFLAGS_EXTENDED = 0x0100
-	KBDFLAGS_DOWN     = 0x4000
-	KBDFLAGS_RELEASE  = 0x8000
+	PTRXFLAGS_DOWN    = 0x8000
+	PTRXFLAGS_BUTTON1 = 0x0001
+	PTRXFLAGS_BUTTON2 = 0x0002
+)
+
+const (
+	KBDFLAGS_EXTENDED  = 0x0100
+	KBDFLAGS_EXTENDED1 = 0x0200
+	KBDFLAGS_DOWN      = 0x4000
+	KBDFLAGS_RELEASE   = 0x8000
+)
+
+// toggle flags of the synchronize event and LED flags of the keyboard indicators
+const (
+	TS_SYNC_SCROLL_LOCK = 0x00000001
+	TS_SYNC_NUM_LOCK    = 0x00000002
+	TS_SYNC_CAPS_LOCK   = 0x00000004
+	TS_SYNC_KANA_LOCK   = 0x00000008
 )
 
 type SurfaceCmdFlags uint32
@@ -435,17 +465,18 @@ func (*BrushCapability) Type() CapsType {
 	return CAPSTYPE_BRUSH
 }
 
-type cacheEntry struct {
+// CacheDefinition is TS_CACHE_DEFINITION
+type CacheDefinition struct {
 	Entries         uint16 `struc:"little"`
 	MaximumCellSize uint16 `struc:"little"`
 }
 
 type GlyphCapability struct {
 	// 10003400000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000
-	GlyphCache   [10]cacheEntry `struc:"little"`
-	FragCache    uint32         `struc:"little"`
-	SupportLevel GlyphSupport   `struc:"little"`
-	Pad2octets   uint16         `struc:"little"`
+	GlyphCache   [10]CacheDefinition `struc:"little"`
+	FragCache    uint32              `struc:"little"`
+	SupportLevel GlyphSupport        `struc:"little"`
+	Pad2octets   uint16              `struc:"little"`
 }
 
 func (*GlyphCapability) Type() CapsType {
@@ -463,6 +494,19 @@ func (*OffscreenBitmapCacheCapability) Type() CapsType {
 	return CAPSTYPE_OFFSCREENCACHE
 }
 
+/**
+ * BitmapCachePersist holds the cache flags, the cell counts carry BITMAPCACHE_CELL_PERSISTENT
+ * @see MS-RDPBCGR 2.2.7.1.4.2 Revision 2 Bitmap Cache Capability Set
+ */
+const (
+	PERSISTENT_KEYS_EXPECTED_FLAG = 0x0001
+	ALLOW_CACHE_WAITING_LIST_FLAG = 0x0002
+	BITMAPCACHE_CELL_PERSISTENT   = 0x80000000
+)
+
+// BitmapCacheCells are the number of entries of the cell caches of the client
+var BitmapCacheCells = [5]uint32{0x258, 0x258, 0x800, 0x1000, 0x800}
+
 type BitmapCache2Capability struct {
 	BitmapCachePersist uint16   `struc:"little"`
 	Pad2octets         uint8    `struc:"little"`
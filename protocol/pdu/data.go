@@ -9,6 +9,7 @@ import (
 
 	"github.com/lunixbochs/struc"
 	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/bulk"
 )
 
 const (
@@ -46,6 +47,7 @@ const (
 	PDUTYPE2_ARC_STATUS_PDU              = 0x32
 	PDUTYPE2_STATUS_INFO_PDU             = 0x36
 	PDUTYPE2_MONITOR_LAYOUT_PDU          = 0x37
+	PDUTYPE2_FRAME_ACKNOWLEDGE           = 0x38
 )
 
 func (p PduType2) String() string {
@@ -98,6 +100,8 @@ func (p PduType2) String() string {
 		return "PDUTYPE2_STATUS_INFO_PDU"
 	case PDUTYPE2_MONITOR_LAYOUT_PDU:
 		return "PDUTYPE2_MONITOR_LAYOUT_PDU"
+	case PDUTYPE2_FRAME_ACKNOWLEDGE:
+		return "PDUTYPE2_FRAME_ACKNOWLEDGE"
 	}
 
 	return "Unknown"
@@ -221,19 +225,24 @@ func (d *DemandActivePDU) Type() uint16 {
 func (d *DemandActivePDU) Serialize() []byte {
 	buff := &bytes.Buffer{}
 	core.WriteUInt32LE(d.SharedId, buff)
-	core.WriteUInt16LE(d.LengthSourceDescriptor, buff)
-	core.WriteUInt16LE(d.LengthCombinedCapabilities, buff)
-	core.WriteBytes([]byte(d.SourceDescriptor), buff)
-	core.WriteUInt16LE(uint16(len(d.CapabilitySets)), buff)
-	core.WriteUInt16LE(d.Pad2Octets, buff)
+	core.WriteUInt16LE(uint16(len(d.SourceDescriptor)), buff)
+
+	capsBuff := &bytes.Buffer{}
 	for _, cap := range d.CapabilitySets {
-		core.WriteUInt16LE(uint16(cap.Type()), buff)
+		core.WriteUInt16LE(uint16(cap.Type()), capsBuff)
 		capBuff := &bytes.Buffer{}
 		struc.Pack(capBuff, cap)
 		capBytes := capBuff.Bytes()
-		core.WriteUInt16LE(uint16(len(capBytes)+4), buff)
-		core.WriteBytes(capBytes, buff)
+		core.WriteUInt16LE(uint16(len(capBytes)+4), capsBuff)
+		core.WriteBytes(capBytes, capsBuff)
 	}
+	capsBytes := capsBuff.Bytes()
+
+	core.WriteUInt16LE(uint16(2+2+len(capsBytes)), buff)
+	core.WriteBytes([]byte(d.SourceDescriptor), buff)
+	core.WriteUInt16LE(uint16(len(d.CapabilitySets)), buff)
+	core.WriteUInt16LE(d.Pad2Octets, buff)
+	core.WriteBytes(capsBytes, buff)
 	core.WriteUInt32LE(d.SessionId, buff)
 	return buff.Bytes()
 }
@@ -366,10 +375,12 @@ func readConfirmActivePDU(r io.Reader) (*ConfirmActivePDU, error) {
 	for i := 0; i < int(p.NumberCapabilities); i++ {
 		c, err := readCapability(r)
 		if err != nil {
-			return nil, err
+			// unknown capability sets are skipped
+			continue
 		}
 		p.CapabilitySets = append(p.CapabilitySets, c)
 	}
+	p.NumberCapabilities = uint16(len(p.CapabilitySets))
 	s, _ := core.ReadUInt32LE(r)
 	slog.Info("readConfirmActivePDU", "sessionid", s)
 	return p, nil
@@ -409,26 +420,46 @@ func (*DataPDU) Type() uint16 {
 func (d *DataPDU) Serialize() []byte {
 	buff := &bytes.Buffer{}
 	struc.Pack(buff, d.Header)
-	struc.Pack(buff, d.Data)
+	buff.Write(serializeData(d.Data))
+	return buff.Bytes()
+}
+
+// serializeData packs data with struc unless it lays out its variable parts itself
+func serializeData(data DataPDUData) []byte {
+	if s, ok := data.(interface{ Serialize() []byte }); ok {
+		return s.Serialize()
+	}
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, data)
 	return buff.Bytes()
 }
 
 func NewDataPDU(data DataPDUData, shareId uint32) *DataPDU {
-	dataBuff := &bytes.Buffer{}
-	struc.Pack(dataBuff, data)
 	return &DataPDU{
-		Header: NewShareDataHeader(len(dataBuff.Bytes()), data.Type2(), shareId),
+		Header: NewShareDataHeader(len(serializeData(data)), data.Type2(), shareId),
 		Data:   data,
 	}
 }
 
-func readDataPDU(r io.Reader) (*DataPDU, error) {
+// readDataPDU reads a data pdu, dec decompresses its body when the sender compressed it
+func readDataPDU(r io.Reader, dec *bulk.Decompressor) (*DataPDU, error) {
 	header := &ShareDataHeader{}
 	err := struc.Unpack(r, header)
 	if err != nil {
 		slog.Error("readDataPDU", "err", err)
 		return nil, err
 	}
+	if bulk.Compressed(header.CompressedType) {
+		if dec == nil {
+			return nil, errors.New("compressed data pdu")
+		}
+		b, _ := io.ReadAll(r)
+		if b, err = dec.Decompress(b, header.CompressedType); err != nil {
+			slog.Error("readDataPDU", "err", err)
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
 	var d DataPDUData
 	slog.Debug("readDataPDU", "PDUTYPE2", header.PDUType2)
 	switch header.PDUType2 {
@@ -453,6 +484,24 @@ func readDataPDU(r io.Reader) (*DataPDU, error) {
 	case PDUTYPE2_SAVE_SESSION_INFO:
 		d = &SaveSessionInfo{}
 
+	case PDUTYPE2_INPUT:
+		d = &ClientInputEventPDU{}
+
+	case PDUTYPE2_BITMAPCACHE_PERSISTENT_LIST:
+		d = &PersistKeyPDU{}
+
+	case PDUTYPE2_FRAME_ACKNOWLEDGE:
+		d = &FrameAcknowledgePDU{}
+
+	case PDUTYPE2_SET_KEYBOARD_INDICATORS:
+		d = &SetKeyboardIndicatorsPDU{}
+
+	case PDUTYPE2_REFRESH_RECT:
+		d = &RefreshRectPDU{}
+
+	case PDUTYPE2_SET_KEYBOARD_IME_STATUS:
+		d = &SetKeyboardImeStatusPDU{}
+
 	default:
 		err = errors.New(fmt.Sprintf("Unknown data pdu type2 0x%02x", header.PDUType2))
 		slog.Error("readDataPDU", "err", err)
@@ -492,9 +541,11 @@ func (d *UpdateDataPDU) Unpack(r io.Reader) (err error) {
 	var p UpdateData
 	switch d.UpdateType {
 	case FASTPATH_UPDATETYPE_ORDERS:
+		p = &SlowPathOrdersPDU{}
 	case FASTPATH_UPDATETYPE_BITMAP:
 		p = &BitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		p = &PaletteUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	}
 	if p != nil {
@@ -512,6 +563,56 @@ func (d *UpdateDataPDU) Unpack(r io.Reader) (err error) {
 	return nil
 }
 
+/**
+ * Colors of the 8 bpp sessions
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.1.1 TS_UPDATE_PALETTE_DATA
+ */
+type PaletteEntry struct {
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+type PaletteUpdateDataPDU struct {
+	NumberColors uint32
+	Entries      []PaletteEntry
+}
+
+func (*PaletteUpdateDataPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PALETTE
+}
+func (f *PaletteUpdateDataPDU) Unpack(r io.Reader) error {
+	// pad2Octets
+	core.ReadUint16LE(r)
+	var err error
+	f.NumberColors, err = core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	if f.NumberColors > 256 {
+		return errors.New(fmt.Sprintf("invalid palette size %d", f.NumberColors))
+	}
+	f.Entries = make([]PaletteEntry, f.NumberColors)
+	for i := range f.Entries {
+		e := &f.Entries[i]
+		e.Red, _ = core.ReadUInt8(r)
+		e.Green, _ = core.ReadUInt8(r)
+		e.Blue, err = core.ReadUInt8(r)
+	}
+	return err
+}
+
+// FastPathPaletteUpdateDataPDU repeats the update type of the slow-path palette
+type FastPathPaletteUpdateDataPDU struct {
+	Header uint16
+	PaletteUpdateDataPDU
+}
+
+func (f *FastPathPaletteUpdateDataPDU) Unpack(r io.Reader) error {
+	f.Header, _ = core.ReadUint16LE(r)
+	return f.PaletteUpdateDataPDU.Unpack(r)
+}
+
 type BitmapUpdateDataPDU struct {
 	NumberRectangles uint16 `struc:"little,sizeof=Rectangles"`
 	Rectangles       []BitmapData
@@ -735,26 +836,172 @@ func (*SaveSessionInfo) Type2() uint8 {
 	return PDUTYPE2_SAVE_SESSION_INFO
 }
 
+/**
+ * @see MS-RDPBCGR 2.2.14.3 Frame Acknowledge PDU
+ */
+type FrameAcknowledgePDU struct {
+	FrameId uint32 `struc:"little"`
+}
+
+func (*FrameAcknowledgePDU) Type2() uint8 {
+	return PDUTYPE2_FRAME_ACKNOWLEDGE
+}
+
+func (d *FrameAcknowledgePDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.8.2.1.1 Set Keyboard Indicators PDU Data
+ */
+type SetKeyboardIndicatorsPDU struct {
+	UnitId uint16 `struc:"little"`
+	// LedFlags hold the TS_SYNC_* bits of the lock keys
+	LedFlags uint16 `struc:"little"`
+}
+
+func (*SetKeyboardIndicatorsPDU) Type2() uint8 {
+	return PDUTYPE2_SET_KEYBOARD_INDICATORS
+}
+
+func (d *SetKeyboardIndicatorsPDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.8.2.2.1 Set Keyboard IME Status PDU Data
+ */
+type SetKeyboardImeStatusPDU struct {
+	UnitId      uint16 `struc:"little"`
+	ImeState    uint32 `struc:"little"`
+	ImeConvMode uint32 `struc:"little"`
+}
+
+func (*SetKeyboardImeStatusPDU) Type2() uint8 {
+	return PDUTYPE2_SET_KEYBOARD_IME_STATUS
+}
+
+func (d *SetKeyboardImeStatusPDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.11.2.1 Refresh Rect PDU Data
+ */
+type RefreshRectPDU struct {
+	NumberOfAreas uint8   `struc:"little"`
+	Pad3Octects   [3]byte `struc:"little"`
+	// AreasToRefresh are TS_RECTANGLE16, right and bottom are inclusive
+	AreasToRefresh []InclusiveRectangle `struc:"skip"`
+}
+
+type InclusiveRectangle struct {
+	Left   uint16 `struc:"little"`
+	Top    uint16 `struc:"little"`
+	Right  uint16 `struc:"little"`
+	Bottom uint16 `struc:"little"`
+}
+
+func (*RefreshRectPDU) Type2() uint8 {
+	return PDUTYPE2_REFRESH_RECT
+}
+
+func (d *RefreshRectPDU) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	d.NumberOfAreas = uint8(len(d.AreasToRefresh))
+	struc.Pack(buff, d)
+	for _, a := range d.AreasToRefresh {
+		struc.Pack(buff, &a)
+	}
+	return buff.Bytes()
+}
+
+func (d *RefreshRectPDU) Unpack(r io.Reader) error {
+	if err := struc.Unpack(r, d); err != nil {
+		return err
+	}
+	d.AreasToRefresh = make([]InclusiveRectangle, d.NumberOfAreas)
+	for i := range d.AreasToRefresh {
+		if err := struc.Unpack(r, &d.AreasToRefresh[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type PersistKeyPDU struct {
-	NumEntriesCache0   uint16 `struc:"little"`
-	NumEntriesCache1   uint16 `struc:"little"`
-	NumEntriesCache2   uint16 `struc:"little"`
-	NumEntriesCache3   uint16 `struc:"little"`
-	NumEntriesCache4   uint16 `struc:"little"`
-	TotalEntriesCache0 uint16 `struc:"little"`
-	TotalEntriesCache1 uint16 `struc:"little"`
-	TotalEntriesCache2 uint16 `struc:"little"`
-	TotalEntriesCache3 uint16 `struc:"little"`
-	TotalEntriesCache4 uint16 `struc:"little"`
-	BBitMask           uint8  `struc:"little"`
-	Pad1               uint8  `struc:"little"`
-	Ppad3              uint16 `struc:"little"`
+	NumEntriesCache0   uint16            `struc:"little"`
+	NumEntriesCache1   uint16            `struc:"little"`
+	NumEntriesCache2   uint16            `struc:"little"`
+	NumEntriesCache3   uint16            `struc:"little"`
+	NumEntriesCache4   uint16            `struc:"little"`
+	TotalEntriesCache0 uint16            `struc:"little"`
+	TotalEntriesCache1 uint16            `struc:"little"`
+	TotalEntriesCache2 uint16            `struc:"little"`
+	TotalEntriesCache3 uint16            `struc:"little"`
+	TotalEntriesCache4 uint16            `struc:"little"`
+	BBitMask           uint8             `struc:"little"`
+	Pad1               uint8             `struc:"little"`
+	Ppad3              uint16            `struc:"little"`
+	Entries            []PersistKeyEntry `struc:"skip"`
+}
+
+/**
+ * @see MS-RDPBCGR 2.2.1.17.1 Persistent Key List PDU Data
+ */
+const (
+	PERSIST_FIRST_PDU = 0x01
+	PERSIST_LAST_PDU  = 0x02
+	// entries of a single PDU
+	PERSIST_MAX_ENTRIES = 169
+)
+
+type PersistKeyEntry struct {
+	Key1 uint32 `struc:"little"`
+	Key2 uint32 `struc:"little"`
 }
 
 func (*PersistKeyPDU) Type2() uint8 {
 	return PDUTYPE2_BITMAPCACHE_PERSISTENT_LIST
 }
 
+func (d *PersistKeyPDU) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, d)
+	for _, e := range d.Entries {
+		struc.Pack(buff, &e)
+	}
+	return buff.Bytes()
+}
+
+func (d *PersistKeyPDU) Unpack(r io.Reader) error {
+	num := []*uint16{&d.NumEntriesCache0, &d.NumEntriesCache1, &d.NumEntriesCache2, &d.NumEntriesCache3, &d.NumEntriesCache4,
+		&d.TotalEntriesCache0, &d.TotalEntriesCache1, &d.TotalEntriesCache2, &d.TotalEntriesCache3, &d.TotalEntriesCache4}
+	n := 0
+	for i, v := range num {
+		*v, _ = core.ReadUint16LE(r)
+		if i < 5 {
+			n += int(*v)
+		}
+	}
+	d.BBitMask, _ = core.ReadUInt8(r)
+	d.Pad1, _ = core.ReadUInt8(r)
+	var err error
+	d.Ppad3, err = core.ReadUint16LE(r)
+	if err != nil {
+		return err
+	}
+	if n > PERSIST_MAX_ENTRIES {
+		return errors.New(fmt.Sprintf("too many persistent keys %d", n))
+	}
+	d.Entries = make([]PersistKeyEntry, n)
+	for i := range d.Entries {
+		d.Entries[i].Key1, _ = core.ReadUInt32LE(r)
+		d.Entries[i].Key2, err = core.ReadUInt32LE(r)
+	}
+	return err
+}
+
 type UpdateData interface {
 	FastPathUpdateType() uint8
 	Unpack(io.Reader) error
@@ -785,6 +1032,26 @@ func (b *BitmapData) IsCompress() bool {
 	return b.Flags&BITMAP_COMPRESSION != 0
 }
 
+func (b *BitmapData) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(b.DestLeft, buff)
+	core.WriteUInt16LE(b.DestTop, buff)
+	core.WriteUInt16LE(b.DestRight, buff)
+	core.WriteUInt16LE(b.DestBottom, buff)
+	core.WriteUInt16LE(b.Width, buff)
+	core.WriteUInt16LE(b.Height, buff)
+	core.WriteUInt16LE(b.BitsPerPixel, buff)
+	core.WriteUInt16LE(b.Flags, buff)
+	if b.BitmapComprHdr != nil {
+		core.WriteUInt16LE(uint16(len(b.BitmapDataStream)+8), buff)
+		struc.Pack(buff, b.BitmapComprHdr)
+	} else {
+		core.WriteUInt16LE(uint16(len(b.BitmapDataStream)), buff)
+	}
+	core.WriteBytes(b.BitmapDataStream, buff)
+	return buff.Bytes()
+}
+
 type FastPathBitmapUpdateDataPDU struct {
 	Header           uint16 `struc:"little"`
 	NumberRectangles uint16 `struc:"little,sizeof=Rectangles"`
@@ -827,16 +1094,27 @@ func (*FastPathBitmapUpdateDataPDU) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_BITMAP
 }
 
+func (f *FastPathBitmapUpdateDataPDU) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(FASTPATH_UPDATETYPE_BITMAP, buff)
+	core.WriteUInt16LE(uint16(len(f.Rectangles)), buff)
+	for i := range f.Rectangles {
+		core.WriteBytes(f.Rectangles[i].Serialize(), buff)
+	}
+	return buff.Bytes()
+}
+
+// FastPathColorPdu is a 24 bpp pointer, the masks are stored bottom-up like in FastPathUpdatePointerPDU
 type FastPathColorPdu struct {
-	CacheIdx uint16
-	X        uint16
-	Y        uint16
-	Width    uint16
-	Height   uint16
-	MaskLen  uint16 `struc:"little,sizeof=Mask"`
-	DataLen  uint16 `struc:"little,sizeof=Data"`
-	Mask     []byte
-	Data     []byte
+	CacheIdx uint16 `struc:"little"`
+	X        uint16 `struc:"little"`
+	Y        uint16 `struc:"little"`
+	Width    uint16 `struc:"little"`
+	Height   uint16 `struc:"little"`
+	MaskLen  uint16 `struc:"little,sizeof=Mask"` // lengthAndMask
+	DataLen  uint16 `struc:"little,sizeof=Data"` // lengthXorMask
+	Data     []byte // xorMaskData
+	Mask     []byte // andMaskData
 }
 
 func (*FastPathColorPdu) FastPathUpdateType() uint8 {
@@ -846,19 +1124,91 @@ func (f *FastPathColorPdu) Unpack(r io.Reader) error {
 	return struc.Unpack(r, f)
 }
 
+/**
+ * @see MS-RDPBCGR 2.2.9.1.2.1.10 Fast-Path Surface Commands Update
+ */
+const (
+	CMDTYPE_SET_SURFACE_BITS    = 0x0001
+	CMDTYPE_FRAME_MARKER        = 0x0004
+	CMDTYPE_STREAM_SURFACE_BITS = 0x0006
+)
+
+const (
+	SURFACECMD_FRAMEACTION_BEGIN = 0x0000
+	SURFACECMD_FRAMEACTION_END   = 0x0001
+)
+
+// flags of TS_BITMAP_DATA_EX
+const (
+	EX_COMPRESSED_BITMAP_HEADER_PRESENT = 0x01
+)
+
+type SurfaceCmd interface {
+	CmdType() uint16
+}
+
+// SurfaceBits paints a bitmap encoded by one of the negotiated codecs
+type SurfaceBits struct {
+	Cmd        uint16
+	DestLeft   uint16
+	DestTop    uint16
+	DestRight  uint16
+	DestBottom uint16
+	Bitmap     BitmapDataEx
+}
+
+func (s *SurfaceBits) CmdType() uint16 {
+	return s.Cmd
+}
+
+// FrameMarker delimits the commands of a frame
+type FrameMarker struct {
+	FrameAction uint16 `struc:"little"`
+	FrameId     uint32 `struc:"little"`
+}
+
+func (*FrameMarker) CmdType() uint16 {
+	return CMDTYPE_FRAME_MARKER
+}
+
 type FastPathSurfaceCmds struct {
+	Commands []SurfaceCmd
 }
 
 func (*FastPathSurfaceCmds) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_SURFCMDS
 }
 func (f *FastPathSurfaceCmds) Unpack(r io.Reader) error {
-	cmdType, _ := core.ReadUint16LE(r)
-	switch cmdType {
-
+	for {
+		b, err := core.ReadBytes(2, r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cmdType := uint16(b[0]) | uint16(b[1])<<8
+		switch cmdType {
+		case CMDTYPE_SET_SURFACE_BITS, CMDTYPE_STREAM_SURFACE_BITS:
+			s := &SurfaceBits{Cmd: cmdType}
+			s.DestLeft, _ = core.ReadUint16LE(r)
+			s.DestTop, _ = core.ReadUint16LE(r)
+			s.DestRight, _ = core.ReadUint16LE(r)
+			s.DestBottom, _ = core.ReadUint16LE(r)
+			if err = readBitmapDataEx(r, &s.Bitmap); err != nil {
+				return err
+			}
+			f.Commands = append(f.Commands, s)
+		case CMDTYPE_FRAME_MARKER:
+			m := &FrameMarker{}
+			if err = struc.Unpack(r, m); err != nil {
+				return err
+			}
+			f.Commands = append(f.Commands, m)
+		default:
+			return fmt.Errorf("unknown surface command 0x%x", cmdType)
+		}
 	}
-
-	return nil
 }
 
 type FastPathUpdatePointerPDU struct {
@@ -882,6 +1232,29 @@ func (f *FastPathUpdatePointerPDU) Unpack(r io.Reader) error {
 	return struc.Unpack(r, f)
 }
 
+type FastPathUpdatePointerPositionPDU struct {
+	X uint16 `struc:"little"`
+	Y uint16 `struc:"little"`
+}
+
+func (*FastPathUpdatePointerPositionPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PTR_POSITION
+}
+
+func (f *FastPathUpdatePointerPositionPDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, f)
+}
+
+type FastPathUpdatePointerDefaultPDU struct {
+}
+
+func (*FastPathUpdatePointerDefaultPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PTR_DEFAULT
+}
+func (f *FastPathUpdatePointerDefaultPDU) Unpack(r io.Reader) error {
+	return nil
+}
+
 type FastPathUpdatePointerNullPDU struct {
 }
 
@@ -933,15 +1306,18 @@ func readFastPathUpdatePDU(r io.Reader, code uint8) (*FastPathUpdatePDU, error)
 	case FASTPATH_UPDATETYPE_BITMAP:
 		d = &FastPathBitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		d = &FastPathPaletteUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	case FASTPATH_UPDATETYPE_SURFCMDS:
-		//d = &FastPathSurfaceCmds{}
+		d = &FastPathSurfaceCmds{}
 	case FASTPATH_UPDATETYPE_PTR_NULL:
 		d = &FastPathUpdatePointerNullPDU{}
 	case FASTPATH_UPDATETYPE_PTR_DEFAULT:
+		d = &FastPathUpdatePointerDefaultPDU{}
 	case FASTPATH_UPDATETYPE_PTR_POSITION:
+		d = &FastPathUpdatePointerPositionPDU{}
 	case FASTPATH_UPDATETYPE_COLOR:
-		//d = &FastPathColorPdu{}
+		d = &FastPathColorPdu{}
 	case FASTPATH_UPDATETYPE_CACHED:
 		d = &FastPathUpdateCachedPDU{}
 	case FASTPATH_UPDATETYPE_POINTER:
@@ -986,7 +1362,7 @@ func NewPDU(userId uint16, message PDUMessage) *PDU {
 	return pdu
 }
 
-func readPDU(r io.Reader) (*PDU, error) {
+func readPDU(r io.Reader, dec *bulk.Decompressor) (*PDU, error) {
 	pdu := &PDU{}
 	var err error
 	header := &ShareControlHeader{}
@@ -1004,7 +1380,7 @@ func readPDU(r io.Reader) (*PDU, error) {
 		d, err = readDemandActivePDU(r)
 	case PDUTYPE_DATAPDU:
 		slog.Debug("readPDU:PDUTYPE_DATAPDU")
-		d, err = readDataPDU(r)
+		d, err = readDataPDU(r, dec)
 	case PDUTYPE_CONFIRMACTIVEPDU:
 		slog.Debug("readPDU:PDUTYPE_CONFIRMACTIVEPDU")
 		d, err = readConfirmActivePDU(r)
@@ -1047,6 +1423,46 @@ func (p *PointerEvent) Serialize() []byte {
 	return buff.Bytes()
 }
 
+// WheelRotation is the 9-bit two's complement of a wheel delta for the pointer
+// flags, PTRFLAGS_WHEEL_NEGATIVE is its sign bit. A notch is 120, the delta is
+// clamped to [-256, 255].
+func WheelRotation(delta int) uint16 {
+	return uint16(min(max(delta, -256), 255)) & WheelRotationMask
+}
+
+// WheelDelta is the signed rotation of a wheel event
+func (p *PointerEvent) WheelDelta() int {
+	rotation := int(p.PointerFlags & WheelRotationMask)
+	if p.PointerFlags&PTRFLAGS_WHEEL_NEGATIVE != 0 {
+		rotation -= 0x200
+	}
+	return rotation
+}
+
+type PointerExEvent struct {
+	PointerFlags uint16 `struc:"little"`
+	XPos         uint16 `struc:"little"`
+	YPos         uint16 `struc:"little"`
+}
+
+func (p *PointerExEvent) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, p)
+	return buff.Bytes()
+}
+
+type RelativePointerEvent struct {
+	PointerFlags uint16 `struc:"little"`
+	XDelta       int16  `struc:"little"`
+	YDelta       int16  `struc:"little"`
+}
+
+func (p *RelativePointerEvent) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, p)
+	return buff.Bytes()
+}
+
 type SynchronizeEvent struct {
 	Pad2Octets  uint16 `struc:"little"`
 	ToggleFlags uint32 `struc:"little"`
@@ -1091,6 +1507,48 @@ type ClientInputEventPDU struct {
 func (*ClientInputEventPDU) Type2() uint8 {
 	return PDUTYPE2_INPUT
 }
-func (*ClientInputEventPDU) Unpack(io.Reader) error {
+func (p *ClientInputEventPDU) Unpack(r io.Reader) error {
+	var err error
+	p.NumEvents, err = core.ReadUint16LE(r)
+	if err != nil {
+		return err
+	}
+	p.Pad2Octets, err = core.ReadUint16LE(r)
+	p.SlowPathInputEvents = make([]SlowPathInputEvent, 0, p.NumEvents)
+	for i := 0; i < int(p.NumEvents); i++ {
+		e := SlowPathInputEvent{}
+		e.EventTime, err = core.ReadUInt32LE(r)
+		e.MessageType, err = core.ReadUint16LE(r)
+		// every slow-path input event carries 6 bytes
+		e.Size = 6
+		e.SlowPathInputData, err = core.ReadBytes(e.Size, r)
+		if err != nil {
+			return err
+		}
+		p.SlowPathInputEvents = append(p.SlowPathInputEvents, e)
+	}
 	return nil
 }
+
+// Event decodes the payload of a slow-path input event according to its message type
+func (e *SlowPathInputEvent) Event() (InputEventsInterface, error) {
+	var event InputEventsInterface
+	switch e.MessageType {
+	case INPUT_EVENT_SYNC:
+		event = &SynchronizeEvent{}
+	case INPUT_EVENT_SCANCODE:
+		event = &ScancodeKeyEvent{}
+	case INPUT_EVENT_UNICODE:
+		event = &UnicodeKeyEvent{}
+	case INPUT_EVENT_MOUSE:
+		event = &PointerEvent{}
+	case INPUT_EVENT_MOUSEX:
+		event = &PointerExEvent{}
+	case INPUT_EVENT_MOUSEREL:
+		event = &RelativePointerEvent{}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown input event type 0x%04x", e.MessageType))
+	}
+	err := struc.Unpack(bytes.NewReader(e.SlowPathInputData), event)
+	return event, err
+}
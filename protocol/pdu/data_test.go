@@ -0,0 +1,139 @@
+package pdu
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/sergei-bronnikov/grdp/protocol/bulk"
+)
+
+func TestCompressedDataPDU(t *testing.T) {
+	b := []byte{
+		1, 0, 1, 0, 0, STREAM_LOW, 8, 0, PDUTYPE2_SYNCHRONIZE,
+		bulk.PACKET_COMPR_TYPE_64K | bulk.PACKET_COMPRESSED | bulk.PACKET_FLUSHED, 4, 0,
+		// the mppc literals below 0x80 are coded as themselves
+		1, 0, 0x12, 0,
+	}
+	if _, err := readDataPDU(bytes.NewReader(b), nil); err == nil {
+		t.Error("compressed pdu read without a decompressor")
+	}
+	p, err := readDataPDU(bytes.NewReader(b), bulk.NewDecompressor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := p.Data.(*SynchronizeDataPDU); !ok || s.MessageType != 1 || s.TargetUser != 0x12 {
+		t.Errorf("data %+v", p.Data)
+	}
+}
+
+func TestFastPathSurfaceCmds(t *testing.T) {
+	b := []byte{
+		// frame 7 begins
+		CMDTYPE_FRAME_MARKER, 0, SURFACECMD_FRAMEACTION_BEGIN, 0, 7, 0, 0, 0,
+		// 2x1 at 10, 20 in codec 3
+		CMDTYPE_SET_SURFACE_BITS, 0, 10, 0, 20, 0, 12, 0, 21, 0,
+		32, 0, 0, 3, 2, 0, 1, 0, 3, 0, 0, 0, 0xaa, 0xbb, 0xcc,
+		CMDTYPE_FRAME_MARKER, 0, SURFACECMD_FRAMEACTION_END, 0, 7, 0, 0, 0,
+	}
+	f := &FastPathSurfaceCmds{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Commands) != 3 {
+		t.Fatal("commands", len(f.Commands))
+	}
+	s, ok := f.Commands[1].(*SurfaceBits)
+	if !ok || s.DestLeft != 10 || s.DestBottom != 21 || s.Bitmap.CodecID != 3 || s.Bitmap.Width != 2 ||
+		!bytes.Equal(s.Bitmap.Data, []byte{0xaa, 0xbb, 0xcc}) {
+		t.Error("surface bits", f.Commands[1])
+	}
+	if m, ok := f.Commands[2].(*FrameMarker); !ok || *m != (FrameMarker{SURFACECMD_FRAMEACTION_END, 7}) {
+		t.Error("frame marker", f.Commands[2])
+	}
+	if err := (&FastPathSurfaceCmds{}).Unpack(bytes.NewReader(b[:20])); err == nil {
+		t.Error("truncated surface bits")
+	}
+}
+
+func TestFastPathInput(t *testing.T) {
+	events := []InputEvent{
+		&ScancodeKeyEvent{KeyCode: 0x1d, KeyboardFlags: KBDFLAGS_RELEASE | KBDFLAGS_EXTENDED},
+		&UnicodeKeyEvent{Unicode: 0x20ac},
+		&PointerEvent{PointerFlags: PTRFLAGS_DOWN | PTRFLAGS_BUTTON1, XPos: 640, YPos: 480},
+		&PointerExEvent{PointerFlags: 0x8001, XPos: 1, YPos: 2},
+		&RelativePointerEvent{PointerFlags: PTRFLAGS_MOVE, XDelta: -5, YDelta: 7},
+		&SynchronizeEvent{ToggleFlags: TS_SYNC_NUM_LOCK | TS_SYNC_CAPS_LOCK},
+	}
+	buff := &bytes.Buffer{}
+	for _, e := range events {
+		e.writeFastPath(buff)
+	}
+	if !bytes.Equal(buff.Bytes()[:4], []byte{0x03, 0x1d, 0x80, 0xac}) {
+		t.Errorf("keyboard events % x", buff.Bytes()[:4])
+	}
+	for _, want := range events {
+		got, err := readFastPathInputEvent(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if buff.Len() != 0 {
+		t.Error("trailing bytes", buff.Len())
+	}
+}
+
+func TestWheelRotation(t *testing.T) {
+	for _, c := range []struct {
+		delta    int
+		rotation uint16
+	}{{120, 0x078}, {-120, 0x188}, {-1, 0x1ff}, {-256, 0x100}, {255, 0x0ff}, {300, 0x0ff}, {-300, 0x100}} {
+		r := WheelRotation(c.delta)
+		if r != c.rotation {
+			t.Errorf("rotation of %d = 0x%x", c.delta, r)
+		}
+		p := &PointerEvent{PointerFlags: PTRFLAGS_WHEEL | r}
+		if d := p.WheelDelta(); d != min(max(c.delta, -256), 255) {
+			t.Errorf("delta of 0x%x = %d", r, d)
+		}
+	}
+}
+
+func TestRefreshRectPDU(t *testing.T) {
+	p := &RefreshRectPDU{AreasToRefresh: []InclusiveRectangle{{Left: 0, Top: 0, Right: 799, Bottom: 599}}}
+	b := p.Serialize()
+	if !bytes.Equal(b, []byte{1, 0, 0, 0, 0, 0, 0, 0, 0x1f, 0x03, 0x57, 0x02}) {
+		t.Errorf("refresh rect % x", b)
+	}
+	got := &RefreshRectPDU{}
+	if err := got.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+}
+
+func TestSurfaceBitsLength(t *testing.T) {
+	for _, bitmap := range [][]byte{
+		// 4 GB announced in codec 3
+		{32, 0, 0, 3, 2, 0, 1, 0, 0xff, 0xff, 0xff, 0xff, 0xaa},
+		// 12 bytes of an uncompressed 2x1 bitmap
+		{32, 0, 0, 0, 2, 0, 1, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		// truncated compressed bitmap header
+		{32, EX_COMPRESSED_BITMAP_HEADER_PRESENT, 0, 3, 2, 0, 1, 0, 30, 0, 0, 0, 0},
+	} {
+		b := append([]byte{CMDTYPE_SET_SURFACE_BITS, 0, 0, 0, 0, 0, 2, 0, 1, 0}, bitmap...)
+		if err := (&FastPathSurfaceCmds{}).Unpack(bytes.NewReader(b)); err == nil {
+			t.Errorf("bitmap % x", bitmap)
+		}
+	}
+	// readers not telling their length are read as far as they go
+	if _, err := readBytes(0xffffffff, io.LimitReader(bytes.NewReader(make([]byte, 8)), 4)); err == nil {
+		t.Error("short reader")
+	}
+}
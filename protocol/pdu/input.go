@@ -0,0 +1,261 @@
+package pdu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/sergei-bronnikov/grdp/core"
+)
+
+/**
+ * Fast-path input events, they go without the share headers of the slow-path
+ * and a single PDU carries up to 15 of them
+ * @see MS-RDPBCGR 2.2.8.1.2 Client Fast-Path Input Event PDU (TS_FP_INPUT_PDU)
+ */
+
+// eventCode of the TS_FP_INPUT_EVENT header
+const (
+	FASTPATH_INPUT_EVENT_SCANCODE      = 0x0
+	FASTPATH_INPUT_EVENT_MOUSE         = 0x1
+	FASTPATH_INPUT_EVENT_MOUSEX        = 0x2
+	FASTPATH_INPUT_EVENT_SYNC          = 0x3
+	FASTPATH_INPUT_EVENT_UNICODE       = 0x4
+	FASTPATH_INPUT_EVENT_RELMOUSE      = 0x5
+	FASTPATH_INPUT_EVENT_QOE_TIMESTAMP = 0x6
+)
+
+// eventFlags of the keyboard events
+const (
+	FASTPATH_INPUT_KBDFLAGS_RELEASE   = 0x01
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED  = 0x02
+	FASTPATH_INPUT_KBDFLAGS_EXTENDED1 = 0x04
+)
+
+// FASTPATH_INPUT_MAX_EVENTS fit in the numEvents bits of the fpInputHeader
+const FASTPATH_INPUT_MAX_EVENTS = 15
+
+// InputEvent is an event the client sends on the slow-path or the fast-path
+type InputEvent interface {
+	InputEventsInterface
+	// MessageType is the INPUT_EVENT_* of the slow-path event
+	MessageType() uint16
+	// writeFastPath writes the TS_FP_INPUT_EVENT
+	writeFastPath(w io.Writer)
+}
+
+func writeFastPathHeader(code, flags uint8, w io.Writer) {
+	core.WriteUInt8(code<<5|flags&0x1f, w)
+}
+
+func (*ScancodeKeyEvent) MessageType() uint16 {
+	return INPUT_EVENT_SCANCODE
+}
+
+func (p *ScancodeKeyEvent) writeFastPath(w io.Writer) {
+	var flags uint8
+	if p.KeyboardFlags&KBDFLAGS_RELEASE != 0 {
+		flags |= FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	if p.KeyboardFlags&KBDFLAGS_EXTENDED != 0 {
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED
+	}
+	if p.KeyboardFlags&KBDFLAGS_EXTENDED1 != 0 {
+		flags |= FASTPATH_INPUT_KBDFLAGS_EXTENDED1
+	}
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_SCANCODE, flags, w)
+	core.WriteUInt8(uint8(p.KeyCode), w)
+}
+
+func (*UnicodeKeyEvent) MessageType() uint16 {
+	return INPUT_EVENT_UNICODE
+}
+
+func (p *UnicodeKeyEvent) writeFastPath(w io.Writer) {
+	var flags uint8
+	if p.KeyboardFlags&KBDFLAGS_RELEASE != 0 {
+		flags |= FASTPATH_INPUT_KBDFLAGS_RELEASE
+	}
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_UNICODE, flags, w)
+	core.WriteUInt16LE(p.Unicode, w)
+}
+
+func (*PointerEvent) MessageType() uint16 {
+	return INPUT_EVENT_MOUSE
+}
+
+func (p *PointerEvent) writeFastPath(w io.Writer) {
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_MOUSE, 0, w)
+	core.WriteBytes(p.Serialize(), w)
+}
+
+func (*PointerExEvent) MessageType() uint16 {
+	return INPUT_EVENT_MOUSEX
+}
+
+func (p *PointerExEvent) writeFastPath(w io.Writer) {
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_MOUSEX, 0, w)
+	core.WriteBytes(p.Serialize(), w)
+}
+
+func (*RelativePointerEvent) MessageType() uint16 {
+	return INPUT_EVENT_MOUSEREL
+}
+
+func (p *RelativePointerEvent) writeFastPath(w io.Writer) {
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_RELMOUSE, 0, w)
+	core.WriteBytes(p.Serialize(), w)
+}
+
+func (*SynchronizeEvent) MessageType() uint16 {
+	return INPUT_EVENT_SYNC
+}
+
+// writeFastPath carries the toggle flags in the event flags
+func (p *SynchronizeEvent) writeFastPath(w io.Writer) {
+	writeFastPathHeader(FASTPATH_INPUT_EVENT_SYNC, uint8(p.ToggleFlags), w)
+}
+
+// readFastPathInputEvent reads a TS_FP_INPUT_EVENT as its slow-path counterpart
+func readFastPathInputEvent(r io.Reader) (InputEvent, error) {
+	header, err := core.ReadBytes(1, r)
+	if err != nil {
+		return nil, err
+	}
+	code, flags := header[0]>>5, header[0]&0x1f
+	switch code {
+	case FASTPATH_INPUT_EVENT_SCANCODE:
+		b, err := core.ReadBytes(1, r)
+		if err != nil {
+			return nil, err
+		}
+		e := &ScancodeKeyEvent{KeyCode: uint16(b[0])}
+		if flags&FASTPATH_INPUT_KBDFLAGS_RELEASE != 0 {
+			e.KeyboardFlags |= KBDFLAGS_RELEASE
+		}
+		if flags&FASTPATH_INPUT_KBDFLAGS_EXTENDED != 0 {
+			e.KeyboardFlags |= KBDFLAGS_EXTENDED
+		}
+		if flags&FASTPATH_INPUT_KBDFLAGS_EXTENDED1 != 0 {
+			e.KeyboardFlags |= KBDFLAGS_EXTENDED1
+		}
+		return e, nil
+	case FASTPATH_INPUT_EVENT_UNICODE:
+		b, err := core.ReadBytes(2, r)
+		if err != nil {
+			return nil, err
+		}
+		e := &UnicodeKeyEvent{Unicode: uint16(b[0]) | uint16(b[1])<<8}
+		if flags&FASTPATH_INPUT_KBDFLAGS_RELEASE != 0 {
+			e.KeyboardFlags |= KBDFLAGS_RELEASE
+		}
+		return e, nil
+	case FASTPATH_INPUT_EVENT_SYNC:
+		return &SynchronizeEvent{ToggleFlags: uint32(flags)}, nil
+	case FASTPATH_INPUT_EVENT_MOUSE, FASTPATH_INPUT_EVENT_MOUSEX, FASTPATH_INPUT_EVENT_RELMOUSE:
+		b, err := core.ReadBytes(6, r)
+		if err != nil {
+			return nil, err
+		}
+		e := &SlowPathInputEvent{Size: 6, SlowPathInputData: b}
+		switch code {
+		case FASTPATH_INPUT_EVENT_MOUSE:
+			e.MessageType = INPUT_EVENT_MOUSE
+		case FASTPATH_INPUT_EVENT_MOUSEX:
+			e.MessageType = INPUT_EVENT_MOUSEX
+		default:
+			e.MessageType = INPUT_EVENT_MOUSEREL
+		}
+		event, err := e.Event()
+		if err != nil {
+			return nil, err
+		}
+		return event.(InputEvent), nil
+	}
+	return nil, fmt.Errorf("unknown fast-path input event 0x%x", code)
+}
+
+// fastPathInput tells whether the server takes the input events on the fast-path
+func (c *Client) fastPathInput() bool {
+	caps, ok := c.serverCapabilities[CAPSTYPE_INPUT].(*InputCapability)
+	return ok && c.fastPathSender != nil &&
+		caps.Flags&(INPUT_FLAG_FASTPATH_INPUT|INPUT_FLAG_FASTPATH_INPUT2) != 0
+}
+
+// supported tells whether the server announced the input flag the event needs
+func (c *Client) supported(e InputEvent) bool {
+	flags := c.ServerInputFlags()
+	switch e := e.(type) {
+	case *PointerEvent:
+		return e.PointerFlags&PTRFLAGS_HWHEEL == 0 || flags&INPUT_FLAG_MOUSE_HWHEEL != 0
+	case *PointerExEvent:
+		return flags&INPUT_FLAG_MOUSEX != 0
+	case *RelativePointerEvent:
+		return flags&INPUT_FLAG_MOUSE_RELATIVE != 0
+	}
+	return true
+}
+
+// SendInput sends the events in as few PDUs as it can, on the fast-path when
+// the server supports it. Mouse events of a kind the server does not announce are dropped
+func (c *Client) SendInput(events ...InputEvent) {
+	supported := make([]InputEvent, 0, len(events))
+	for _, e := range events {
+		if !c.supported(e) {
+			slog.Debug("drop input event, the server does not support it", "type", e.MessageType())
+			continue
+		}
+		supported = append(supported, e)
+	}
+	if len(supported) == 0 {
+		return
+	}
+
+	if !c.fastPathInput() {
+		p := &ClientInputEventPDU{}
+		p.NumEvents = uint16(len(supported))
+		p.SlowPathInputEvents = make([]SlowPathInputEvent, 0, p.NumEvents)
+		for _, in := range supported {
+			seria := in.Serialize()
+			p.SlowPathInputEvents = append(p.SlowPathInputEvents, SlowPathInputEvent{0, in.MessageType(), len(seria), seria})
+		}
+		c.sendDataPDU(p)
+		return
+	}
+
+	for len(supported) > 0 {
+		n := min(len(supported), FASTPATH_INPUT_MAX_EVENTS)
+		buff := &bytes.Buffer{}
+		for _, in := range supported[:n] {
+			in.writeFastPath(buff)
+		}
+		if _, err := c.fastPathSender.SendFastPath(byte(n)<<2, buff.Bytes()); err != nil {
+			slog.Error("SendInput", "err", err)
+			return
+		}
+		supported = supported[n:]
+	}
+}
+
+// RecvFastPath emits the fast-path input events like the slow-path ones
+func (s *Server) RecvFastPath(secFlag byte, b []byte) {
+	r := bytes.NewReader(b)
+	numEvents := int(secFlag>>2) & 0xf
+	if numEvents == 0 {
+		n, err := core.ReadBytes(1, r)
+		if err != nil {
+			slog.Warn("RecvFastPath", "err", err)
+			return
+		}
+		numEvents = int(n[0])
+	}
+	for i := 0; i < numEvents; i++ {
+		event, err := readFastPathInputEvent(r)
+		if err != nil {
+			slog.Warn("RecvFastPath", "err", err)
+			return
+		}
+		s.Emit("input", event.MessageType(), event)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"reflect"
 
 	"github.com/sergei-bronnikov/grdp/core"
 )
@@ -40,11 +41,11 @@ const (
 	//ORDER_TYPE_MULTIPATBLT        = 0x10 //16
 	//ORDER_TYPE_MULTISCRBLT        = 0x11 //17
 	//ORDER_TYPE_MULTIOPAQUERECT    = 0x12 //18
-	//ORDER_TYPE_FAST_INDEX         = 0x13 //19
+	ORDER_TYPE_FAST_INDEX = 0x13 //19
 	ORDER_TYPE_POLYGON_SC = 0x14 //20
 	ORDER_TYPE_POLYGON_CB = 0x15 //21
 	ORDER_TYPE_POLYLINE   = 0x16 //22
-	//ORDER_TYPE_FAST_GLYPH         = 0x18 //24
+	ORDER_TYPE_FAST_GLYPH = 0x18 //24
 	ORDER_TYPE_ELLIPSE_SC = 0x19 //25
 	ORDER_TYPE_ELLIPSE_CB = 0x1A //26
 	ORDER_TYPE_TEXT2      = 0x1B //27
@@ -137,6 +138,9 @@ type Altsec struct {
 }
 
 type Secondary struct {
+	OrderType uint8
+	// the decoded order, nil for the unsupported ones
+	Data interface{}
 }
 
 type Primary struct {
@@ -155,6 +159,10 @@ func (*FastPathOrdersPDU) FastPathUpdateType() uint8 {
 
 func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
 	f.NumberOrders, _ = core.ReadUint16LE(r)
+	return f.readOrders(r)
+}
+
+func (f *FastPathOrdersPDU) readOrders(r io.Reader) error {
 	//slog.Info("NumberOrders:", f.NumberOrders)
 	for i := 0; i < int(f.NumberOrders); i++ {
 		var o OrderPdu
@@ -181,6 +189,21 @@ func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
 	}
 	return nil
 }
+
+// SlowPathOrdersPDU is the orders update of the share data PDU, the count is padded
+type SlowPathOrdersPDU struct {
+	FastPathOrdersPDU
+}
+
+func (f *SlowPathOrdersPDU) Unpack(r io.Reader) error {
+	// pad2OctetsA
+	core.ReadUint16LE(r)
+	f.NumberOrders, _ = core.ReadUint16LE(r)
+	// pad2OctetsB
+	core.ReadUint16LE(r)
+	return f.readOrders(r)
+}
+
 func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 	orderType := o.ControlFlags >> 2
 	//slog.Info("Altsec:", orderType)
@@ -205,12 +228,14 @@ func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 	return nil
 }
 func (o *OrderPdu) processSecondaryOrder(r io.Reader) error {
-	var sec Secondary
+	sec := &Secondary{}
+	o.Secondary = sec
 	length, _ := core.ReadUint16LE(r)
 	flags, _ := core.ReadUint16LE(r)
 	orderType, _ := core.ReadUInt8(r)
+	sec.OrderType = orderType
 
-	slog.Info("processSecondaryOrder", "SecondaryOrderType", SecondaryOrderType(orderType))
+	slog.Debug("processSecondaryOrder", "SecondaryOrderType", SecondaryOrderType(orderType))
 
 	b, _ := core.ReadBytes(int(length)+13-6, r)
 	r0 := bytes.NewReader(b)
@@ -244,26 +269,26 @@ func (b *Bounds) updateBounds(r io.Reader) {
 	present, _ := core.ReadUInt8(r)
 
 	if present&1 != 0 {
-		readOrderCoord(r, &b.left, false)
+		readOrderCoord(r, &b.Left, false)
 	} else if present&16 != 0 {
-		readOrderCoord(r, &b.left, true)
+		readOrderCoord(r, &b.Left, true)
 	}
 
 	if present&2 != 0 {
-		readOrderCoord(r, &b.top, false)
+		readOrderCoord(r, &b.Top, false)
 	} else if present&32 != 0 {
-		readOrderCoord(r, &b.top, true)
+		readOrderCoord(r, &b.Top, true)
 	}
 
 	if present&4 != 0 {
-		readOrderCoord(r, &b.right, false)
+		readOrderCoord(r, &b.Right, false)
 	} else if present&64 != 0 {
-		readOrderCoord(r, &b.right, true)
+		readOrderCoord(r, &b.Right, true)
 	}
 	if present&8 != 0 {
-		readOrderCoord(r, &b.bottom, false)
+		readOrderCoord(r, &b.Bottom, false)
 	} else if present&128 != 0 {
-		readOrderCoord(r, &b.bottom, true)
+		readOrderCoord(r, &b.Bottom, true)
 	}
 }
 
@@ -275,6 +300,8 @@ type PrimaryOrder interface {
 var (
 	orderType uint8
 	bounds    Bounds
+	// the last order of every type, the fields an order omits keep their previous value
+	primaryOrders = make(map[uint8]PrimaryOrder)
 )
 
 func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
@@ -287,7 +314,8 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 	case ORDER_TYPE_MEM3BLT, ORDER_TYPE_TEXT2:
 		size = 3
 
-	case ORDER_TYPE_PATBLT, ORDER_TYPE_MEMBLT, ORDER_TYPE_LINETO, ORDER_TYPE_POLYGON_CB, ORDER_TYPE_ELLIPSE_CB:
+	case ORDER_TYPE_PATBLT, ORDER_TYPE_MEMBLT, ORDER_TYPE_LINETO, ORDER_TYPE_POLYGON_CB, ORDER_TYPE_ELLIPSE_CB,
+		ORDER_TYPE_FAST_INDEX, ORDER_TYPE_FAST_GLYPH:
 		size = 2
 	}
 
@@ -357,7 +385,8 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 
 	//case ORDER_TYPE_MULTIOPAQUERECT:
 
-	//case ORDER_TYPE_FAST_INDEX:
+	case ORDER_TYPE_FAST_INDEX:
+		p = &FastIndex{}
 
 	case ORDER_TYPE_POLYGON_SC:
 		p = &PolygonSc{}
@@ -368,7 +397,8 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 	case ORDER_TYPE_POLYLINE:
 		p = &Polyline{}
 
-	//case ORDER_TYPE_FAST_GLYPH:
+	case ORDER_TYPE_FAST_GLYPH:
+		p = &FastGlyph{}
 
 	case ORDER_TYPE_ELLIPSE_SC:
 		p = &EllipeSc{}
@@ -377,16 +407,18 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 		p = &EllipeCb{}
 
 	case ORDER_TYPE_TEXT2:
-		p = &GlayphIndex{}
+		p = &GlyphIndex{}
 	default:
 		slog.Error("processPrimaryOrder", "orderType", orderType)
 		return errors.New("Not Support order type")
 	}
-	if p != nil {
-		if err := p.Unpack(r, present, delta); err != nil {
-			return err
-		}
+	if last, ok := primaryOrders[orderType]; ok {
+		reflect.ValueOf(p).Elem().Set(reflect.ValueOf(last).Elem())
 	}
+	if err := p.Unpack(r, present, delta); err != nil {
+		return err
+	}
+	primaryOrders[orderType] = p
 
 	o.Primary.Data = p
 	return nil
@@ -402,80 +434,100 @@ func readOrderCoord(r io.Reader, coord *int32, delta bool) {
 }
 
 type Dstblt struct {
-	x      int32
-	y      int32
-	cx     int32
-	cy     int32
-	opcode uint8
+	X      int32
+	Y      int32
+	Cx     int32
+	Cy     int32
+	Opcode uint8
 }
 
 func (d *Dstblt) Type() int {
 	return ORDER_TYPE_DSTBLT
 }
 func (d *Dstblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Info("Dstblt Order")
+	slog.Debug("Dstblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	return nil
 }
 
 type Patblt struct {
-	x        int32
-	y        int32
-	cx       int32
-	cy       int32
-	opcode   uint8
-	bgcolour [4]uint8
-	fgcolour [4]uint8
-	brush    Brush
+	X        int32
+	Y        int32
+	Cx       int32
+	Cy       int32
+	Opcode   uint8
+	Bgcolour [4]uint8
+	Fgcolour [4]uint8
+	Brush    Brush
 }
 
 func (d *Patblt) Type() int {
 	return ORDER_TYPE_PATBLT
 }
 func (d *Patblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Info("Patblt Order")
+	slog.Debug("Patblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	if present&0x0020 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.bgcolour[0], d.bgcolour[1], d.bgcolour[2], d.bgcolour[3] = b, g, r, a
+		d.Bgcolour = readOrderColor(r)
 	}
 	if present&0x0040 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.fgcolour[0], d.fgcolour[1], d.fgcolour[2], d.fgcolour[3] = b, g, r, a
+		d.Fgcolour = readOrderColor(r)
 	}
-	d.brush.updateBrush(r, present>>7)
+	d.Brush.updateBrush(r, present>>7)
 
 	return nil
 }
 
+/**
+ * Brush styles and hatches of the drawing orders
+ * @see MS-RDPEGDI 2.2.2.2.1.1.2.7 Brush
+ */
+const (
+	BS_SOLID   = 0x00
+	BS_NULL    = 0x01
+	BS_HATCHED = 0x02
+	BS_PATTERN = 0x03
+	// the brush is an entry of the brush cache
+	CACHED_BRUSH = 0x80
+)
+
+const (
+	HS_HORIZONTAL = 0x00
+	HS_VERTICAL   = 0x01
+	HS_FDIAGONAL  = 0x02
+	HS_BDIAGONAL  = 0x03
+	HS_CROSS      = 0x04
+	HS_DIAGCROSS  = 0x05
+)
+
 type Brush struct {
 	X     uint8
 	Y     uint8
@@ -501,11 +553,14 @@ func (b *Brush) updateBrush(r io.Reader, present uint32) {
 		b.Hatch, _ = core.ReadUInt8(r)
 	}
 
+	// the hatch is the first row of a pattern, BrushExtra holds the others from the last one
 	if present&16 != 0 {
-		data, _ := core.ReadBytes(7, r)
-		b.Data = make([]byte, 0, 8)
-		b.Data = append(b.Data, b.Hatch)
-		b.Data = append(b.Data, data...)
+		extra, _ := core.ReadBytes(7, r)
+		b.Data = make([]byte, 8)
+		b.Data[0] = b.Hatch
+		for i, v := range extra {
+			b.Data[7-i] = v
+		}
 	}
 }
 
@@ -523,10 +578,8 @@ func (d *Scrblt) Type() int {
 	return ORDER_TYPE_SCRBLT
 }
 
-var d Scrblt
-
-func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Info("Scrblt Order")
+func (d *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
+	slog.Debug("Scrblt Order")
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -548,7 +601,6 @@ func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0040 != 0 {
 		readOrderCoord(r, &d.Srcy, delta)
 	}
-	*d1 = d
 	return nil
 }
 
@@ -567,7 +619,7 @@ func (d *LineTo) Type() int {
 	return ORDER_TYPE_LINETO
 }
 func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Info("LineTo Order")
+	slog.Debug("LineTo Order")
 	if present&0x0001 != 0 {
 		d.Mixmode, _ = core.ReadUint16LE(r)
 	}
@@ -584,8 +636,7 @@ func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
 		readOrderCoord(r, &d.Endy, delta)
 	}
 	if present&0x0020 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+		d.Bgcolour = readOrderColor(r)
 	}
 	if present&0x0040 != 0 {
 		d.Opcode, _ = core.ReadUInt8(r)
@@ -596,6 +647,11 @@ func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
 	return nil
 }
 
+const (
+	PS_SOLID = 0x00
+	PS_NULL  = 0x05
+)
+
 type Pen struct {
 	Style  uint8
 	Width  uint8
@@ -612,8 +668,7 @@ func (d *Pen) updatePen(r io.Reader, present uint32) {
 	}
 
 	if present&4 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Colour[0], d.Colour[1], d.Colour[2], d.Colour[3] = b, g, r, a
+		d.Colour = readOrderColor(r)
 	}
 }
 
@@ -629,7 +684,7 @@ func (d *OpaqueRect) Type() int {
 	return ORDER_TYPE_OPAQUERECT
 }
 func (d *OpaqueRect) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Info("OpaqueRect Order")
+	slog.Debug("OpaqueRect Order")
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -785,12 +840,10 @@ func (d *Mem3blt) Unpack(r io.Reader, present uint32, delta bool) error {
 		readOrderCoord(r, &d.Srcy, delta)
 	}
 	if present&0x000100 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+		d.Bgcolour = readOrderColor(r)
 	}
 	if present&0x000200 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+		d.Fgcolour = readOrderColor(r)
 	}
 	d.Brush.updateBrush(r, present>>10)
 	if present&0x008000 != 0 {
@@ -835,8 +888,7 @@ func (d *PolygonSc) Unpack(r io.Reader, present uint32, delta bool) error {
 		d.Fillmode, _ = core.ReadUInt8(r)
 	}
 	if present&0x0010 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+		d.Fgcolour = readOrderColor(r)
 	}
 	if present&0x0020 != 0 {
 		d.Npoints, _ = core.ReadUInt8(r)
@@ -920,26 +972,262 @@ func (d *EllipeCb) Unpack(r io.Reader, present uint32, delta bool) error {
 	return nil
 }
 
-type GlayphIndex struct {
-}
+/**
+ * Flags of the text orders
+ * @see MS-RDPEGDI 2.2.2.2.1.1.2.13 GlyphIndex
+ */
+const (
+	SO_FLAG_DEFAULT_PLACEMENT = 0x01
+	SO_HORIZONTAL             = 0x02
+	SO_VERTICAL               = 0x04
+	SO_REVERSED               = 0x08
+	SO_ZERO_BEARINGS          = 0x10
+	SO_CHAR_INC_EQUAL_BM_BASE = 0x20
+	SO_MAXEXT_EQUAL_BM_SIDE   = 0x40
+)
 
-func (d *GlayphIndex) Type() int {
+// GlyphIndex draws the glyphs of a cache, the glyphs take BackColor and the opaque
+// rectangle ForeColor. Its rectangles are inclusive.
+type GlyphIndex struct {
+	CacheId      uint8
+	FlAccel      uint8
+	UlCharInc    uint8
+	FOpRedundant uint8
+	BackColor    [4]uint8
+	ForeColor    [4]uint8
+	BkLeft       int32
+	BkTop        int32
+	BkRight      int32
+	BkBottom     int32
+	OpLeft       int32
+	OpTop        int32
+	OpRight      int32
+	OpBottom     int32
+	Brush        Brush
+	X            int32
+	Y            int32
+	Data         []byte
+}
+
+func (d *GlyphIndex) Type() int {
 	return ORDER_TYPE_TEXT2
 }
-func (d *GlayphIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+func (d *GlyphIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+	slog.Debug("GlyphIndex Order")
+	if present&0x000001 != 0 {
+		d.CacheId, _ = core.ReadUInt8(r)
+	}
+	if present&0x000002 != 0 {
+		d.FlAccel, _ = core.ReadUInt8(r)
+	}
+	if present&0x000004 != 0 {
+		d.UlCharInc, _ = core.ReadUInt8(r)
+	}
+	if present&0x000008 != 0 {
+		d.FOpRedundant, _ = core.ReadUInt8(r)
+	}
+	if present&0x000010 != 0 {
+		d.BackColor = readOrderColor(r)
+	}
+	if present&0x000020 != 0 {
+		d.ForeColor = readOrderColor(r)
+	}
+	// the rectangles and the origin are never delta encoded
+	fields := []*int32{&d.BkLeft, &d.BkTop, &d.BkRight, &d.BkBottom, &d.OpLeft, &d.OpTop, &d.OpRight, &d.OpBottom}
+	for i, v := range fields {
+		if present&(0x40<<i) != 0 {
+			readOrderCoord(r, v, false)
+		}
+	}
+	d.Brush.updateBrush(r, present>>14)
+	if present&0x080000 != 0 {
+		readOrderCoord(r, &d.X, false)
+	}
+	if present&0x100000 != 0 {
+		readOrderCoord(r, &d.Y, false)
+	}
+	if present&0x200000 != 0 {
+		d.Data = readOrderData(r)
+	}
+	return nil
+}
+
+// FastIndex is a GlyphIndex without brush, its rectangles are exclusive
+type FastIndex struct {
+	CacheId   uint8
+	UlCharInc uint8
+	FlAccel   uint8
+	BackColor [4]uint8
+	ForeColor [4]uint8
+	BkLeft    int32
+	BkTop     int32
+	BkRight   int32
+	BkBottom  int32
+	OpLeft    int32
+	OpTop     int32
+	OpRight   int32
+	OpBottom  int32
+	X         int32
+	Y         int32
+	Data      []byte
+}
+
+func (d *FastIndex) Type() int {
+	return ORDER_TYPE_FAST_INDEX
+}
+func (d *FastIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+	slog.Debug("FastIndex Order")
+	readFastTextFields(r, present, delta, &d.CacheId, &d.UlCharInc, &d.FlAccel, &d.BackColor, &d.ForeColor,
+		[]*int32{&d.BkLeft, &d.BkTop, &d.BkRight, &d.BkBottom, &d.OpLeft, &d.OpTop, &d.OpRight, &d.OpBottom, &d.X, &d.Y})
+	if present&0x4000 != 0 {
+		d.Data = readOrderData(r)
+	}
 	return nil
 }
 
+// FastGlyph draws a single glyph, which it may also add to the glyph cache
+type FastGlyph struct {
+	CacheId    uint8
+	UlCharInc  uint8
+	FlAccel    uint8
+	BackColor  [4]uint8
+	ForeColor  [4]uint8
+	BkLeft     int32
+	BkTop      int32
+	BkRight    int32
+	BkBottom   int32
+	OpLeft     int32
+	OpTop      int32
+	OpRight    int32
+	OpBottom   int32
+	X          int32
+	Y          int32
+	CacheIndex uint8
+	// Glyph is nil when the order draws a cached glyph
+	Glyph *Glyph
+}
+
+func (d *FastGlyph) Type() int {
+	return ORDER_TYPE_FAST_GLYPH
+}
+func (d *FastGlyph) Unpack(r io.Reader, present uint32, delta bool) error {
+	slog.Debug("FastGlyph Order")
+	readFastTextFields(r, present, delta, &d.CacheId, &d.UlCharInc, &d.FlAccel, &d.BackColor, &d.ForeColor,
+		[]*int32{&d.BkLeft, &d.BkTop, &d.BkRight, &d.BkBottom, &d.OpLeft, &d.OpTop, &d.OpRight, &d.OpBottom, &d.X, &d.Y})
+	if present&0x4000 == 0 {
+		return nil
+	}
+	data := readOrderData(r)
+	if len(data) == 0 {
+		return errors.New("empty FastGlyph data")
+	}
+	d.CacheIndex = data[0]
+	d.Glyph = nil
+	if len(data) == 1 {
+		return nil
+	}
+	gr := bytes.NewReader(data[1:])
+	g := &Glyph{CacheIndex: uint16(data[0])}
+	g.X = readTwoByteSigned(gr)
+	g.Y = readTwoByteSigned(gr)
+	g.Cx = readTwoByteUnsigned(gr)
+	g.Cy = readTwoByteUnsigned(gr)
+	var err error
+	g.Aj, err = readBytes(glyphDataSize(g.Cx, g.Cy), gr)
+	if err != nil {
+		return err
+	}
+	// the unicode character that may follow is not used
+	d.Glyph = g
+	return nil
+}
+
+// readFastTextFields reads the fields shared by FastIndex and FastGlyph, coords are
+// the rectangles then the origin
+func readFastTextFields(r io.Reader, present uint32, delta bool, cacheId, ulCharInc, flAccel *uint8, back, fore *[4]uint8, coords []*int32) {
+	if present&0x0001 != 0 {
+		*cacheId, _ = core.ReadUInt8(r)
+	}
+	if present&0x0002 != 0 {
+		*ulCharInc, _ = core.ReadUInt8(r)
+		*flAccel, _ = core.ReadUInt8(r)
+	}
+	if present&0x0004 != 0 {
+		*back = readOrderColor(r)
+	}
+	if present&0x0008 != 0 {
+		*fore = readOrderColor(r)
+	}
+	for i, v := range coords {
+		if present&(0x10<<i) != 0 {
+			readOrderCoord(r, v, delta)
+		}
+	}
+}
+
+// readOrderData reads the variable bytes of an order, prefixed by their length
+func readOrderData(r io.Reader) []byte {
+	n, _ := core.ReadUInt8(r)
+	data, _ := core.ReadBytes(int(n), r)
+	return data
+}
+
+// readOrderColor reads a TS_COLOR, the bytes of the color or of its palette index
+func readOrderColor(r io.Reader) [4]uint8 {
+	var c [4]uint8
+	c[0], _ = core.ReadUInt8(r)
+	c[1], _ = core.ReadUInt8(r)
+	c[2], _ = core.ReadUInt8(r)
+	c[3] = 255
+	return c
+}
+
 /*Secondary*/
+
+// readTwoByteUnsigned reads a TWO_BYTE_UNSIGNED_ENCODING value of the cache orders
+func readTwoByteUnsigned(r io.Reader) uint16 {
+	b, _ := core.ReadUInt8(r)
+	if b&0x80 == 0 {
+		return uint16(b)
+	}
+	lo, _ := core.ReadUInt8(r)
+	return uint16(b&0x7f)<<8 | uint16(lo)
+}
+
+// readTwoByteSigned reads a TWO_BYTE_SIGNED_ENCODING value, bit 6 of the first byte is the sign
+func readTwoByteSigned(r io.Reader) int16 {
+	b, _ := core.ReadUInt8(r)
+	v := int16(b & 0x3f)
+	if b&0x80 != 0 {
+		lo, _ := core.ReadUInt8(r)
+		v = v<<8 | int16(lo)
+	}
+	if b&0x40 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// readFourByteUnsigned reads a FOUR_BYTE_UNSIGNED_ENCODING value, the top bits count the extra bytes
+func readFourByteUnsigned(r io.Reader) uint32 {
+	b, _ := core.ReadUInt8(r)
+	v := uint32(b & 0x3f)
+	for i := 0; i < int(b>>6); i++ {
+		next, _ := core.ReadUInt8(r)
+		v = v<<8 | uint32(next)
+	}
+	return v
+}
+
 func (s *Secondary) updateCacheBitmapOrder(r io.Reader, compressed bool, flags uint16) {
 	var cb CacheBitmapOrder
-	cb.cacheId, _ = core.ReadUInt8(r)
+	cb.CacheId, _ = core.ReadUInt8(r)
 	core.ReadUInt8(r)
-	cb.bitmapWidth, _ = core.ReadUInt8(r)
-	cb.bitmapHeight, _ = core.ReadUInt8(r)
-	cb.bitmapBpp, _ = core.ReadUInt8(r)
+	cb.BitmapWidth, _ = core.ReadUInt8(r)
+	cb.BitmapHeight, _ = core.ReadUInt8(r)
+	cb.BitmapBpp, _ = core.ReadUInt8(r)
 	bitmapLength, _ := core.ReadUint16LE(r)
-	cb.cacheIndex, _ = core.ReadUint16LE(r)
+	cb.CacheIndex, _ = core.ReadUint16LE(r)
 	var bitmapComprHdr []byte
 	if compressed {
 		if (flags & NO_BITMAP_COMPRESSION_HDR) == 0 {
@@ -947,21 +1235,23 @@ func (s *Secondary) updateCacheBitmapOrder(r io.Reader, compressed bool, flags u
 			bitmapLength -= 8
 		}
 	}
-	cb.bitmapComprHdr = bitmapComprHdr
-	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
-	cb.bitmapLength = bitmapLength
-
+	cb.BitmapComprHdr = bitmapComprHdr
+	cb.BitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
+	cb.BitmapLength = bitmapLength
+	cb.Compressed = compressed
+	s.Data = &cb
 }
 
 type CacheBitmapOrder struct {
-	cacheId          uint8
-	bitmapBpp        uint8
-	bitmapWidth      uint8
-	bitmapHeight     uint8
-	bitmapLength     uint16
-	cacheIndex       uint16
-	bitmapComprHdr   []byte
-	bitmapDataStream []byte
+	CacheId          uint8
+	BitmapBpp        uint8
+	BitmapWidth      uint8
+	BitmapHeight     uint8
+	BitmapLength     uint16
+	CacheIndex       uint16
+	Compressed       bool
+	BitmapComprHdr   []byte
+	BitmapDataStream []byte
 }
 
 func getCbV2Bpp(bpp uint32) (b uint32) {
@@ -980,112 +1270,168 @@ func getCbV2Bpp(bpp uint32) (b uint32) {
 	return
 }
 
+// BITMAPCACHE_WAITING_LIST_INDEX is the cell of the bitmaps the server does not keep
+const BITMAPCACHE_WAITING_LIST_INDEX = 0x7FFF
+
 type CacheBitmapV2Order struct {
-	cacheId            uint32
-	flags              uint32
-	key1               uint32
-	key2               uint32
-	bitmapBpp          uint32
-	bitmapWidth        uint8
-	bitmapHeight       uint8
-	bitmapLength       uint16
-	cacheIndex         uint32
-	compressed         bool
-	cbCompFirstRowSize uint16
-	cbCompMainBodySize uint16
-	cbScanWidth        uint16
-	cbUncompressedSize uint16
-	bitmapDataStream   []byte
+	CacheId            uint32
+	Flags              uint32
+	Key1               uint32
+	Key2               uint32
+	BitmapBpp          uint32
+	BitmapWidth        uint16
+	BitmapHeight       uint16
+	BitmapLength       uint32
+	CacheIndex         uint32
+	Compressed         bool
+	CbCompFirstRowSize uint16
+	CbCompMainBodySize uint16
+	CbScanWidth        uint16
+	CbUncompressedSize uint16
+	BitmapDataStream   []byte
 }
 
 func (s *Secondary) updateCacheBitmapV2Order(r io.Reader, compressed bool, flags uint16) {
 	var cb CacheBitmapV2Order
-	cb.cacheId = uint32(flags) & 0x0003
-	cb.flags = (uint32(flags) & 0xFF80) >> 7
+	cb.CacheId = uint32(flags) & 0x0003
+	cb.Flags = (uint32(flags) & 0xFF80) >> 7
 	bitsPerPixelId := (uint32(flags) & 0x0078) >> 3
-	cb.bitmapBpp = getCbV2Bpp(bitsPerPixelId)
+	cb.BitmapBpp = getCbV2Bpp(bitsPerPixelId)
 
-	if cb.flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
-		cb.key1, _ = core.ReadUInt32LE(r)
-		cb.key2, _ = core.ReadUInt32LE(r)
+	if cb.Flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
+		cb.Key1, _ = core.ReadUInt32LE(r)
+		cb.Key2, _ = core.ReadUInt32LE(r)
 	}
 
-	if cb.flags&CBR2_HEIGHT_SAME_AS_WIDTH != 0 {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
-		cb.bitmapHeight = cb.bitmapWidth
+	cb.BitmapWidth = readTwoByteUnsigned(r)
+	if cb.Flags&CBR2_HEIGHT_SAME_AS_WIDTH != 0 {
+		cb.BitmapHeight = cb.BitmapWidth
 	} else {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
-		cb.bitmapHeight, _ = core.ReadUInt8(r)
+		cb.BitmapHeight = readTwoByteUnsigned(r)
 	}
 
-	bitmapLength, _ := core.ReadUint16LE(r)
-	cacheIndex, _ := core.ReadUInt8(r)
+	bitmapLength := readFourByteUnsigned(r)
+	cacheIndex := readTwoByteUnsigned(r)
 
-	if cb.flags&CBR2_DO_NOT_CACHE != 0 {
-		cb.cacheIndex = 0x7FFF
+	if cb.Flags&CBR2_DO_NOT_CACHE != 0 {
+		cb.CacheIndex = BITMAPCACHE_WAITING_LIST_INDEX
 	} else {
-		cb.cacheIndex = uint32(cacheIndex)
+		cb.CacheIndex = uint32(cacheIndex)
 	}
 
 	if compressed {
-		if cb.flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0 {
-			cb.cbCompFirstRowSize, _ = core.ReadUint16LE(r)
-			cb.cbCompMainBodySize, _ = core.ReadUint16LE(r)
-			cb.cbScanWidth, _ = core.ReadUint16LE(r)
-			cb.cbUncompressedSize, _ = core.ReadUint16LE(r)
-			bitmapLength = cb.cbCompMainBodySize
+		if cb.Flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0 {
+			cb.CbCompFirstRowSize, _ = core.ReadUint16LE(r)
+			cb.CbCompMainBodySize, _ = core.ReadUint16LE(r)
+			cb.CbScanWidth, _ = core.ReadUint16LE(r)
+			cb.CbUncompressedSize, _ = core.ReadUint16LE(r)
+			bitmapLength = uint32(cb.CbCompMainBodySize)
 		}
 	}
 
-	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
-	cb.bitmapLength = bitmapLength
-	cb.compressed = compressed
+	cb.BitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
+	cb.BitmapLength = bitmapLength
+	cb.Compressed = compressed
+	s.Data = &cb
+}
 
+// Key is the 64-bit key of the persistent bitmap cache
+func (cb *CacheBitmapV2Order) Key() uint64 {
+	return uint64(cb.Key2)<<32 | uint64(cb.Key1)
 }
 
 type CacheBitmapV3Order struct {
-	cacheId    uint32
-	bpp        uint32
-	flags      uint32
-	cacheIndex uint16
-	key1       uint32
-	key2       uint32
-	bitmapData BitmapDataEx
+	CacheId    uint32
+	Bpp        uint32
+	Flags      uint32
+	CacheIndex uint16
+	Key1       uint32
+	Key2       uint32
+	BitmapData BitmapDataEx
+}
+
+// Key is the 64-bit key of the persistent bitmap cache
+func (cb *CacheBitmapV3Order) Key() uint64 {
+	return uint64(cb.Key2)<<32 | uint64(cb.Key1)
 }
+
+// BitmapDataEx is TS_BITMAP_DATA_EX, CodecID 0 is an uncompressed bottom-up bitmap
 type BitmapDataEx struct {
-	bpp     uint8
-	codecID uint8
-	width   uint16
-	height  uint16
-	length  uint32
-	data    []byte
+	Bpp     uint8
+	Flags   uint8
+	CodecID uint8
+	Width   uint16
+	Height  uint16
+	Length  uint32
+	Data    []byte
+}
+
+func readBitmapDataEx(r io.Reader, b *BitmapDataEx) error {
+	header, err := core.ReadBytes(12, r)
+	if err != nil {
+		return err
+	}
+	hr := bytes.NewReader(header)
+	b.Bpp, _ = core.ReadUInt8(hr)
+	b.Flags, _ = core.ReadUInt8(hr)
+	core.ReadUInt8(hr)
+	b.CodecID, _ = core.ReadUInt8(hr)
+	b.Width, _ = core.ReadUint16LE(hr)
+	b.Height, _ = core.ReadUint16LE(hr)
+	b.Length, _ = core.ReadUInt32LE(hr)
+	n := int(b.Length)
+	if b.Flags&EX_COMPRESSED_BITMAP_HEADER_PRESENT != 0 {
+		// TS_COMPRESSED_BITMAP_HEADER_EX, the timestamps are not used
+		if _, err = core.ReadBytes(24, r); err != nil {
+			return err
+		}
+		n -= 24
+	}
+	if n < 0 {
+		return errors.New("invalid bitmap data length")
+	}
+	// codec 0 is uncompressed
+	if b.CodecID == 0 && n > int(b.Width)*int(b.Height)*((int(b.Bpp)+7)/8) {
+		return errors.New("bitmap data longer than the bitmap")
+	}
+	b.Data, err = readBytes(n, r)
+	return err
+}
+
+// readBytes reads n bytes of r, which are only allocated once they are known to be
+// there. The sizes of bitmaps and glyphs read from the orders go through it.
+func readBytes(n int, r io.Reader) ([]byte, error) {
+	if l, ok := r.(interface{ Len() int }); ok {
+		if n > l.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return core.ReadBytes(n, r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err == nil && len(b) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
 }
 
 func (s *Secondary) updateCacheBitmapV3Order(r io.Reader, flags uint16) {
 	var cb CacheBitmapV3Order
 
-	cb.cacheId = uint32(flags) & 0x00000003
-	cb.flags = (uint32(flags) & 0x0000FF80) >> 7
+	cb.CacheId = uint32(flags) & 0x00000003
+	cb.Flags = (uint32(flags) & 0x0000FF80) >> 7
 	bitsPerPixelId := (uint32(flags) & 0x00000078) >> 3
-	cb.bpp = getCbV2Bpp(bitsPerPixelId)
+	cb.Bpp = getCbV2Bpp(bitsPerPixelId)
 
 	cacheIndex, _ := core.ReadUint16LE(r)
-	cb.cacheIndex = cacheIndex
-	cb.key1, _ = core.ReadUInt32LE(r)
-	cb.key2, _ = core.ReadUInt32LE(r)
-
-	bitmapData := &cb.bitmapData
-	bitmapData.bpp, _ = core.ReadUInt8(r)
-	core.ReadUInt8(r)
-	core.ReadUInt8(r)
-	bitmapData.codecID, _ = core.ReadUInt8(r)
-	bitmapData.width, _ = core.ReadUint16LE(r)
-	bitmapData.height, _ = core.ReadUint16LE(r)
-	new_len, _ := core.ReadUInt32LE(r)
-
-	bitmapData.data, _ = core.ReadBytes(int(new_len), r)
-	bitmapData.length = new_len
+	cb.CacheIndex = cacheIndex
+	cb.Key1, _ = core.ReadUInt32LE(r)
+	cb.Key2, _ = core.ReadUInt32LE(r)
 
+	if err := readBitmapDataEx(r, &cb.BitmapData); err != nil {
+		slog.Warn("cache bitmap v3", "err", err)
+		return
+	}
+	s.Data = &cb
 }
 
 type CacheColorTableOrder struct {
@@ -1117,41 +1463,78 @@ func updateReadColorRef(r io.Reader) (uint8, uint8, uint8, uint8) {
 	return blue, green, red, 255
 }
 
-type CacheGlyphOrder struct {
-	cacheId uint8
-	nglyphs uint8
-	glyphs  []CacheGlyph
+// CG_GLYPH_UNICODE_PRESENT tells that the characters of the glyphs follow them
+const CG_GLYPH_UNICODE_PRESENT = 0x0010
+
+// Glyph is a monochrome glyph, its rows are padded to bytes. X and Y place it from
+// the origin of the text.
+type Glyph struct {
+	CacheIndex uint16
+	X          int16
+	Y          int16
+	Cx         uint16
+	Cy         uint16
+	Aj         []byte
 }
-type CacheGlyph struct {
-	character uint16
-	offset    uint16
-	baseline  uint16
-	width     uint16
-	height    uint16
-	datasize  int
-	data      []uint8
+
+// glyphDataSize is the size of the bitmap of a glyph, padded to 4 bytes
+func glyphDataSize(cx, cy uint16) int {
+	return ((int(cx)+7)/8*int(cy) + 3) &^ 3
+}
+
+// CacheGlyphOrder is the Cache Glyph order of both revisions
+type CacheGlyphOrder struct {
+	CacheId uint8
+	Glyphs  []Glyph
+	Unicode []uint16
 }
 
 func (s *Secondary) updateCacheGlyphOrder(r io.Reader, flags uint16) {
 	var cb CacheGlyphOrder
-
-	cb.cacheId, _ = core.ReadUInt8(r)
-	cb.nglyphs, _ = core.ReadUInt8(r)
-	cb.glyphs = make([]CacheGlyph, 0, cb.nglyphs)
-
-	for i := 0; i < int(cb.nglyphs); i++ {
-		var c CacheGlyph
-		c.character, _ = core.ReadUint16LE(r)
-		c.offset, _ = core.ReadUint16LE(r)
-		c.baseline, _ = core.ReadUint16LE(r)
-		c.width, _ = core.ReadUint16LE(r)
-		c.height, _ = core.ReadUint16LE(r)
-
-		c.datasize = int(c.height*((c.width+7)/8)+3) & ^3
-		c.data, _ = core.ReadBytes(c.datasize, r)
-
-		cb.glyphs = append(cb.glyphs, c)
+	var n int
+	if GlyphSupportLevel == GLYPH_SUPPORT_ENCODE {
+		// revision 2 packs the cache and the count in the extra flags
+		cb.CacheId = uint8(flags & 0x000F)
+		n = int(flags >> 8)
+	} else {
+		cb.CacheId, _ = core.ReadUInt8(r)
+		count, _ := core.ReadUInt8(r)
+		n = int(count)
+	}
+	cb.Glyphs = make([]Glyph, 0, n)
+
+	for i := 0; i < n; i++ {
+		var g Glyph
+		if GlyphSupportLevel == GLYPH_SUPPORT_ENCODE {
+			index, _ := core.ReadUInt8(r)
+			g.CacheIndex = uint16(index)
+			g.X = readTwoByteSigned(r)
+			g.Y = readTwoByteSigned(r)
+			g.Cx = readTwoByteUnsigned(r)
+			g.Cy = readTwoByteUnsigned(r)
+		} else {
+			g.CacheIndex, _ = core.ReadUint16LE(r)
+			x, _ := core.ReadUint16LE(r)
+			y, _ := core.ReadUint16LE(r)
+			g.X, g.Y = int16(x), int16(y)
+			g.Cx, _ = core.ReadUint16LE(r)
+			g.Cy, _ = core.ReadUint16LE(r)
+		}
+		var err error
+		g.Aj, err = readBytes(glyphDataSize(g.Cx, g.Cy), r)
+		if err != nil {
+			slog.Error("updateCacheGlyphOrder", "err", err)
+			return
+		}
+		cb.Glyphs = append(cb.Glyphs, g)
+	}
+	if flags&CG_GLYPH_UNICODE_PRESENT != 0 {
+		for range cb.Glyphs {
+			c, _ := core.ReadUint16LE(r)
+			cb.Unicode = append(cb.Unicode, c)
+		}
 	}
+	s.Data = &cb
 }
 
 type CacheBrushOrder struct {
@@ -1220,11 +1603,12 @@ func update_decompress_brush(in []uint8, bpp int) []uint8 {
 }
 
 /*Primary*/
+// Bounds clips a primary order, right and bottom are inclusive
 type Bounds struct {
-	left   int32
-	top    int32
-	right  int32
-	bottom int32
+	Left   int32
+	Top    int32
+	Right  int32
+	Bottom int32
 }
 type OrderInfo struct {
 	controlFlags     uint32
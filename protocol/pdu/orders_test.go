@@ -0,0 +1,162 @@
+package pdu
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestPrimaryOrderDelta(t *testing.T) {
+	b := []byte{
+		2, 0,
+		// OpaqueRect with every field
+		TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_OPAQUERECT, 0x7f,
+		10, 0, 20, 0, 5, 0, 6, 0, 1, 2, 3,
+		// moved by +2, -1, the size and color are repeated
+		TS_STANDARD | TS_DELTA_COORDINATES, 0x03, 2, 0xff,
+	}
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.OrderPdus) != 2 {
+		t.Fatal("orders", len(f.OrderPdus))
+	}
+	first := f.OrderPdus[0].Primary.Data.(*OpaqueRect)
+	second := f.OrderPdus[1].Primary.Data.(*OpaqueRect)
+	if *first != (OpaqueRect{10, 20, 5, 6, [4]uint8{1, 2, 3}}) {
+		t.Error("first", *first)
+	}
+	if *second != (OpaqueRect{12, 19, 5, 6, [4]uint8{1, 2, 3}}) {
+		t.Error("second", *second)
+	}
+}
+
+func TestPatbltOrder(t *testing.T) {
+	b := []byte{
+		1, 0,
+		TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_PATBLT, 0xff, 0x0f,
+		10, 0, 20, 0, 8, 0, 8, 0, 0xf0,
+		// TS_COLOR are 3 bytes
+		0x11, 0x22, 0x33, 0x44, 0x55, 0x66,
+		// pattern brush, the hatch is the first row and BrushExtra the last 7 reversed
+		0, 0, BS_PATTERN, 0x01, 0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02,
+	}
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	d, ok := f.OrderPdus[0].Primary.Data.(*Patblt)
+	if !ok {
+		t.Fatal("order", f.OrderPdus[0].Primary)
+	}
+	if d.X != 10 || d.Y != 20 || d.Cx != 8 || d.Cy != 8 || d.Opcode != 0xf0 {
+		t.Error("bounds", *d)
+	}
+	if d.Bgcolour != [4]uint8{0x11, 0x22, 0x33, 0xff} || d.Fgcolour != [4]uint8{0x44, 0x55, 0x66, 0xff} {
+		t.Error("colors", d.Bgcolour, d.Fgcolour)
+	}
+	if !bytes.Equal(d.Brush.Data, []byte{0x01, 0x02, 0x04, 0x08, 0x10, 0x20, 0x40, 0x80}) {
+		t.Errorf("brush rows % x", d.Brush.Data)
+	}
+}
+
+func TestCacheBitmapV2Order(t *testing.T) {
+	b := []byte{
+		1, 0,
+		// 20 bytes after the order type, cache 1 at 16 bpp with a persistent key
+		// and the height same as the width
+		TS_STANDARD | TS_SECONDARY, 20 - 7, 0, 0xa1, 0x01, ORDER_TYPE_BITMAP_UNCOMPRESSED_V2,
+		0x01, 0, 0, 0, 0x02, 0, 0, 0,
+		// width 2 and length 8 in one byte, index 0x1234 in two
+		2, 8, 0x92, 0x34,
+		1, 2, 3, 4, 5, 6, 7, 8,
+	}
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	cb, ok := f.OrderPdus[0].Secondary.Data.(*CacheBitmapV2Order)
+	if !ok {
+		t.Fatal("order", f.OrderPdus[0].Secondary)
+	}
+	if cb.CacheId != 1 || cb.BitmapBpp != 16 || cb.BitmapWidth != 2 || cb.BitmapHeight != 2 || cb.CacheIndex != 0x1234 {
+		t.Error("header", *cb)
+	}
+	if cb.Key() != 0x0000000200000001 || !bytes.Equal(cb.BitmapDataStream, b[len(b)-8:]) {
+		t.Error("data", *cb)
+	}
+}
+
+func TestPersistKeyPDU(t *testing.T) {
+	p := &PersistKeyPDU{NumEntriesCache2: 2, TotalEntriesCache2: 2, BBitMask: PERSIST_FIRST_PDU | PERSIST_LAST_PDU,
+		Entries: []PersistKeyEntry{{1, 2}, {3, 4}}}
+	buff := bytes.NewBuffer(p.Serialize())
+	if buff.Len() != 24+16 {
+		t.Fatal("length", buff.Len())
+	}
+	d := &PersistKeyPDU{}
+	if err := d.Unpack(buff); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, d) {
+		t.Error(d)
+	}
+}
+
+func TestGlyphOrders(t *testing.T) {
+	b := []byte{
+		2, 0,
+		// revision 2 Cache Glyph of one glyph in cache 3
+		TS_STANDARD | TS_SECONDARY, 9 - 7, 0, 0x03, 0x01, ORDER_TYPE_CACHE_GLYPH,
+		5, 0x00, 0x42, 8, 1, 0xff, 0, 0, 0,
+		// FastGlyph bringing glyph 9 of 3x2 at -1, -10
+		TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_FAST_GLYPH, 0x03, 0x70,
+		7, 0, SO_HORIZONTAL, 100, 0, 50, 0,
+		9, 9, 0x41, 0x4a, 3, 2, 0xa0, 0x40, 0, 0,
+	}
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	cg := f.OrderPdus[0].Secondary.Data.(*CacheGlyphOrder)
+	want := Glyph{CacheIndex: 5, X: 0, Y: -2, Cx: 8, Cy: 1, Aj: []byte{0xff, 0, 0, 0}}
+	if cg.CacheId != 3 || len(cg.Glyphs) != 1 || !reflect.DeepEqual(cg.Glyphs[0], want) {
+		t.Error("cache glyph", *cg)
+	}
+	fg := f.OrderPdus[1].Primary.Data.(*FastGlyph)
+	if fg.CacheId != 7 || fg.FlAccel != SO_HORIZONTAL || fg.X != 100 || fg.Y != 50 || fg.CacheIndex != 9 {
+		t.Error("fast glyph", *fg)
+	}
+	want = Glyph{CacheIndex: 9, X: -1, Y: -10, Cx: 3, Cy: 2, Aj: []byte{0xa0, 0x40, 0, 0}}
+	if fg.Glyph == nil || !reflect.DeepEqual(*fg.Glyph, want) {
+		t.Error("fast glyph bitmap", fg.Glyph)
+	}
+}
+
+func TestGlyphOrdersLength(t *testing.T) {
+	b := []byte{
+		1, 0,
+		// revision 2 Cache Glyph of 32767x32767 without its bitmap
+		TS_STANDARD | TS_SECONDARY, 7 - 7, 0, 0x03, 0x01, ORDER_TYPE_CACHE_GLYPH,
+		5, 0x00, 0x42, 0xff, 0xff, 0xff, 0xff,
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Error("allocated", n)
+	}
+	if d := f.OrderPdus[0].Secondary.Data; d != nil {
+		t.Error("cache glyph", d)
+	}
+	fg := &FastGlyph{}
+	if err := fg.Unpack(bytes.NewReader([]byte{7, 9, 0x41, 0x4a, 0xff, 0xff, 0xff, 0xff}), 0x4000, false); err == nil || fg.Glyph != nil {
+		t.Error("fast glyph", fg.Glyph)
+	}
+}
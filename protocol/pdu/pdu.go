@@ -2,11 +2,14 @@ package pdu
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"image"
 	"log/slog"
 
 	"github.com/sergei-bronnikov/grdp/core"
 	"github.com/sergei-bronnikov/grdp/emission"
+	"github.com/sergei-bronnikov/grdp/protocol/bulk"
 	"github.com/sergei-bronnikov/grdp/protocol/t125/gcc"
 )
 
@@ -20,12 +23,15 @@ type PDULayer struct {
 	clientCapabilities map[CapsType]Capability
 	fastPathSender     core.FastPathSender
 	demandActivePDU    *DemandActivePDU
+	// bulk decompresses the fast-path and slow-path updates
+	bulk *bulk.Decompressor
 }
 
 func NewPDULayer(t core.Transport) *PDULayer {
 	p := &PDULayer{
 		Emitter:   *emission.NewEmitter(),
 		transport: t,
+		bulk:      bulk.NewDecompressor(),
 		sharedId:  0x103EA,
 		serverCapabilities: map[CapsType]Capability{
 			CAPSTYPE_GENERAL: &GeneralCapability{
@@ -83,15 +89,15 @@ func NewPDULayer(t core.Transport) *PDULayer {
 			CAPSTYPE_GLYPHCACHE:      &GlyphCapability{},
 			CAPSETTYPE_BITMAP_CODECS: &BitmapCodecsCapability{},
 			CAPSTYPE_BITMAPCACHE_REV2: &BitmapCache2Capability{
-				BitmapCachePersist: 2,
+				BitmapCachePersist: ALLOW_CACHE_WAITING_LIST_FLAG,
 				CachesNum:          5,
-				BmpC0Cells:         0x258,
-				BmpC1Cells:         0x258,
-				BmpC2Cells:         0x800,
-				BmpC3Cells:         0x1000,
-				BmpC4Cells:         0x800,
+				BmpC0Cells:         BitmapCacheCells[0],
+				BmpC1Cells:         BitmapCacheCells[1],
+				BmpC2Cells:         BitmapCacheCells[2],
+				BmpC3Cells:         BitmapCacheCells[3],
+				BmpC4Cells:         BitmapCacheCells[4],
 			},
-			CAPSTYPE_VIRTUALCHANNEL:        &VirtualChannelCapability{0, 1600},
+			CAPSTYPE_VIRTUALCHANNEL:        &VirtualChannelCapability{VCCAPS_COMPR_SC, 1600},
 			CAPSETTYPE_MULTIFRAGMENTUPDATE: &MultiFragmentUpdate{65535},
 			CAPSTYPE_RAIL: &RemoteProgramsCapability{
 				RailSupportLevel: RAIL_LEVEL_SUPPORTED |
@@ -137,6 +143,9 @@ type Client struct {
 	*PDULayer
 	clientCoreData *gcc.ClientCoreData
 	buff           *bytes.Buffer
+	persistentKeys [][]uint64
+	// drawingOrders announces the orders only drawn on a framebuffer
+	drawingOrders bool
 }
 
 func NewClient(t core.Transport) *Client {
@@ -156,11 +165,59 @@ func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint
 	c.transport.Once("data", c.recvDemandActivePDU)
 }
 
+// SetPersistentKeys enables the persistent bitmap cache, keys are the cells the client
+// already holds, by cache and index. They are announced during the activation.
+func (c *Client) SetPersistentKeys(keys [][]uint64) {
+	c.persistentKeys = keys
+}
+
+// SetDrawingOrders announces the orders drawing from the bitmap and glyph caches
+// of the client, they are only painted by a framebuffer
+func (c *Client) SetDrawingOrders(enabled bool) {
+	c.drawingOrders = enabled
+}
+
+// SetBitmapCodecs announces the codecs the client decodes in the surface bits commands
+func (c *Client) SetBitmapCodecs(codecs []BitmapCodec) {
+	c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability).SupportedBitmapCodecs.Array = codecs
+}
+
+// ServerBitmapCodecs are the codec ids assigned by the server, by GUID
+func (c *Client) ServerBitmapCodecs() map[uint8][16]byte {
+	codecs := make(map[uint8][16]byte)
+	if caps, ok := c.serverCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability); ok {
+		for _, b := range caps.SupportedBitmapCodecs.Array {
+			codecs[b.ID] = b.GUID
+		}
+	}
+	return codecs
+}
+
+// BitsPerPixel is the color depth of the session, the one of the server once activated
+func (c *Client) BitsPerPixel() int {
+	if caps, ok := c.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability); ok {
+		return int(caps.PreferredBitsPerPixel)
+	}
+	if c.clientCoreData != nil {
+		return int(c.clientCoreData.HighColorDepth)
+	}
+	return 0
+}
+
+// ServerInputFlags are the INPUT_FLAG_* of the input capability of the server
+func (c *Client) ServerInputFlags() uint16 {
+	if caps, ok := c.serverCapabilities[CAPSTYPE_INPUT].(*InputCapability); ok {
+		return caps.Flags
+	}
+	return 0
+}
+
 func (c *Client) recvDemandActivePDU(s []byte) {
 	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
+	pdu, err := readPDU(r, c.bulk)
 	if err != nil {
 		slog.Error("recvDemandActivePDU", "err", err)
+		c.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
 		return
 	}
 	if pdu.ShareCtrlHeader.PDUType != PDUTYPE_DEMANDACTIVEPDU {
@@ -202,9 +259,11 @@ func (c *Client) sendConfirmActivePDU() {
 	orderCapa.OrderSupport[TS_NEG_DSTBLT_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_PATBLT_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_SCRBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_LINETO_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEM3BLT_INDEX] = 1
+	if c.drawingOrders {
+		orderCapa.OrderSupport[TS_NEG_LINETO_INDEX] = 1
+		orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] = 1
+		orderCapa.OrderSupport[TS_NEG_MEM3BLT_INDEX] = 1
+	}
 	//orderCapa.OrderSupport[TS_NEG_POLYLINE_INDEX] = 1
 	/*orderCapa.OrderSupport[TS_NEG_MULTIOPAQUERECT_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_GLYPH_INDEX_INDEX] = 1
@@ -214,10 +273,34 @@ func (c *Client) sendConfirmActivePDU() {
 	orderCapa.OrderSupport[TS_NEG_POLYGON_CB_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_ELLIPSE_SC_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_ELLIPSE_CB_INDEX] = 1*/
-	orderCapa.OrderSupport[TS_NEG_FAST_GLYPH_INDEX] = 1
+	glyphSupport := GlyphSupport(GLYPH_SUPPORT_NONE)
+	if c.drawingOrders {
+		glyphSupport = GlyphSupportLevel
+	}
+	if glyphSupport != GLYPH_SUPPORT_NONE {
+		orderCapa.OrderSupport[TS_NEG_GLYPH_INDEX_INDEX] = 1
+		orderCapa.OrderSupport[TS_NEG_FAST_INDEX_INDEX] = 1
+		orderCapa.OrderSupport[TS_NEG_FAST_GLYPH_INDEX] = 1
+	}
+
+	cacheCapa := c.clientCapabilities[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability)
+	cacheCapa.BitmapCachePersist = ALLOW_CACHE_WAITING_LIST_FLAG
+	cells := []*uint32{&cacheCapa.BmpC0Cells, &cacheCapa.BmpC1Cells, &cacheCapa.BmpC2Cells, &cacheCapa.BmpC3Cells, &cacheCapa.BmpC4Cells}
+	for i, n := range cells {
+		*n = BitmapCacheCells[i]
+		if c.persistentKeys != nil {
+			*n |= BITMAPCACHE_CELL_PERSISTENT
+		}
+	}
+	for _, keys := range c.persistentKeys {
+		if len(keys) > 0 {
+			cacheCapa.BitmapCachePersist |= PERSISTENT_KEYS_EXPECTED_FLAG
+		}
+	}
 
 	inputCapa := c.clientCapabilities[CAPSTYPE_INPUT].(*InputCapability)
-	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE
+	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE |
+		INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_FASTPATH_INPUT2 | INPUT_FLAG_MOUSE_RELATIVE | INPUT_FLAG_MOUSE_HWHEEL
 	inputCapa.KeyboardLayout = c.clientCoreData.KbdLayout
 	inputCapa.KeyboardType = c.clientCoreData.KeyboardType
 	inputCapa.KeyboardSubType = c.clientCoreData.KeyboardSubType
@@ -225,18 +308,9 @@ func (c *Client) sendConfirmActivePDU() {
 	inputCapa.ImeFileName = c.clientCoreData.ImeFileName
 
 	glyphCapa := c.clientCapabilities[CAPSTYPE_GLYPHCACHE].(*GlyphCapability)
-	/*glyphCapa.GlyphCache[0] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[1] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[2] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[3] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[4] = cacheEntry{254, 16}
-	glyphCapa.GlyphCache[5] = cacheEntry{254, 32}
-	glyphCapa.GlyphCache[6] = cacheEntry{254, 64}
-	glyphCapa.GlyphCache[7] = cacheEntry{254, 128}
-	glyphCapa.GlyphCache[8] = cacheEntry{254, 256}
-	glyphCapa.GlyphCache[9] = cacheEntry{64, 2048}
-	glyphCapa.FragCache = 0x01000100*/
-	glyphCapa.SupportLevel = GLYPH_SUPPORT_NONE
+	glyphCapa.GlyphCache = GlyphCaches
+	glyphCapa.FragCache = GLYPH_FRAGMENT_CACHE
+	glyphCapa.SupportLevel = glyphSupport
 
 	pdu.SharedId = c.sharedId
 	for _, v := range c.clientCapabilities {
@@ -255,15 +329,60 @@ func (c *Client) sendClientFinalizeSynchronizePDU() {
 	c.sendDataPDU(NewSynchronizeDataPDU(c.channelId))
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_COOPERATE})
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_REQUEST_CONTROL})
-	//c.sendDataPDU(&PersistKeyPDU{BBitMask: 0x03})
+	c.sendPersistentKeyList()
 	c.sendDataPDU(&FontListDataPDU{ListFlags: 0x0003, EntrySize: 0x0032})
 }
 
+// sendPersistentKeyList announces the cached bitmaps in as many PDUs as needed
+func (c *Client) sendPersistentKeyList() {
+	var total [5]uint16
+	type entry struct {
+		cacheId int
+		key     uint64
+	}
+	entries := make([]entry, 0)
+	for i, keys := range c.persistentKeys {
+		if i >= len(total) {
+			break
+		}
+		total[i] = uint16(len(keys))
+		for _, k := range keys {
+			entries = append(entries, entry{i, k})
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	for start := 0; start < len(entries); start += PERSIST_MAX_ENTRIES {
+		end := min(start+PERSIST_MAX_ENTRIES, len(entries))
+		p := &PersistKeyPDU{
+			TotalEntriesCache0: total[0],
+			TotalEntriesCache1: total[1],
+			TotalEntriesCache2: total[2],
+			TotalEntriesCache3: total[3],
+			TotalEntriesCache4: total[4],
+		}
+		if start == 0 {
+			p.BBitMask |= PERSIST_FIRST_PDU
+		}
+		if end == len(entries) {
+			p.BBitMask |= PERSIST_LAST_PDU
+		}
+		num := []*uint16{&p.NumEntriesCache0, &p.NumEntriesCache1, &p.NumEntriesCache2, &p.NumEntriesCache3, &p.NumEntriesCache4}
+		for _, e := range entries[start:end] {
+			*num[e.cacheId]++
+			p.Entries = append(p.Entries, PersistKeyEntry{uint32(e.key), uint32(e.key >> 32)})
+		}
+		c.sendDataPDU(p)
+	}
+}
+
 func (c *Client) recvServerSynchronizePDU(s []byte) {
 	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
+	pdu, err := readPDU(r, c.bulk)
 	if err != nil {
 		slog.Error("recvServerSynchronizePDU", "err", err)
+		c.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -282,9 +401,10 @@ func (c *Client) recvServerSynchronizePDU(s []byte) {
 
 func (c *Client) recvServerControlCooperatePDU(s []byte) {
 	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
+	pdu, err := readPDU(r, c.bulk)
 	if err != nil {
 		slog.Error("recvServerControlCooperatePDU", "err", err)
+		c.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -307,9 +427,10 @@ func (c *Client) recvServerControlCooperatePDU(s []byte) {
 
 func (c *Client) recvServerControlGrantedPDU(s []byte) {
 	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
+	pdu, err := readPDU(r, c.bulk)
 	if err != nil {
 		slog.Error("recvServerControlGrantedPDU", "err", err)
+		c.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -332,9 +453,10 @@ func (c *Client) recvServerControlGrantedPDU(s []byte) {
 
 func (c *Client) recvServerFontMapPDU(s []byte) {
 	r := bytes.NewReader(s)
-	pdu, err := readPDU(r)
+	pdu, err := readPDU(r, c.bulk)
 	if err != nil {
 		slog.Error("recvServerFontMapPDU", "err", err)
+		c.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
@@ -353,7 +475,7 @@ func (c *Client) recvServerFontMapPDU(s []byte) {
 func (c *Client) recvPDU(s []byte) {
 	r := bytes.NewReader(s)
 	if r.Len() > 0 {
-		p, err := readPDU(r)
+		p, err := readPDU(r, c.bulk)
 		if err != nil {
 			slog.Error("recvPDU", "err", err)
 			return
@@ -362,13 +484,21 @@ func (c *Client) recvPDU(s []byte) {
 			c.transport.Once("data", c.recvDemandActivePDU)
 		} else if p.ShareCtrlHeader.PDUType == PDUTYPE_DATAPDU {
 			d := p.Message.(*DataPDU)
+			switch data := d.Data.(type) {
+			case *SetKeyboardIndicatorsPDU:
+				c.Emit("keyboard_indicators", data.LedFlags)
+			case *SetKeyboardImeStatusPDU:
+				c.Emit("ime_status", data.ImeState, data.ImeConvMode)
+			}
 			if d.Header.PDUType2 == PDUTYPE2_UPDATE {
 				up := d.Data.(*UpdateDataPDU)
 				p := up.Udata
 				if up.UpdateType == FASTPATH_UPDATETYPE_BITMAP {
 					c.Emit("bitmap", p.(*BitmapUpdateDataPDU).Rectangles)
 				} else if up.UpdateType == FASTPATH_UPDATETYPE_ORDERS {
-					c.Emit("orders", p.(*FastPathOrdersPDU).OrderPdus)
+					c.Emit("orders", p.(*SlowPathOrdersPDU).OrderPdus)
+				} else if up.UpdateType == FASTPATH_UPDATETYPE_PALETTE {
+					c.Emit("palette", p.(*PaletteUpdateDataPDU))
 				}
 			}
 		}
@@ -387,7 +517,7 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 		compression := updateHeader & 0xC0
 
 		var compressionFlags uint8 = 0
-		if compression == FASTPATH_OUTPUT_COMPRESSION_USED {
+		if compression>>6 == FASTPATH_OUTPUT_COMPRESSION_USED {
 			compressionFlags, err = core.ReadUInt8(r)
 		}
 
@@ -400,25 +530,33 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 			"compressionFlags", compressionFlags,
 			"fragmentation", fragmentation,
 			"size", size, "len", r.Len())
-		if compressionFlags&RDP_MPPC_COMPRESSED != 0 {
-			slog.Info("RDP_MPPC_COMPRESSED")
+		data, err := core.ReadBytes(int(size), r)
+		if err != nil {
+			slog.Warn("RecvFastPath: truncated update", "Code", FastPathUpdateType(updateCode), "err", err)
+			return
+		}
+		if bulk.Compressed(compressionFlags) {
+			// fragments are compressed one by one
+			if data, err = c.bulk.Decompress(data, compressionFlags); err != nil {
+				slog.Error("RecvFastPath: decompress", "Code", FastPathUpdateType(updateCode), "err", err)
+				continue
+			}
 		}
 		if fragmentation != FASTPATH_FRAGMENT_SINGLE {
 			if fragmentation == FASTPATH_FRAGMENT_FIRST {
 				c.buff.Reset()
 			}
-			b, _ := core.ReadBytes(r.Len(), r)
-			c.buff.Write(b)
+			c.buff.Write(data)
 			if fragmentation != FASTPATH_FRAGMENT_LAST {
-				return
+				continue
 			}
-			r = bytes.NewReader(c.buff.Bytes())
+			data = c.buff.Bytes()
 		}
 
-		p, err := readFastPathUpdatePDU(r, updateCode)
+		p, err := readFastPathUpdatePDU(bytes.NewReader(data), updateCode)
 		if err != nil {
 			slog.Warn("readFastPathUpdatePDU:", "Code", FastPathUpdateType(updateCode), "err", err)
-			return
+			continue
 		}
 
 		if updateCode == FASTPATH_UPDATETYPE_BITMAP {
@@ -427,12 +565,35 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 			c.Emit("color", p.Data.(*FastPathColorPdu))
 		} else if updateCode == FASTPATH_UPDATETYPE_ORDERS {
 			c.Emit("orders", p.Data.(*FastPathOrdersPDU).OrderPdus)
+		} else if updateCode == FASTPATH_UPDATETYPE_PALETTE {
+			c.Emit("palette", &p.Data.(*FastPathPaletteUpdateDataPDU).PaletteUpdateDataPDU)
 		} else if updateCode == FASTPATH_UPDATETYPE_PTR_NULL {
 			c.Emit("pointer_hide")
+		} else if updateCode == FASTPATH_UPDATETYPE_PTR_DEFAULT {
+			c.Emit("pointer_default")
+		} else if updateCode == FASTPATH_UPDATETYPE_PTR_POSITION {
+			pos := p.Data.(*FastPathUpdatePointerPositionPDU)
+			c.Emit("pointer_position", pos.X, pos.Y)
 		} else if updateCode == FASTPATH_UPDATETYPE_CACHED {
 			c.Emit("pointer_cached", p.Data.(*FastPathUpdateCachedPDU).CacheIdx)
 		} else if updateCode == FASTPATH_UPDATETYPE_POINTER {
 			c.Emit("pointer_update", p.Data.(*FastPathUpdatePointerPDU))
+		} else if updateCode == FASTPATH_UPDATETYPE_SURFCMDS {
+			c.recvSurfaceCmds(p.Data.(*FastPathSurfaceCmds).Commands)
+		}
+	}
+}
+
+// recvSurfaceCmds emits the surface bits and acknowledges the frames once painted
+func (c *Client) recvSurfaceCmds(cmds []SurfaceCmd) {
+	for _, cmd := range cmds {
+		switch cmd := cmd.(type) {
+		case *SurfaceBits:
+			c.Emit("surface_bits", cmd)
+		case *FrameMarker:
+			if cmd.FrameAction == SURFACECMD_FRAMEACTION_END {
+				c.sendDataPDU(&FrameAcknowledgePDU{FrameId: cmd.FrameId})
+			}
 		}
 	}
 }
@@ -453,3 +614,179 @@ func (c *Client) SendInputEvents(msgType uint16, events []InputEventsInterface)
 
 	c.sendDataPDU(p)
 }
+
+// SendRefreshRect asks the server to repaint r
+// @see MS-RDPBCGR 2.2.11.2 Client Refresh Rect PDU
+func (c *Client) SendRefreshRect(r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	c.sendDataPDU(&RefreshRectPDU{AreasToRefresh: []InclusiveRectangle{{
+		Left:   uint16(r.Min.X),
+		Top:    uint16(r.Min.Y),
+		Right:  uint16(r.Max.X - 1),
+		Bottom: uint16(r.Max.Y - 1),
+	}}})
+}
+
+/**
+ * Server side of the capability exchange and connection finalization
+ * @see http://msdn.microsoft.com/en-us/library/cc240452.aspx
+ */
+type Server struct {
+	*PDULayer
+	clientCoreData *gcc.ClientCoreData
+	desktopWidth   uint16
+	desktopHeight  uint16
+}
+
+func NewServer(t core.Transport) *Server {
+	s := &Server{
+		PDULayer: NewPDULayer(t),
+	}
+	s.transport.Once("connect", s.connect)
+	return s
+}
+
+// SetDesktop overrides the desktop size requested by the client
+func (s *Server) SetDesktop(width, height uint16) {
+	s.desktopWidth = width
+	s.desktopHeight = height
+}
+
+// Desktop returns the desktop size announced to the client
+func (s *Server) Desktop() (width, height uint16) {
+	return s.desktopWidth, s.desktopHeight
+}
+
+func (s *Server) connect(data *gcc.ClientCoreData, userId uint16, channelId uint16) {
+	slog.Debug("pdu server connect", "userId", userId, "channelId", channelId)
+	s.clientCoreData = data
+	// server channel id
+	s.userId = 0x03EA
+	s.channelId = channelId
+	if s.desktopWidth == 0 || s.desktopHeight == 0 {
+		s.desktopWidth = data.DesktopWidth
+		s.desktopHeight = data.DesktopHeight
+	}
+	s.sendDemandActivePDU()
+	s.transport.Once("data", s.recvConfirmActivePDU)
+}
+
+func (s *Server) sendDemandActivePDU() {
+	generalCapa := s.serverCapabilities[CAPSTYPE_GENERAL].(*GeneralCapability)
+	generalCapa.OSMajorType = OSMAJORTYPE_WINDOWS
+	generalCapa.OSMinorType = OSMINORTYPE_WINDOWS_NT
+	generalCapa.ExtraFlags = LONG_CREDENTIALS_SUPPORTED | NO_BITMAP_COMPRESSION_HDR | FASTPATH_OUTPUT_SUPPORTED
+
+	bitmapCapa := s.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
+	bitmapCapa.PreferredBitsPerPixel = gcc.HighColor(32)
+	bitmapCapa.DesktopWidth = s.desktopWidth
+	bitmapCapa.DesktopHeight = s.desktopHeight
+
+	inputCapa := s.serverCapabilities[CAPSTYPE_INPUT].(*InputCapability)
+	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE |
+		INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_FASTPATH_INPUT2
+
+	pdu := &DemandActivePDU{
+		SharedId:         s.sharedId,
+		SourceDescriptor: []byte("RDP\x00"),
+	}
+	for _, v := range s.serverCapabilities {
+		pdu.CapabilitySets = append(pdu.CapabilitySets, v)
+	}
+	pdu.NumberCapabilities = uint16(len(pdu.CapabilitySets))
+	s.demandActivePDU = pdu
+	s.sendPDU(pdu)
+}
+
+func (s *Server) recvConfirmActivePDU(b []byte) {
+	r := bytes.NewReader(b)
+	pdu, err := readPDU(r, s.bulk)
+	if err != nil {
+		slog.Error("recvConfirmActivePDU", "err", err)
+		s.Emit("error", fmt.Errorf("%w: %s", core.ErrActivation, err))
+		return
+	}
+	confirm, ok := pdu.Message.(*ConfirmActivePDU)
+	if !ok {
+		slog.Info("ignore message during connection sequence", "type", pdu.ShareCtrlHeader.PDUType)
+		s.transport.Once("data", s.recvConfirmActivePDU)
+		return
+	}
+	s.clientCapabilities = make(map[CapsType]Capability, len(confirm.CapabilitySets))
+	for _, caps := range confirm.CapabilitySets {
+		slog.Debug("clientCaps", "type", caps.Type(), "value", caps)
+		s.clientCapabilities[caps.Type()] = caps
+	}
+	s.transport.On("data", s.recvPDU)
+}
+
+// ClientCapabilities returns the capability sets confirmed by the client
+func (s *Server) ClientCapabilities() map[CapsType]Capability {
+	return s.clientCapabilities
+}
+
+func (s *Server) recvPDU(b []byte) {
+	r := bytes.NewReader(b)
+	p, err := readPDU(r, s.bulk)
+	if err != nil {
+		slog.Error("recvPDU", "err", err)
+		return
+	}
+	d, ok := p.Message.(*DataPDU)
+	if !ok {
+		slog.Info("ignore pdu", "type", p.ShareCtrlHeader.PDUType)
+		return
+	}
+	switch data := d.Data.(type) {
+	case *SynchronizeDataPDU:
+		s.sendDataPDU(NewSynchronizeDataPDU(s.channelId))
+	case *ControlDataPDU:
+		switch data.Action {
+		case CTRLACTION_COOPERATE:
+			s.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_COOPERATE})
+		case CTRLACTION_REQUEST_CONTROL:
+			s.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL, GrantId: s.channelId, ControlId: uint32(s.userId)})
+		}
+	case *FontListDataPDU:
+		s.sendDataPDU(&FontMapDataPDU{MapFlags: 0x0003, EntrySize: 0x0004})
+		s.Emit("ready")
+	case *ClientInputEventPDU:
+		for _, e := range data.SlowPathInputEvents {
+			event, err := e.Event()
+			if err != nil {
+				slog.Warn("recvPDU", "err", err)
+				continue
+			}
+			s.Emit("input", e.MessageType, event)
+		}
+	default:
+		slog.Debug("ignore data pdu", "type2", d.Header.PDUType2)
+	}
+}
+
+// SendKeyboardIndicators sets the lock key LEDs of the client, ledFlags hold the TS_SYNC_* bits
+func (s *Server) SendKeyboardIndicators(ledFlags uint16) {
+	s.sendDataPDU(&SetKeyboardIndicatorsPDU{LedFlags: ledFlags})
+}
+
+// SendBitmapUpdate pushes rectangles to the client as a fast-path bitmap update
+func (s *Server) SendBitmapUpdate(rectangles []BitmapData) error {
+	if s.fastPathSender == nil {
+		return errors.New("no fast-path sender")
+	}
+	generalCapa, ok := s.clientCapabilities[CAPSTYPE_GENERAL].(*GeneralCapability)
+	if !ok || generalCapa.ExtraFlags&FASTPATH_OUTPUT_SUPPORTED == 0 {
+		return errors.New("client does not support fast-path output")
+	}
+	update := &FastPathBitmapUpdateDataPDU{Rectangles: rectangles}
+	data := update.Serialize()
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(FASTPATH_UPDATETYPE_BITMAP|FASTPATH_FRAGMENT_SINGLE, buff)
+	core.WriteUInt16LE(uint16(len(data)), buff)
+	core.WriteBytes(data, buff)
+	_, err := s.fastPathSender.SendFastPath(0, buff.Bytes())
+	return err
+}
@@ -9,6 +9,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"unicode/utf16"
@@ -89,6 +90,11 @@ const (
 	FASTPATH_OUTPUT_ENCRYPTED       = 0x2
 )
 
+const (
+	FASTPATH_INPUT_SECURE_CHECKSUM = 0x1
+	FASTPATH_INPUT_ENCRYPTED       = 0x2
+)
+
 type ClientAutoReconnect struct {
 	CbAutoReconnectLen uint16
 	CbLen              uint32
@@ -212,6 +218,46 @@ func (o *RDPInfo) Serialize(hasExtended bool) []byte {
 	return buff.Bytes()
 }
 
+func readRDPInfo(r io.Reader) (*RDPInfo, error) {
+	o := NewRDPInfo()
+	var err error
+	o.CodePage, err = core.ReadUInt32LE(r)
+	if err != nil {
+		return nil, err
+	}
+	o.Flag, _ = core.ReadUInt32LE(r)
+	o.CbDomain, _ = core.ReadUint16LE(r)
+	o.CbUserName, _ = core.ReadUint16LE(r)
+	o.CbPassword, _ = core.ReadUint16LE(r)
+	o.CbAlternateShell, _ = core.ReadUint16LE(r)
+	o.CbWorkingDir, _ = core.ReadUint16LE(r)
+
+	// every field is followed by a null terminator
+	terminator := 1
+	if o.Flag&INFO_UNICODE != 0 {
+		terminator = 2
+	}
+	fields := []*[]byte{&o.Domain, &o.UserName, &o.Password, &o.AlternateShell, &o.WorkingDir}
+	sizes := []uint16{o.CbDomain, o.CbUserName, o.CbPassword, o.CbAlternateShell, o.CbWorkingDir}
+	for i, f := range fields {
+		*f, err = core.ReadBytes(int(sizes[i])+terminator, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *RDPInfo) decode(b []byte) string {
+	if o.Flag&INFO_UNICODE == 0 {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+	if len(b) >= 2 {
+		b = b[:len(b)-2]
+	}
+	return core.UnicodeDecode(b)
+}
+
 type SecurityHeader struct {
 	securityFlag   uint16
 	securityFlagHi uint16
@@ -414,6 +460,7 @@ type Client struct {
 	initialEncryptKey []byte
 
 	fastPathListener core.FastPathListener
+	fastPathSender   core.FastPathSender
 	channelSender    core.ChannelSender
 }
 
@@ -440,6 +487,13 @@ func (c *Client) SetAlternateShell(shell string) {
 	c.info.Flag |= INFO_RAIL
 }
 
+// SetCompression asks the server to compress its data with compressionType, one of bulk.PACKET_COMPR_TYPE_*,
+// or any type below it
+func (c *Client) SetCompression(compressionType uint32) {
+	c.info.Flag &^= INFO_CompressionTypeMask
+	c.info.Flag |= INFO_COMPRESSION | compressionType<<9&INFO_CompressionTypeMask
+}
+
 func (c *Client) SetUser(user string) {
 	buff := &bytes.Buffer{}
 	for _, ch := range utf16.Encode([]rune(user)) {
@@ -458,6 +512,12 @@ func (c *Client) SetPwd(pwd string) {
 	c.info.Password = buff.Bytes()
 }
 
+// SetSmartCardPin sends the PIN of the smart card logon in place of the password
+func (c *Client) SetSmartCardPin(pin string) {
+	c.SetPwd(pin)
+	c.info.Flag |= INFO_PASSWORD_IS_SC_PIN
+}
+
 func (c *Client) SetDomain(domain string) {
 	buff := &bytes.Buffer{}
 	for _, ch := range utf16.Encode([]rune(domain)) {
@@ -686,7 +746,7 @@ func (c *Client) recvLicenceInfo(channel string, s []byte) {
 	r := bytes.NewReader(s)
 	h := readSecurityHeader(r)
 	if (h.securityFlag & LICENSE_PKT) == 0 {
-		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_PDU_SEC_BAD_LICENSE_HEADER"))
+		c.Emit("error", fmt.Errorf("%w: NODE_RDP_PROTOCOL_PDU_SEC_BAD_LICENSE_HEADER", core.ErrLicense))
 		return
 	}
 
@@ -702,6 +762,10 @@ func (c *Client) recvLicenceInfo(channel string, s []byte) {
 		if message.DwErrorCode == lic.STATUS_VALID_CLIENT && message.DwStateTransaction == lic.ST_NO_TRANSITION {
 			goto connect
 		}
+		if message.DwStateTransaction == lic.ST_TOTAL_ABORT {
+			c.Emit("error", fmt.Errorf("%w: error code 0x%x", core.ErrLicense, message.DwErrorCode))
+			return
+		}
 		goto retry
 	case lic.LICENSE_REQUEST:
 		slog.Info("recvLicenceInfo LICENSE_REQUEST")
@@ -713,7 +777,7 @@ func (c *Client) recvLicenceInfo(channel string, s []byte) {
 		goto retry
 	default:
 		slog.Error("Not a valid license packet")
-		c.Emit("error", errors.New("Not a valid license packet"))
+		c.Emit("error", fmt.Errorf("%w: not a valid license packet", core.ErrLicense))
 		return
 	}
 
@@ -854,6 +918,19 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 	c.fastPathListener.RecvFastPath(secFlag, data)
 }
 
+func (c *Client) SetFastPathSender(f core.FastPathSender) {
+	c.fastPathSender = f
+}
+
+// SendFastPath encrypts the fast-path input PDUs under standard RDP security
+func (c *Client) SendFastPath(secFlag byte, data []byte) (int, error) {
+	if c.enableEncryption {
+		data = c.writeEncryptedPayload(data, false)
+		secFlag |= FASTPATH_INPUT_ENCRYPTED
+	}
+	return c.fastPathSender.SendFastPath(secFlag, data)
+}
+
 func (c *Client) SetChannelSender(f core.ChannelSender) {
 	c.channelSender = f
 }
@@ -876,3 +953,127 @@ func (c *Client) SendToChannel(channel string, b []byte) (int, error) {
 	slog.Debug("SendToChannel", "channel", channel, "buff", hex.EncodeToString(buff.Bytes()))
 	return c.channelSender.SendToChannel(channel, buff.Bytes())
 }
+
+/**
+ * Server side of the security layer, only enhanced security
+ * is supported so the layer never encrypts anything itself
+ */
+type Server struct {
+	*SEC
+	userId    uint16
+	channelId uint16
+
+	fastPathListener core.FastPathListener
+	channelSender    core.ChannelSender
+}
+
+func NewServer(t core.Transport) *Server {
+	s := &Server{
+		SEC: NewSEC(t),
+	}
+	t.On("connect", s.connect)
+	return s
+}
+
+func (s *Server) connect(clientData []interface{}, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
+	slog.Debug("sec server connect", "userId", userId, "channels", channels)
+	s.clientData = clientData
+	s.serverData = serverData
+	s.userId = userId
+	for _, channel := range channels {
+		if channel.Name == t125.GLOBAL_CHANNEL_NAME {
+			s.channelId = channel.ID
+		}
+	}
+	if s.ClientCoreData().ServerSelectedProtocol == 0 {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_SEC_STANDARD_SECURITY_NOT_SUPPORTED"))
+		return
+	}
+	s.transport.Once("sec", s.recvInfoPkt)
+}
+
+func (s *Server) ClientCoreData() *gcc.ClientCoreData {
+	return s.clientData[0].(*gcc.ClientCoreData)
+}
+
+func (s *Server) ClientNetworkData() *gcc.ClientNetworkData {
+	return s.clientData[2].(*gcc.ClientNetworkData)
+}
+
+// User returns the user name sent by the client info packet
+func (s *Server) User() string {
+	return s.info.decode(s.info.UserName)
+}
+
+// Domain returns the domain sent by the client info packet
+func (s *Server) Domain() string {
+	return s.info.decode(s.info.Domain)
+}
+
+// Password returns the password sent by the client info packet,
+// it is empty when the client authenticated with NLA
+func (s *Server) Password() string {
+	return s.info.decode(s.info.Password)
+}
+
+func (s *Server) recvInfoPkt(channel string, b []byte) {
+	slog.Debug("recvInfoPkt", "b", hex.EncodeToString(b))
+	r := bytes.NewReader(b)
+	h := readSecurityHeader(r)
+	if h.securityFlag&INFO_PKT == 0 {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_PDU_SEC_BAD_INFO_PKT_HEADER"))
+		return
+	}
+	info, err := readRDPInfo(r)
+	if err != nil {
+		s.Emit("error", fmt.Errorf("read client info %w", err))
+		return
+	}
+	s.info = info
+	s.sendLicenseValidClient()
+
+	s.transport.On("sec", s.recvData)
+	s.Emit("connect", s.ClientCoreData(), s.userId, s.channelId)
+}
+
+/**
+ * Skip the licensing sequence
+ * @see http://msdn.microsoft.com/en-us/library/cc240482.aspx
+ */
+func (s *Server) sendLicenseValidClient() {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(lic.ERROR_ALERT, buff)
+	// PREAMBLE_VERSION_3_0
+	core.WriteUInt8(0x03, buff)
+	core.WriteUInt16LE(16, buff)
+	core.WriteUInt32LE(lic.STATUS_VALID_CLIENT, buff)
+	core.WriteUInt32LE(lic.ST_NO_TRANSITION, buff)
+	core.WriteUInt16LE(lic.BB_ERROR_BLOB, buff)
+	core.WriteUInt16LE(0, buff)
+	s.sendFlagged(LICENSE_PKT, buff.Bytes())
+}
+
+func (s *Server) recvData(channel string, b []byte) {
+	slog.Debug("sec server recvData", "channel", channel, "b", hex.EncodeToString(b))
+	if channel != t125.GLOBAL_CHANNEL_NAME {
+		s.Emit("channel", channel, b)
+		return
+	}
+	s.Emit("data", b)
+}
+
+func (s *Server) SetFastPathListener(f core.FastPathListener) {
+	s.fastPathListener = f
+}
+
+func (s *Server) RecvFastPath(secFlag byte, b []byte) {
+	s.fastPathListener.RecvFastPath(secFlag, b)
+}
+
+func (s *Server) SetChannelSender(f core.ChannelSender) {
+	s.channelSender = f
+}
+
+func (s *Server) SendToChannel(channel string, b []byte) (int, error) {
+	return s.channelSender.SendToChannel(channel, b)
+}
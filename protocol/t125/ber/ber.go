@@ -55,6 +55,12 @@ func ReadEnumerated(r io.Reader) (uint8, error) {
 	return core.ReadUInt8(r)
 }
 
+func WriteEnumerated(e uint8, w io.Writer) {
+	WriteUniversalTag(TAG_ENUMERATED, false, w)
+	WriteLength(1, w)
+	core.WriteUInt8(e, w)
+}
+
 func ReadUniversalTag(tag uint8, pc bool, r io.Reader) bool {
 	bb, _ := core.ReadUInt8(r)
 	return bb == (CLASS_UNIV|berPC(pc))|(TAG_MASK&tag)
@@ -143,6 +149,32 @@ func WriteOctetstring(str string, w io.Writer) {
 	core.WriteBytes([]byte(str), w)
 }
 
+func ReadOctetstring(r io.Reader) ([]byte, error) {
+	if !ReadUniversalTag(TAG_OCTET_STRING, false, r) {
+		return nil, errors.New("invalid octet string tag")
+	}
+	size, err := ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+	return core.ReadBytes(size, r)
+}
+
+func ReadBoolean(r io.Reader) (bool, error) {
+	if !ReadUniversalTag(TAG_BOOLEAN, false, r) {
+		return false, errors.New("invalid boolean tag")
+	}
+	size, err := ReadLength(r)
+	if err != nil {
+		return false, err
+	}
+	if size != 1 {
+		return false, errors.New(fmt.Sprintf("boolean size is wrong, get %v, expect 1", size))
+	}
+	b, err := core.ReadUInt8(r)
+	return b != 0, err
+}
+
 func WriteBoolean(b bool, w io.Writer) {
 	bb := uint8(0)
 	if b {
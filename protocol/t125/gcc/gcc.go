@@ -272,6 +272,18 @@ func (data *ClientCoreData) Pack() []byte {
 	return buff.Bytes()
 }
 
+// Unpack accepts core data of any length, the optional fields missing
+// from older clients are left to zero
+func (data *ClientCoreData) Unpack(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	full := make([]byte, 0xd8-4)
+	copy(full, b)
+	return struc.Unpack(bytes.NewReader(full), data)
+}
+
 type ClientNetworkData struct {
 	ChannelCount    uint32
 	ChannelDefArray []ChannelDef
@@ -319,6 +331,26 @@ func (n *ClientNetworkData) Pack() []byte {
 	return buff.Bytes()
 }
 
+func (n *ClientNetworkData) Unpack(r io.Reader) error {
+	count, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	n.ChannelDefArray = make([]ChannelDef, 0, count)
+	for i := 0; i < int(count); i++ {
+		name, err := core.ReadBytes(8, r)
+		if err != nil {
+			return err
+		}
+		var d ChannelDef
+		d.Name = string(bytes.TrimRight(name, "\x00"))
+		d.Options, _ = core.ReadUInt32LE(r)
+		n.ChannelDefArray = append(n.ChannelDefArray, d)
+	}
+	n.ChannelCount = count
+	return nil
+}
+
 type ClientSecurityData struct {
 	EncryptionMethods    uint32
 	ExtEncryptionMethods uint32
@@ -339,6 +371,17 @@ func (d *ClientSecurityData) Pack() []byte {
 	return buff.Bytes()
 }
 
+func (d *ClientSecurityData) Unpack(r io.Reader) error {
+	d.EncryptionMethods, _ = core.ReadUInt32LE(r)
+	d.ExtEncryptionMethods, _ = core.ReadUInt32LE(r)
+	return nil
+}
+
+// CsData is a client data block of the conference create request
+type CsData interface {
+	Unpack(io.Reader) error
+}
+
 type RSAPublicKey struct {
 	Magic   uint32 `struc:"little"` //0x31415352
 	Keylen  uint32 `struc:"little,sizeof=Modulus"`
@@ -455,8 +498,14 @@ func NewServerCoreData() *ServerCoreData {
 		RDP_VERSION_5_PLUS, 0, 0}
 }
 
-func (d *ServerCoreData) Serialize() []byte {
-	return []byte{}
+func (d *ServerCoreData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(uint16(SC_CORE), buff) // type
+	core.WriteUInt16LE(0x10, buff)            // len 16
+	core.WriteUInt32LE(uint32(d.RdpVersion), buff)
+	core.WriteUInt32LE(d.ClientRequestedProtocol, buff)
+	core.WriteUInt32LE(d.EarlyCapabilityFlags, buff)
+	return buff.Bytes()
 }
 
 func (d *ServerCoreData) ScType() Message {
@@ -488,6 +537,23 @@ func (d *ServerNetworkData) Unpack(r io.Reader) error {
 	return struc.Unpack(r, d)
 }
 
+func (d *ServerNetworkData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(SC_NET, buff) // type
+	length := 8 + 2*len(d.ChannelIdArray)
+	padding := len(d.ChannelIdArray) % 2
+	core.WriteUInt16LE(uint16(length+2*padding), buff)
+	core.WriteUInt16LE(d.MCSChannelId, buff)
+	core.WriteUInt16LE(uint16(len(d.ChannelIdArray)), buff)
+	for _, id := range d.ChannelIdArray {
+		core.WriteUInt16LE(id, buff)
+	}
+	if padding != 0 {
+		core.WriteUInt16LE(0, buff)
+	}
+	return buff.Bytes()
+}
+
 type CertData interface {
 	GetPublicKey() (*rsa.PublicKey, error)
 	Verify() bool
@@ -560,6 +626,17 @@ func (s *ServerSecurityData) Unpack(r io.Reader) error {
 	return nil
 }
 
+// Pack only supports a server without standard RDP security,
+// the enhanced security layer protects the connection
+func (s *ServerSecurityData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(SC_SECURITY, buff) // type
+	core.WriteUInt16LE(0x0c, buff)        // len 12
+	core.WriteUInt32LE(s.EncryptionMethod, buff)
+	core.WriteUInt32LE(s.EncryptionLevel, buff)
+	return buff.Bytes()
+}
+
 func MakeConferenceCreateRequest(userData []byte) []byte {
 	buff := &bytes.Buffer{}
 	per.WriteChoice(0, buff)                        // 00
@@ -576,6 +653,22 @@ func MakeConferenceCreateRequest(userData []byte) []byte {
 	return buff.Bytes()
 }
 
+func MakeConferenceCreateResponse(userData []byte) []byte {
+	buff := &bytes.Buffer{}
+	per.WriteChoice(0, buff)                        // 00
+	per.WriteObjectIdentifier(t124_02_98_oid, buff) // 05:00:14:7c:00:01
+	per.WriteLength(len(userData)+14, buff)
+	per.WriteChoice(0x14, buff)                // 14
+	per.WriteInteger16(0x79F3-1001, buff)      // node id
+	per.WriteInteger(1, buff)                  // tag
+	per.WriteEnumerates(0, buff)               // result
+	per.WriteNumberOfSet(1, buff)              // 01
+	per.WriteChoice(0xc0, buff)                // c0
+	per.WriteOctetStream(h221_sc_key, 4, buff) // 00 4d:63:44:6e
+	per.WriteOctetStream(string(userData), 0, buff)
+	return buff.Bytes()
+}
+
 type ScData interface {
 	ScType() Message
 	Unpack(io.Reader) error
@@ -634,3 +727,56 @@ func ReadConferenceCreateResponse(data []byte) []interface{} {
 
 	return ret
 }
+
+func ReadConferenceCreateRequest(data []byte) ([]interface{}, error) {
+	ret := make([]interface{}, 0, 3)
+
+	r := bytes.NewReader(data)
+	per.ReadChoice(r)
+	if !per.ReadObjectIdentifier(r, t124_02_98_oid) {
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_OBJECT_IDENTIFIER_T124")
+	}
+	per.ReadLength(r)
+	per.ReadChoice(r)
+	per.ReadSelection(r)
+	per.ReadNumericString(r, 1)
+	per.ReadPadding(r, 1)
+	if per.ReadNumberOfSet(r) != 1 {
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_SET_OF_USER_DATA")
+	}
+	if per.ReadChoice(r) != 0xc0 {
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_CHOICE")
+	}
+	if !per.ReadOctetStream(r, h221_cs_key, 4) {
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_CS_KEY")
+	}
+
+	ln, _ := per.ReadLength(r)
+	for ln > 0 {
+		t, _ := core.ReadUint16LE(r)
+		l, _ := core.ReadUint16LE(r)
+		if l < 4 || int(l) > r.Len()+4 {
+			return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_USER_DATA_LENGTH")
+		}
+		dataBytes, _ := core.ReadBytes(int(l)-4, r)
+		ln -= l
+		var d CsData
+		switch Message(t) {
+		case CS_CORE:
+			d = &ClientCoreData{}
+		case CS_SECURITY:
+			d = &ClientSecurityData{}
+		case CS_NET:
+			d = &ClientNetworkData{}
+		default:
+			slog.Debug("ReadConferenceCreateRequest skip", "type", t)
+			continue
+		}
+		if err := d.Unpack(bytes.NewReader(dataBytes)); err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+
+	return ret, nil
+}
@@ -10,10 +10,9 @@ import (
 	"reflect"
 
 	//	"github.com/nakagami/grdp/plugin/cliprdr"
+	"github.com/sergei-bronnikov/grdp/plugin/drdynvc"
 	"github.com/sergei-bronnikov/grdp/plugin/rail"
 
-	//	"github.com/nakagami/grdp/plugin/drdynvc"
-
 	"github.com/sergei-bronnikov/grdp/core"
 	"github.com/sergei-bronnikov/grdp/emission"
 	"github.com/sergei-bronnikov/grdp/protocol/t125/ber"
@@ -208,6 +207,45 @@ func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
 	return c, err
 }
 
+func (c *ConnectResponse) BER() []byte {
+	buff := &bytes.Buffer{}
+	ber.WriteEnumerated(c.result, buff)
+	ber.WriteInteger(c.calledConnectId, buff)
+	ber.WriteEncodedDomainParams(c.domainParameters.BER(), buff)
+	ber.WriteOctetstring(string(c.userData), buff)
+	return buff.Bytes()
+}
+
+func ReadConnectInitial(r io.Reader) (*ConnectInitial, error) {
+	c := &ConnectInitial{}
+	var err error
+	_, err = ber.ReadApplicationTag(uint8(MCS_TYPE_CONNECT_INITIAL), r)
+	if err != nil {
+		return nil, err
+	}
+	c.CallingDomainSelector, err = ber.ReadOctetstring(r)
+	if err != nil {
+		return nil, err
+	}
+	c.CalledDomainSelector, err = ber.ReadOctetstring(r)
+	if err != nil {
+		return nil, err
+	}
+	c.UpwardFlag, err = ber.ReadBoolean(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []*DomainParameters{&c.TargetParameters, &c.MinimumParameters, &c.MaximumParameters} {
+		p, err := ReadDomainParameters(r)
+		if err != nil {
+			return nil, err
+		}
+		*d = *p
+	}
+	c.UserData, err = ber.ReadOctetstring(r)
+	return c, err
+}
+
 type MCSChannelInfo struct {
 	ID   uint16
 	Name string
@@ -283,8 +321,13 @@ func (c *MCSClient) SetClientDesktop(width, height uint16) {
 }
 
 func (c *MCSClient) SetClientDynvcProtocol() {
-	c.clientCoreData.EarlyCapabilityFlags = gcc.RNS_UD_CS_SUPPORT_DYNVC_GFX_PROTOCOL
-	// c.clientNetworkData.AddVirtualChannel(drdynvc.ChannelName, drdynvc.ChannelOption)
+	c.clientNetworkData.AddVirtualChannel(drdynvc.ChannelName, drdynvc.ChannelOption)
+}
+
+// SetClientGraphicsPipeline announces the graphics pipeline, it runs over the dynamic channels
+func (c *MCSClient) SetClientGraphicsPipeline() {
+	c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_SUPPORT_DYNVC_GFX_PROTOCOL |
+		gcc.RNS_UD_CS_WANT_32BPP_SESSION
 }
 
 func (c *MCSClient) SetClientRemoteProgram() {
@@ -567,3 +610,273 @@ func (c *MCSClient) SendToChannel(channel string, data []byte) (n int, err error
 	data = c.Pack(data, channelId)
 	return c.transport.Write(data)
 }
+
+/**
+ * Server side of the MCS layer, answers the client connection sequence
+ * @see http://msdn.microsoft.com/en-us/library/cc240508.aspx
+ */
+type MCSServer struct {
+	*MCS
+	clientCoreData     *gcc.ClientCoreData
+	clientNetworkData  *gcc.ClientNetworkData
+	clientSecurityData *gcc.ClientSecurityData
+
+	serverCoreData     *gcc.ServerCoreData
+	serverNetworkData  *gcc.ServerNetworkData
+	serverSecurityData *gcc.ServerSecurityData
+
+	channelsConnected int
+	userId            uint16
+}
+
+func NewMCSServer(t core.Transport) *MCSServer {
+	s := &MCSServer{
+		MCS:                NewMCS(t, SEND_DATA_REQUEST, SEND_DATA_INDICATION),
+		serverCoreData:     gcc.NewServerCoreData(),
+		serverNetworkData:  gcc.NewServerNetworkData(),
+		serverSecurityData: gcc.NewServerSecurityData(),
+		userId:             1 + MCS_USERCHANNEL_BASE,
+	}
+	s.transport.On("connect", s.connect)
+	return s
+}
+
+func (s *MCSServer) connect(selectedProtocol, requestedProtocol uint32) {
+	slog.Debug("mcs server connect", "selectedProtocol", selectedProtocol)
+	s.serverCoreData.ClientRequestedProtocol = requestedProtocol
+	s.transport.Once("data", s.recvConnectInitial)
+}
+
+func (s *MCSServer) recvConnectInitial(data []byte) {
+	slog.Debug("mcs recvConnectInitial", "data", hex.EncodeToString(data))
+	cInit, err := ReadConnectInitial(bytes.NewReader(data))
+	if err != nil {
+		s.Emit("error", errors.New(fmt.Sprintf("ReadConnectInitial %v", err)))
+		return
+	}
+	clientSettings, err := gcc.ReadConferenceCreateRequest(cInit.UserData)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	for _, v := range clientSettings {
+		switch v := v.(type) {
+		case *gcc.ClientCoreData:
+			s.clientCoreData = v
+		case *gcc.ClientSecurityData:
+			s.clientSecurityData = v
+		case *gcc.ClientNetworkData:
+			s.clientNetworkData = v
+		}
+	}
+	if s.clientCoreData == nil {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_NO_CLIENT_CORE_DATA"))
+		return
+	}
+	if s.clientSecurityData == nil {
+		s.clientSecurityData = gcc.NewClientSecurityData()
+	}
+	if s.clientNetworkData == nil {
+		s.clientNetworkData = gcc.NewClientNetworkData()
+	}
+
+	// static virtual channels follow the global channel
+	s.serverNetworkData.MCSChannelId = MCS_GLOBAL_CHANNEL_ID
+	s.serverNetworkData.ChannelIdArray = make([]uint16, 0, s.clientNetworkData.ChannelCount)
+	for i, def := range s.clientNetworkData.ChannelDefArray {
+		id := MCS_GLOBAL_CHANNEL_ID + 1 + uint16(i)
+		s.serverNetworkData.ChannelIdArray = append(s.serverNetworkData.ChannelIdArray, id)
+		s.channels = append(s.channels, MCSChannelInfo{id, def.Name})
+	}
+	s.serverNetworkData.ChannelCount = uint16(len(s.serverNetworkData.ChannelIdArray))
+	s.userId = MCS_GLOBAL_CHANNEL_ID + 1 + s.serverNetworkData.ChannelCount
+
+	userDataBuff := bytes.Buffer{}
+	userDataBuff.Write(s.serverCoreData.Pack())
+	userDataBuff.Write(s.serverSecurityData.Pack())
+	userDataBuff.Write(s.serverNetworkData.Pack())
+	ccResp := gcc.MakeConferenceCreateResponse(userDataBuff.Bytes())
+	connectResponseBerEncoded := NewConnectResponse(ccResp).BER()
+
+	dataBuff := &bytes.Buffer{}
+	ber.WriteApplicationTag(uint8(MCS_TYPE_CONNECT_RESPONSE), len(connectResponseBerEncoded), dataBuff)
+	dataBuff.Write(connectResponseBerEncoded)
+	slog.Debug("send connect response", "data", hex.EncodeToString(dataBuff.Bytes()), "len", dataBuff.Len())
+
+	_, err = s.transport.Write(dataBuff.Bytes())
+	if err != nil {
+		s.Emit("error", errors.New(fmt.Sprintf("mcs sendConnectResponse write error %v", err)))
+		return
+	}
+	s.transport.Once("data", s.recvErectDomainRequest)
+}
+
+func (s *MCSServer) recvErectDomainRequest(data []byte) {
+	slog.Debug("mcs recvErectDomainRequest", "data", hex.EncodeToString(data))
+	option, err := core.ReadUInt8(bytes.NewReader(data))
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, ERECT_DOMAIN_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_BAD_HEADER"))
+		return
+	}
+	s.transport.Once("data", s.recvAttachUserRequest)
+}
+
+func (s *MCSServer) recvAttachUserRequest(data []byte) {
+	slog.Debug("mcs recvAttachUserRequest", "data", hex.EncodeToString(data))
+	option, err := core.ReadUInt8(bytes.NewReader(data))
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, ATTACH_USER_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_BAD_HEADER"))
+		return
+	}
+	s.sendAttachUserConfirm()
+	s.channels = append(s.channels, MCSChannelInfo{s.userId, "user"})
+	s.transport.Once("data", s.recvChannelJoinRequest)
+}
+
+func (s *MCSServer) sendAttachUserConfirm() {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(ATTACH_USER_CONFIRM, 2, buff)
+	per.WriteEnumerates(0, buff)
+	per.WriteInteger16(s.userId-MCS_USERCHANNEL_BASE, buff)
+	s.transport.Write(buff.Bytes())
+}
+
+func (s *MCSServer) recvChannelJoinRequest(data []byte) {
+	slog.Debug("mcs recvChannelJoinRequest", "data", hex.EncodeToString(data))
+	r := bytes.NewReader(data)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+	if !readMCSPDUHeader(option, CHANNEL_JOIN_REQUEST) {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_WAIT_CHANNEL_JOIN_REQUEST"))
+		return
+	}
+	userId, _ := per.ReadInteger16(r)
+	userId += MCS_USERCHANNEL_BASE
+	if userId != s.userId {
+		s.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_INVALID_USER_ID"))
+		return
+	}
+	channelId, _ := per.ReadInteger16(r)
+
+	// rt-no-such-channel
+	var confirm uint8 = 14
+	for _, channel := range s.channels {
+		if channel.ID == channelId {
+			confirm = 0
+			break
+		}
+	}
+	s.sendChannelJoinConfirm(confirm, channelId)
+
+	s.channelsConnected++
+	if s.channelsConnected < len(s.channels) {
+		s.transport.Once("data", s.recvChannelJoinRequest)
+		return
+	}
+
+	s.transport.On("data", s.recvData)
+	clientData := make([]interface{}, 0)
+	clientData = append(clientData, s.clientCoreData)
+	clientData = append(clientData, s.clientSecurityData)
+	clientData = append(clientData, s.clientNetworkData)
+
+	serverData := make([]interface{}, 0)
+	serverData = append(serverData, s.serverCoreData)
+	serverData = append(serverData, s.serverSecurityData)
+	s.Emit("connect", clientData, serverData, s.userId, s.channels)
+}
+
+func (s *MCSServer) sendChannelJoinConfirm(confirm uint8, channelId uint16) {
+	slog.Debug("sendChannelJoinConfirm", "channelId", channelId, "confirm", confirm)
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(CHANNEL_JOIN_CONFIRM, 2, buff)
+	per.WriteEnumerates(confirm, buff)
+	per.WriteInteger16(s.userId-MCS_USERCHANNEL_BASE, buff)
+	per.WriteInteger16(channelId, buff)
+	per.WriteInteger16(channelId, buff)
+	s.transport.Write(buff.Bytes())
+}
+
+func (s *MCSServer) recvData(data []byte) {
+	slog.Debug("mcs server recvData", "data", hex.EncodeToString(data))
+
+	r := bytes.NewReader(data)
+	option, err := core.ReadUInt8(r)
+	if err != nil {
+		s.Emit("error", err)
+		return
+	}
+
+	if readMCSPDUHeader(option, DISCONNECT_PROVIDER_ULTIMATUM) {
+		slog.Info("mcs client disconnect")
+		s.transport.Close()
+		return
+	} else if !readMCSPDUHeader(option, s.recvOpCode) {
+		s.Emit("error", errors.New("Invalid expected MCS opcode receive data"))
+		return
+	}
+
+	per.ReadInteger16(r)
+	channelId, _ := per.ReadInteger16(r)
+	per.ReadEnumerates(r)
+	size, _ := per.ReadLength(r)
+	channelName := ""
+	found := false
+	for _, channel := range s.channels {
+		if channel.ID == channelId {
+			found = true
+			channelName = channel.Name
+			break
+		}
+	}
+	if !found {
+		slog.Error("mcs receive data for an unconnected layer")
+		return
+	}
+	left, err := core.ReadBytes(int(size), r)
+	if err != nil {
+		s.Emit("error", errors.New(fmt.Sprintf("mcs recvData get data error %v", err)))
+		return
+	}
+	s.Emit("sec", channelName, left)
+}
+
+func (s *MCSServer) Pack(data []byte, channelId uint16) []byte {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(s.sendOpCode, 0, buff)
+	per.WriteInteger16(s.userId-MCS_USERCHANNEL_BASE, buff)
+	per.WriteInteger16(channelId, buff)
+	core.WriteUInt8(0x70, buff)
+	per.WriteLength(len(data), buff)
+	core.WriteBytes(data, buff)
+	return buff.Bytes()
+}
+
+func (s *MCSServer) Write(data []byte) (n int, err error) {
+	data = s.Pack(data, s.channels[0].ID)
+	return s.transport.Write(data)
+}
+
+func (s *MCSServer) SendToChannel(channel string, data []byte) (n int, err error) {
+	channelId := s.channels[0].ID
+	for _, ch := range s.channels {
+		if channel == ch.Name {
+			channelId = ch.ID
+			break
+		}
+	}
+
+	data = s.Pack(data, channelId)
+	return s.transport.Write(data)
+}
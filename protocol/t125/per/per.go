@@ -12,6 +12,10 @@ func ReadEnumerates(r io.Reader) (uint8, error) {
 	return core.ReadUInt8(r)
 }
 
+func WriteEnumerates(n uint8, w io.Writer) {
+	core.WriteUInt8(n, w)
+}
+
 func WriteInteger(n int, w io.Writer) {
 	if n <= 0xff {
 		WriteLength(1, w)
@@ -200,3 +204,22 @@ func ReadOctetStream(r io.Reader, s string, min int) bool {
 
 	return true
 }
+
+func ReadSelection(r io.Reader) uint8 {
+	selection, _ := core.ReadUInt8(r)
+	return selection
+}
+
+func ReadPadding(r io.Reader, length int) {
+	core.ReadBytes(length, r)
+}
+
+func ReadNumericString(r io.Reader, minValue int) error {
+	ln, err := ReadLength(r)
+	if err != nil {
+		return err
+	}
+	length := (int(ln) + minValue + 1) / 2
+	_, err = core.ReadBytes(length, r)
+	return err
+}
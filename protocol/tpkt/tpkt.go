@@ -2,8 +2,12 @@ package tpkt
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 
 	"github.com/sergei-bronnikov/grdp/core"
@@ -24,117 +28,337 @@ const (
 	FASTPATH_ACTION_X224     = 0x3
 )
 
+/**
+ * Credentials delegated to the server at the end of NLA. Remote Credential
+ * Guard, TSRemoteGuardCreds, is not supported: the server would then redirect
+ * its Kerberos calls to the client over MS-RDPEAR, which is not implemented.
+ * @see MS-CSSP 2.2.1.2 TSCredentials
+ */
+const (
+	DELEGATE_PASSWORD = iota
+	// empty credentials, the server logs on with the identity of NLA
+	DELEGATE_RESTRICTED_ADMIN
+)
+
 /**
  * TPKT layer of rdp stack
  */
 type TPKT struct {
 	emission.Emitter
 	Conn             *core.SocketLayer
-	ntlm             *nla.NTLMv2
+	auth             nla.Authenticator
 	secFlag          byte
 	lastShortLength  int
 	fastPathListener core.FastPathListener
 	ntlmSec          *nla.NTLMv2Security
+	// negotiated CredSSP version and the nonce bound to the public key from version 5
+	credsspVersion int
+	clientNonce    []byte
+	delegation     int
+	// server side security
+	tlsConfig  *tls.Config
+	ntlmServer *nla.NTLMv2Server
 }
 
-func New(s *core.SocketLayer, ntlm *nla.NTLMv2) *TPKT {
+// New creates the tpkt layer of a client, auth is the security package of NLA
+func New(s *core.SocketLayer, auth nla.Authenticator) *TPKT {
 	t := &TPKT{
 		Emitter: *emission.NewEmitter(),
 		Conn:    s,
 		secFlag: 0,
-		ntlm:    ntlm}
+		auth:    auth}
 	core.StartReadBytes(2, s, t.recvHeader)
 	return t
 }
 
+// NewServer creates the tpkt layer of a server, ntlm may be nil when NLA is not offered.
+// The client speaks first so reading only begins with Listen, once the upper layers are wired.
+func NewServer(s *core.SocketLayer, config *tls.Config, ntlm *nla.NTLMv2Server) *TPKT {
+	return &TPKT{
+		Emitter:    *emission.NewEmitter(),
+		Conn:       s,
+		tlsConfig:  config,
+		ntlmServer: ntlm}
+}
+
+func (t *TPKT) Listen() {
+	core.StartReadBytes(2, t.Conn, t.recvHeader)
+}
+
+// SetDelegation chooses the credentials sent once NLA succeeds, DELEGATE_PASSWORD by default
+func (t *TPKT) SetDelegation(mode int) {
+	t.delegation = mode
+}
+
 func (t *TPKT) StartTLS() error {
 	return t.Conn.StartTLS()
 }
 
+// StartNLA runs the client side of CredSSP with the security package of New
+// @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
 func (t *TPKT) StartNLA() error {
 	err := t.StartTLS()
 	if err != nil {
 		slog.Error("StartNLA", "start tls failed", err)
 		return err
 	}
-	req := nla.EncodeDERTRequest([]nla.Message{t.ntlm.GetNegotiateMessage()}, nil, nil)
-	slog.Debug("StartNLA send", "req", hex.EncodeToString(req), "len", len(req))
-	_, err = t.Conn.Write(req)
+	token, established, err := t.auth.InitSecContext(nil)
 	if err != nil {
-		slog.Error("send NegotiateMessage", "err", err)
-		return err
+		return fmt.Errorf("%w: %s", core.ErrAuthFailed, err)
 	}
+	for !established {
+		req := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, []nla.Message{nla.Token(token)}, nil, nil, nil)
+		slog.Debug("StartNLA send", "req", hex.EncodeToString(req), "len", len(req))
+		_, err = t.Conn.Write(req)
+		if err != nil {
+			slog.Error("send negoToken", "err", err)
+			return err
+		}
+
+		tsreq, err := t.readTSRequest()
+		if err != nil {
+			return fmt.Errorf("read %s", err)
+		}
+		if token, established, err = t.recvChallenge(tsreq); err != nil {
+			return err
+		}
+	}
+	return t.sendPubKeyAuth(token)
+}
 
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
-	slog.Debug("StartNLA recv", "n", n, "err", err)
+func (t *TPKT) recvChallenge(tsreq *nla.TSRequest) ([]byte, bool, error) {
+	slog.Debug("recvChallenge", "tsreq", tsreq)
+	if tsreq.ErrorCode != 0 {
+		return nil, false, fmt.Errorf("%w: server error code 0x%08x", core.ErrAuthFailed, uint32(tsreq.ErrorCode))
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return nil, false, fmt.Errorf("%w: no challenge in server TSRequest", core.ErrAuthFailed)
+	}
+	t.credsspVersion = min(tsreq.Version, nla.CREDSSP_VERSION)
+	token, established, err := t.auth.InitSecContext(tsreq.NegoTokens[0].Data)
 	if err != nil {
-		return fmt.Errorf("read %s", err)
-	} else {
-		slog.Debug("StartNLA Read success")
+		return nil, false, fmt.Errorf("%w: %s", core.ErrAuthFailed, err)
 	}
-	return t.recvChallenge(resp[:n])
+	return token, established, nil
 }
 
-func (t *TPKT) recvChallenge(data []byte) error {
-	slog.Debug("recvChallenge", "data", hex.EncodeToString(data))
-	tsreq, err := nla.DecodeDERTRequest(data)
+// sendPubKeyAuth sends the last token of the security package with the public key of the TLS channel
+func (t *TPKT) sendPubKeyAuth(token []byte) error {
+	pubkey, err := t.Conn.TlsPubKey()
 	if err != nil {
-		slog.Info("DecodeDERTRequest", "err", err)
 		return err
 	}
-	slog.Debug("recvChallenge", "tsreq", tsreq)
-	// get pubkey
-	pubkey, err := t.Conn.TlsPubKey()
-	slog.Debug("recvChallenge", "pubkey", hex.EncodeToString(pubkey))
+	slog.Debug("sendPubKeyAuth", "pubkey", hex.EncodeToString(pubkey))
 
-	authMsg, ntlmSec := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
-	t.ntlmSec = ntlmSec
+	t.clientNonce = nil
+	if t.credsspVersion >= nla.CREDSSP_VERSION_5 {
+		t.clientNonce, err = nla.NewClientNonce()
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("sendPubKeyAuth", "credssp version", t.credsspVersion)
 
-	encryptPubkey := ntlmSec.GssEncrypt(pubkey)
-	req := nla.EncodeDERTRequest([]nla.Message{authMsg}, nil, encryptPubkey)
-	slog.Debug("recvChallenge", "send", hex.EncodeToString(req), "len", len(req))
+	var msgs []nla.Message
+	if len(token) > 0 {
+		msgs = append(msgs, nla.Token(token))
+	}
+	encryptPubkey := t.auth.Wrap(nla.ClientPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey))
+	req := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, msgs, nil, encryptPubkey, t.clientNonce)
+	slog.Debug("sendPubKeyAuth", "send", hex.EncodeToString(req), "len", len(req))
 	_, err = t.Conn.Write(req)
 	if err != nil {
-		slog.Error("send AuthenticateMessage", "err", err)
+		slog.Error("send pubKeyAuth", "err", err)
 		return err
 	}
 
-	slog.Debug("recvChallenge read challenge start")
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
+	tsreq, err := t.readTSRequest()
 	if err != nil {
-		slog.Error("recvChallenge", "err", err)
-		return fmt.Errorf("read %s", err)
+		// the server drops the connection when it rejects the credentials
+		slog.Error("sendPubKeyAuth", "err", err)
+		return fmt.Errorf("%w: read %s", core.ErrAuthFailed, err)
 	}
 
-	return t.recvPubKeyInc(resp[:n])
+	return t.recvPubKeyInc(tsreq, pubkey)
 }
 
-func (t *TPKT) recvPubKeyInc(data []byte) error {
-	slog.Debug("recvPubKeyInc", "data", hex.EncodeToString(data), "len", len(data))
-	tsreq, err := nla.DecodeDERTRequest(data)
+func (t *TPKT) recvPubKeyInc(tsreq *nla.TSRequest, pubkey []byte) error {
+	slog.Debug("PubKeyAuth", "key", hex.EncodeToString(tsreq.PubKeyAuth))
+	if tsreq.ErrorCode != 0 {
+		return fmt.Errorf("%w: server error code 0x%08x", core.ErrAuthFailed, uint32(tsreq.ErrorCode))
+	}
+	// SPNEGO may send its final mechListMIC along with the public key
+	if len(tsreq.NegoTokens) > 0 {
+		if _, _, err := t.auth.InitSecContext(tsreq.NegoTokens[0].Data); err != nil {
+			return fmt.Errorf("%w: %s", core.ErrAuthFailed, err)
+		}
+	}
+	serverPubKey, err := t.auth.Unwrap(tsreq.PubKeyAuth)
 	if err != nil {
-		slog.Info("DecodeDERTRequest", "err", err)
-		return err
+		return fmt.Errorf("%w: invalid server pubKeyAuth: %s", core.ErrAuthFailed, err)
 	}
-	slog.Debug("PubKeyAuth", "key", hex.EncodeToString(tsreq.PubKeyAuth))
-	//ignore
-	pubkey := t.ntlmSec.GssDecrypt([]byte(tsreq.PubKeyAuth))
-	slog.Debug("GssDecrypy", "pubkey", hex.EncodeToString(pubkey))
-	domain, username, password := t.ntlm.GetEncodedCredentials()
-	credentials := nla.EncodeDERTCredentials(domain, username, password)
-	authInfo := t.ntlmSec.GssEncrypt(credentials)
-	req := nla.EncodeDERTRequest(nil, authInfo, nil)
+	if !bytes.Equal(serverPubKey, nla.ServerPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey)) {
+		return fmt.Errorf("%w: server public key does not match", core.ErrAuthFailed)
+	}
+
+	authInfo := t.auth.Wrap(t.credentials())
+	req := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, nil, authInfo, nil, nil)
 	_, err = t.Conn.Write(req)
 	if err != nil {
-		slog.Info("send AuthenticateMessage", "err", err)
+		slog.Info("send TSCredentials", "err", err)
 		return err
 	}
 
 	return nil
 }
 
+// credentials returns the TSCredentials of the delegation mode
+func (t *TPKT) credentials() []byte {
+	if t.delegation == DELEGATE_RESTRICTED_ADMIN {
+		return nla.EncodeDERTCredentials(nil, nil, nil)
+	}
+	return t.auth.Credentials()
+}
+
+func (t *TPKT) AcceptTLS() error {
+	return t.Conn.StartServerTLS(t.tlsConfig)
+}
+
+// AcceptNLA runs the server side of CredSSP over NTLMv2
+// @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+func (t *TPKT) AcceptNLA() error {
+	if t.ntlmServer == nil {
+		return errors.New("NLA is not configured")
+	}
+	err := t.AcceptTLS()
+	if err != nil {
+		slog.Error("AcceptNLA", "accept tls failed", err)
+		return err
+	}
+
+	tsreq, err := t.readTSRequest()
+	if err != nil {
+		return err
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return fmt.Errorf("%w: no negotiate message in client TSRequest", core.ErrAuthFailed)
+	}
+	t.credsspVersion = min(tsreq.Version, nla.CREDSSP_VERSION)
+	challenge, err := t.ntlmServer.GetChallengeMessage(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", core.ErrAuthFailed, err)
+	}
+	_, err = t.Conn.Write(nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, []nla.Message{challenge}, nil, nil, nil))
+	if err != nil {
+		return err
+	}
+
+	tsreq, err = t.readTSRequest()
+	if err != nil {
+		return err
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return fmt.Errorf("%w: no authenticate message in client TSRequest", core.ErrAuthFailed)
+	}
+	ntlmSec, err := t.ntlmServer.Authenticate(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", core.ErrAuthFailed, err)
+	}
+	t.ntlmSec = ntlmSec
+
+	pubkey, err := t.Conn.TlsPubKey()
+	if err != nil {
+		return err
+	}
+	if t.credsspVersion >= nla.CREDSSP_VERSION_5 && len(tsreq.ClientNonce) == 0 {
+		return fmt.Errorf("%w: no client nonce in CredSSP version %d", core.ErrAuthFailed, t.credsspVersion)
+	}
+	t.clientNonce = tsreq.ClientNonce
+	if !bytes.Equal(ntlmSec.GssDecrypt(tsreq.PubKeyAuth), nla.ClientPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey)) {
+		return fmt.Errorf("%w: client public key does not match", core.ErrAuthFailed)
+	}
+	// the server proves it owns the key
+	pubKeyAuth := ntlmSec.GssEncrypt(nla.ServerPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey))
+	_, err = t.Conn.Write(nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, nil, nil, pubKeyAuth, nil))
+	if err != nil {
+		return err
+	}
+
+	tsreq, err = t.readTSRequest()
+	if err != nil {
+		return err
+	}
+	credentials := ntlmSec.GssDecrypt(tsreq.AuthInfo)
+	if credentials == nil {
+		return fmt.Errorf("%w: invalid credentials signature", core.ErrAuthFailed)
+	}
+	_, err = nla.DecodeDERTCredentials(credentials)
+	return err
+}
+
+// RecvEarlyUserAuthResult reads the result sent after CredSSP with HYBRID_EX
+// @see https://msdn.microsoft.com/en-us/library/dn392331.aspx
+func (t *TPKT) RecvEarlyUserAuthResult() (uint32, error) {
+	// core.ReadUInt32LE hides the read error, a closed connection is no success
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(t.Conn, b); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (t *TPKT) SendEarlyUserAuthResult(result uint32) error {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(result, buff)
+	_, err := t.Conn.Write(buff.Bytes())
+	return err
+}
+
+// NLAIdentity returns the user authenticated by AcceptNLA
+func (t *TPKT) NLAIdentity() (domain, user string) {
+	if t.ntlmServer == nil {
+		return "", ""
+	}
+	return t.ntlmServer.Identity()
+}
+
+// maxTSRequestSize bounds the TSRequest read before the peer is authenticated
+const maxTSRequestSize = 64 * 1024
+
+// readTSRequest reads one DER encoded TSRequest from the TLS connection
+func (t *TPKT) readTSRequest() (*nla.TSRequest, error) {
+	header, err := core.ReadBytes(2, t.Conn)
+	if err != nil {
+		return nil, err
+	}
+	size := int(header[1])
+	data := header
+	if size&0x80 != 0 {
+		if size&0x7f > 4 {
+			return nil, fmt.Errorf("TSRequest length of %d bytes", size&0x7f)
+		}
+		sizeBytes, err := core.ReadBytes(size&0x7f, t.Conn)
+		if err != nil {
+			return nil, err
+		}
+		size = 0
+		for _, b := range sizeBytes {
+			size = size<<8 | int(b)
+		}
+		data = append(data, sizeBytes...)
+	}
+	if size > maxTSRequestSize {
+		return nil, fmt.Errorf("TSRequest of %d bytes", size)
+	}
+	body, err := core.ReadBytes(size, t.Conn)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, body...)
+	slog.Debug("readTSRequest", "data", hex.EncodeToString(data))
+	return nla.DecodeDERTRequest(data)
+}
+
 func (t *TPKT) Read(b []byte) (n int, err error) {
 	return t.Conn.Read(b)
 }
@@ -158,7 +382,7 @@ func (t *TPKT) SetFastPathListener(f core.FastPathListener) {
 
 func (t *TPKT) SendFastPath(secFlag byte, data []byte) (n int, err error) {
 	buff := &bytes.Buffer{}
-	core.WriteUInt8(FASTPATH_ACTION_FASTPATH|((secFlag&0x3)<<6), buff)
+	core.WriteUInt8(FASTPATH_ACTION_FASTPATH|(secFlag&0x3c)|((secFlag&0x3)<<6), buff)
 	core.WriteUInt16BE(uint16(len(data)+3)|0x8000, buff)
 	buff.Write(data)
 	slog.Debug("TPTK SendFastPath", "buff", hex.EncodeToString(buff.Bytes()))
@@ -175,7 +399,7 @@ func (t *TPKT) recvHeader(s []byte, err error) {
 	if version == FASTPATH_ACTION_X224 {
 		core.StartReadBytes(2, t.Conn, t.recvExtendedHeader)
 	} else {
-		t.secFlag = (version >> 6) & 0x3
+		t.secFlag = (version>>6)&0x3 | version&0x3c
 		length, _ := core.ReadUInt8(r)
 		t.lastShortLength = int(length)
 		if t.lastShortLength&0x80 != 0 {
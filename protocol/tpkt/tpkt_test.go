@@ -0,0 +1,56 @@
+package tpkt
+
+import (
+	"encoding/asn1"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/nla"
+)
+
+func TestReadTSRequestLength(t *testing.T) {
+	for _, header := range [][]byte{
+		{0x30, 0x88, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		{0x30, 0x83, 0x01, 0x00, 0x01},
+	} {
+		client, server := net.Pipe()
+		go client.Write(header)
+		// the body is never sent, the length alone must fail
+		server.SetDeadline(time.Now().Add(time.Second))
+		tp := NewServer(core.NewSocketLayer(server), nil, nil)
+		if _, err := tp.readTSRequest(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("TSRequest % x: %v", header, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	tp := &TPKT{auth: nla.NewNTLMv2Hash("dom", "user", nla.NTHash("pwd"))}
+	for _, c := range []struct {
+		mode int
+		user string
+	}{
+		{DELEGATE_RESTRICTED_ADMIN, ""},
+		{DELEGATE_PASSWORD, "user"},
+	} {
+		tp.SetDelegation(c.mode)
+		tcre, err := nla.DecodeDERTCredentials(tp.credentials())
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds := &nla.TSPasswordCreds{}
+		if _, err := asn1.Unmarshal(tcre.Credentials, creds); err != nil {
+			t.Fatal(err)
+		}
+		if string(creds.UserName) != c.user || len(creds.Password) != 0 {
+			t.Error("delegation", c.mode, creds)
+		}
+	}
+}
@@ -50,6 +50,27 @@ const (
 	PROTOCOL_HYBRID_EX        = 0x00000008
 )
 
+/**
+ * Flags of the negotiation request
+ * @see http://msdn.microsoft.com/en-us/library/cc240500.aspx
+ */
+const (
+	RESTRICTED_ADMIN_MODE_REQUIRED          uint8 = 0x01
+	REDIRECTED_AUTHENTICATION_MODE_REQUIRED       = 0x02
+	CORRELATION_INFO_PRESENT                      = 0x08
+)
+
+/**
+ * Flags of the negotiation response
+ * @see http://msdn.microsoft.com/en-us/library/cc240506.aspx
+ */
+const (
+	EXTENDED_CLIENT_DATA_SUPPORTED           uint8 = 0x01
+	DYNVC_GFX_PROTOCOL_SUPPORTED                   = 0x02
+	RESTRICTED_ADMIN_MODE_SUPPORTED                = 0x08
+	REDIRECTED_AUTHENTICATION_MODE_SUPPORTED       = 0x10
+)
+
 /**
  * Use to negotiate security layer of RDP stack
  * In node-rdpjs only ssl is available
@@ -91,6 +112,15 @@ const (
 	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER = 0x00000006
 )
 
+/**
+ * Early User Authorization Result sent after CredSSP with PROTOCOL_HYBRID_EX
+ * @see https://msdn.microsoft.com/en-us/library/dn392331.aspx
+ */
+const (
+	AUTHZ_SUCCESS       uint32 = 0x00000000
+	AUTHZ_ACCESS_DENIED        = 0x00000005
+)
+
 /**
  * X224 client connection request
  * @param opt {object} component type options
@@ -181,6 +211,11 @@ type X224 struct {
 	requestedProtocol uint32
 	selectedProtocol  uint32
 	dataHeader        *DataHeader
+	// protocols accepted when acting as a server
+	supportedProtocol uint32
+	authorize         func(domain, user string) bool
+	requestFlags      uint8
+	responseFlags     uint8
 }
 
 func New(t core.Transport) *X224 {
@@ -190,6 +225,10 @@ func New(t core.Transport) *X224 {
 		PROTOCOL_RDP | PROTOCOL_SSL | PROTOCOL_HYBRID,
 		PROTOCOL_SSL,
 		NewDataHeader(),
+		PROTOCOL_SSL,
+		nil,
+		0,
+		0,
 	}
 
 	t.On("close", func() {
@@ -224,6 +263,35 @@ func (x *X224) SetRequestedProtocol(p uint32) {
 	x.requestedProtocol = p
 }
 
+// SetRequestFlags sets the flags of the negotiation request, such as RESTRICTED_ADMIN_MODE_REQUIRED
+func (x *X224) SetRequestFlags(flags uint8) {
+	x.requestFlags = flags
+}
+
+// RequestFlags returns the flags requested by the client
+func (x *X224) RequestFlags() uint8 {
+	return x.requestFlags
+}
+
+// ResponseFlags returns the flags of the negotiation response of the server
+func (x *X224) ResponseFlags() uint8 {
+	return x.responseFlags
+}
+
+func (x *X224) SetSupportedProtocol(p uint32) {
+	x.supportedProtocol = p
+}
+
+// SetAuthorizer sets the check answered in the early user authorization
+// result when PROTOCOL_HYBRID_EX is selected, every NLA user is allowed when nil
+func (x *X224) SetAuthorizer(f func(domain, user string) bool) {
+	x.authorize = f
+}
+
+func (x *X224) SelectedProtocol() uint32 {
+	return x.selectedProtocol
+}
+
 func (x *X224) Connect() error {
 	if x.transport == nil {
 		return errors.New("no transport")
@@ -231,6 +299,7 @@ func (x *X224) Connect() error {
 	cookie := "Cookie: mstshash=test"
 	message := NewClientConnectionRequestPDU([]byte(cookie), x.requestedProtocol)
 	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
+	message.ProtocolNeg.Flag = x.requestFlags
 	message.ProtocolNeg.Result = uint32(x.requestedProtocol)
 
 	slog.Debug("x224 Connect", "message", hex.EncodeToString(message.Serialize()))
@@ -239,6 +308,15 @@ func (x *X224) Connect() error {
 	return err
 }
 
+// requested tells if the client asked for the selected protocol, standard RDP
+// security is only accepted when nothing else was requested
+func (x *X224) requested(selected uint32) bool {
+	if selected == PROTOCOL_RDP {
+		return x.requestedProtocol == PROTOCOL_RDP
+	}
+	return selected&(selected-1) == 0 && selected&x.requestedProtocol != 0
+}
+
 func (x *X224) recvConnectionConfirm(s []byte) {
 	slog.Debug("x224 recvConnectionConfirm", "s", hex.EncodeToString(s))
 	r := bytes.NewReader(s)
@@ -247,6 +325,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		message := &ServerConnectionConfirm{}
 		if err := struc.Unpack(bytes.NewReader(s), message); err != nil {
 			slog.Error("ReadServerConnectionConfirm", "err", err)
+			x.Emit("error", err)
 			return
 		}
 		slog.Debug("recvConnectionConfirm", "message", *message.ProtocolNeg)
@@ -257,6 +336,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 			if message.ProtocolNeg.Result == 2 {
 				slog.Info("Only use Standard RDP Security mechanisms, Reconnect with Standard RDP")
 			}
+			x.Emit("error", core.ErrNegotiationFailure{Code: message.ProtocolNeg.Result})
 			x.Close()
 			return
 		}
@@ -264,13 +344,27 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		if message.ProtocolNeg.Type == TYPE_RDP_NEG_RSP {
 			slog.Info("TYPE_RDP_NEG_RSP")
 			x.selectedProtocol = message.ProtocolNeg.Result
+			x.responseFlags = message.ProtocolNeg.Flag
 		}
 	} else {
 		x.selectedProtocol = PROTOCOL_RDP
 	}
 
-	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
-		slog.Error("NODE_RDP_PROTOCOL_HYBRID_EX_NOT_SUPPORTED")
+	// a server without negotiation or selecting another protocol than the
+	// requested ones would skip the TLS and NLA checks of the client
+	if !x.requested(x.selectedProtocol) {
+		slog.Error("x224 server selected a protocol that was not requested", "requested", x.requestedProtocol, "selected", x.selectedProtocol)
+		x.Emit("error", core.ErrProtocolDowngrade)
+		x.Close()
+		return
+	}
+
+	// the credentials must not be delegated to a server ignoring the mode
+	if x.requestFlags&RESTRICTED_ADMIN_MODE_REQUIRED != 0 &&
+		(x.responseFlags&RESTRICTED_ADMIN_MODE_SUPPORTED == 0 || x.selectedProtocol&(PROTOCOL_HYBRID|PROTOCOL_HYBRID_EX) == 0) {
+		slog.Error("restricted admin mode is not supported by the server", "flags", x.responseFlags)
+		x.Emit("error", core.ErrRestrictedAdmin)
+		x.Close()
 		return
 	}
 
@@ -287,6 +381,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		err := x.transport.(*tpkt.TPKT).StartTLS()
 		if err != nil {
 			slog.Error("start tls failed:", "err", err)
+			x.Emit("error", err)
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
@@ -298,6 +393,37 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		err := x.transport.(*tpkt.TPKT).StartNLA()
 		if err != nil {
 			slog.Error("start NLA failed:", "err", err)
+			x.Emit("error", err)
+			return
+		}
+		x.Emit("connect", x.selectedProtocol)
+		return
+	}
+
+	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
+		slog.Info("*** NLA Security with early user authorization selected ***")
+		tp := x.transport.(*tpkt.TPKT)
+		err := tp.StartNLA()
+		if err != nil {
+			slog.Error("start NLA failed:", "err", err)
+			x.Emit("error", err)
+			return
+		}
+		result, err := tp.RecvEarlyUserAuthResult()
+		if err != nil {
+			slog.Error("read early user authorization result failed:", "err", err)
+			x.Emit("error", err)
+			x.Close()
+			return
+		}
+		if result != AUTHZ_SUCCESS {
+			slog.Error("early user authorization failed", "result", result)
+			if result == AUTHZ_ACCESS_DENIED {
+				x.Emit("error", core.ErrAccessDenied)
+			} else {
+				x.Emit("error", fmt.Errorf("%w: early user authorization result 0x%08x", core.ErrAccessDenied, result))
+			}
+			x.Close()
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
@@ -309,3 +435,117 @@ func (x *X224) recvData(s []byte) {
 	// x224 header takes 3 bytes
 	x.Emit("data", s[3:])
 }
+
+/**
+ * Server side of the negotiation, wait for the client connection request
+ * @see http://msdn.microsoft.com/en-us/library/cc240470.aspx
+ */
+func (x *X224) Listen() error {
+	if x.transport == nil {
+		return errors.New("no transport")
+	}
+	x.transport.Once("data", x.recvConnectionRequest)
+	return nil
+}
+
+func (x *X224) recvConnectionRequest(s []byte) {
+	slog.Debug("x224 recvConnectionRequest", "s", hex.EncodeToString(s))
+	if len(s) < 7 || MessageType(s[1]) != TPDU_CONNECTION_REQUEST {
+		x.Emit("error", errors.New("NODE_RDP_PROTOCOL_X224_BAD_CONNECTION_REQUEST"))
+		x.Close()
+		return
+	}
+	// skip the cookie or routing token
+	rest := s[7:]
+	if i := bytes.Index(rest, []byte("\r\n")); i >= 0 {
+		rest = rest[i+2:]
+	}
+	x.requestedProtocol = PROTOCOL_RDP
+	if len(rest) >= 8 && NegotiationType(rest[0]) == TYPE_RDP_NEG_REQ {
+		neg := &Negotiation{}
+		if err := struc.Unpack(bytes.NewReader(rest), neg); err != nil {
+			x.Emit("error", err)
+			return
+		}
+		x.requestedProtocol = neg.Result
+		x.requestFlags = neg.Flag
+	}
+
+	switch {
+	case x.requestedProtocol&PROTOCOL_HYBRID_EX != 0 && x.supportedProtocol&PROTOCOL_HYBRID_EX != 0:
+		x.selectedProtocol = PROTOCOL_HYBRID_EX
+	case x.requestedProtocol&PROTOCOL_HYBRID != 0 && x.supportedProtocol&PROTOCOL_HYBRID != 0:
+		x.selectedProtocol = PROTOCOL_HYBRID
+	case x.requestedProtocol&PROTOCOL_SSL != 0 && x.supportedProtocol&PROTOCOL_SSL != 0:
+		x.selectedProtocol = PROTOCOL_SSL
+	default:
+		// standard RDP security is not implemented on the server side
+		var code uint32 = SSL_REQUIRED_BY_SERVER
+		if x.supportedProtocol&PROTOCOL_SSL == 0 {
+			code = HYBRID_REQUIRED_BY_SERVER
+		}
+		slog.Error("x224 no common security protocol", "requested", x.requestedProtocol, "supported", x.supportedProtocol)
+		x.sendConnectionConfirm(TYPE_RDP_NEG_FAILURE, code)
+		x.Emit("error", core.ErrNegotiationFailure{Code: code})
+		x.Close()
+		return
+	}
+
+	// the delegated credentials of NLA are accepted in any form
+	if x.selectedProtocol&(PROTOCOL_HYBRID|PROTOCOL_HYBRID_EX) != 0 {
+		x.responseFlags = RESTRICTED_ADMIN_MODE_SUPPORTED
+	}
+	if err := x.sendConnectionConfirm(TYPE_RDP_NEG_RSP, x.selectedProtocol); err != nil {
+		x.Emit("error", err)
+		return
+	}
+
+	x.transport.On("data", x.recvData)
+
+	var err error
+	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
+		slog.Info("*** NLA Security with early user authorization selected ***")
+		err = x.acceptEarlyUserAuth()
+	} else if x.selectedProtocol == PROTOCOL_HYBRID {
+		slog.Info("*** NLA Security selected ***")
+		err = x.transport.(*tpkt.TPKT).AcceptNLA()
+	} else {
+		slog.Info("*** SSL security selected ***")
+		err = x.transport.(*tpkt.TPKT).AcceptTLS()
+	}
+	if err != nil {
+		slog.Error("accept security layer failed:", "err", err)
+		x.Emit("error", err)
+		x.Close()
+		return
+	}
+	x.Emit("connect", x.selectedProtocol, x.requestedProtocol)
+}
+
+// acceptEarlyUserAuth runs NLA then answers the early user authorization result
+func (x *X224) acceptEarlyUserAuth() error {
+	tp := x.transport.(*tpkt.TPKT)
+	if err := tp.AcceptNLA(); err != nil {
+		return err
+	}
+	if x.authorize != nil && !x.authorize(tp.NLAIdentity()) {
+		tp.SendEarlyUserAuthResult(AUTHZ_ACCESS_DENIED)
+		return core.ErrAccessDenied
+	}
+	return tp.SendEarlyUserAuthResult(AUTHZ_SUCCESS)
+}
+
+func (x *X224) sendConnectionConfirm(negType NegotiationType, result uint32) error {
+	message := &ServerConnectionConfirm{
+		Len:         14,
+		Code:        TPDU_CONNECTION_CONFIRM,
+		ProtocolNeg: &Negotiation{negType, x.responseFlags, 0x0008, result},
+	}
+	buff := &bytes.Buffer{}
+	if err := struc.Pack(buff, message); err != nil {
+		return err
+	}
+	slog.Debug("x224 sendConnectionConfirm", "message", hex.EncodeToString(buff.Bytes()))
+	_, err := x.transport.Write(buff.Bytes())
+	return err
+}
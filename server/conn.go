@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"image"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/nla"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/sec"
+	"github.com/sergei-bronnikov/grdp/protocol/t125"
+	"github.com/sergei-bronnikov/grdp/protocol/tpkt"
+	"github.com/sergei-bronnikov/grdp/protocol/x224"
+)
+
+// bitmaps are split in tiles so that each update fits in one fast-path pdu
+const tileSize = 64
+
+// Conn is a client connection accepted by a Server
+type Conn struct {
+	conn   net.Conn
+	tpkt   *tpkt.TPKT
+	x224   *x224.X224
+	mcs    *t125.MCSServer
+	sec    *sec.Server
+	pdu    *pdu.Server
+	ntlm   *nla.NTLMv2Server
+	result chan error
+}
+
+func newConn(conn net.Conn, config *Config) *Conn {
+	c := &Conn{
+		conn:   conn,
+		result: make(chan error, 1),
+	}
+	if config.Authenticate != nil {
+		c.ntlm = nla.NewNTLMv2Server(config.Domain, config.ComputerName, config.Authenticate)
+	}
+	c.tpkt = tpkt.NewServer(core.NewSocketLayer(conn), config.TLSConfig, c.ntlm)
+	c.x224 = x224.New(c.tpkt)
+	c.mcs = t125.NewMCSServer(c.x224)
+	c.sec = sec.NewServer(c.mcs)
+	c.pdu = pdu.NewServer(c.sec)
+
+	c.tpkt.SetFastPathListener(c.sec)
+	c.sec.SetFastPathListener(c.pdu)
+	c.sec.SetChannelSender(c.mcs)
+	c.pdu.SetFastPathSender(c.tpkt)
+
+	if config.Width > 0 && config.Height > 0 {
+		c.pdu.SetDesktop(uint16(config.Width), uint16(config.Height))
+	}
+	if c.ntlm != nil {
+		c.x224.SetSupportedProtocol(x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX)
+		c.x224.SetAuthorizer(config.Authorize)
+	} else {
+		c.x224.SetSupportedProtocol(x224.PROTOCOL_SSL)
+	}
+
+	done := func(err error) {
+		select {
+		case c.result <- err:
+		default:
+		}
+	}
+	c.pdu.Once("ready", func() {
+		done(nil)
+	})
+	c.pdu.Once("error", func(err error) {
+		done(err)
+	})
+	c.pdu.Once("close", func() {
+		done(core.ErrConnectionClosed)
+	})
+
+	c.x224.Listen()
+	c.tpkt.Listen()
+	return c
+}
+
+// Handshake waits until the client completes the connection sequence,
+// the connection is closed when it fails or when ctx is done first
+func (c *Conn) Handshake(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+	select {
+	case err := <-c.result:
+		if err != nil {
+			c.Close()
+			return err
+		}
+		c.conn.SetDeadline(time.Time{})
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// User returns the authenticated user with NLA, the user of the client info packet otherwise
+func (c *Conn) User() string {
+	if c.ntlm != nil {
+		_, user := c.ntlm.Identity()
+		return user
+	}
+	return c.sec.User()
+}
+
+// Domain returns the authenticated domain with NLA, the domain of the client info packet otherwise
+func (c *Conn) Domain() string {
+	if c.ntlm != nil {
+		domain, _ := c.ntlm.Identity()
+		return domain
+	}
+	return c.sec.Domain()
+}
+
+// Password returns the password of the client info packet, it is empty with NLA
+func (c *Conn) Password() string {
+	return c.sec.Password()
+}
+
+func (c *Conn) Width() int {
+	w, _ := c.pdu.Desktop()
+	return int(w)
+}
+
+func (c *Conn) Height() int {
+	_, h := c.pdu.Desktop()
+	return int(h)
+}
+
+func (c *Conn) OnClose(f func()) *Conn {
+	c.pdu.On("close", f)
+	return c
+}
+
+func (c *Conn) OnError(f func(e error)) *Conn {
+	c.pdu.On("error", f)
+	return c
+}
+
+// OnKeyboard is called with each scancode event, flags hold the pdu.KBDFLAGS_* bits
+func (c *Conn) OnKeyboard(f func(flags, scancode uint16)) *Conn {
+	c.pdu.On("input", func(_ uint16, e pdu.InputEventsInterface) {
+		if k, ok := e.(*pdu.ScancodeKeyEvent); ok {
+			f(k.KeyboardFlags, k.KeyCode)
+		}
+	})
+	return c
+}
+
+// OnUnicode is called with each unicode key event
+func (c *Conn) OnUnicode(f func(flags, code uint16)) *Conn {
+	c.pdu.On("input", func(_ uint16, e pdu.InputEventsInterface) {
+		if k, ok := e.(*pdu.UnicodeKeyEvent); ok {
+			f(k.KeyboardFlags, k.Unicode)
+		}
+	})
+	return c
+}
+
+// OnMouse is called with each pointer event, flags hold the pdu.PTRFLAGS_* bits
+func (c *Conn) OnMouse(f func(flags, x, y uint16)) *Conn {
+	c.pdu.On("input", func(_ uint16, e pdu.InputEventsInterface) {
+		if p, ok := e.(*pdu.PointerEvent); ok {
+			f(p.PointerFlags, p.XPos, p.YPos)
+		}
+	})
+	return c
+}
+
+// OnMouseEx is called with each extended pointer event, flags hold the PTRXFLAGS_* bits
+func (c *Conn) OnMouseEx(f func(flags, x, y uint16)) *Conn {
+	c.pdu.On("input", func(_ uint16, e pdu.InputEventsInterface) {
+		if p, ok := e.(*pdu.PointerExEvent); ok {
+			f(p.PointerFlags, p.XPos, p.YPos)
+		}
+	})
+	return c
+}
+
+// OnSynchronize is called with the toggle keys state sent by the client
+func (c *Conn) OnSynchronize(f func(toggleFlags uint32)) *Conn {
+	c.pdu.On("input", func(_ uint16, e pdu.InputEventsInterface) {
+		if s, ok := e.(*pdu.SynchronizeEvent); ok {
+			f(s.ToggleFlags)
+		}
+	})
+	return c
+}
+
+// SendBitmap pushes raw bitmap rectangles to the client
+func (c *Conn) SendBitmap(rectangles []pdu.BitmapData) error {
+	return c.pdu.SendBitmapUpdate(rectangles)
+}
+
+// SetKeyboardIndicators turns the lock key LEDs of the client on, flags hold the pdu.TS_SYNC_* bits
+func (c *Conn) SetKeyboardIndicators(flags uint16) {
+	c.pdu.SendKeyboardIndicators(flags)
+}
+
+// SendImage draws img at x, y on the client desktop as uncompressed 32 bpp tiles
+func (c *Conn) SendImage(x, y int, img image.Image) error {
+	b := img.Bounds()
+	for ty := b.Min.Y; ty < b.Max.Y; ty += tileSize {
+		for tx := b.Min.X; tx < b.Max.X; tx += tileSize {
+			r := image.Rect(tx, ty, min(tx+tileSize, b.Max.X), min(ty+tileSize, b.Max.Y))
+			t := tile(img, r, x+tx-b.Min.X, y+ty-b.Min.Y)
+			if err := c.pdu.SendBitmapUpdate([]pdu.BitmapData{t}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tile encodes r as an uncompressed bitmap, rows are stored bottom-up
+func tile(img image.Image, r image.Rectangle, x, y int) pdu.BitmapData {
+	w, h := r.Dx(), r.Dy()
+	data := make([]byte, 0, w*h*4)
+	for py := r.Max.Y - 1; py >= r.Min.Y; py-- {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			cr, cg, cb, _ := img.At(px, py).RGBA()
+			data = append(data, byte(cb>>8), byte(cg>>8), byte(cr>>8), 0xff)
+		}
+	}
+	return pdu.BitmapData{
+		DestLeft:         uint16(x),
+		DestTop:          uint16(y),
+		DestRight:        uint16(x + w - 1),
+		DestBottom:       uint16(y + h - 1),
+		Width:            uint16(w),
+		Height:           uint16(h),
+		BitsPerPixel:     32,
+		BitmapDataStream: data,
+	}
+}
+
+func (c *Conn) Close() error {
+	slog.Debug("server conn Close()", "remote", c.conn.RemoteAddr())
+	return c.tpkt.Close()
+}
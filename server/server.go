@@ -0,0 +1,74 @@
+// Package server accepts rdp clients, it drives the server side of the
+// connection sequence and lets the application push bitmaps and receive input.
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+)
+
+// Config holds the options shared by every connection of a Server
+type Config struct {
+	// TLSConfig holds the certificate presented to the clients, an RSA key is required by NLA
+	TLSConfig *tls.Config
+	// Width and Height of the desktop, the size requested by the client is used when zero
+	Width  int
+	Height int
+	// Authenticate enables NLA, it returns the password of a known user.
+	// Clients are only required to negotiate TLS when it is nil.
+	Authenticate func(domain, user string) (password string, ok bool)
+	// Authorize is answered in the early user authorization result of
+	// clients using PROTOCOL_HYBRID_EX, every authenticated user is allowed when nil
+	Authorize func(domain, user string) bool
+	// Domain and ComputerName are announced in the NTLM challenge
+	Domain       string
+	ComputerName string
+}
+
+type Server struct {
+	listener net.Listener
+	config   *Config
+}
+
+// Listen announces on the local network address and accepts rdp clients
+func Listen(network, address string, config *Config) (*Server, error) {
+	if config == nil || config.TLSConfig == nil {
+		return nil, errors.New("server TLS config is required")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(l, config), nil
+}
+
+// NewServer accepts rdp clients from an existing listener
+func NewServer(l net.Listener, config *Config) *Server {
+	cfg := *config
+	if cfg.ComputerName == "" {
+		cfg.ComputerName, _ = os.Hostname()
+	}
+	if cfg.Domain == "" {
+		cfg.Domain = cfg.ComputerName
+	}
+	return &Server{listener: l, config: &cfg}
+}
+
+// Accept waits for the next client, the connection sequence runs with Conn.Handshake
+func (s *Server) Accept() (*Conn, error) {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, s.config), nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
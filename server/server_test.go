@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sergei-bronnikov/grdp/core"
+	"github.com/sergei-bronnikov/grdp/protocol/nla"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+	"github.com/sergei-bronnikov/grdp/protocol/sec"
+	"github.com/sergei-bronnikov/grdp/protocol/t125"
+	"github.com/sergei-bronnikov/grdp/protocol/t125/gcc"
+	"github.com/sergei-bronnikov/grdp/protocol/tpkt"
+	"github.com/sergei-bronnikov/grdp/protocol/x224"
+)
+
+func selfSigned(t *testing.T) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grdp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+type testClient struct {
+	x224 *x224.X224
+	pdu  *pdu.Client
+}
+
+func dial(t *testing.T, addr string, protocol uint32, domain, user, password string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{}
+	tp := tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2(domain, user, password))
+	c.x224 = x224.New(tp)
+	mcs := t125.NewMCSClient(c.x224, gcc.US, gcc.KT_IBM_101_102_KEYS, 0)
+	mcs.SetClientDesktop(800, 600)
+	s := sec.NewClient(mcs)
+	s.SetUser(user)
+	s.SetPwd(password)
+	s.SetDomain(domain)
+	c.pdu = pdu.NewClient(s)
+	tp.SetFastPathListener(s)
+	s.SetFastPathListener(c.pdu)
+	s.SetFastPathSender(tp)
+	c.pdu.SetFastPathSender(s)
+	s.SetChannelSender(mcs)
+	c.x224.SetRequestedProtocol(protocol)
+	return c
+}
+
+func listen(t *testing.T, config *Config) *Server {
+	s, err := Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestServerSession(t *testing.T) {
+	s := listen(t, &Config{TLSConfig: selfSigned(t), Width: 320, Height: 200})
+
+	accepted := make(chan *Conn, 1)
+	keys := make(chan uint16, 32)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		conn.OnKeyboard(func(flags, scancode uint16) {
+			keys <- scancode
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Handshake(ctx); err != nil {
+			t.Error("handshake", err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	c := dial(t, s.Addr().String(), x224.PROTOCOL_SSL, "", "alice", "secret")
+	ready := make(chan struct{}, 1)
+	bitmaps := make(chan []pdu.BitmapData, 1)
+	c.pdu.On("ready", func() { ready <- struct{}{} })
+	c.pdu.On("bitmap", func(r []pdu.BitmapData) { bitmaps <- r })
+	if err := c.x224.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var conn *Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake timeout")
+	}
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client ready timeout")
+	}
+	if conn.User() != "alice" || conn.Password() != "secret" {
+		t.Error("credentials", conn.User(), conn.Password())
+	}
+	if conn.Width() != 320 || conn.Height() != 200 {
+		t.Error("desktop", conn.Width(), conn.Height())
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
+	img.Set(0, 1, color.RGBA{B: 0xff, A: 0xff})
+	if err := conn.SendImage(10, 20, img); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-bitmaps:
+		if len(r) != 1 {
+			t.Fatal("rectangles", len(r))
+		}
+		b := r[0]
+		if b.DestLeft != 10 || b.DestTop != 20 || b.DestRight != 11 || b.DestBottom != 21 {
+			t.Error("destination", b.DestLeft, b.DestTop, b.DestRight, b.DestBottom)
+		}
+		// bottom-up rows, the blue pixel comes first
+		if b.BitmapDataStream[0] != 0xff || b.BitmapDataStream[8+2] != 0xff {
+			t.Errorf("pixels % x", b.BitmapDataStream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bitmap timeout")
+	}
+
+	c.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, []pdu.InputEventsInterface{
+		&pdu.ScancodeKeyEvent{KeyCode: 0x1e},
+	})
+	select {
+	case code := <-keys:
+		if code != 0x1e {
+			t.Error("scancode", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("input timeout")
+	}
+
+	// the server announces fast-path input, 20 events take two PDUs
+	events := make([]pdu.InputEvent, 0, 20)
+	for i := 0; i < 20; i++ {
+		events = append(events, &pdu.ScancodeKeyEvent{KeyCode: uint16(0x10 + i)})
+	}
+	c.pdu.SendInput(events...)
+	for i := 0; i < 20; i++ {
+		select {
+		case code := <-keys:
+			if code != uint16(0x10+i) {
+				t.Fatal("fast-path scancode", i, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("fast-path input timeout", i)
+		}
+	}
+}
+
+func TestServerNLA(t *testing.T) {
+	s := listen(t, &Config{
+		TLSConfig: selfSigned(t),
+		Domain:    "CORP",
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", user == "alice"
+		},
+	})
+
+	result := make(chan *Conn, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Handshake(ctx); err != nil {
+			result <- nil
+			return
+		}
+		result <- conn
+	}()
+
+	c := dial(t, s.Addr().String(), x224.PROTOCOL_HYBRID, "CORP", "alice", "secret")
+	if err := c.x224.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-result:
+		if conn == nil {
+			t.Fatal("handshake failed")
+		}
+		if conn.User() != "alice" || conn.Domain() != "CORP" {
+			t.Error("identity", conn.Domain(), conn.User())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake timeout")
+	}
+}
+
+func TestServerNLAWrongPassword(t *testing.T) {
+	s := listen(t, &Config{
+		TLSConfig: selfSigned(t),
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", true
+		},
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- conn.Handshake(ctx)
+	}()
+
+	c := dial(t, s.Addr().String(), x224.PROTOCOL_HYBRID, "", "alice", "wrong")
+	c.x224.Connect()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server handshake timeout")
+	}
+}
+
+func TestServerEarlyUserAuthorization(t *testing.T) {
+	s := listen(t, &Config{
+		TLSConfig: selfSigned(t),
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", true
+		},
+		Authorize: func(domain, user string) bool {
+			return user == "alice"
+		},
+	})
+
+	results := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				results <- conn.Handshake(ctx)
+			}()
+		}
+	}()
+
+	c := dial(t, s.Addr().String(), x224.PROTOCOL_HYBRID_EX|x224.PROTOCOL_HYBRID, "", "alice", "secret")
+	ready := make(chan struct{}, 1)
+	c.pdu.On("ready", func() { ready <- struct{}{} })
+	c.x224.Connect()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client ready timeout")
+	}
+	if p := c.x224.SelectedProtocol(); p != x224.PROTOCOL_HYBRID_EX {
+		t.Error("selected protocol", p)
+	}
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+
+	c = dial(t, s.Addr().String(), x224.PROTOCOL_HYBRID_EX, "", "bob", "secret")
+	clientErr := make(chan error, 1)
+	c.pdu.On("error", func(err error) {
+		select {
+		case clientErr <- err:
+		default:
+		}
+	})
+	c.x224.Connect()
+	select {
+	case err := <-clientErr:
+		if !errors.Is(err, core.ErrAccessDenied) {
+			t.Error("client error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client error timeout")
+	}
+	if err := <-results; !errors.Is(err, core.ErrAccessDenied) {
+		t.Error("server error", err)
+	}
+}
+
+func TestClientEarlyUserAuthorizationClosed(t *testing.T) {
+	var conn *Conn
+	s := listen(t, &Config{
+		TLSConfig: selfSigned(t),
+		Authenticate: func(domain, user string) (string, bool) {
+			return "secret", true
+		},
+		// the server goes away instead of sending the result
+		Authorize: func(domain, user string) bool {
+			conn.Close()
+			return true
+		},
+	})
+	go func() {
+		var err error
+		if conn, err = s.Accept(); err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.Handshake(ctx)
+	}()
+
+	c := dial(t, s.Addr().String(), x224.PROTOCOL_HYBRID_EX, "", "alice", "secret")
+	clientErr := make(chan error, 1)
+	ready := make(chan struct{}, 1)
+	c.pdu.On("error", func(err error) {
+		select {
+		case clientErr <- err:
+		default:
+		}
+	})
+	c.pdu.On("ready", func() { ready <- struct{}{} })
+	connected := make(chan struct{}, 1)
+	c.x224.On("connect", func(uint32) { connected <- struct{}{} })
+	c.x224.Connect()
+	select {
+	case err := <-clientErr:
+		if !errors.Is(err, io.EOF) {
+			t.Error("client error", err)
+		}
+		if len(connected) != 0 {
+			t.Error("connected without an authorization result")
+		}
+	case <-ready:
+		t.Fatal("client ready without an authorization result")
+	case <-time.After(5 * time.Second):
+		t.Fatal("client error timeout")
+	}
+}
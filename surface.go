@@ -0,0 +1,90 @@
+package grdp
+
+import (
+	"image"
+	"image/draw"
+	"log/slog"
+
+	"github.com/sergei-bronnikov/grdp/codec"
+	_ "github.com/sergei-bronnikov/grdp/codec/nsc"
+	_ "github.com/sergei-bronnikov/grdp/codec/rfx"
+	"github.com/sergei-bronnikov/grdp/protocol/pdu"
+)
+
+/**
+ * Rendering of the surface bits commands
+ * @see MS-RDPBCGR 2.2.9.2 Surface Commands
+ */
+
+// CODEC_ID_NONE is the uncompressed bitmaps of the surface bits
+const CODEC_ID_NONE = 0x00
+
+// bitmapCodecs announces the registered codecs
+func bitmapCodecs() []pdu.BitmapCodec {
+	var codecs []pdu.BitmapCodec
+	for _, c := range codec.Registered() {
+		codecs = append(codecs, pdu.BitmapCodec{GUID: c.GUID, ID: c.ID, Properties: c.Properties()})
+	}
+	return codecs
+}
+
+func (f *Framebuffer) applySurfaceBits(s *pdu.SurfaceBits) {
+	f.update(func() []image.Rectangle {
+		b := s.Bitmap
+		at := image.Pt(int(s.DestLeft), int(s.DestTop))
+		if b.CodecID == CODEC_ID_NONE {
+			return []image.Rectangle{f.rawSurfaceBits(b, at)}
+		}
+		d := f.codecs.Decoder(b.CodecID)
+		if d == nil {
+			slog.Debug("surface bits codec not supported", "codec", b.CodecID)
+			return nil
+		}
+		dirty, err := d.Decode(b.Data, int(b.Width), int(b.Height), f.img, at)
+		if err != nil {
+			slog.Warn("surface bits", "codec", b.CodecID, "err", err)
+		}
+		return dirty
+	})
+}
+
+// rawSurfaceBits copies an uncompressed bitmap, its rows are top-down at 32 bpp
+func (f *Framebuffer) rawSurfaceBits(b pdu.BitmapDataEx, at image.Point) image.Rectangle {
+	if b.Bpp != 32 {
+		slog.Debug("uncompressed surface bits depth not supported", "bpp", b.Bpp)
+		return image.Rectangle{}
+	}
+	w, h := int(b.Width), int(b.Height)
+	if len(b.Data) < w*h*4 {
+		return image.Rectangle{}
+	}
+	r := image.Rect(0, 0, w, h).Add(at).Intersect(f.img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := b.Data[((y-at.Y)*w+r.Min.X-at.X)*4:]
+		dst := f.img.Pix[f.img.PixOffset(r.Min.X, y):f.img.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(dst); i += 4 {
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = src[i+2], src[i+1], src[i], 0xff
+		}
+	}
+	return r
+}
+
+// applyGfxPaint copies the area r of a surface of the graphics pipeline, the
+// surface is at origin on the desktop
+func (f *Framebuffer) applyGfxPaint(src *image.RGBA, r image.Rectangle, origin image.Point) {
+	f.update(func() []image.Rectangle {
+		dst := r.Add(origin).Intersect(f.img.Rect)
+		draw.Draw(f.img, dst, src, dst.Min.Sub(origin), draw.Src)
+		return []image.Rectangle{dst}
+	})
+}
+
+// applyGfxReset resizes the desktop to the output of the graphics pipeline
+func (f *Framebuffer) applyGfxReset(width, height int) {
+	f.update(func() []image.Rectangle {
+		if f.img.Rect.Dx() != width || f.img.Rect.Dy() != height {
+			f.img = image.NewRGBA(image.Rect(0, 0, width, height))
+		}
+		return []image.Rectangle{f.img.Rect}
+	})
+}
@@ -0,0 +1,46 @@
+package grdp
+
+import (
+	"errors"
+
+	"github.com/sergei-bronnikov/grdp/plugin/rdpei"
+)
+
+// errTouchDisabled is returned by the touch and pen input when Config.TouchContacts is 0
+var errTouchDisabled = errors.New("touch input is disabled")
+
+// TouchFrame sends the touch contacts at one instant. It fails with
+// rdpei.ErrNotReady until the server opened the input extension and with
+// rdpei.ErrSuspended while the server suspends the input.
+func (g *RdpClient) TouchFrame(contacts ...rdpei.TouchContact) error {
+	if g.rdpei == nil {
+		return errTouchDisabled
+	}
+	return g.rdpei.TouchFrame(contacts)
+}
+
+// PenEvent sends the pens at one instant, one per DeviceId. Several pens need
+// a server supporting multipen injection.
+func (g *RdpClient) PenEvent(contacts ...rdpei.PenContact) error {
+	if g.rdpei == nil {
+		return errTouchDisabled
+	}
+	return g.rdpei.PenFrame(contacts)
+}
+
+// DismissHovering removes a touch contact hovering over the screen
+func (g *RdpClient) DismissHovering(contactId uint8) error {
+	if g.rdpei == nil {
+		return errTouchDisabled
+	}
+	return g.rdpei.DismissHovering(contactId)
+}
+
+// OnTouchSuspend is called when the server suspends or resumes the touch and pen input
+func (g *RdpClient) OnTouchSuspend(f func(suspended bool)) *RdpClient {
+	if g.rdpei != nil {
+		g.rdpei.On("suspend", func() { f(true) })
+		g.rdpei.On("resume", func() { f(false) })
+	}
+	return g
+}